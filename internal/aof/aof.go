@@ -1,16 +1,75 @@
 package aof
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"io"
 	"jellyfish/internal/resp"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// FsyncPolicy controls when writes are flushed to disk, like Redis appendfsync.
+type FsyncPolicy uint8
+
+const (
+	FsyncNo       FsyncPolicy = iota // leave flushing to the operating system
+	FsyncEverySec                    // sync once a second in the background
+	FsyncAlways                      // sync after every write
+)
+
+var fsyncPolicyNames = []string{
+	FsyncNo:       "no",
+	FsyncEverySec: "everysec",
+	FsyncAlways:   "always",
+}
+
+// ParseFsyncPolicy returns the policy for an appendfsync value.
+func ParseFsyncPolicy(name string) (FsyncPolicy, bool) {
+	for p, n := range fsyncPolicyNames {
+		if n == name {
+			return FsyncPolicy(p), true
+		}
+	}
+	return 0, false
+}
+
+func (p FsyncPolicy) String() string {
+	return fsyncPolicyNames[p]
+}
+
+// readBufferSize is the buffer used to replay the file, large enough that
+// reading a big AOF takes few system calls.
+const readBufferSize = 1 << 20
+
+// ErrRewriteInProgress is returned by StartRewrite while a rewrite is running.
+var ErrRewriteInProgress = errors.New("AOF rewrite already in progress")
+
 type Aof struct {
+	path string
 	file *os.File
-	rd   *resp.Reader
 	mu   sync.Mutex
+
+	fsync FsyncPolicy
+	dirty bool          // written since the last sync
+	stop  chan struct{} // stops the everysec sync loop
+
+	size     atomic.Int64 // current file size in bytes
+	baseSize atomic.Int64 // size after the last rewrite, or when opened
+
+	// Offsets count the bytes passed to Write since the file was opened,
+	// across rewrites. synced is closed and replaced whenever syncedOffset
+	// moves forward.
+	offset       int64
+	syncedOffset int64
+	synced       chan struct{}
+
+	rewriting  bool
+	rewriteBuf []byte // writes made since the running rewrite started
 }
 
 func New(path string) (*Aof, error) {
@@ -18,16 +77,69 @@ func New(path string) (*Aof, error) {
 	if err != nil {
 		return nil, err
 	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	aof := &Aof{
+		path:   path,
+		file:   f,
+		synced: make(chan struct{}),
+	}
+	aof.size.Store(info.Size())
+	aof.baseSize.Store(info.Size())
+	return aof, nil
+}
+
+// SetFsync changes when writes are flushed to disk. New files start with
+// FsyncNo. Under FsyncEverySec a background goroutine syncs pending writes
+// once a second until Close.
+func (aof *Aof) SetFsync(policy FsyncPolicy) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.fsync = policy
+	if policy == FsyncEverySec && aof.stop == nil {
+		aof.stop = make(chan struct{})
+		go aof.syncEverySecond(aof.stop)
+	}
+}
 
-	return &Aof{
-		file: f,
-		rd:   resp.NewReader(f),
-	}, nil
+func (aof *Aof) syncEverySecond(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			aof.mu.Lock()
+			if aof.fsync == FsyncEverySec && aof.dirty {
+				if aof.file.Sync() == nil {
+					aof.markSynced()
+				}
+				aof.dirty = false
+			}
+			aof.mu.Unlock()
+		}
+	}
 }
 
+// Close stops background syncing and closes the file, syncing any pending
+// writes first unless the policy is FsyncNo.
 func (aof *Aof) Close() error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
+
+	if aof.stop != nil {
+		close(aof.stop)
+		aof.stop = nil
+	}
+	if aof.fsync != FsyncNo && aof.dirty {
+		aof.file.Sync()
+	}
 	return aof.file.Close()
 }
 
@@ -35,14 +147,85 @@ func (aof *Aof) Write(v resp.Value) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	w := resp.NewWriter(aof.file)
-	if err := w.Write(v); err != nil {
+	var buf bytes.Buffer
+	resp.NewWriter(&buf).Write(v)
+	n, err := aof.file.Write(buf.Bytes())
+	aof.size.Add(int64(n))
+	if err != nil {
 		return err
 	}
+	aof.offset += int64(n)
+	if aof.rewriting {
+		aof.rewriteBuf = append(aof.rewriteBuf, buf.Bytes()...)
+	}
 
+	switch aof.fsync {
+	case FsyncAlways:
+		if err := aof.file.Sync(); err != nil {
+			return err
+		}
+		aof.markSynced()
+		return nil
+	case FsyncNo:
+		// Nothing is ever synced explicitly, so as in Redis a write counts
+		// as synced once the operating system has it.
+		aof.markSynced()
+	}
+	aof.dirty = true
 	return nil
 }
 
+// markSynced records that every write so far is on disk and wakes
+// WaitSynced callers. Caller must hold aof.mu.
+func (aof *Aof) markSynced() {
+	if aof.syncedOffset == aof.offset {
+		return
+	}
+	aof.syncedOffset = aof.offset
+	close(aof.synced)
+	aof.synced = make(chan struct{})
+}
+
+// Offset returns the offset just past the last write.
+func (aof *Aof) Offset() int64 {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	return aof.offset
+}
+
+// SyncedOffset returns the offset up to which writes are synced to disk.
+func (aof *Aof) SyncedOffset() int64 {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	return aof.syncedOffset
+}
+
+// WaitSynced blocks until the writes up to offset are synced to disk or the
+// timeout elapses (0 waits forever), and reports whether they are. Under
+// FsyncEverySec this takes up to a second; under FsyncAlways and FsyncNo,
+// writes are synced as soon as Write returns.
+func (aof *Aof) WaitSynced(offset int64, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		aof.mu.Lock()
+		done, synced := aof.syncedOffset >= offset, aof.synced
+		aof.mu.Unlock()
+		if done {
+			return true
+		}
+		select {
+		case <-synced:
+		case <-expired:
+			return false
+		}
+	}
+}
+
 // Read reads all commands from the AOF file and calls the callback for each one.
 // This is used for replaying the log on startup.
 func (aof *Aof) Read(fn func(value resp.Value)) error {
@@ -52,26 +235,114 @@ func (aof *Aof) Read(fn func(value resp.Value)) error {
 	// Seek to start
 	aof.file.Seek(0, 0)
 
-	reader := resp.NewReader(aof.file)
-
-	for {
-		value, err := reader.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
+	return resp.NewReaderSize(aof.file, readBufferSize).ReadAll(fn)
+}
 
-		fn(value)
+// Sync forces a flush to disk
+func (aof *Aof) Sync() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	aof.dirty = false
+	if err := aof.file.Sync(); err != nil {
+		return err
 	}
+	aof.markSynced()
+	return nil
+}
 
+// Size returns the current size of the file and its size after the last
+// rewrite, or when it was opened if it has not been rewritten.
+func (aof *Aof) Size() (current, base int64) {
+	return aof.size.Load(), aof.baseSize.Load()
+}
+
+// Rewriting reports whether a rewrite is running.
+func (aof *Aof) Rewriting() bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	return aof.rewriting
+}
+
+// StartRewrite begins a rewrite: from now on writes are also kept aside, to
+// be appended to the new file by FinishRewrite. The caller must make sure no
+// write happens between taking the snapshot it will pass to FinishRewrite and
+// calling StartRewrite.
+func (aof *Aof) StartRewrite() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.rewriting {
+		return ErrRewriteInProgress
+	}
+	aof.rewriting = true
+	aof.rewriteBuf = nil
 	return nil
 }
 
-// Sync forces a flush to disk
-func (aof *Aof) Sync() error {
+// FinishRewrite completes the rewrite begun by StartRewrite. snapshot writes
+// the commands that rebuild the dataset as it was then to a new file, which
+// can take a while and runs without blocking writes; the writes made since
+// are then appended and the new file replaces the old one. If anything fails
+// the old file is kept as it is.
+func (aof *Aof) FinishRewrite(snapshot func(w io.Writer) error) error {
+	f, err := aof.writeSnapshot(snapshot)
+
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
-	return aof.file.Sync()
+	pending := aof.rewriteBuf
+	aof.rewriting = false
+	aof.rewriteBuf = nil
+	if err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if _, err := f.Write(pending); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	// Reopen in append mode, as New does, so that writes always go to the end.
+	newFile, err := os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(f.Name(), aof.path); err != nil {
+		newFile.Close()
+		return fail(err)
+	}
+	f.Close()
+	aof.file.Close()
+	aof.file = newFile
+	aof.dirty = false
+	aof.markSynced()
+	aof.size.Store(info.Size())
+	aof.baseSize.Store(info.Size())
+	return nil
+}
+
+// writeSnapshot writes snapshot to a temporary file next to the log.
+func (aof *Aof) writeSnapshot(snapshot func(w io.Writer) error) (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(aof.path), filepath.Base(aof.path)+".rewrite-*")
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(f)
+	if err = snapshot(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
 }
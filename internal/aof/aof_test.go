@@ -1,9 +1,16 @@
 package aof
 
 import (
+	"bytes"
+	"io"
 	"jellyfish/internal/resp"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAof_WriteRead(t *testing.T) {
@@ -142,3 +149,172 @@ func TestAof_AppendOrder(t *testing.T) {
 		t.Fatalf("Second command mismatch: %v", readCmds[1])
 	}
 }
+
+func TestAof_Fsync(t *testing.T) {
+	for _, name := range []string{"no", "everysec", "always"} {
+		policy, ok := ParseFsyncPolicy(name)
+		if !ok || policy.String() != name {
+			t.Errorf("ParseFsyncPolicy(%q) = %v, %v", name, policy, ok)
+		}
+	}
+	if _, ok := ParseFsyncPolicy("sometimes"); ok {
+		t.Error("ParseFsyncPolicy accepted an unknown policy")
+	}
+
+	for _, policy := range []FsyncPolicy{FsyncEverySec, FsyncAlways} {
+		f, err := os.CreateTemp("", "jellyfish_test_*.aof")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpName := f.Name()
+		f.Close()
+		defer os.Remove(tmpName)
+
+		aof, err := New(tmpName)
+		if err != nil {
+			t.Fatalf("Failed to open AOF: %v", err)
+		}
+		aof.SetFsync(policy)
+		cmd := resp.Value{Type: "array", Array: []resp.Value{{Type: "bulk", Bulk: "PING"}}}
+		if err := aof.Write(cmd); err != nil {
+			t.Errorf("Write with appendfsync %v failed: %v", policy, err)
+		}
+		if err := aof.Close(); err != nil {
+			t.Errorf("Close with appendfsync %v failed: %v", policy, err)
+		}
+
+		if info, err := os.Stat(tmpName); err != nil || info.Size() == 0 {
+			t.Errorf("AOF with appendfsync %v is empty after Close (%v)", policy, err)
+		}
+	}
+}
+
+func TestAof_WaitSynced(t *testing.T) {
+	cmd := resp.Value{Type: "array", Array: []resp.Value{{Type: "bulk", Bulk: "PING"}}}
+	for _, policy := range []FsyncPolicy{FsyncNo, FsyncEverySec, FsyncAlways} {
+		aof, err := New(filepath.Join(t.TempDir(), "wait.aof"))
+		if err != nil {
+			t.Fatalf("Failed to open AOF: %v", err)
+		}
+		aof.SetFsync(policy)
+		if err := aof.Write(cmd); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		offset := aof.Offset()
+		if offset == 0 {
+			t.Errorf("Offset after a write = 0 with appendfsync %v", policy)
+		}
+
+		// Under everysec the write is only synced by the background loop.
+		start := time.Now()
+		if !aof.WaitSynced(offset, 3*time.Second) {
+			t.Errorf("WaitSynced timed out with appendfsync %v", policy)
+		}
+		if elapsed := time.Since(start); policy != FsyncEverySec && elapsed > 100*time.Millisecond {
+			t.Errorf("WaitSynced with appendfsync %v took %v, want no wait", policy, elapsed)
+		}
+		if aof.WaitSynced(offset+1, 10*time.Millisecond) {
+			t.Errorf("WaitSynced past the last write succeeded with appendfsync %v", policy)
+		}
+		aof.Close()
+	}
+}
+
+func TestAof_Rewrite(t *testing.T) {
+	dir := t.TempDir()
+	tmpName := filepath.Join(dir, "rewrite.aof")
+	aof, err := New(tmpName)
+	if err != nil {
+		t.Fatalf("Failed to open AOF: %v", err)
+	}
+	defer aof.Close()
+
+	command := func(args ...string) resp.Value {
+		v := resp.Value{Type: "array"}
+		for _, a := range args {
+			v.Array = append(v.Array, resp.Value{Type: "bulk", Bulk: a})
+		}
+		return v
+	}
+	for _, v := range []string{"1", "2", "3"} {
+		aof.Write(command("SET", "k", v))
+	}
+
+	if err := aof.StartRewrite(); err != nil {
+		t.Fatalf("StartRewrite failed: %v", err)
+	}
+	if err := aof.StartRewrite(); err != ErrRewriteInProgress {
+		t.Errorf("second StartRewrite = %v, want ErrRewriteInProgress", err)
+	}
+	// Written while the rewrite runs: must end up after the snapshot.
+	aof.Write(command("SET", "after", "x"))
+
+	err = aof.FinishRewrite(func(w io.Writer) error {
+		return resp.NewWriter(w).Write(command("SET", "k", "3"))
+	})
+	if err != nil {
+		t.Fatalf("FinishRewrite failed: %v", err)
+	}
+	aof.Write(command("DEL", "after"))
+
+	var got []string
+	aof.Read(func(v resp.Value) {
+		got = append(got, v.Array[0].Bulk+" "+v.Array[1].Bulk)
+	})
+	want := []string{"SET k", "SET after", "DEL after"}
+	if !slices.Equal(got, want) {
+		t.Errorf("rewritten AOF = %v, want %v", got, want)
+	}
+	if info, err := os.Stat(tmpName); err != nil || info.Size() != aof.size.Load() {
+		t.Errorf("Size = %d, want the file's size (%v)", aof.size.Load(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files left in the AOF directory, want 1", len(entries))
+	}
+
+	// A failed snapshot leaves the log as it was.
+	aof.StartRewrite()
+	err = aof.FinishRewrite(func(w io.Writer) error { return io.ErrShortWrite })
+	if err != io.ErrShortWrite {
+		t.Errorf("FinishRewrite with a failing snapshot = %v", err)
+	}
+	if aof.Rewriting() {
+		t.Error("still rewriting after a failed rewrite")
+	}
+	got = nil
+	aof.Read(func(v resp.Value) { got = append(got, v.Array[0].Bulk+" "+v.Array[1].Bulk) })
+	if !slices.Equal(got, want) {
+		t.Errorf("AOF after a failed rewrite = %v, want %v", got, want)
+	}
+}
+
+// BenchmarkAof_Read replays an AOF of benchAOFSize bytes of SET commands.
+func BenchmarkAof_Read(b *testing.B) {
+	const benchAOFSize = 100 << 20
+	path := filepath.Join(b.TempDir(), "bench.aof")
+	var buf bytes.Buffer
+	w := resp.NewWriter(&buf)
+	for i := 0; buf.Len() < benchAOFSize; i++ {
+		w.Write(resp.Value{Type: "array", Array: []resp.Value{
+			{Type: "bulk", Bulk: "SET"},
+			{Type: "bulk", Bulk: "key:" + strconv.Itoa(i)},
+			{Type: "bulk", Bulk: strings.Repeat("v", i%64)},
+		}})
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		b.Fatal(err)
+	}
+	aof, err := New(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer aof.Close()
+
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+	for range b.N {
+		if err := aof.Read(func(resp.Value) {}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
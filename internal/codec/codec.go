@@ -0,0 +1,219 @@
+// Package codec serializes single store items to a compact binary form, as
+// used by DUMP and RESTORE.
+//
+// An encoded item is laid out as
+//
+//	type (1 byte) | expiry (8 bytes) | value | version (2 bytes) | CRC-64 (8 bytes)
+//
+// where expiry is the absolute expiry in Unix milliseconds (0 for none) and
+// the value depends on the type:
+//
+//	string: uvarint length, bytes
+//	vector: uvarint count, count little-endian float32s, or for a float16
+//	        vector, whose type byte has halfFlag set, count float16s
+//	hash:   uvarint count, then per field (in sorted order) a length-prefixed
+//	        name, a length-prefixed value and the field's expiry
+//
+// Integers are little-endian. The trailing version and ECMA CRC-64 of
+// everything before it let Decode reject payloads from other encodings or
+// that were damaged in transit.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"jellyfish/internal/store"
+	"maps"
+	"math"
+	"slices"
+	"time"
+)
+
+// Version is the encoding version written by Encode.
+const Version = 2
+
+// halfFlag is set in the type byte of a float16 encoded vector.
+const halfFlag = 0x80
+
+// ErrBadPayload is returned by Decode for data that was not produced by
+// Encode with this Version or that has been corrupted.
+var ErrBadPayload = errors.New("payload version or checksum are wrong")
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// Encode serializes item, including its type and expiry.
+func Encode(item store.Item) []byte {
+	b := []byte{item.Type}
+
+	b = appendExpiry(b, item.ExpiresAt)
+
+	switch item.Type {
+	case store.TypeString:
+		b = appendString(b, item.Str())
+	case store.TypeVector:
+		if item.HalfEncoded {
+			b[0] |= halfFlag
+			b = binary.AppendUvarint(b, uint64(len(item.HalfVal)))
+			for _, h := range item.HalfVal {
+				b = binary.LittleEndian.AppendUint16(b, h)
+			}
+			break
+		}
+		b = binary.AppendUvarint(b, uint64(len(item.VecVal)))
+		for _, v := range item.VecVal {
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+		}
+	case store.TypeHash:
+		hash := item.Hash()
+		b = binary.AppendUvarint(b, uint64(len(hash)))
+		for _, f := range slices.Sorted(maps.Keys(hash)) {
+			b = appendString(b, f)
+			b = appendString(b, hash[f])
+			b = appendExpiry(b, item.FieldExpiresAt[f])
+		}
+	}
+
+	b = binary.LittleEndian.AppendUint16(b, Version)
+	return binary.LittleEndian.AppendUint64(b, crc64.Checksum(b, crcTable))
+}
+
+// Decode reverses Encode. Only the type, value and expiries of the returned
+// item are set.
+func Decode(b []byte) (store.Item, error) {
+	const footer = 2 + 8
+	if len(b) < 1+8+footer {
+		return store.Item{}, ErrBadPayload
+	}
+	body, sum := b[:len(b)-8], binary.LittleEndian.Uint64(b[len(b)-8:])
+	if crc64.Checksum(body, crcTable) != sum {
+		return store.Item{}, ErrBadPayload
+	}
+	if binary.LittleEndian.Uint16(body[len(body)-2:]) != Version {
+		return store.Item{}, ErrBadPayload
+	}
+
+	d := decoder{b: body[:len(body)-2]}
+	item := store.Item{Type: d.b[0] &^ halfFlag, HalfEncoded: d.b[0]&halfFlag != 0}
+	if item.HalfEncoded && item.Type != store.TypeVector {
+		return store.Item{}, ErrBadPayload
+	}
+	d.b = d.b[1:]
+	item.ExpiresAt = d.expiry()
+
+	switch item.Type {
+	case store.TypeString:
+		item.SetStr(d.string())
+	case store.TypeVector:
+		if item.HalfEncoded {
+			item.HalfVal = make([]uint16, d.count(2))
+			for i := range item.HalfVal {
+				item.HalfVal[i] = d.uint16()
+			}
+			break
+		}
+		n := d.count(4)
+		item.VecVal = make([]float32, n)
+		for i := range item.VecVal {
+			item.VecVal[i] = math.Float32frombits(d.uint32())
+		}
+	case store.TypeHash:
+		n := d.count(2 + 8)
+		item.HashVal = make(map[string]string, n)
+		for range n {
+			f := d.string()
+			item.HashVal[f] = d.string()
+			if at := d.expiry(); !at.IsZero() {
+				if item.FieldExpiresAt == nil {
+					item.FieldExpiresAt = make(map[string]time.Time)
+				}
+				item.FieldExpiresAt[f] = at
+			}
+		}
+	default:
+		return store.Item{}, ErrBadPayload
+	}
+
+	if d.err || len(d.b) != 0 {
+		return store.Item{}, ErrBadPayload
+	}
+	return item, nil
+}
+
+// appendExpiry appends t in Unix milliseconds, or 0 if t is zero.
+func appendExpiry(b []byte, t time.Time) []byte {
+	var ms int64
+	if !t.IsZero() {
+		ms = t.UnixMilli()
+	}
+	return binary.LittleEndian.AppendUint64(b, uint64(ms))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decoder reads from b, recording in err instead of panicking when the data
+// runs out early. Once err is set every read returns a zero value.
+type decoder struct {
+	b   []byte
+	err bool
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err || n < 0 || n > len(d.b) {
+		d.err = true
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *decoder) uint16() uint16 {
+	if p := d.take(2); p != nil {
+		return binary.LittleEndian.Uint16(p)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if p := d.take(4); p != nil {
+		return binary.LittleEndian.Uint32(p)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if p := d.take(8); p != nil {
+		return binary.LittleEndian.Uint64(p)
+	}
+	return 0
+}
+
+// count reads an element count, rejecting counts that can't fit in the
+// remaining data when each element takes at least minSize bytes, so a
+// corrupt count can't trigger a huge allocation.
+func (d *decoder) count(minSize int) int {
+	n, k := binary.Uvarint(d.b)
+	if k <= 0 || n > uint64(len(d.b)-k)/uint64(minSize) {
+		d.err = true
+		return 0
+	}
+	d.b = d.b[k:]
+	return int(n)
+}
+
+// expiry reads a time written by appendExpiry.
+func (d *decoder) expiry() time.Time {
+	if ms := int64(d.uint64()); ms != 0 {
+		return time.UnixMilli(ms)
+	}
+	return time.Time{}
+}
+
+func (d *decoder) string() string {
+	n := d.count(1)
+	return string(d.take(n))
+}
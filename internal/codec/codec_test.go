@@ -0,0 +1,66 @@
+package codec
+
+import (
+	"jellyfish/internal/store"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCodec_RoundTrip(t *testing.T) {
+	expiry := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	tests := []struct {
+		name string
+		item store.Item
+	}{
+		{"string", store.Item{Type: store.TypeString, StrVal: "hello\r\n\x00world"}},
+		{"empty string", store.Item{Type: store.TypeString}},
+		{"vector", store.Item{Type: store.TypeVector, VecVal: []float32{0.1, -2.5, 3e10}}},
+		{"empty vector", store.Item{Type: store.TypeVector, VecVal: []float32{}}},
+		{"float16 vector", store.Item{Type: store.TypeVector, HalfVal: []uint16{0x3c00, 0xc000, 0x7bff}, HalfEncoded: true}},
+		{"hash", store.Item{Type: store.TypeHash, HashVal: map[string]string{"name": "Alice", "age": "30", "": "empty"}}},
+		{"with expiry", store.Item{Type: store.TypeString, StrVal: "v", ExpiresAt: expiry}},
+		{"field expiry", store.Item{Type: store.TypeHash, HashVal: map[string]string{"a": "1", "b": "2"}, FieldExpiresAt: map[string]time.Time{"b": expiry}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(Encode(tt.item))
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.item) {
+				t.Errorf("Decode(Encode(%+v)) = %+v", tt.item, got)
+			}
+		})
+	}
+}
+
+func TestCodec_Deterministic(t *testing.T) {
+	item := store.Item{Type: store.TypeHash, HashVal: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}}
+	first := string(Encode(item))
+	for range 10 {
+		if string(Encode(item)) != first {
+			t.Fatal("Encode of the same hash produced different payloads")
+		}
+	}
+}
+
+func TestCodec_BadPayload(t *testing.T) {
+	good := Encode(store.Item{Type: store.TypeHash, HashVal: map[string]string{"f": "v"}})
+
+	flipped := append([]byte(nil), good...)
+	flipped[10] ^= 0xff
+
+	tests := map[string][]byte{
+		"empty":     nil,
+		"truncated": good[:len(good)-1],
+		"corrupt":   flipped,
+		"garbage":   []byte("this is not a dump payload"),
+	}
+	for name, b := range tests {
+		if _, err := Decode(b); err != ErrBadPayload {
+			t.Errorf("Decode(%s) error = %v, want ErrBadPayload", name, err)
+		}
+	}
+}
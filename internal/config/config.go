@@ -0,0 +1,194 @@
+// Package config loads the server configuration from a redis.conf-style file.
+//
+// The file holds one directive per line, a name followed by its value:
+//
+//	# comments and blank lines are ignored
+//	port 6380
+//	dir /var/lib/jellyfish
+//	maxmemory 100mb
+//
+// A value may be wrapped in double quotes. The file covers the settings needed
+// at startup: port, bind, unixsocket, dir, appendonly, appendfilename,
+// appendfsync, maxmemory, maxmemory-policy and shards. Their names match the
+// CONFIG GET parameters, and a command-line flag of the same name overrides
+// the file. Parameters that only matter at runtime, such as timeout or
+// maxclients, are not read from the file; set them with CONFIG SET once the
+// server is up.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"jellyfish/internal/aof"
+	"jellyfish/internal/store"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config is the server configuration read at startup.
+type Config struct {
+	Port            int
+	Bind            string // empty listens on all interfaces
+	UnixSocket      string // path of a Unix socket to listen on as well, empty for none
+	Dir             string
+	AppendOnly      bool
+	AppendFilename  string
+	AppendFsync     aof.FsyncPolicy
+	MaxMemory       int64 // bytes, 0 for no limit
+	MaxMemoryPolicy store.EvictionPolicy
+	Shards          int // number of store shards, see store.NewSharded
+}
+
+// Default returns the configuration used when no file or flag says otherwise.
+func Default() Config {
+	return Config{
+		Port:            6379,
+		Dir:             ".",
+		AppendOnly:      true,
+		AppendFilename:  "database.aof",
+		AppendFsync:     aof.FsyncEverySec,
+		MaxMemoryPolicy: store.NoEviction,
+		Shards:          store.DefaultShards,
+	}
+}
+
+// Load reads the file at path on top of the defaults.
+func Load(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+
+	cfg := Default()
+	if err := cfg.Parse(f); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse applies every directive read from r to c.
+func (c *Config) Parse(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// The name ends at the first space or tab; the value is the rest of
+		// the line, which may itself contain spaces.
+		name := strings.Fields(line)[0]
+		value := strings.TrimSpace(line[len(name):])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if err := c.Set(strings.ToLower(name), value); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return sc.Err()
+}
+
+// Set applies a single directive.
+func (c *Config) Set(name, value string) error {
+	switch name {
+	case "port":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 65535 {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		c.Port = n
+	case "bind":
+		c.Bind = value
+	case "unixsocket":
+		c.UnixSocket = value
+	case "dir":
+		c.Dir = value
+	case "appendonly":
+		switch strings.ToLower(value) {
+		case "yes":
+			c.AppendOnly = true
+		case "no":
+			c.AppendOnly = false
+		default:
+			return fmt.Errorf("appendonly must be yes or no, not %q", value)
+		}
+	case "appendfilename":
+		if value == "" || filepath.Base(value) != value {
+			return fmt.Errorf("appendfilename must be a plain file name, not %q", value)
+		}
+		c.AppendFilename = value
+	case "appendfsync":
+		policy, ok := aof.ParseFsyncPolicy(strings.ToLower(value))
+		if !ok {
+			return fmt.Errorf("appendfsync must be always, everysec or no, not %q", value)
+		}
+		c.AppendFsync = policy
+	case "maxmemory":
+		n, err := ParseMemory(value)
+		if err != nil {
+			return err
+		}
+		c.MaxMemory = n
+	case "maxmemory-policy":
+		policy, ok := store.ParseEvictionPolicy(strings.ToLower(value))
+		if !ok {
+			return fmt.Errorf("maxmemory-policy must be noeviction, allkeys-lru or allkeys-lfu, not %q", value)
+		}
+		c.MaxMemoryPolicy = policy
+	case "shards":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1024 {
+			return fmt.Errorf("shards must be between 1 and 1024, not %q", value)
+		}
+		c.Shards = n
+	default:
+		// This includes the runtime-only CONFIG SET parameters; see the
+		// package doc.
+		return fmt.Errorf("unknown directive %q", name)
+	}
+	return nil
+}
+
+// AOFPath returns the path of the append-only file.
+func (c *Config) AOFPath() string {
+	return filepath.Join(c.Dir, c.AppendFilename)
+}
+
+// Addr returns the address to listen on.
+func (c *Config) Addr() string {
+	return net.JoinHostPort(c.Bind, strconv.Itoa(c.Port))
+}
+
+// memoryUnits are the size suffixes accepted by ParseMemory, as in redis.conf:
+// k, m and g are powers of 1000 and kb, mb and gb powers of 1024.
+var memoryUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9},
+	{"b", 1},
+}
+
+// ParseMemory parses a byte count with an optional unit, such as 100mb.
+func ParseMemory(value string) (int64, error) {
+	s := strings.ToLower(value)
+	scale := int64(1)
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, scale = strings.TrimSuffix(s, u.suffix), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/scale {
+		return 0, fmt.Errorf("invalid memory size %q", value)
+	}
+	return n * scale, nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"jellyfish/internal/aof"
+	"jellyfish/internal/store"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfig_Parse(t *testing.T) {
+	file := `
+# Jellyfish test configuration
+port 6380
+bind 127.0.0.1
+unixsocket /tmp/jellyfish.sock
+dir "/var/lib/jellyfish"
+
+appendonly no
+appendfilename appendonly.aof
+APPENDFSYNC always
+# Names and values may be separated by tabs or several spaces.
+maxmemory	100mb
+maxmemory-policy   allkeys-lfu
+shards 64
+`
+	cfg := Default()
+	if err := cfg.Parse(strings.NewReader(file)); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	want := Config{
+		Port:            6380,
+		Bind:            "127.0.0.1",
+		UnixSocket:      "/tmp/jellyfish.sock",
+		Dir:             "/var/lib/jellyfish",
+		AppendOnly:      false,
+		AppendFilename:  "appendonly.aof",
+		AppendFsync:     aof.FsyncAlways,
+		MaxMemory:       100 << 20,
+		MaxMemoryPolicy: store.AllKeysLFU,
+		Shards:          64,
+	}
+	if cfg != want {
+		t.Errorf("Parse = %+v, want %+v", cfg, want)
+	}
+	if path := cfg.AOFPath(); path != "/var/lib/jellyfish/appendonly.aof" {
+		t.Errorf("AOFPath = %q", path)
+	}
+	if addr := cfg.Addr(); addr != "127.0.0.1:6380" {
+		t.Errorf("Addr = %q", addr)
+	}
+}
+
+func TestConfig_ParseErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{file: "port 6380\nbogus 1\n", want: `line 2: unknown directive "bogus"`},
+		{file: "timeout 300\n", want: `line 1: unknown directive "timeout"`},
+		{file: "port 70000\n", want: `line 1: invalid port "70000"`},
+		{file: "appendonly maybe\n", want: `line 1: appendonly must be yes or no, not "maybe"`},
+		{file: "appendfsync sometimes\n", want: `line 1: appendfsync must be always, everysec or no, not "sometimes"`},
+		{file: "appendfilename ../x.aof\n", want: `line 1: appendfilename must be a plain file name, not "../x.aof"`},
+		{file: "maxmemory lots\n", want: `line 1: invalid memory size "lots"`},
+		{file: "shards 0\n", want: `line 1: shards must be between 1 and 1024, not "0"`},
+		{file: "maxmemory-policy volatile-lru\n", want: `line 1: maxmemory-policy must be noeviction, allkeys-lru or allkeys-lfu, not "volatile-lru"`},
+	}
+
+	for _, tt := range tests {
+		cfg := Default()
+		err := cfg.Parse(strings.NewReader(tt.file))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("Parse(%q) error = %v, want %q", tt.file, err, tt.want)
+		}
+	}
+}
+
+func TestConfig_Load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jellyfish.conf")
+	if err := os.WriteFile(path, []byte("port 6381\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	// Directives missing from the file keep their defaults.
+	want := Default()
+	want.Port = 6381
+	if cfg != want {
+		t.Errorf("Load = %+v, want %+v", cfg, want)
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.conf")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"1k", 1000},
+		{"1kb", 1024},
+		{"2MB", 2 << 20},
+		{"1g", 1e9},
+		{"1gb", 1 << 30},
+		{"10b", 10},
+	}
+	for _, tt := range tests {
+		if got, err := ParseMemory(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseMemory(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "-1", "mb", "1tb", "9999999999gb"} {
+		if _, err := ParseMemory(in); err == nil {
+			t.Errorf("ParseMemory(%q) succeeded, want error", in)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"jellyfish/internal/resp"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Access control lists.
+//
+// Every connection runs as an ACL user, starting as "default", which is
+// enabled, needs no password and may run every command until ACL SETUSER
+// changes it. A user's permissions are the set of commands it may run, built
+// up by rules applied in order as in Redis: +cmd and -cmd allow or forbid one
+// command, +@category and -@category every command in a category. Users are
+// kept in memory only.
+
+const defaultUser = "default"
+
+// aclCategories maps each ACL category to the command table flag of the
+// commands in it. The all category holds every command.
+var aclCategories = map[string]string{
+	"read":  "readonly",
+	"write": "write",
+	"admin": "admin",
+	"fast":  "fast",
+}
+
+const noPermError = "NOPERM User %s has no permissions to run the '%s' command"
+
+type aclUser struct {
+	enabled   bool
+	nopass    bool
+	passwords map[[sha256.Size]byte]bool // SHA-256 of every accepted password
+	commands  map[string]bool            // commands the user may run, by table name
+}
+
+// acl is the registry of users, shared by all connections.
+type acl struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+}
+
+func newACL() *acl {
+	return &acl{users: map[string]*aclUser{
+		defaultUser: {enabled: true, nopass: true, passwords: map[[sha256.Size]byte]bool{}, commands: categoryCommands("all")},
+	}}
+}
+
+// categoryCommands returns the set of commands in an ACL category, or nil if
+// there is no such category.
+func categoryCommands(category string) map[string]bool {
+	flag, ok := aclCategories[category]
+	if !ok && category != "all" {
+		return nil
+	}
+	cmds := make(map[string]bool)
+	for name, spec := range commandTable {
+		if category == "all" || spec.hasFlag(flag) {
+			cmds[name] = true
+		}
+	}
+	return cmds
+}
+
+// authenticate reports whether name is an enabled user accepting password.
+func (a *acl) authenticate(name, password string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	return ok && u.enabled && (u.nopass || u.passwords[sha256.Sum256([]byte(password))])
+}
+
+// allowed reports whether the user name may run command. As in Redis,
+// disabling a user doesn't affect connections already authenticated as it.
+func (a *acl) allowed(name, command string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	return ok && u.commands[command]
+}
+
+// setUser applies rules to the user name, creating it first if needed. A new
+// user is disabled and may run nothing. Either every rule is applied or, if
+// one is invalid, none are.
+func (a *acl) setUser(name string, rules []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u := &aclUser{passwords: map[[sha256.Size]byte]bool{}, commands: map[string]bool{}}
+	if old, ok := a.users[name]; ok {
+		*u = *old
+		u.passwords = maps.Clone(old.passwords)
+		u.commands = maps.Clone(old.commands)
+	}
+	for _, rule := range rules {
+		if err := u.apply(rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %v", rule, err)
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// apply changes u according to a single ACL SETUSER rule.
+func (u *aclUser) apply(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		clear(u.passwords)
+	case lower == "resetpass":
+		u.nopass = false
+		clear(u.passwords)
+	case lower == "allcommands":
+		maps.Copy(u.commands, categoryCommands("all"))
+	case lower == "nocommands":
+		clear(u.commands)
+	case lower == "reset":
+		*u = aclUser{passwords: map[[sha256.Size]byte]bool{}, commands: map[string]bool{}}
+	case strings.HasPrefix(rule, ">"):
+		u.nopass = false
+		u.passwords[sha256.Sum256([]byte(rule[1:]))] = true
+	case strings.HasPrefix(rule, "<"):
+		sum := sha256.Sum256([]byte(rule[1:]))
+		if !u.passwords[sum] {
+			return fmt.Errorf("no such password")
+		}
+		delete(u.passwords, sum)
+	case strings.HasPrefix(lower, "+@"), strings.HasPrefix(lower, "-@"):
+		cmds := categoryCommands(lower[2:])
+		if cmds == nil {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		for name := range cmds {
+			u.commands[name] = rule[0] == '+'
+		}
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		name := strings.ToUpper(rule[1:])
+		if _, ok := commandTable[name]; !ok {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		u.commands[name] = rule[0] == '+'
+	default:
+		return fmt.Errorf("Syntax error")
+	}
+	return nil
+}
+
+// describe renders the user name in the ACL LIST format, with passwords shown
+// as their SHA-256 hashes.
+func (u *aclUser) describe(name string) string {
+	parts := []string{"user", name, "off"}
+	if u.enabled {
+		parts[2] = "on"
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	var hashes []string
+	for sum := range u.passwords {
+		hashes = append(hashes, "#"+hex.EncodeToString(sum[:]))
+	}
+	slices.Sort(hashes)
+	parts = append(parts, hashes...)
+
+	var allowed []string
+	for _, name := range commandNames() {
+		if u.commands[name] {
+			allowed = append(allowed, "+"+strings.ToLower(name))
+		}
+	}
+	if len(allowed) == len(commandTable) {
+		return strings.Join(append(parts, "+@all"), " ")
+	}
+	return strings.Join(append(append(parts, "-@all"), allowed...), " ")
+}
+
+// aclHelp lists the subcommands of ACL for ACL HELP.
+var aclHelp = map[string]string{
+	"LIST":                            "List all users in the ACL SETUSER rule format.",
+	"SETUSER <username> [<rule> ...]": "Create or modify a user with the specified rules: on, off, nopass, resetpass, >password, <password, +command, -command, +@category, -@category, allcommands, nocommands or reset.",
+	"WHOAMI":                          "Return the user the connection is authenticated as.",
+}
+
+// ACL SETUSER username [rule ...] | ACL WHOAMI | ACL LIST | ACL HELP
+// ACL is handled in handleCommand because WHOAMI depends on the connection.
+func (h *Handler) aclCommand(args []resp.Value, sess *session) resp.Value {
+	switch strings.ToUpper(args[0].Bulk) {
+	case "HELP":
+		return subcommandHelp("ACL", aclHelp)
+
+	case "SETUSER":
+		if len(args) < 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'acl|setuser' command"}
+		}
+		rules := make([]string, len(args)-2)
+		for i, a := range args[2:] {
+			rules[i] = a.Bulk
+		}
+		if err := h.acl.setUser(args[1].Bulk, rules); err != nil {
+			return resp.Value{Type: "error", Str: "ERR " + err.Error()}
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "WHOAMI":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'acl|whoami' command"}
+		}
+		return resp.Value{Type: "bulk", Bulk: sess.user}
+
+	case "LIST":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'acl|list' command"}
+		}
+		h.acl.mu.RLock()
+		defer h.acl.mu.RUnlock()
+		names := slices.Sorted(maps.Keys(h.acl.users))
+		arr := make([]resp.Value, len(names))
+		for i, name := range names {
+			arr[i] = resp.Value{Type: "bulk", Bulk: h.acl.users[name].describe(name)}
+		}
+		return resp.Value{Type: "array", Array: arr}
+
+	default:
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'", args[0].Bulk)}
+	}
+}
+
+// AUTH [username] password
+func (h *Handler) authCommand(args []resp.Value, sess *session) resp.Value {
+	name, password := defaultUser, args[0].Bulk
+	switch len(args) {
+	case 1:
+	case 2:
+		name, password = args[0].Bulk, args[1].Bulk
+	default:
+		return resp.Value{Type: "error", Str: "ERR syntax error"}
+	}
+	if !h.acl.authenticate(name, password) {
+		return resp.Value{Type: "error", Str: "WRONGPASS invalid username-password pair or user is disabled."}
+	}
+	sess.user = name
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// isSecretArg reports whether argument i of the command value is a password,
+// which MONITOR shows as (redacted).
+func isSecretArg(value resp.Value, i int) bool {
+	switch strings.ToUpper(value.Array[0].Bulk) {
+	case "AUTH":
+		return i > 0
+	case "ACL":
+		arg := value.Array[i].Bulk
+		return i > 2 && strings.EqualFold(value.Array[1].Bulk, "SETUSER") && (strings.HasPrefix(arg, ">") || strings.HasPrefix(arg, "<"))
+	}
+	return false
+}
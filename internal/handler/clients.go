@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"fmt"
+	"jellyfish/internal/resp"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reapInterval is how often the registry is checked for idle clients.
+const reapInterval = 100 * time.Millisecond
+
+// client is the entry of one connection in the client registry.
+type client struct {
+	id      int64
+	conn    net.Conn
+	out     *outputBuffer
+	created time.Time
+
+	lastCommand atomic.Int64 // Unix time in nanoseconds the last command was received
+	reapExempt  atomic.Bool  // replica and monitor links, which don't send commands
+	noTouch     atomic.Bool  // set by CLIENT NO-TOUCH: reads don't count as key accesses
+}
+
+// clients is the registry of open connections, used by the CLIENT command.
+// While it isn't empty, a reaper goroutine closes the clients that have sent
+// no command for longer than idleLimit, if that isn't 0.
+type clients struct {
+	idleLimit func() time.Duration
+
+	mu      sync.Mutex
+	nextID  int64
+	set     map[int64]*client
+	reaping bool // the reaper goroutine is running
+}
+
+func newClients(idleLimit func() time.Duration) *clients {
+	return &clients{idleLimit: idleLimit, set: make(map[int64]*client)}
+}
+
+// add registers conn, whose replies go to out, and returns its entry. IDs
+// are never reused.
+func (c *clients) add(conn net.Conn, out *outputBuffer) *client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	cl := &client{id: c.nextID, conn: conn, out: out, created: time.Now()}
+	cl.lastCommand.Store(cl.created.UnixNano())
+	c.set[cl.id] = cl
+	if !c.reaping {
+		c.reaping = true
+		go c.reap()
+	}
+	return cl
+}
+
+// reap closes and unregisters idle clients every reapInterval until the
+// registry is empty. Like kill, it leaves each one's Handle goroutine to exit
+// when its read fails.
+func (c *clients) reap() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		if len(c.set) == 0 {
+			c.reaping = false
+			c.mu.Unlock()
+			return
+		}
+		if limit := c.idleLimit(); limit > 0 {
+			oldest := time.Now().Add(-limit).UnixNano()
+			for id, cl := range c.set {
+				if !cl.reapExempt.Load() && cl.lastCommand.Load() < oldest {
+					fmt.Println("closing idle client:", cl.conn.RemoteAddr())
+					cl.conn.Close()
+					delete(c.set, id)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// remove unregisters cl. It is safe to call more than once.
+func (c *clients) remove(cl *client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.set, cl.id)
+}
+
+// kill closes and unregisters every client matched by match and returns how
+// many there were. Each one's Handle goroutine exits when its read fails.
+func (c *clients) kill(match func(cl *client) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	killed := 0
+	for id, cl := range c.set {
+		if match(cl) {
+			cl.conn.Close()
+			delete(c.set, id)
+			killed++
+		}
+	}
+	return killed
+}
+
+// list renders the registry in the CLIENT LIST format, one line per client
+// in ID order.
+func (c *clients) list() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	for _, id := range slices.Sorted(maps.Keys(c.set)) {
+		cl := c.set[id]
+		fmt.Fprintf(&b, "id=%d addr=%s laddr=%s age=%d idle=%d omem=%d no-evict=%s no-touch=%s\n",
+			cl.id, cl.conn.RemoteAddr(), cl.conn.LocalAddr(), int(time.Since(cl.created).Seconds()),
+			int(time.Since(time.Unix(0, cl.lastCommand.Load())).Seconds()), cl.out.pending(),
+			onOff(cl.out.noEvict.Load()), onOff(cl.noTouch.Load()))
+	}
+	return b.String()
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// clientHelp lists the subcommands of CLIENT for CLIENT HELP.
+var clientHelp = map[string]string{
+	"ID":             "Return the ID of the current connection.",
+	"KILL <ip:port>": "Kill connection made from <ip:port>.",
+	"KILL <option> <value> [<option> <value> [...]]": "Kill connections matching every filter: ID <client-id>, ADDR <ip:port> or SKIPME (YES|NO), which defaults to YES.",
+	"LIST":              "Return information about client connections.",
+	"NO-EVICT (ON|OFF)": "Protect the current connection from client-output-buffer-limit.",
+	"NO-TOUCH (ON|OFF)": "Stop the commands of the current connection, other than TOUCH, from changing the access time and frequency of keys.",
+}
+
+// CLIENT ID | CLIENT LIST | CLIENT NO-EVICT on|off | CLIENT NO-TOUCH on|off | CLIENT KILL addr | CLIENT KILL [ID id] [ADDR addr] [SKIPME yes|no] | CLIENT HELP
+// CLIENT is handled in handleCommand because it depends on the connection.
+func (h *Handler) clientCommand(args []resp.Value, sess *session) resp.Value {
+	switch strings.ToUpper(args[0].Bulk) {
+	case "HELP":
+		return subcommandHelp("CLIENT", clientHelp)
+
+	case "ID":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'client|id' command"}
+		}
+		return resp.Value{Type: "integer", Num: int(sess.client.id)}
+
+	case "LIST":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'client|list' command"}
+		}
+		return resp.Value{Type: "bulk", Bulk: h.clients.list()}
+
+	case "NO-EVICT":
+		if len(args) != 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'client|no-evict' command"}
+		}
+		switch strings.ToLower(args[1].Bulk) {
+		case "on":
+			sess.out.noEvict.Store(true)
+		case "off":
+			sess.out.noEvict.Store(false)
+		default:
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "NO-TOUCH":
+		if len(args) != 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'client|no-touch' command"}
+		}
+		switch strings.ToLower(args[1].Bulk) {
+		case "on":
+			sess.client.noTouch.Store(true)
+		case "off":
+			sess.client.noTouch.Store(false)
+		default:
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "KILL":
+		if len(args) < 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'client|kill' command"}
+		}
+		return h.clientKill(args[1:], sess)
+
+	default:
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'", args[0].Bulk)}
+	}
+}
+
+// clientKill implements both forms of CLIENT KILL: the old one taking a
+// single address, which replies OK or an error, and the filter form, which
+// replies with the number of clients killed. Filters must all match, and
+// unless SKIPME no is given the calling client is never killed.
+func (h *Handler) clientKill(args []resp.Value, sess *session) resp.Value {
+	if len(args) == 1 {
+		addr := args[0].Bulk
+		if h.clients.kill(func(cl *client) bool { return cl.conn.RemoteAddr().String() == addr }) == 0 {
+			return resp.Value{Type: "error", Str: "ERR No such client"}
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+	}
+	if len(args)%2 != 0 {
+		return resp.Value{Type: "error", Str: "ERR syntax error"}
+	}
+
+	var filters []func(cl *client) bool
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		arg := args[i+1].Bulk
+		switch strings.ToUpper(args[i].Bulk) {
+		case "ID":
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || id <= 0 {
+				return resp.Value{Type: "error", Str: "ERR client-id should be greater than 0"}
+			}
+			filters = append(filters, func(cl *client) bool { return cl.id == id })
+		case "ADDR":
+			filters = append(filters, func(cl *client) bool { return cl.conn.RemoteAddr().String() == arg })
+		case "SKIPME":
+			switch strings.ToLower(arg) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return resp.Value{Type: "error", Str: "ERR syntax error"}
+			}
+		default:
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	killed := h.clients.kill(func(cl *client) bool {
+		if skipMe && cl == sess.client {
+			return false
+		}
+		for _, match := range filters {
+			if !match(cl) {
+				return false
+			}
+		}
+		return true
+	})
+	return resp.Value{Type: "integer", Num: killed}
+}
@@ -0,0 +1,405 @@
+package handler
+
+import (
+	"jellyfish/internal/resp"
+	"jellyfish/internal/store"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HSET key field value [field value ...]
+func hsetCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key := args[0].Bulk
+	fields := make(map[string]string, (len(args)-1)/2)
+	for i := 1; i < len(args); i += 2 {
+		fields[args[i].Bulk] = args[i+1].Bulk
+	}
+	if typ, exists := h.store.TypeWithoutLock(key); exists && typ != store.TypeHash {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	return resp.Value{Type: "integer", Num: h.store.HSetWithoutLock(key, fields)}
+}
+
+// HGET key field
+func hgetCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	val, found, typeOk := h.store.HGetWithoutLock(args[0].Bulk, args[1].Bulk)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !found {
+		return resp.Value{Type: "null"}
+	}
+	return resp.Value{Type: "bulk", Bulk: val}
+}
+
+// HDEL key field [field ...]
+func hdelCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key := args[0].Bulk
+	fields := make([]string, len(args)-1)
+	for i, a := range args[1:] {
+		fields[i] = a.Bulk
+	}
+	// Nothing is logged unless a field will be deleted. The check peeks, so
+	// that only the delete below counts as an access to the key.
+	item, ok := h.store.PeekItemWithoutLock(key)
+	if !ok {
+		return resp.Value{Type: "integer", Num: 0}
+	}
+	if item.Type != store.TypeHash {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !slices.ContainsFunc(fields, func(f string) bool { _, ok := item.HashGet(f); return ok }) {
+		return resp.Value{Type: "integer", Num: 0}
+	}
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	return resp.Value{Type: "integer", Num: h.store.HDelWithoutLock(key, fields)}
+}
+
+// HGETALL key
+func hgetallCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return hashContents(h, args[0].Bulk, true, true)
+}
+
+// HKEYS key
+func hkeysCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return hashContents(h, args[0].Bulk, true, false)
+}
+
+// HVALS key
+func hvalsCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return hashContents(h, args[0].Bulk, false, true)
+}
+
+// hashContents replies with the field names, the values or both, interleaved,
+// of the hash at key. Fields come in Go map order unless sort-hash-fields is
+// on, in which case they are sorted by name.
+func hashContents(h *Handler, key string, fields, values bool) resp.Value {
+	m, typeOk := h.store.HGetAllWithoutLock(key)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	names := slices.AppendSeq(make([]string, 0, len(m)), maps.Keys(m))
+	if h.config.sortHashFields.Load() {
+		slices.Sort(names)
+	}
+	arr := make([]resp.Value, 0, 2*len(m))
+	for _, f := range names {
+		if fields {
+			arr = append(arr, resp.Value{Type: "bulk", Bulk: f})
+		}
+		if values {
+			arr = append(arr, resp.Value{Type: "bulk", Bulk: m[f]})
+		}
+	}
+	return resp.Value{Type: "array", Array: arr}
+}
+
+// HEXISTS key field
+func hexistsCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	exists, typeOk := h.store.HExistsWithoutLock(args[0].Bulk, args[1].Bulk)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if exists {
+		return resp.Value{Type: "integer", Num: 1}
+	}
+	return resp.Value{Type: "integer", Num: 0}
+}
+
+// HLEN key
+func hlenCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	length := h.store.HLenWithoutLock(args[0].Bulk)
+	if length == -1 {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	return resp.Value{Type: "integer", Num: length}
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count]
+func hscanCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	sa, errStr := parseScanArgs(args[1:], false)
+	if errStr != "" {
+		return resp.Value{Type: "error", Str: errStr}
+	}
+	next, pairs, typeOk := h.store.HScanWithoutLock(args[0].Bulk, sa.cursor, sa.pattern, sa.count)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	return scanReply(next, pairs)
+}
+
+// maxRandomRepeats is the most fields HRANDFIELD returns for a negative count.
+// The reply is built in memory, so a count of billions would otherwise take
+// the server down trying to allocate it.
+const maxRandomRepeats = 1 << 20
+
+// HRANDFIELD key [count [WITHVALUES]]
+func hrandfieldCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key := args[0].Bulk
+	if len(args) == 1 {
+		fields, typeOk := h.store.HRandFieldWithoutLock(key, 1, false)
+		if !typeOk {
+			return resp.Value{Type: "error", Str: wrongTypeError}
+		}
+		if len(fields) == 0 {
+			return resp.Value{Type: "null"}
+		}
+		return resp.Value{Type: "bulk", Bulk: fields[0]}
+	}
+
+	count, err := strconv.Atoi(args[1].Bulk)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	withValues := false
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2].Bulk, "WITHVALUES") {
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+		withValues = true
+	}
+	if len(args) > 3 {
+		return resp.Value{Type: "error", Str: "ERR syntax error"}
+	}
+	if count < -maxRandomRepeats {
+		return resp.Value{Type: "error", Str: "ERR value is out of range"}
+	}
+
+	fields, typeOk := h.store.HRandFieldWithoutLock(key, count, withValues)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	arr := make([]resp.Value, len(fields))
+	for i, f := range fields {
+		arr[i] = resp.Value{Type: "bulk", Bulk: f}
+	}
+	return resp.Value{Type: "array", Array: arr}
+}
+
+// HGETDEL key FIELDS numfields field [field ...]
+// The removed fields are logged to the AOF as HDEL.
+func hgetdelCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	opts, fields, errMsg := parseFieldsArg(args[1:])
+	if errMsg == "" && len(opts) > 0 {
+		errMsg = fieldsMissingError
+	}
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	key := args[0].Bulk
+	arr := make([]resp.Value, len(fields))
+	logged := []string{"HDEL", key}
+	for i, f := range fields {
+		v, ok, typeOk := h.store.HGetWithoutLock(key, f)
+		if !typeOk {
+			return resp.Value{Type: "error", Str: wrongTypeError}
+		}
+		// A field named twice is gone by the second time, as in Redis.
+		if !ok || slices.Contains(logged[2:], f) {
+			arr[i] = resp.Value{Type: "null"}
+			continue
+		}
+		arr[i] = resp.Value{Type: "bulk", Bulk: v}
+		logged = append(logged, f)
+	}
+	if len(logged) > 2 {
+		if err := h.writeAOF(bulkCommand(logged...)); err != nil {
+			return resp.Value{Type: "error", Str: aofWriteError}
+		}
+		h.store.HGetDelWithoutLock(key, logged[2:])
+	}
+	return resp.Value{Type: "array", Array: arr}
+}
+
+// HGETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST] FIELDS numfields field [field ...]
+// As with GETEX, a TTL change is logged as HPEXPIREAT or HPERSIST of the
+// fields that exist; a plain read logs nothing.
+func hgetexCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	opts, fields, errMsg := parseFieldsArg(args[1:])
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	expiresAt, persist, errMsg := parseGetExOptions(opts, "hgetex", h.store.Now())
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+
+	key := args[0].Bulk
+	arr := make([]resp.Value, len(fields))
+	var found []string
+	for i, f := range fields {
+		v, ok, typeOk := h.store.HGetWithoutLock(key, f)
+		if !typeOk {
+			return resp.Value{Type: "error", Str: wrongTypeError}
+		}
+		if !ok {
+			arr[i] = resp.Value{Type: "null"}
+			continue
+		}
+		arr[i] = resp.Value{Type: "bulk", Bulk: v}
+		found = append(found, f)
+	}
+
+	var logged []string
+	switch {
+	case len(found) == 0:
+	case persist:
+		ttls, _ := h.store.HTTLWithoutLock(key, found)
+		if slices.ContainsFunc(ttls, func(ttl int) bool { return ttl >= 0 }) {
+			logged = append([]string{"HPERSIST", key, "FIELDS", strconv.Itoa(len(found))}, found...)
+		}
+	case !expiresAt.IsZero():
+		logged = append([]string{"HPEXPIREAT", key, strconv.FormatInt(expiresAt.UnixMilli(), 10), "FIELDS", strconv.Itoa(len(found))}, found...)
+	}
+	if logged == nil {
+		return resp.Value{Type: "array", Array: arr}
+	}
+	if err := h.writeAOF(bulkCommand(logged...)); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	if persist {
+		h.store.HPersistWithoutLock(key, found)
+	} else {
+		h.store.HExpireAtWithoutLock(key, found, expiresAt, 0)
+	}
+	return resp.Value{Type: "array", Array: arr}
+}
+
+// HEXPIRE key seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hexpireCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	seconds, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	at, ok := expireIn(h.store.Now(), seconds, time.Second)
+	if !ok {
+		return resp.Value{Type: "error", Str: "ERR invalid expire time in 'hexpire' command"}
+	}
+	return hashExpireAt(h, args[0].Bulk, at, args[2:])
+}
+
+// HPEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hpexpireatCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	ms, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	at, ok := unixTime(ms, time.Millisecond)
+	if !ok {
+		return resp.Value{Type: "error", Str: "ERR invalid expire time in 'hpexpireat' command"}
+	}
+	return hashExpireAt(h, args[0].Bulk, at, args[2:])
+}
+
+// hashExpireAt applies an HEXPIRE-family command once its expiry has been
+// resolved to an absolute time. As with expireAt, the AOF records it as
+// HPEXPIREAT with that time, listing only the fields that were changed.
+func hashExpireAt(h *Handler, key string, at time.Time, args []resp.Value) resp.Value {
+	opts, fields, errMsg := parseFieldsArg(args)
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	flags, errMsg := parseExpireFlags(opts)
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+
+	results, typeOk := h.store.HExpireAtResultsWithoutLock(key, fields, at, flags)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+
+	var changed []string
+	for i, r := range results {
+		if r == store.FieldUpdated || r == store.FieldDeleted {
+			changed = append(changed, fields[i])
+		}
+	}
+	if len(changed) > 0 {
+		logged := append([]string{"HPEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10), "FIELDS", strconv.Itoa(len(changed))}, changed...)
+		if err := h.writeAOF(bulkCommand(logged...)); err != nil {
+			return resp.Value{Type: "error", Str: aofWriteError}
+		}
+		h.store.HExpireAtWithoutLock(key, fields, at, flags)
+	}
+	return intArray(results)
+}
+
+// HTTL key FIELDS numfields field [field ...]
+func httlCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	opts, fields, errMsg := parseFieldsArg(args[1:])
+	if errMsg == "" && len(opts) > 0 {
+		errMsg = fieldsMissingError
+	}
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	results, typeOk := h.store.HTTLWithoutLock(args[0].Bulk, fields)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	return intArray(results)
+}
+
+// HPERSIST key FIELDS numfields field [field ...]
+func hpersistCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	opts, fields, errMsg := parseFieldsArg(args[1:])
+	if errMsg == "" && len(opts) > 0 {
+		errMsg = fieldsMissingError
+	}
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	ttls, typeOk := h.store.HTTLWithoutLock(args[0].Bulk, fields)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !slices.ContainsFunc(ttls, func(ttl int) bool { return ttl >= 0 }) {
+		return intArray(ttls)
+	}
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	results, _ := h.store.HPersistWithoutLock(args[0].Bulk, fields)
+	return intArray(results)
+}
+
+const fieldsMissingError = "ERR Mandatory argument FIELDS is missing or not at the right position"
+
+// parseFieldsArg splits the arguments of the hash field expiry commands into
+// the options before FIELDS and the field names that follow numfields.
+func parseFieldsArg(args []resp.Value) (opts []resp.Value, fields []string, errMsg string) {
+	i := slices.IndexFunc(args, func(a resp.Value) bool { return strings.EqualFold(a.Bulk, "FIELDS") })
+	if i < 0 || i+1 >= len(args) {
+		return nil, nil, fieldsMissingError
+	}
+	n, err := strconv.Atoi(args[i+1].Bulk)
+	if err != nil || n <= 0 {
+		return nil, nil, "ERR Parameter `numFields` should be greater than 0"
+	}
+	if n != len(args)-i-2 {
+		return nil, nil, "ERR The `numfields` parameter must match the number of arguments"
+	}
+	fields = make([]string, n)
+	for j, a := range args[i+2:] {
+		fields[j] = a.Bulk
+	}
+	return args[:i], fields, ""
+}
+
+// intArray returns ns as an array of integer replies.
+func intArray(ns []int) resp.Value {
+	arr := make([]resp.Value, len(ns))
+	for i, n := range ns {
+		arr[i] = resp.Value{Type: "integer", Num: n}
+	}
+	return resp.Value{Type: "array", Array: arr}
+}
@@ -0,0 +1,416 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"jellyfish/internal/aof"
+	"jellyfish/internal/codec"
+	"jellyfish/internal/resp"
+	"jellyfish/internal/store"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEL key [key ...]
+// Only the keys that exist are logged, and nothing at all if none do.
+func delCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	logged := []string{"DEL"}
+	for _, a := range args {
+		if _, exists := h.store.TypeWithoutLock(a.Bulk); exists {
+			logged = append(logged, a.Bulk)
+		}
+	}
+	if len(logged) == 1 {
+		return resp.Value{Type: "integer", Num: 0}
+	}
+	if err := h.writeAOF(bulkCommand(logged...)); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	return resp.Value{Type: "integer", Num: h.store.DelManyWithoutLock(logged[1:])}
+}
+
+// UNLINK key [key ...]
+//
+// UNLINK is DEL. Redis frees large values on a background thread, but here
+// removing a key only drops its last reference and the garbage collector
+// reclaims the memory later either way, so there is nothing to hand off.
+func unlinkCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return delCommand(h, value, args)
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT]
+func expireCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	seconds, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	at, ok := expireIn(h.store.Now(), seconds, time.Second)
+	if !ok {
+		return resp.Value{Type: "error", Str: "ERR invalid expire time in 'expire' command"}
+	}
+	flags, errMsg := parseExpireFlags(args[2:])
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	return expireAt(h, args[0].Bulk, at, flags)
+}
+
+// EXPIREAT key unix-time-seconds [NX|XX|GT|LT]
+func expireatCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	sec, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	at, ok := unixTime(sec, time.Second)
+	if !ok {
+		return resp.Value{Type: "error", Str: "ERR invalid expire time in 'expireat' command"}
+	}
+	flags, errMsg := parseExpireFlags(args[2:])
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	return expireAt(h, args[0].Bulk, at, flags)
+}
+
+// expireAt applies an EXPIRE-family command once its expiry has been resolved
+// to an absolute time. The AOF records it as PEXPIREAT with that time, or as a
+// DEL if the key was deleted because the time had passed, so that replaying
+// the log later neither restarts the countdown nor revives a dead key.
+func expireAt(h *Handler, key string, at time.Time, flags store.ExpireFlags) resp.Value {
+	if !h.store.ExpireAllowedWithoutLock(key, at, flags) {
+		return resp.Value{Type: "integer", Num: 0}
+	}
+
+	logged := bulkCommand("PEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10))
+	if !at.After(h.store.Now()) {
+		logged = bulkCommand("DEL", key)
+	}
+	if err := h.writeAOF(logged); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	h.store.ExpireAtIfWithoutLock(key, at, flags)
+	return resp.Value{Type: "integer", Num: 1}
+}
+
+// TTL key
+func ttlCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	ttl := h.store.TTLWithoutLock(args[0].Bulk)
+	return resp.Value{Type: "integer", Num: ttl}
+}
+
+// EXPIRETIME key
+func expiretimeCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	at := h.store.ExpireTimeWithoutLock(args[0].Bulk)
+	if at > 0 {
+		at /= 1000
+	}
+	return resp.Value{Type: "integer", Num: int(at)}
+}
+
+// PEXPIRETIME key
+func pexpiretimeCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return resp.Value{Type: "integer", Num: int(h.store.ExpireTimeWithoutLock(args[0].Bulk))}
+}
+
+// objectHelp lists the subcommands of OBJECT for OBJECT HELP.
+var objectHelp = map[string]string{
+	"ENCODING <key>": "Return the kind of internal representation used to store the value of <key>.",
+	"FREQ <key>":     "Return the logarithmic access frequency counter of <key>.",
+	"IDLETIME <key>": "Return the number of seconds since <key> was last read or written.",
+	"REFCOUNT <key>": "Return the number of references to the value of <key>, always 1.",
+}
+
+// OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT key | OBJECT HELP
+func objectCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	if strings.EqualFold(args[0].Bulk, "HELP") {
+		return subcommandHelp("OBJECT", objectHelp)
+	}
+	if len(args) != 2 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'object' command"}
+	}
+	switch strings.ToUpper(args[0].Bulk) {
+	case "ENCODING":
+		enc, ok := h.store.EncodingWithoutLock(args[1].Bulk)
+		if !ok {
+			return resp.Value{Type: "error", Str: "ERR no such key"}
+		}
+		return resp.Value{Type: "bulk", Bulk: enc}
+	case "IDLETIME":
+		idle, ok := h.store.IdleTimeWithoutLock(args[1].Bulk)
+		if !ok {
+			return resp.Value{Type: "error", Str: "ERR no such key"}
+		}
+		return resp.Value{Type: "integer", Num: idle}
+	case "FREQ":
+		freq, ok := h.store.FreqWithoutLock(args[1].Bulk)
+		if !ok {
+			return resp.Value{Type: "error", Str: "ERR no such key"}
+		}
+		return resp.Value{Type: "integer", Num: freq}
+	case "REFCOUNT":
+		if _, ok := h.store.EncodingWithoutLock(args[1].Bulk); !ok {
+			return resp.Value{Type: "error", Str: "ERR no such key"}
+		}
+		return resp.Value{Type: "integer", Num: 1}
+	default:
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'", args[0].Bulk)}
+	}
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT]
+func pexpireatCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	ms, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	at, ok := unixTime(ms, time.Millisecond)
+	if !ok {
+		return resp.Value{Type: "error", Str: "ERR invalid expire time in 'pexpireat' command"}
+	}
+	flags, errMsg := parseExpireFlags(args[2:])
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	return expireAt(h, args[0].Bulk, at, flags)
+}
+
+// PERSIST key
+func persistCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	if h.store.TTLWithoutLock(args[0].Bulk) < 0 {
+		return resp.Value{Type: "integer", Num: 0}
+	}
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	h.store.PersistWithoutLock(args[0].Bulk)
+	return resp.Value{Type: "integer", Num: 1}
+}
+
+// DUMP key
+func dumpCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	item, ok := h.store.GetItemWithoutLock(args[0].Bulk)
+	if !ok {
+		return resp.Value{Type: "null"}
+	}
+	return resp.Value{Type: "bulk", Bulk: string(codec.Encode(item))}
+}
+
+// RESTORE key ttl serialized-value [REPLACE]
+// A ttl of 0 keeps the expiry recorded in the payload, if any; a positive ttl
+// replaces it with one that many milliseconds from now.
+func restoreCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key := args[0].Bulk
+	ttl, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	expiresAt, ok := expireIn(h.store.Now(), ttl, time.Millisecond)
+	if ttl < 0 || !ok {
+		return resp.Value{Type: "error", Str: "ERR Invalid TTL value, must be >= 0"}
+	}
+	replace := false
+	for _, arg := range args[3:] {
+		if !strings.EqualFold(arg.Bulk, "REPLACE") {
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+		replace = true
+	}
+
+	item, err := codec.Decode([]byte(args[2].Bulk))
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR DUMP " + err.Error()}
+	}
+	if _, exists := h.store.TypeWithoutLock(key); exists && !replace {
+		return resp.Value{Type: "error", Str: "BUSYKEY Target key name already exists."}
+	}
+	if ttl > 0 {
+		item.ExpiresAt = expiresAt
+	}
+
+	// Log the payload re-encoded with the absolute expiry, so that replaying
+	// it later doesn't restart the TTL.
+	logged := bulkCommand("RESTORE", key, "0", string(codec.Encode(item)), "REPLACE")
+	if err := h.writeAOF(logged); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	h.store.SetItemWithoutLock(key, item)
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// SCAN has no key arguments, so it runs with every shard locked.
+func scanCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	sa, errStr := parseScanArgs(args, true)
+	if errStr != "" {
+		return resp.Value{Type: "error", Str: errStr}
+	}
+	next, keys := h.store.ScanWithoutLock(sa.cursor, sa.pattern, sa.count)
+	if sa.hasType {
+		// Filtering after the keys are picked can leave fewer than COUNT, or
+		// none, before the scan is over, as in Redis.
+		keys = slices.DeleteFunc(keys, func(key string) bool {
+			typ, _ := h.store.TypeWithoutLock(key)
+			return typ != sa.typ
+		})
+	}
+	return scanReply(next, keys)
+}
+
+// FLUSHALL [ASYNC | SYNC]
+// FLUSHALL is logged like any write, so replaying the AOF empties the dataset
+// at the same point. With aof-rewrite-on-flushall on, it then rewrites the
+// AOF, which leaves it empty instead of holding every write that came before;
+// turn it off to keep that history. The keys are always freed at once, so
+// ASYNC and SYNC are accepted for compatibility only. FLUSHALL has no key
+// arguments, so it runs with every shard locked.
+func flushallCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	if len(args) == 1 && !strings.EqualFold(args[0].Bulk, "ASYNC") && !strings.EqualFold(args[0].Bulk, "SYNC") {
+		return resp.Value{Type: "error", Str: "ERR syntax error"}
+	}
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	h.store.FlushWithoutLock()
+
+	// The dataset is empty now, so the rewrite is quick enough to wait for,
+	// and a failure is reported rather than leaving the old dataset in the
+	// log unnoticed. A rewrite already running gets the FLUSHALL appended
+	// like any other write, so the log stays correct, just not truncated.
+	if h.aof != nil && h.config.aofRewriteOnFlushall.Load() {
+		finish, err := h.beginAOFRewriteWithoutLock()
+		if err == nil {
+			err = finish()
+		}
+		if err != nil && !errors.Is(err, aof.ErrRewriteInProgress) {
+			return resp.Value{Type: "error", Str: fmt.Sprintf("ERR FLUSHALL could not rewrite the append only file: %v", err)}
+		}
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// TOUCH key [key ...]
+// Access times aren't persisted, so TOUCH is not written to the AOF.
+func touchCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	touched := 0
+	for _, a := range args {
+		if h.store.TouchWithoutLock(a.Bulk) {
+			touched++
+		}
+	}
+	return resp.Value{Type: "integer", Num: touched}
+}
+
+// expireIn returns the time n units after now, and false if n units overflow
+// a time.Duration, which would wrap around to a time in the past.
+func expireIn(now time.Time, n int64, unit time.Duration) (time.Time, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return time.Time{}, false
+	}
+	return now.Add(time.Duration(n) * unit), true
+}
+
+// unixTime returns the time n units after the Unix epoch, and false if that
+// is further from the epoch than a time.Duration can count, roughly outside
+// the years 1678 to 2262. Beyond that the time would wrap around, or a TTL
+// counted to it would be out of range.
+func unixTime(n int64, unit time.Duration) (time.Time, bool) {
+	return expireIn(time.Unix(0, 0), n, unit)
+}
+
+// parseExpireFlags parses the optional NX/XX/GT/LT arguments of EXPIRE.
+func parseExpireFlags(args []resp.Value) (store.ExpireFlags, string) {
+	var flags store.ExpireFlags
+	for _, arg := range args {
+		switch strings.ToUpper(arg.Bulk) {
+		case "NX":
+			flags |= store.ExpireNX
+		case "XX":
+			flags |= store.ExpireXX
+		case "GT":
+			flags |= store.ExpireGT
+		case "LT":
+			flags |= store.ExpireLT
+		default:
+			return 0, fmt.Sprintf("ERR Unsupported option %s", arg.Bulk)
+		}
+	}
+
+	if flags&store.ExpireNX != 0 && flags&(store.ExpireXX|store.ExpireGT|store.ExpireLT) != 0 {
+		return 0, "ERR NX and XX, GT or LT options at the same time are not compatible"
+	}
+	if flags&store.ExpireGT != 0 && flags&store.ExpireLT != 0 {
+		return 0, "ERR GT and LT options at the same time are not compatible"
+	}
+	return flags, ""
+}
+
+// scanDefaultCount is how many elements a scan examines per call without COUNT.
+const scanDefaultCount = 10
+
+// scanArgs holds the parsed arguments shared by the *SCAN commands.
+type scanArgs struct {
+	cursor  int
+	pattern string
+	count   int
+	typ     uint8 // SCAN TYPE, if hasType
+	hasType bool
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count]", with
+// [TYPE type] as well if withType is set.
+func parseScanArgs(args []resp.Value, withType bool) (scanArgs, string) {
+	cursor, err := strconv.Atoi(args[0].Bulk)
+	if err != nil || cursor < 0 {
+		return scanArgs{}, "ERR invalid cursor"
+	}
+	sa := scanArgs{cursor: cursor, count: scanDefaultCount}
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return scanArgs{}, "ERR syntax error"
+		}
+		switch strings.ToUpper(args[i].Bulk) {
+		case "MATCH":
+			sa.pattern = args[i+1].Bulk
+			if sa.pattern == "*" {
+				sa.pattern = ""
+			}
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return scanArgs{}, "ERR value is not an integer or out of range"
+			}
+			if n < 1 {
+				return scanArgs{}, "ERR syntax error"
+			}
+			sa.count = n
+		case "TYPE":
+			if !withType {
+				return scanArgs{}, "ERR syntax error"
+			}
+			typ, ok := parseTypeName(args[i+1].Bulk)
+			if !ok {
+				return scanArgs{}, fmt.Sprintf("ERR unknown type name '%s'", args[i+1].Bulk)
+			}
+			sa.typ, sa.hasType = typ, true
+		default:
+			return scanArgs{}, "ERR syntax error"
+		}
+	}
+	return sa, ""
+}
+
+// scanReply renders a *SCAN reply: the next cursor and a flat batch of elements.
+func scanReply(next int, elems []string) resp.Value {
+	arr := make([]resp.Value, len(elems))
+	for i, e := range elems {
+		arr[i] = resp.Value{Type: "bulk", Bulk: e}
+	}
+	return resp.Value{Type: "array", Array: []resp.Value{
+		{Type: "bulk", Bulk: strconv.Itoa(next)},
+		{Type: "array", Array: arr},
+	}}
+}
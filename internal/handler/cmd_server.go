@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"fmt"
+	"jellyfish/internal/codec"
+	"jellyfish/internal/resp"
+	"jellyfish/internal/store"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// PING [message]
+func pingCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		return resp.Value{Type: "string", Str: "PONG"}
+	}
+	return resp.Value{Type: "bulk", Bulk: args[0].Bulk}
+}
+
+// ECHO message
+func echoCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return resp.Value{Type: "bulk", Bulk: args[0].Bulk}
+}
+
+// Version is the jellyfish version reported by VERSION. Release builds set
+// it with -ldflags "-X jellyfish/internal/handler.Version=v1.2.3".
+var Version = "dev"
+
+// VERSION
+func versionCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return resp.Value{Type: "bulk", Bulk: fmt.Sprintf("jellyfish %s %s", Version, runtime.Version())}
+}
+
+// COMMAND [COUNT | DOCS [command ...]]
+func commandCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return commandReply(args)
+}
+
+// INFO [section ...]
+func infoCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	sections := make([]string, len(args))
+	for i, a := range args {
+		sections[i] = a.Bulk
+	}
+	return resp.Value{Type: "bulk", Bulk: infoReply(h, sections)}
+}
+
+// debugHelp lists the subcommands of DEBUG for DEBUG HELP.
+var debugHelp = map[string]string{
+	"OBJECT <key>": "Show low-level information about <key>.",
+	"RELOAD":       "Sync the AOF, empty the dataset and load it back from the AOF.",
+}
+
+// DEBUG OBJECT key | DEBUG RELOAD | DEBUG HELP
+func debugCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	switch strings.ToUpper(args[0].Bulk) {
+	case "HELP":
+		return subcommandHelp("DEBUG", debugHelp)
+	case "OBJECT":
+		if len(args) != 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'debug|object' command"}
+		}
+		return debugObject(h, args[1].Bulk)
+	case "RELOAD":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'debug|reload' command"}
+		}
+		return debugReload(h)
+	default:
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'", args[0].Bulk)}
+	}
+}
+
+// debugReload empties the store and replays the AOF into it, the same way the
+// server loads it at startup, so that a test can check the dataset survives
+// a round trip through persistence. Every write is already in the AOF, so
+// there is nothing to save first beyond syncing it. DEBUG has no keys, so
+// every shard is locked.
+func debugReload(h *Handler) resp.Value {
+	if h.aof == nil {
+		return resp.Value{Type: "error", Str: "ERR DEBUG RELOAD needs appendonly persistence to reload from"}
+	}
+	if err := h.aof.Sync(); err != nil {
+		return resp.Value{Type: "error", Str: "ERR Error trying to sync the AOF: " + err.Error()}
+	}
+
+	h.store.FlushWithoutLock()
+	replay := New(h.store, nil)
+	if err := h.aof.Read(func(v resp.Value) { replay.executeWithoutLock(v) }); err != nil {
+		return resp.Value{Type: "error", Str: "ERR Error trying to load the AOF: " + err.Error()}
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// debugObject describes the value at key in one status line: its type,
+// encoding, the length of its DUMP serialization, seconds since last access,
+// and the dimension of a vector or the field count of a hash. Like OBJECT it
+// does not count as an access.
+func debugObject(h *Handler, key string) resp.Value {
+	item, ok := h.store.PeekItemWithoutLock(key)
+	if !ok {
+		return resp.Value{Type: "error", Str: "ERR no such key"}
+	}
+	enc, _ := h.store.EncodingWithoutLock(key)
+	idle, _ := h.store.IdleTimeWithoutLock(key)
+
+	status := fmt.Sprintf("type:%s encoding:%s serializedlength:%d lru_seconds_idle:%d",
+		typeName(item.Type), enc, len(codec.Encode(item)), idle)
+	switch item.Type {
+	case store.TypeVector:
+		status += fmt.Sprintf(" dim:%d", item.Dim())
+	case store.TypeHash:
+		status += fmt.Sprintf(" fields:%d", item.HashLen())
+	}
+	return resp.Value{Type: "string", Str: status}
+}
+
+// memoryUsageSamples is the default SAMPLES of MEMORY USAGE, as in Redis.
+const memoryUsageSamples = 5
+
+// memoryHelp lists the subcommands of MEMORY for MEMORY HELP.
+var memoryHelp = map[string]string{
+	"DOCTOR":                        "Return a report of likely memory problems.",
+	"STATS":                         "Return the key count and estimated memory use, in total and by type.",
+	"USAGE <key> [SAMPLES <count>]": "Return the estimated memory use of <key>, sampling <count> fields of a large hash (default 5, 0 for all).",
+}
+
+// MEMORY USAGE key [SAMPLES count] | MEMORY STATS | MEMORY DOCTOR | MEMORY HELP
+// STATS and DOCTOR walk the whole keyspace with the store locked, so they
+// are slow on a large dataset and best run sparingly.
+func memoryCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	switch strings.ToUpper(args[0].Bulk) {
+	case "HELP":
+		return subcommandHelp("MEMORY", memoryHelp)
+	case "STATS":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'memory|stats' command"}
+		}
+		return memoryStats(h.store.MemoryStatsWithoutLock())
+	case "DOCTOR":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'memory|doctor' command"}
+		}
+		return resp.Value{Type: "bulk", Bulk: memoryDoctor(h.store.MemoryStatsWithoutLock(), h.config.maxMemory.Load())}
+	case "USAGE":
+		if len(args) != 2 && len(args) != 4 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'memory|usage' command"}
+		}
+		samples := memoryUsageSamples
+		if len(args) == 4 {
+			if !strings.EqualFold(args[2].Bulk, "SAMPLES") {
+				return resp.Value{Type: "error", Str: "ERR syntax error"}
+			}
+			n, err := strconv.Atoi(args[3].Bulk)
+			if err != nil || n < 0 {
+				return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			samples = n
+		}
+		n, ok := h.store.MemoryUsageSampledWithoutLock(args[1].Bulk, samples)
+		if !ok {
+			return resp.Value{Type: "null"}
+		}
+		return resp.Value{Type: "integer", Num: int(n)}
+	default:
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'", args[0].Bulk)}
+	}
+}
+
+// memoryStats renders stats as the flat name, value array of MEMORY STATS.
+func memoryStats(stats store.MemoryStats) resp.Value {
+	var arr []resp.Value
+	add := func(name string, n int64) {
+		arr = append(arr, resp.Value{Type: "bulk", Bulk: name}, resp.Value{Type: "integer", Num: int(n)})
+	}
+	add("keys.count", int64(stats.Keys))
+	add("keys.with-ttl", int64(stats.KeysWithTTL))
+	add("dataset.bytes", stats.Bytes)
+	for _, typ := range valueTypes {
+		add(typeName(typ)+".keys", int64(stats.TypeKeys[typ]))
+		add(typeName(typ)+".bytes", stats.TypeBytes[typ])
+	}
+	return resp.Value{Type: "array", Array: arr}
+}
+
+// Thresholds past which MEMORY DOCTOR reports a problem.
+const (
+	doctorMinKeys      = 1000   // fewer keys than this are never a concern
+	doctorNoTTLPercent = 90     // share of keys without a TTL
+	doctorMaxVectors   = 100000 // VSEARCH compares the query with every vector
+	doctorMaxMemoryPct = 90     // share of maxmemory in use
+)
+
+// memoryDoctor returns the MEMORY DOCTOR report for stats, given the
+// maxmemory setting.
+func memoryDoctor(stats store.MemoryStats, maxMemory int64) string {
+	var issues []string
+	if stats.Keys >= doctorMinKeys && (stats.Keys-stats.KeysWithTTL)*100 >= stats.Keys*doctorNoTTLPercent {
+		issues = append(issues, fmt.Sprintf("Many keys without TTL: %d of %d keys never expire. If they are caches, give them an expiry or set a maxmemory-policy that evicts.",
+			stats.Keys-stats.KeysWithTTL, stats.Keys))
+	}
+	if n := stats.TypeKeys[store.TypeVector]; n > doctorMaxVectors {
+		issues = append(issues, fmt.Sprintf("Vector count very high: %d vectors. VSEARCH compares the query with every vector, so searches slow down as the count grows.", n))
+	}
+	if maxMemory > 0 && stats.Bytes*100 >= maxMemory*doctorMaxMemoryPct {
+		issues = append(issues, fmt.Sprintf("Memory almost full: the dataset uses %d of %d bytes allowed by maxmemory.", stats.Bytes, maxMemory))
+	}
+
+	if len(issues) == 0 {
+		return fmt.Sprintf("No memory issues found (%d keys, %d bytes).", stats.Keys, stats.Bytes)
+	}
+	return "Memory issues found:\n\n * " + strings.Join(issues, "\n\n * ") + "\n"
+}
+
+// valueTypes lists the store value types, in the order MEMORY STATS reports them.
+var valueTypes = []uint8{store.TypeString, store.TypeVector, store.TypeHash}
+
+// typeName returns the name of a store value type as reported to clients.
+func typeName(typ uint8) string {
+	switch typ {
+	case store.TypeString:
+		return "string"
+	case store.TypeVector:
+		return "vector"
+	case store.TypeHash:
+		return "hash"
+	default:
+		return "unknown"
+	}
+}
+
+// parseTypeName returns the store value type named name, as typeName reports
+// it, in any case.
+func parseTypeName(name string) (uint8, bool) {
+	for _, typ := range valueTypes {
+		if strings.EqualFold(name, typeName(typ)) {
+			return typ, true
+		}
+	}
+	return 0, false
+}
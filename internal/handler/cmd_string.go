@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"fmt"
+	"jellyfish/internal/resp"
+	"jellyfish/internal/store"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SET key value
+func setCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	if h.strictTypeConflictWithoutLock(args[0].Bulk, store.TypeString) {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+
+	h.store.SetWithoutLock(args[0].Bulk, args[1].Bulk)
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// GET key
+func getCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	val, found, typeOk := h.store.GetWithoutLock(args[0].Bulk)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !found {
+		return resp.Value{Type: "null"}
+	}
+	return resp.Value{Type: "bulk", Bulk: val}
+}
+
+// GETDEL key
+// The deletion is logged to the AOF as DEL, and only if the key existed.
+func getdelCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key := args[0].Bulk
+	val, found, typeOk := h.store.GetWithoutLock(key)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !found {
+		return resp.Value{Type: "null"}
+	}
+	if err := h.writeAOF(bulkCommand("DEL", key)); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	h.store.DelWithoutLock(key)
+	return resp.Value{Type: "bulk", Bulk: val}
+}
+
+// DELIFEQ key value
+// Deletes key only if it holds value, for releasing a lock only while it is
+// still the caller's. Only a deletion is logged to the AOF, as DEL.
+func delifeqCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key, expected := args[0].Bulk, args[1].Bulk
+	item, found := h.store.PeekItemWithoutLock(key)
+	if found && item.Type != store.TypeString {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !found || item.Str() != expected {
+		return resp.Value{Type: "integer", Num: 0}
+	}
+	if err := h.writeAOF(bulkCommand("DEL", key)); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	return resp.Value{Type: "integer", Num: h.store.DelIfEqWithoutLock(key, expected)}
+}
+
+// SETIFEQ key [expected] value
+// Sets key to value, like SET, only if it holds expected or, with expected
+// left out, only if it doesn't exist: a compare-and-set for optimistic updates
+// without WATCH. Only a successful set is logged to the AOF, as SET.
+func setifeqCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key, newValue := args[0].Bulk, args[len(args)-1].Bulk
+	item, found := h.store.PeekItemWithoutLock(key)
+	if len(args) == 3 {
+		if found && item.Type != store.TypeString {
+			return resp.Value{Type: "error", Str: wrongTypeError}
+		}
+		if !found || item.Str() != args[1].Bulk {
+			return resp.Value{Type: "integer", Num: 0}
+		}
+	} else if found {
+		return resp.Value{Type: "integer", Num: 0}
+	}
+	if err := h.writeAOF(bulkCommand("SET", key, newValue)); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+
+	if len(args) == 2 {
+		return resp.Value{Type: "integer", Num: h.store.SetIfAbsentWithoutLock(key, newValue)}
+	}
+	n, _ := h.store.SetIfEqWithoutLock(key, args[1].Bulk, newValue)
+	return resp.Value{Type: "integer", Num: n}
+}
+
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+// A TTL change is logged to the AOF as PEXPIREAT or PERSIST, so replay applies
+// the same absolute expiry; a plain read logs nothing.
+func getexCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key := args[0].Bulk
+
+	expiresAt, persist, errMsg := parseGetExOptions(args[1:], "getex", h.store.Now())
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+
+	val, found, typeOk := h.store.GetWithoutLock(key)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !found {
+		return resp.Value{Type: "null"}
+	}
+
+	var logged resp.Value
+	switch {
+	case persist:
+		if h.store.TTLWithoutLock(key) != -1 {
+			logged = bulkCommand("PERSIST", key)
+		}
+	case !expiresAt.IsZero():
+		logged = bulkCommand("PEXPIREAT", key, strconv.FormatInt(expiresAt.UnixMilli(), 10))
+	}
+	if logged.Array == nil {
+		return resp.Value{Type: "bulk", Bulk: val}
+	}
+	if err := h.writeAOF(logged); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	if persist {
+		h.store.PersistWithoutLock(key)
+	} else {
+		h.store.ExpireAtIfWithoutLock(key, expiresAt, 0)
+	}
+	return resp.Value{Type: "bulk", Bulk: val}
+}
+
+// parseGetExOptions parses the expiry option of GETEX and HGETEX: none, PERSIST,
+// or one of EX, PX, EXAT and PXAT with a positive time, resolved to an
+// absolute expiry counted from now. cmd names the command in errors.
+func parseGetExOptions(args []resp.Value, cmd string, now time.Time) (expiresAt time.Time, persist bool, errMsg string) {
+	switch len(args) {
+	case 0:
+		return time.Time{}, false, ""
+	case 1:
+		if !strings.EqualFold(args[0].Bulk, "PERSIST") {
+			return time.Time{}, false, "ERR syntax error"
+		}
+		return time.Time{}, true, ""
+	case 2:
+		n, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+		if err != nil {
+			return time.Time{}, false, "ERR value is not an integer or out of range"
+		}
+		if n <= 0 {
+			return time.Time{}, false, fmt.Sprintf("ERR invalid expire time in '%s' command", cmd)
+		}
+		var at time.Time
+		var ok bool
+		switch strings.ToUpper(args[0].Bulk) {
+		case "EX":
+			at, ok = expireIn(now, n, time.Second)
+		case "PX":
+			at, ok = expireIn(now, n, time.Millisecond)
+		case "EXAT":
+			at, ok = unixTime(n, time.Second)
+		case "PXAT":
+			at, ok = unixTime(n, time.Millisecond)
+		default:
+			return time.Time{}, false, "ERR syntax error"
+		}
+		if !ok {
+			return time.Time{}, false, fmt.Sprintf("ERR invalid expire time in '%s' command", cmd)
+		}
+		return at, false, ""
+	}
+	return time.Time{}, false, "ERR syntax error"
+}
+
+// INCR key
+func incrCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return incrBy(h, value, args[0].Bulk, 1)
+}
+
+// DECR key
+func decrCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	return incrBy(h, value, args[0].Bulk, -1)
+}
+
+// INCRBY key increment
+func incrbyCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	delta, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	return incrBy(h, value, args[0].Bulk, delta)
+}
+
+// DECRBY key decrement
+func decrbyCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	delta, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil || delta == math.MinInt64 {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	return incrBy(h, value, args[0].Bulk, -delta)
+}
+
+// incrBy adds delta to the counter at key and logs the command as received,
+// which replays to the same result. Only a command that will succeed is
+// logged, so the result is worked out before anything changes.
+func incrBy(h *Handler, value resp.Value, key string, delta int64) resp.Value {
+	n, err := h.store.IncrByResultWithoutLock(key, delta)
+	switch err {
+	case nil:
+	case store.ErrWrongType:
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	default:
+		return resp.Value{Type: "error", Str: "ERR " + err.Error()}
+	}
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	h.store.IncrByWithoutLock(key, delta)
+	return resp.Value{Type: "integer", Num: int(n)}
+}
+
+// parseBitOffset parses a SETBIT/GETBIT offset. Offsets are capped at 2^32-1,
+// which keeps a bitmap within 512MB like Redis.
+func parseBitOffset(arg string) (int, bool) {
+	n, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// SETBIT key offset 0|1
+func setbitCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	offset, ok := parseBitOffset(args[1].Bulk)
+	if !ok {
+		return resp.Value{Type: "error", Str: "ERR bit offset is not an integer or out of range"}
+	}
+	if args[2].Bulk != "0" && args[2].Bulk != "1" {
+		return resp.Value{Type: "error", Str: "ERR bit is not an integer or out of range"}
+	}
+
+	if typ, exists := h.store.TypeWithoutLock(args[0].Bulk); exists && typ != store.TypeString {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+	prev := h.store.SetBitWithoutLock(args[0].Bulk, offset, args[2].Bulk == "1")
+	return resp.Value{Type: "integer", Num: prev}
+}
+
+// GETBIT key offset
+func getbitCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	offset, ok := parseBitOffset(args[1].Bulk)
+	if !ok {
+		return resp.Value{Type: "error", Str: "ERR bit offset is not an integer or out of range"}
+	}
+
+	bit := h.store.GetBitWithoutLock(args[0].Bulk, offset)
+	if bit == -1 {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	return resp.Value{Type: "integer", Num: bit}
+}
+
+// BITCOUNT key [start end]
+func bitcountCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	start, end := 0, -1
+	switch len(args) {
+	case 1:
+	case 3:
+		var err1, err2 error
+		start, err1 = strconv.Atoi(args[1].Bulk)
+		end, err2 = strconv.Atoi(args[2].Bulk)
+		if err1 != nil || err2 != nil {
+			return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+		}
+	default:
+		return resp.Value{Type: "error", Str: "ERR syntax error"}
+	}
+
+	count := h.store.BitCountWithoutLock(args[0].Bulk, start, end)
+	if count == -1 {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	return resp.Value{Type: "integer", Num: count}
+}
@@ -0,0 +1,408 @@
+package handler
+
+import (
+	"jellyfish/internal/resp"
+	"jellyfish/internal/store"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TSET key [FP16] [DIM n] v1 v2 v3 ...
+// DIM declares the number of components, so a truncated vector is rejected
+// instead of stored with the wrong dimension.
+func tsetCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key := args[0].Bulk
+	half, dim := false, 0
+	comps := args[1:]
+	for len(comps) > 0 {
+		if strings.EqualFold(comps[0].Bulk, "FP16") {
+			if half {
+				return resp.Value{Type: "error", Str: "ERR syntax error"}
+			}
+			half, comps = true, comps[1:]
+			continue
+		}
+		if !strings.EqualFold(comps[0].Bulk, "DIM") {
+			break
+		}
+		if len(comps) < 2 || dim > 0 {
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+		n, err := strconv.Atoi(comps[1].Bulk)
+		if err != nil || n <= 0 {
+			return resp.Value{Type: "error", Str: "ERR invalid dimension value"}
+		}
+		dim, comps = n, comps[2:]
+	}
+	if len(comps) == 0 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'tset' command"}
+	}
+	if dim > 0 && len(comps) != dim {
+		return resp.Value{Type: "error", Str: "ERR vector length does not match declared dimension"}
+	}
+	vec := make([]float32, 0, len(comps))
+	for _, arg := range comps {
+		val, errMsg := parseComponent(arg.Bulk)
+		if errMsg != "" {
+			return resp.Value{Type: "error", Str: errMsg}
+		}
+		if half && math.Abs(float64(val)) > store.MaxHalf {
+			return resp.Value{Type: "error", Str: "ERR vector value out of range for FP16"}
+		}
+		vec = append(vec, val)
+	}
+	if h.strictTypeConflictWithoutLock(key, store.TypeVector) {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+
+	if half {
+		h.store.SetHalfVectorWithoutLock(key, vec)
+	} else {
+		h.store.SetVectorWithoutLock(key, vec)
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// TMSET key1 dim1 v1 ... key2 dim2 v1 ...
+func tmsetCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	vecs, errMsg := parseVectorBatch(args)
+	if errMsg != "" {
+		return resp.Value{Type: "error", Str: errMsg}
+	}
+	for key := range vecs {
+		if h.strictTypeConflictWithoutLock(key, store.TypeVector) {
+			return resp.Value{Type: "error", Str: wrongTypeError}
+		}
+	}
+
+	if err := h.writeAOF(value); err != nil {
+		return resp.Value{Type: "error", Str: aofWriteError}
+	}
+
+	h.store.MSetVectorWithoutLock(vecs)
+	return resp.Value{Type: "integer", Num: len(vecs)}
+}
+
+// TGET key [META]
+func tgetCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	if len(args) > 1 {
+		if len(args) != 2 || !strings.EqualFold(args[1].Bulk, "META") {
+			return resp.Value{Type: "error", Str: "ERR syntax error"}
+		}
+		return tgetMeta(h, args[0].Bulk)
+	}
+
+	vec, found, typeOk := h.store.GetVectorWithoutLock(args[0].Bulk)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !found {
+		return resp.Value{Type: "null"}
+	}
+
+	// Convert []float32 to []resp.Value
+	vals := make([]resp.Value, len(vec))
+	for i, v := range vec {
+		vals[i] = resp.Value{Type: "bulk", Bulk: strconv.FormatFloat(float64(v), 'g', -1, 32)}
+	}
+	return resp.Value{Type: "array", Array: vals}
+}
+
+// tgetMeta implements TGET key META: the dimension, L2 norm and smallest and
+// largest component of a vector, as field/value pairs.
+func tgetMeta(h *Handler, key string) resp.Value {
+	vec, found, typeOk := h.store.GetVectorWithoutLock(key)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !found {
+		return resp.Value{Type: "null"}
+	}
+
+	var sumSq float64
+	minV, maxV := float32(math.Inf(1)), float32(math.Inf(-1))
+	for _, v := range vec {
+		sumSq += float64(v) * float64(v)
+		minV = min(minV, v)
+		maxV = max(maxV, v)
+	}
+
+	meta := []resp.Value{
+		{Type: "bulk", Bulk: "dim"},
+		{Type: "integer", Num: len(vec)},
+		{Type: "bulk", Bulk: "l2norm"},
+		{Type: "bulk", Bulk: strconv.FormatFloat(math.Sqrt(sumSq), 'g', -1, 64)},
+	}
+	if len(vec) > 0 {
+		meta = append(meta,
+			resp.Value{Type: "bulk", Bulk: "min"},
+			resp.Value{Type: "bulk", Bulk: strconv.FormatFloat(float64(minV), 'g', -1, 32)},
+			resp.Value{Type: "bulk", Bulk: "max"},
+			resp.Value{Type: "bulk", Bulk: strconv.FormatFloat(float64(maxV), 'g', -1, 32)},
+		)
+	}
+	return resp.Value{Type: "array", Array: meta}
+}
+
+// VSEARCH q1 q2 ... k [EXCLUDE key] [OFFSET n]
+func vsearchCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	// The query and K come first; options start at the first keyword.
+	n := len(args)
+	for i, arg := range args {
+		if isVSearchOption(arg.Bulk) {
+			n = i
+			break
+		}
+	}
+	if n < 2 {
+		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'vsearch' command"}
+	}
+
+	// Last argument before the options is K
+	k, err := strconv.Atoi(args[n-1].Bulk)
+	if err != nil || k < 0 {
+		return resp.Value{Type: "error", Str: "ERR invalid K value"}
+	}
+
+	opts, errStr := parseVSearchOptions(args[n:])
+	if errStr != "" {
+		return resp.Value{Type: "error", Str: errStr}
+	}
+
+	// Parse query vector
+	queryVec := make([]float32, 0, n-1)
+	for _, arg := range args[:n-1] {
+		val, errMsg := parseComponent(arg.Bulk)
+		if errMsg != "" {
+			return resp.Value{Type: "error", Str: errMsg}
+		}
+		queryVec = append(queryVec, val)
+	}
+
+	if !h.config.vsearchCache.Load() {
+		results, _ := nearestVectors(h, queryVec, opts)
+		return vectorKeysReply(results, opts.offset, k)
+	}
+	// VSEARCH has no keys, so every shard is locked and the generation can't
+	// move between the lookup and the search.
+	cacheKey := searchCacheKey(queryVec, k, opts)
+	if reply, ok := h.searchCache.get(cacheKey, h.store.VectorGeneration(), h.store.Now()); ok {
+		return reply
+	}
+	results, validUntil := nearestVectors(h, queryVec, opts)
+	reply := vectorKeysReply(results, opts.offset, k)
+	h.searchCache.put(cacheKey, h.store.VectorGeneration(), validUntil, reply, int(h.config.vsearchCacheSize.Load()))
+	return reply
+}
+
+// VSCAN cursor [MATCH pattern] [COUNT count]
+// Like SCAN TYPE vector, but replies with each vector key followed by its
+// dimension, so dimensions can be audited without fetching the vectors.
+// VSCAN has no key arguments, so it runs with every shard locked.
+func vscanCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	sa, errStr := parseScanArgs(args, false)
+	if errStr != "" {
+		return resp.Value{Type: "error", Str: errStr}
+	}
+	next, keys := h.store.ScanWithoutLock(sa.cursor, sa.pattern, sa.count)
+	pairs := make([]resp.Value, 0, 2*len(keys))
+	for _, key := range keys {
+		if item, ok := h.store.PeekItemWithoutLock(key); ok && item.Type == store.TypeVector {
+			pairs = append(pairs, resp.Value{Type: "bulk", Bulk: key}, resp.Value{Type: "integer", Num: item.Dim()})
+		}
+	}
+	return resp.Value{Type: "array", Array: []resp.Value{
+		{Type: "bulk", Bulk: strconv.Itoa(next)},
+		{Type: "array", Array: pairs},
+	}}
+}
+
+// VSIMILAR key k [OFFSET n]
+func vsimilarCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	key := args[0].Bulk
+	k, err := strconv.Atoi(args[1].Bulk)
+	if err != nil || k < 0 {
+		return resp.Value{Type: "error", Str: "ERR invalid K value"}
+	}
+
+	opts, errStr := parseVSearchOptions(args[2:])
+	if errStr != "" {
+		return resp.Value{Type: "error", Str: errStr}
+	}
+	opts.exclude, opts.hasExclude = key, true
+
+	queryVec, found, typeOk := h.store.GetVectorWithoutLock(key)
+	if !typeOk {
+		return resp.Value{Type: "error", Str: wrongTypeError}
+	}
+	if !found {
+		return resp.Value{Type: "error", Str: "ERR no such key"}
+	}
+
+	results, _ := nearestVectors(h, queryVec, opts)
+	return vectorKeysReply(results, opts.offset, k)
+}
+
+// vsearchOptions holds the optional clauses of VSEARCH and VSIMILAR.
+type vsearchOptions struct {
+	exclude    string
+	hasExclude bool
+	offset     int // results to skip; ranking still scans every vector
+}
+
+func isVSearchOption(arg string) bool {
+	return strings.EqualFold(arg, "EXCLUDE") || strings.EqualFold(arg, "OFFSET")
+}
+
+// parseVSearchOptions parses "[EXCLUDE key] [OFFSET n]" in any order.
+func parseVSearchOptions(args []resp.Value) (vsearchOptions, string) {
+	var opts vsearchOptions
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return vsearchOptions{}, "ERR syntax error"
+		}
+		switch strings.ToUpper(args[i].Bulk) {
+		case "EXCLUDE":
+			opts.exclude, opts.hasExclude = args[i+1].Bulk, true
+		case "OFFSET":
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil || n < 0 {
+				return vsearchOptions{}, "ERR invalid OFFSET value"
+			}
+			opts.offset = n
+		default:
+			return vsearchOptions{}, "ERR syntax error"
+		}
+	}
+	return opts, ""
+}
+
+// vectorMatch is a stored vector ranked against a query.
+type vectorMatch struct {
+	key   string
+	score float64
+}
+
+// nearestVectors ranks every stored vector with the query's dimension by
+// cosine distance, nearest first, leaving out opts.exclude if set. It also
+// returns when the first of the stored vectors expires, as the ranking holds
+// until then unless a vector is written or deleted.
+func nearestVectors(h *Handler, queryVec []float32, opts vsearchOptions) ([]vectorMatch, time.Time) {
+	// Perform linear search
+	candidates, validUntil := h.store.VectorsWithoutLock()
+	results := make([]vectorMatch, 0, len(candidates))
+
+	for key, vec := range candidates {
+		if len(vec) != len(queryVec) {
+			continue // Skip dimension mismatch
+		}
+		if opts.hasExclude && key == opts.exclude {
+			continue
+		}
+		dist := cosineDistance(queryVec, vec)
+		results = append(results, vectorMatch{key: key, score: dist})
+	}
+
+	// Sort by distance (ascending). Ties are broken by key so that pages
+	// requested with OFFSET line up across calls.
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score < results[j].score
+		}
+		return results[i].key < results[j].key
+	})
+	return results, validUntil
+}
+
+// vectorKeysReply returns the keys of up to k matches starting at rank offset.
+// An offset past the end yields an empty array.
+func vectorKeysReply(results []vectorMatch, offset, k int) resp.Value {
+	if offset > len(results) {
+		offset = len(results)
+	}
+	results = results[offset:]
+	if k > len(results) {
+		k = len(results)
+	}
+
+	respArr := make([]resp.Value, k)
+	for i := 0; i < k; i++ {
+		respArr[i] = resp.Value{Type: "bulk", Bulk: results[i].key}
+	}
+	return resp.Value{Type: "array", Array: respArr}
+}
+
+// parseVectorBatch parses TMSET arguments of the form key dim v1 ... vdim, repeated.
+// It returns the vectors keyed by name and an error message if the arguments are
+// malformed. A later group for the same key wins, so a repeated key is counted once.
+func parseVectorBatch(args []resp.Value) (map[string][]float32, string) {
+	if len(args) < 3 {
+		return nil, "ERR wrong number of arguments for 'tmset' command"
+	}
+
+	vecs := make(map[string][]float32)
+	for i := 0; i < len(args); {
+		if len(args)-i < 2 {
+			return nil, "ERR wrong number of arguments for 'tmset' command"
+		}
+		key := args[i].Bulk
+		dim, err := strconv.Atoi(args[i+1].Bulk)
+		if err != nil || dim <= 0 {
+			return nil, "ERR invalid dimension value"
+		}
+		i += 2
+
+		if len(args)-i < dim {
+			return nil, "ERR vector length does not match declared dimension"
+		}
+		vec := make([]float32, dim)
+		for j := range dim {
+			val, errMsg := parseComponent(args[i+j].Bulk)
+			if errMsg != "" {
+				return nil, errMsg
+			}
+			vec[j] = val
+		}
+		i += dim
+
+		vecs[key] = vec
+	}
+
+	return vecs, ""
+}
+
+// parseComponent parses one vector component. NaN and the infinities parse
+// as floats but would make every distance to the vector meaningless, so they
+// are rejected along with anything that is not a float.
+func parseComponent(arg string) (float32, string) {
+	val, err := strconv.ParseFloat(arg, 32)
+	if err != nil {
+		return 0, "ERR invalid float value"
+	}
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, "ERR vector contains non-finite value"
+	}
+	return float32(val), ""
+}
+
+// cosineDistance calculates 1 - CosineSimilarity. Lower is closer.
+func cosineDistance(a, b []float32) float64 {
+	var dot, magA, magB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		magA += float64(a[i]) * float64(a[i])
+		magB += float64(b[i]) * float64(b[i])
+	}
+	if magA == 0 || magB == 0 {
+		return 1.0 // Maximum distance if zero vector
+	}
+	similarity := dot / (math.Sqrt(magA) * math.Sqrt(magB))
+	return 1.0 - similarity
+}
@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"fmt"
+	"jellyfish/internal/resp"
+	"sort"
+	"strings"
+)
+
+// commandFunc executes a command with the store lock held and returns its reply.
+// value is the full command as received, for AOF logging; args excludes the name.
+// Commands that mutate the store are responsible for appending value to the AOF.
+type commandFunc func(h *Handler, value resp.Value, args []resp.Value) resp.Value
+
+// commandSpec describes a command for dispatch, arity validation and COMMAND
+// introspection. Commands flagged "write" are the ones that append to the AOF,
+// and those flagged "denyoom" may grow the dataset, so maxmemory is enforced
+// before they run.
+//
+// Arity follows the Redis convention and counts the command name itself: a
+// positive value is an exact argument count, a negative value -N means at least N.
+// For the latter, maxArity bounds the count from above if it isn't 0, and
+// argGroup, if it isn't 0, requires the arguments past the first N to come in
+// groups of that size, like the field-value pairs of HSET.
+// firstKey, lastKey and step locate the key arguments (1-based, lastKey -1 means
+// the final argument); all three are 0 for commands whose keys can't be located
+// positionally. A command runs with only the store shards of its keys locked,
+// or every shard if it has none or, like VSIMILAR, sets allShards because it
+// reads keys beyond its arguments.
+type commandSpec struct {
+	fn        commandFunc
+	arity     int
+	maxArity  int
+	argGroup  int
+	flags     []string
+	firstKey  int
+	lastKey   int
+	step      int
+	allShards bool
+	summary   string
+}
+
+// commandTable is the registry of every command the server understands. It is
+// populated in init because COMMAND itself reads the table.
+var commandTable map[string]commandSpec
+
+func init() {
+	commandTable = map[string]commandSpec{
+		"PING":         {fn: pingCommand, arity: -1, maxArity: 2, flags: []string{"fast"}, summary: "Returns the server's liveliness response."},
+		"ECHO":         {fn: echoCommand, arity: 2, flags: []string{"fast"}, summary: "Returns the given string."},
+		"SET":          {fn: setCommand, arity: 3, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the string value of a key."},
+		"SETIFEQ":      {fn: setifeqCommand, arity: -3, maxArity: 4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the string value of a key only if it equals the given value, or only if the key doesn't exist."},
+		"GET":          {fn: getCommand, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the string value of a key."},
+		"GETDEL":       {fn: getdelCommand, arity: 2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the string value of a key after deleting the key."},
+		"DELIFEQ":      {fn: delifeqCommand, arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Deletes a key only if its string value equals the given value."},
+		"GETEX":        {fn: getexCommand, arity: -2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the string value of a key after setting its expiration time."},
+		"INCR":         {fn: incrCommand, arity: 2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Increments the integer value of a key by one."},
+		"DECR":         {fn: decrCommand, arity: 2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Decrements the integer value of a key by one."},
+		"INCRBY":       {fn: incrbyCommand, arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Increments the integer value of a key by a number."},
+		"DECRBY":       {fn: decrbyCommand, arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Decrements a number from the integer value of a key."},
+		"SETBIT":       {fn: setbitCommand, arity: 4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets or clears the bit at offset of the string value."},
+		"GETBIT":       {fn: getbitCommand, arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns a bit value by offset."},
+		"BITCOUNT":     {fn: bitcountCommand, arity: -2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, summary: "Counts the number of set bits in a string."},
+		"DEL":          {fn: delCommand, arity: -2, flags: []string{"write"}, firstKey: 1, lastKey: -1, step: 1, summary: "Deletes one or more keys."},
+		"UNLINK":       {fn: unlinkCommand, arity: -2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: -1, step: 1, summary: "Asynchronously deletes one or more keys."},
+		"FLUSHALL":     {fn: flushallCommand, arity: -1, maxArity: 2, flags: []string{"write"}, summary: "Removes all keys from the database."},
+		"SCAN":         {fn: scanCommand, arity: -2, flags: []string{"readonly"}, summary: "Iterates over the key names in the database."},
+		"TOUCH":        {fn: touchCommand, arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: -1, step: 1, summary: "Updates the last access time of keys and returns the number that exist."},
+		"DUMP":         {fn: dumpCommand, arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns a serialized representation of the value stored at a key."},
+		"RESTORE":      {fn: restoreCommand, arity: -4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, summary: "Creates a key from the serialized representation of a value."},
+		"MIGRATE":      {fn: migrateCommand, arity: -6, flags: []string{"write"}, firstKey: 3, lastKey: 3, step: 1, summary: "Atomically transfers a key from one instance to another."},
+		"EXPIRE":       {fn: expireCommand, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the expiration time of a key in seconds."},
+		"EXPIREAT":     {fn: expireatCommand, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the expiration time of a key to a Unix timestamp."},
+		"PEXPIREAT":    {fn: pexpireatCommand, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+		"PERSIST":      {fn: persistCommand, arity: 2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Removes the expiration time of a key."},
+		"TTL":          {fn: ttlCommand, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the expiration time in seconds of a key."},
+		"EXPIRETIME":   {fn: expiretimeCommand, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the expiration time of a key as a Unix timestamp."},
+		"PEXPIRETIME":  {fn: pexpiretimeCommand, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the expiration time of a key as a Unix milliseconds timestamp."},
+		"TSET":         {fn: tsetCommand, arity: -3, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the vector value of a key."},
+		"TMSET":        {fn: tmsetCommand, arity: -4, flags: []string{"write", "denyoom"}, summary: "Sets the vector values of multiple keys."},
+		"TGET":         {fn: tgetCommand, arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the vector value of a key."},
+		"VSEARCH":      {fn: vsearchCommand, arity: -3, flags: []string{"readonly"}, summary: "Returns the keys of the K nearest vectors by cosine distance."},
+		"VSCAN":        {fn: vscanCommand, arity: -2, flags: []string{"readonly"}, summary: "Iterates over the vector keys in the database and their dimensions."},
+		"VSIMILAR":     {fn: vsimilarCommand, arity: -3, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, allShards: true, summary: "Returns the keys of the K vectors nearest to the vector stored at a key."},
+		"HSET":         {fn: hsetCommand, arity: -4, argGroup: 2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the values of one or more fields in a hash."},
+		"HGET":         {fn: hgetCommand, arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the value of a field in a hash."},
+		"HDEL":         {fn: hdelCommand, arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Deletes one or more fields from a hash."},
+		"HGETALL":      {fn: hgetallCommand, arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns all fields and values in a hash."},
+		"HEXISTS":      {fn: hexistsCommand, arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Determines whether a field exists in a hash."},
+		"HKEYS":        {fn: hkeysCommand, arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns all fields in a hash."},
+		"HVALS":        {fn: hvalsCommand, arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns all values in a hash."},
+		"HLEN":         {fn: hlenCommand, arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the number of fields in a hash."},
+		"HRANDFIELD":   {fn: hrandfieldCommand, arity: -2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns one or more random fields from a hash."},
+		"HGETDEL":      {fn: hgetdelCommand, arity: -5, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the values of one or more fields and deletes them from a hash."},
+		"HGETEX":       {fn: hgetexCommand, arity: -5, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the values of one or more fields and optionally sets their expiration time."},
+		"HEXPIRE":      {fn: hexpireCommand, arity: -6, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the expiration time of one or more hash fields in seconds."},
+		"HPEXPIREAT":   {fn: hpexpireatCommand, arity: -6, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Sets the expiration time of one or more hash fields to a Unix milliseconds timestamp."},
+		"HTTL":         {fn: httlCommand, arity: -5, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Returns the time to live in seconds of one or more hash fields."},
+		"HPERSIST":     {fn: hpersistCommand, arity: -5, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1, summary: "Removes the expiration time of one or more hash fields."},
+		"HSCAN":        {fn: hscanCommand, arity: -3, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, summary: "Iterates over fields and values of a hash."},
+		"OBJECT":       {fn: objectCommand, arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1, summary: "Inspects the internals of a key."},
+		"MEMORY":       {fn: memoryCommand, arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1, summary: "A container for memory diagnostics commands."},
+		"COMMAND":      {fn: commandCommand, arity: -1, flags: []string{}, summary: "Returns detailed information about all commands."},
+		"VERSION":      {fn: versionCommand, arity: 1, flags: []string{"fast"}, summary: "Returns the server's version and the Go version it was built with."},
+		"INFO":         {fn: infoCommand, arity: -1, flags: []string{}, summary: "Returns information and statistics about the server."},
+		"BGREWRITEAOF": {fn: bgrewriteaofCommand, arity: 1, flags: []string{"admin"}, summary: "Asynchronously rewrites the append-only file to disk."},
+		"DEBUG":        {fn: debugCommand, arity: -2, flags: []string{"admin"}, summary: "A container for debugging commands."},
+		"CONFIG":       {fn: configCommand, arity: -2, flags: []string{"admin"}, summary: "Gets or sets the values of configuration parameters."},
+
+		// Authentication and ACL are handled per connection in handleCommand.
+		"AUTH": {arity: -2, flags: []string{"fast"}, summary: "Authenticates the connection."},
+		"ACL":  {arity: -2, flags: []string{"admin"}, summary: "A container for Access List Control commands."},
+
+		// Connection modes and CLIENT are handled per connection in handleCommand.
+		"CLIENT":  {arity: -2, flags: []string{"admin"}, summary: "A container for client connection commands."},
+		"MONITOR": {arity: 1, flags: []string{"admin"}, summary: "Listens for all requests received by the server in real-time."},
+		"RESET":   {arity: 1, flags: []string{"fast"}, summary: "Resets the connection."},
+
+		// Replication. SYNC, REPLCONF, WAIT and WAITAOF are handled per connection in handleCommand.
+		"REPLICAOF": {fn: replicaofCommand, arity: 3, flags: []string{"admin"}, summary: "Makes the server a replica of another instance, or promotes it to a master."},
+		"SYNC":      {arity: 1, flags: []string{"admin"}, summary: "Internal command used for replication."},
+		"REPLCONF":  {arity: -1, flags: []string{"admin"}, summary: "An internal command for configuring the replication stream."},
+		"WAIT":      {arity: 3, flags: []string{}, summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed."},
+		"WAITAOF":   {arity: 4, flags: []string{}, summary: "Blocks until all of the preceding write commands sent by the connection are written to the append-only file of the master and/or replicas."},
+
+		// Transaction control is handled per connection in handleCommand.
+		"MULTI":   {arity: 1, flags: []string{"fast"}, summary: "Starts a transaction."},
+		"EXEC":    {arity: 1, flags: []string{}, summary: "Executes all commands in a transaction."},
+		"DISCARD": {arity: 1, flags: []string{"fast"}, summary: "Discards a transaction."},
+	}
+
+	names := make([]string, 0, 2*len(commandTable))
+	for name := range commandTable {
+		names = append(names, name, strings.ToLower(name))
+	}
+	commandTokens = resp.NewInternTable(names...)
+}
+
+// commandTokens interns command names, in upper and lower case, so that
+// reading one from a client doesn't allocate.
+var commandTokens resp.InternTable
+
+// hasFlag reports whether the command carries flag, e.g. "write".
+func (spec commandSpec) hasFlag(flag string) bool {
+	for _, f := range spec.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// keys returns the key arguments of the command value, located by the key
+// positions of spec.
+func (spec commandSpec) keys(value resp.Value) []string {
+	if spec.firstKey == 0 {
+		return nil
+	}
+	last := spec.lastKey
+	if last < 0 {
+		last += len(value.Array)
+	}
+	var keys []string
+	for i := spec.firstKey; i <= last && i < len(value.Array); i += spec.step {
+		keys = append(keys, value.Array[i].Bulk)
+	}
+	return keys
+}
+
+// validArgc reports whether argc, which includes the command name, is an
+// argument count the command accepts.
+func (spec commandSpec) validArgc(argc int) bool {
+	switch {
+	case spec.arity >= 0:
+		return argc == spec.arity
+	case argc < -spec.arity:
+		return false
+	case spec.maxArity > 0 && argc > spec.maxArity:
+		return false
+	case spec.argGroup > 0 && (argc+spec.arity)%spec.argGroup != 0:
+		return false
+	}
+	return true
+}
+
+// lookupCommand finds command in the table and validates its argument count,
+// where argc includes the command name. If ok is false, errReply holds the
+// error to send back to the client.
+func lookupCommand(command string, argc int) (spec commandSpec, errReply resp.Value, ok bool) {
+	spec, ok = commandTable[command]
+	if !ok {
+		return spec, resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown command '%s'", command)}, false
+	}
+	if !spec.validArgc(argc) {
+		return spec, resp.Value{Type: "error", Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))}, false
+	}
+	return spec, resp.Value{}, true
+}
+
+// subcommandHelp builds the reply to "<command> HELP" from subcommands, which
+// maps the syntax of each subcommand, such as "ENCODING <key>", to what it
+// does. As in Redis, a header line is followed by each subcommand in order
+// with its description indented below it, and HELP itself comes last.
+func subcommandHelp(command string, subcommands map[string]string) resp.Value {
+	lines := []string{command + " <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"}
+	syntaxes := make([]string, 0, len(subcommands))
+	for syntax := range subcommands {
+		syntaxes = append(syntaxes, syntax)
+	}
+	sort.Strings(syntaxes)
+	for _, syntax := range syntaxes {
+		lines = append(lines, syntax, "    "+subcommands[syntax])
+	}
+	lines = append(lines, "HELP", "    Print this help.")
+
+	arr := make([]resp.Value, len(lines))
+	for i, line := range lines {
+		arr[i] = resp.Value{Type: "bulk", Bulk: line}
+	}
+	return resp.Value{Type: "array", Array: arr}
+}
+
+// commandNames returns the names in the command table in sorted order.
+func commandNames() []string {
+	names := make([]string, 0, len(commandTable))
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandInfo renders a command table entry in the COMMAND reply format.
+func commandInfo(name string, spec commandSpec) resp.Value {
+	flags := make([]resp.Value, len(spec.flags))
+	for i, f := range spec.flags {
+		flags[i] = resp.Value{Type: "string", Str: f}
+	}
+	return resp.Value{Type: "array", Array: []resp.Value{
+		{Type: "bulk", Bulk: strings.ToLower(name)},
+		{Type: "integer", Num: spec.arity},
+		{Type: "array", Array: flags},
+		{Type: "integer", Num: spec.firstKey},
+		{Type: "integer", Num: spec.lastKey},
+		{Type: "integer", Num: spec.step},
+	}}
+}
+
+// commandHelp lists the subcommands of COMMAND for COMMAND HELP.
+var commandHelp = map[string]string{
+	"(no subcommand)":           "Return details about all commands.",
+	"COUNT":                     "Return the total number of commands in this server.",
+	"DOCS [<command-name> ...]": "Return the summary of all commands, or of the given ones.",
+	"INFO [<command-name> ...]": "Return details about all commands, or of the given ones.",
+}
+
+// commandReply implements COMMAND, COMMAND COUNT, COMMAND DOCS, COMMAND INFO
+// and COMMAND HELP.
+func commandReply(args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		names := commandNames()
+		arr := make([]resp.Value, len(names))
+		for i, name := range names {
+			arr[i] = commandInfo(name, commandTable[name])
+		}
+		return resp.Value{Type: "array", Array: arr}
+	}
+
+	switch strings.ToUpper(args[0].Bulk) {
+	case "HELP":
+		return subcommandHelp("COMMAND", commandHelp)
+
+	case "COUNT":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'command|count' command"}
+		}
+		return resp.Value{Type: "integer", Num: len(commandTable)}
+
+	case "INFO":
+		// As in Redis, an unknown command gets a null in its place.
+		if len(args) == 1 {
+			return commandReply(nil)
+		}
+		arr := make([]resp.Value, len(args)-1)
+		for i, a := range args[1:] {
+			name := strings.ToUpper(a.Bulk)
+			if spec, ok := commandTable[name]; ok {
+				arr[i] = commandInfo(name, spec)
+			} else {
+				arr[i] = resp.Value{Type: "null"}
+			}
+		}
+		return resp.Value{Type: "array", Array: arr}
+
+	case "DOCS":
+		names := commandNames()
+		if len(args) > 1 {
+			names = nil
+			for _, a := range args[1:] {
+				if name := strings.ToUpper(a.Bulk); commandTable[name].arity != 0 {
+					names = append(names, name)
+				}
+			}
+		}
+		arr := make([]resp.Value, 0, len(names)*2)
+		for _, name := range names {
+			arr = append(arr,
+				resp.Value{Type: "bulk", Bulk: strings.ToLower(name)},
+				resp.Value{Type: "array", Array: []resp.Value{
+					{Type: "bulk", Bulk: "summary"},
+					{Type: "bulk", Bulk: commandTable[name].summary},
+				}},
+			)
+		}
+		return resp.Value{Type: "array", Array: arr}
+
+	default:
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'", args[0].Bulk)}
+	}
+}
@@ -0,0 +1,444 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	serverconfig "jellyfish/internal/config"
+	"jellyfish/internal/resp"
+	"jellyfish/internal/store"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// config holds the runtime parameters exposed through CONFIG GET and CONFIG SET.
+// Fields are atomic because connections read them without holding the store lock.
+type config struct {
+	timeout         atomic.Int64  // client idle timeout in seconds, 0 disables it
+	clientIdleLimit atomic.Int64  // seconds without a command before the reaper closes a client, 0 disables it
+	protoMaxBulkLen atomic.Int64  // largest bulk string accepted from a client
+	maxMemory       atomic.Int64  // memory limit in bytes for the keyspace, 0 disables it
+	maxMemoryPolicy atomic.Uint32 // a store.EvictionPolicy
+	maxTxQueue      atomic.Int64  // most commands a client may queue inside MULTI
+	maxClients      atomic.Int64  // most connections served at once, 0 for no limit
+
+	// clientOutputBufferLimit is the most reply bytes that may be pending for
+	// a connection before it is closed, 0 for no limit.
+	clientOutputBufferLimit atomic.Int64
+
+	sortHashFields   atomic.Bool  // HGETALL, HKEYS and HVALS reply with fields sorted by name
+	strictSetType    atomic.Bool  // SET, TSET and TMSET reply WRONGTYPE instead of replacing another type
+	vsearchCache     atomic.Bool  // cache VSEARCH replies, see searchcache.go
+	vsearchCacheSize atomic.Int64 // most VSEARCH replies cached
+
+	// See rewrite.go. A percentage of 0 disables automatic rewrites.
+	autoAOFRewritePercentage atomic.Int64
+	autoAOFRewriteMinSize    atomic.Int64
+	aofRewriteOnFlushall     atomic.Bool // FLUSHALL rewrites the AOF, dropping the history before it
+
+	// store holds hash-max-listpack-entries and hash-max-listpack-value, which
+	// the store applies itself.
+	store *store.Store
+
+	// searchCache is emptied when vsearch-cache is turned off, so that it
+	// doesn't hold on to replies it will no longer serve.
+	searchCache *searchCache
+
+	// server holds the startup configuration. Only the runtime parameters
+	// above can change after the server starts accepting connections.
+	server serverconfig.Config
+}
+
+const (
+	defaultMaxTxQueue              = 100000   // max-tx-queue
+	defaultMaxClients              = 10000    // maxclients
+	defaultClientOutputBufferLimit = 64 << 20 // client-output-buffer-limit
+)
+
+func newConfig() *config {
+	c := &config{server: serverconfig.Default()}
+	c.protoMaxBulkLen.Store(resp.DefaultMaxBulkLen)
+	c.maxTxQueue.Store(defaultMaxTxQueue)
+	c.maxClients.Store(defaultMaxClients)
+	c.clientOutputBufferLimit.Store(defaultClientOutputBufferLimit)
+	c.vsearchCacheSize.Store(defaultSearchCacheSize)
+	c.autoAOFRewritePercentage.Store(defaultAutoAOFRewritePercentage)
+	c.autoAOFRewriteMinSize.Store(defaultAutoAOFRewriteMinSize)
+	c.aofRewriteOnFlushall.Store(true)
+	c.maxMemoryPolicy.Store(uint32(c.server.MaxMemoryPolicy))
+	return c
+}
+
+// UseConfig applies the configuration the server was started with, so that
+// CONFIG GET reports it. It must be called before the handler serves clients.
+func (h *Handler) UseConfig(cfg serverconfig.Config) {
+	h.config.server = cfg
+	h.config.maxMemory.Store(cfg.MaxMemory)
+	h.config.maxMemoryPolicy.Store(uint32(cfg.MaxMemoryPolicy))
+}
+
+// errImmutable rejects CONFIG SET of a parameter that is fixed at startup.
+var errImmutable = errors.New("can't set immutable config")
+
+// immutableParam exposes a startup setting through CONFIG GET.
+func immutableParam(get func(c *config) string) configParam {
+	return configParam{
+		get:   get,
+		parse: func(string) (func(c *config), error) { return nil, errImmutable },
+	}
+}
+
+// boolParam exposes a yes/no setting through CONFIG GET and CONFIG SET.
+func boolParam(field func(c *config) *atomic.Bool) configParam {
+	return configParam{
+		get: func(c *config) string {
+			if field(c).Load() {
+				return "yes"
+			}
+			return "no"
+		},
+		parse: func(value string) (func(c *config), error) {
+			var on bool
+			switch strings.ToLower(value) {
+			case "yes":
+				on = true
+			case "no":
+				on = false
+			default:
+				return nil, fmt.Errorf("argument must be 'yes' or 'no'")
+			}
+			return func(c *config) { field(c).Store(on) }, nil
+		},
+	}
+}
+
+// vsearchCacheParam is the vsearch-cache switch, which also empties the cache
+// when it is turned off.
+func vsearchCacheParam() configParam {
+	p := boolParam(func(c *config) *atomic.Bool { return &c.vsearchCache })
+	parse := p.parse
+	p.parse = func(value string) (func(c *config), error) {
+		apply, err := parse(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *config) {
+			apply(c)
+			if !c.vsearchCache.Load() {
+				c.searchCache.reset()
+			}
+		}, nil
+	}
+	return p
+}
+
+// configParam reads and writes one CONFIG parameter in its string form. parse
+// checks a value without changing anything, and returns either the function
+// that applies it or an error describing why it was rejected.
+type configParam struct {
+	get   func(c *config) string
+	parse func(value string) (apply func(c *config), err error)
+}
+
+var configParams = map[string]configParam{
+	"port":           immutableParam(func(c *config) string { return strconv.Itoa(c.server.Port) }),
+	"bind":           immutableParam(func(c *config) string { return c.server.Bind }),
+	"unixsocket":     immutableParam(func(c *config) string { return c.server.UnixSocket }),
+	"dir":            immutableParam(func(c *config) string { return c.server.Dir }),
+	"appendfilename": immutableParam(func(c *config) string { return c.server.AppendFilename }),
+	"appendfsync":    immutableParam(func(c *config) string { return c.server.AppendFsync.String() }),
+	"shards":         immutableParam(func(c *config) string { return strconv.Itoa(c.server.Shards) }),
+	"appendonly": immutableParam(func(c *config) string {
+		if c.server.AppendOnly {
+			return "yes"
+		}
+		return "no"
+	}),
+	"timeout": {
+		get: func(c *config) string { return strconv.FormatInt(c.timeout.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(c *config) {
+				c.timeout.Store(n)
+			}, nil
+		},
+	},
+	"client-idle-limit": {
+		get: func(c *config) string { return strconv.FormatInt(c.clientIdleLimit.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(c *config) {
+				c.clientIdleLimit.Store(n)
+			}, nil
+		},
+	},
+	"maxclients": {
+		get: func(c *config) string { return strconv.FormatInt(c.maxClients.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(c *config) {
+				c.maxClients.Store(n)
+			}, nil
+		},
+	},
+	"hash-max-listpack-entries": {
+		get: func(c *config) string {
+			entries, _ := c.store.HashListpackLimits()
+			return strconv.FormatInt(entries, 10)
+		},
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(c *config) {
+				_, maxLen := c.store.HashListpackLimits()
+				c.store.SetHashListpackLimits(n, maxLen)
+			}, nil
+		},
+	},
+	"hash-max-listpack-value": {
+		get: func(c *config) string {
+			_, maxLen := c.store.HashListpackLimits()
+			return strconv.FormatInt(maxLen, 10)
+		},
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(c *config) {
+				entries, _ := c.store.HashListpackLimits()
+				c.store.SetHashListpackLimits(entries, n)
+			}, nil
+		},
+	},
+	"maxmemory": {
+		get: func(c *config) string { return strconv.FormatInt(c.maxMemory.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := serverconfig.ParseMemory(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(c *config) {
+				c.maxMemory.Store(n)
+			}, nil
+		},
+	},
+	"client-output-buffer-limit": {
+		get: func(c *config) string { return strconv.FormatInt(c.clientOutputBufferLimit.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := serverconfig.ParseMemory(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(c *config) {
+				c.clientOutputBufferLimit.Store(n)
+			}, nil
+		},
+	},
+	"maxmemory-policy": {
+		get: func(c *config) string { return c.evictionPolicy().String() },
+		parse: func(value string) (func(c *config), error) {
+			policy, ok := store.ParseEvictionPolicy(strings.ToLower(value))
+			if !ok {
+				return nil, fmt.Errorf("argument(s) must be one of the following: noeviction, allkeys-lru, allkeys-lfu")
+			}
+			return func(c *config) {
+				c.maxMemoryPolicy.Store(uint32(policy))
+			}, nil
+		},
+	},
+	"max-tx-queue": {
+		get: func(c *config) string { return strconv.FormatInt(c.maxTxQueue.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			if n < 1 {
+				return nil, fmt.Errorf("argument must be between 1 and %d inclusive", int64(math.MaxInt64))
+			}
+			return func(c *config) {
+				c.maxTxQueue.Store(n)
+			}, nil
+		},
+	},
+	"auto-aof-rewrite-percentage": {
+		get: func(c *config) string { return strconv.FormatInt(c.autoAOFRewritePercentage.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || n > math.MaxInt32 {
+				return nil, fmt.Errorf("argument must be between 0 and %d inclusive", math.MaxInt32)
+			}
+			return func(c *config) {
+				c.autoAOFRewritePercentage.Store(n)
+			}, nil
+		},
+	},
+	"auto-aof-rewrite-min-size": {
+		get: func(c *config) string { return strconv.FormatInt(c.autoAOFRewriteMinSize.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := serverconfig.ParseMemory(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(c *config) {
+				c.autoAOFRewriteMinSize.Store(n)
+			}, nil
+		},
+	},
+	"aof-rewrite-on-flushall": boolParam(func(c *config) *atomic.Bool { return &c.aofRewriteOnFlushall }),
+	"sort-hash-fields":        boolParam(func(c *config) *atomic.Bool { return &c.sortHashFields }),
+	"strict-set-type":         boolParam(func(c *config) *atomic.Bool { return &c.strictSetType }),
+	"vsearch-cache":           vsearchCacheParam(),
+	"vsearch-cache-size": {
+		get: func(c *config) string { return strconv.FormatInt(c.vsearchCacheSize.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			if n < 1 || n > math.MaxInt32 {
+				return nil, fmt.Errorf("argument must be between 1 and %d inclusive", math.MaxInt32)
+			}
+			return func(c *config) {
+				c.vsearchCacheSize.Store(n)
+			}, nil
+		},
+	},
+	"proto-max-bulk-len": {
+		get: func(c *config) string { return strconv.FormatInt(c.protoMaxBulkLen.Load(), 10) },
+		parse: func(value string) (func(c *config), error) {
+			n, err := parseConfigInt(value)
+			if err != nil {
+				return nil, err
+			}
+			if n < 1 || n > math.MaxInt32 {
+				return nil, fmt.Errorf("argument must be between 1 and %d inclusive", math.MaxInt32)
+			}
+			return func(c *config) {
+				c.protoMaxBulkLen.Store(n)
+			}, nil
+		},
+	},
+}
+
+// parseConfigInt parses a non-negative integer parameter value.
+func parseConfigInt(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("argument couldn't be parsed into an integer")
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("argument must be between 0 and %d inclusive", int64(math.MaxInt64))
+	}
+	return n, nil
+}
+
+func (c *config) evictionPolicy() store.EvictionPolicy {
+	return store.EvictionPolicy(c.maxMemoryPolicy.Load())
+}
+
+// idleTimeout returns how long a client may stay silent before it is
+// disconnected, or 0 if idle clients are kept forever.
+func (c *config) idleTimeout() time.Duration {
+	return time.Duration(c.timeout.Load()) * time.Second
+}
+
+// idleLimit returns how long a client may go without sending a command before
+// the reaper closes it, or 0 if the reaper is off.
+func (c *config) idleLimit() time.Duration {
+	return time.Duration(c.clientIdleLimit.Load()) * time.Second
+}
+
+// configHelp lists the subcommands of CONFIG for CONFIG HELP.
+var configHelp = map[string]string{
+	"GET <pattern> [<pattern> ...]":                     "Return parameters matching the glob-like <pattern>s and their values.",
+	"SET <directive> <value> [<directive> <value> ...]": "Set the configuration <directive>s to <value>s.",
+	"RESETSTAT": "Reset the statistics reported by INFO commandstats.",
+}
+
+// CONFIG GET pattern [pattern ...] | CONFIG SET parameter value [parameter value ...] | CONFIG RESETSTAT | CONFIG HELP
+func configCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	switch strings.ToUpper(args[0].Bulk) {
+	case "HELP":
+		return subcommandHelp("CONFIG", configHelp)
+
+	case "RESETSTAT":
+		if len(args) != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'config|resetstat' command"}
+		}
+		for _, s := range h.stats {
+			s.reset()
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+
+	case "GET":
+		if len(args) < 2 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'config|get' command"}
+		}
+		names := make([]string, 0, len(configParams))
+		for name := range configParams {
+			for _, pattern := range args[1:] {
+				if store.MatchGlob(strings.ToLower(pattern.Bulk), name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+
+		arr := make([]resp.Value, 0, len(names)*2)
+		for _, name := range names {
+			arr = append(arr,
+				resp.Value{Type: "bulk", Bulk: name},
+				resp.Value{Type: "bulk", Bulk: configParams[name].get(h.config)},
+			)
+		}
+		return resp.Value{Type: "array", Array: arr}
+
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'config|set' command"}
+		}
+		// Validate every parameter name before applying anything.
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := configParams[strings.ToLower(args[i].Bulk)]; !ok {
+				return resp.Value{Type: "error", Str: fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i].Bulk)}
+			}
+		}
+		// Then every value, so that a bad one leaves the configuration as it was.
+		applies := make([]func(c *config), 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(args[i].Bulk)
+			apply, err := configParams[name].parse(args[i+1].Bulk)
+			if err != nil {
+				return resp.Value{Type: "error", Str: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", name, err)}
+			}
+			applies = append(applies, apply)
+		}
+		for _, apply := range applies {
+			apply(h.config)
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+
+	default:
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'", args[0].Bulk)}
+	}
+}
@@ -1,53 +1,134 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"jellyfish/internal/aof"
 	"jellyfish/internal/resp"
 	"jellyfish/internal/store"
-	"math"
 	"net"
-	"sort"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type Handler struct {
-	store *store.Store
-	aof   *aof.Aof
+	store    *store.Store
+	aof      *aof.Aof
+	repl     *replication
+	config   *config
+	monitors *monitors
+	acl      *acl
+	clients  *clients
+	stats    map[string]*commandStats
+
+	searchCache *searchCache // VSEARCH replies, used when vsearch-cache is on
+	rewrites    aofRewrites
+	connected   atomic.Int64 // connections in Handle, checked against maxclients
+	dirty       atomic.Int64 // writes since the last AOF rewrite snapshot, see writeAOF
 }
 
-const aofWriteError = "ERR AOF write failed"
+const (
+	aofWriteError   = "ERR AOF write failed"
+	maxClientsError = "ERR max number of clients reached"
+	wrongTypeError  = "WRONGTYPE Operation against a key holding the wrong kind of value"
+)
 
 func New(s *store.Store, aof *aof.Aof) *Handler {
+	config := newConfig()
+	config.store = s
+	config.searchCache = newSearchCache()
 	return &Handler{
-		store: s,
-		aof:   aof,
+		store:    s,
+		aof:      aof,
+		repl:     newReplication(),
+		config:   config,
+		monitors: newMonitors(),
+		acl:      newACL(),
+		clients:  newClients(config.idleLimit),
+		stats:    newCommandStats(),
+
+		searchCache: config.searchCache,
 	}
 }
 
 type session struct {
-	inTx    bool
-	txQueue []resp.Value
+	conn        net.Conn
+	out         *outputBuffer // replies are written here, not to conn
+	client      *client       // entry in the client registry
+	inTx        bool
+	txQueue     []resp.Value
+	txDirty     bool     // a command was refused while queueing, so EXEC must abort
+	user        string   // ACL user the connection is authenticated as
+	replica     *replica // set once the connection has issued SYNC
+	monitor     *monitor // set once the connection has issued MONITOR
+	writeOffset int64    // replication offset after this client's last write
+	aofOffset   int64    // AOF offset after this client's last write
 }
 
 func (h *Handler) Handle(conn net.Conn) {
 	defer conn.Close()
 
+	// A connection past maxclients is refused before anything is set up for it.
+	// Lowering the limit doesn't close connections already served.
+	n := h.connected.Add(1)
+	defer h.connected.Add(-1)
+	if limit := h.config.maxClients.Load(); limit > 0 && n > limit {
+		resp.NewWriter(conn).Write(resp.Value{Type: "error", Str: maxClientsError})
+		return
+	}
+
+	out := newOutputBuffer(conn, h.config.clientOutputBufferLimit.Load)
+	defer out.close()
+
 	r := resp.NewReader(conn)
-	w := resp.NewWriter(conn)
+	r.SetInternTable(commandTokens)
+	// A command is a flat array of arguments; nothing nests inside it.
+	r.SetMaxDepth(1)
+	w := resp.NewWriter(out)
 	sess := &session{
+		conn:    conn,
+		out:     out,
 		inTx:    false,
 		txQueue: make([]resp.Value, 0),
+		user:    defaultUser,
 	}
+	sess.client = h.clients.add(conn, out)
+	defer h.clients.remove(sess.client)
+	defer func() {
+		if sess.monitor != nil {
+			h.monitors.remove(sess.monitor)
+		}
+	}()
 
 	for {
+		// Replica and monitor links are kept open regardless of the idle timeout
+		// and the idle client reaper.
+		if timeout := h.config.idleTimeout(); timeout > 0 && sess.replica == nil && sess.monitor == nil {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		sess.client.reapExempt.Store(sess.replica != nil || sess.monitor != nil)
+		r.SetMaxBulkLen(int(h.config.protoMaxBulkLen.Load()))
+
 		value, err := r.Read()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				fmt.Println("closing idle client:", conn.RemoteAddr())
+				return
+			}
+			if errors.Is(err, resp.ErrProtocol) {
+				// The stream can't be resynchronized, so report and disconnect.
+				w.Write(resp.Value{Type: "error", Str: "ERR " + err.Error()})
+				return
+			}
 			fmt.Println("error reading from client:", err)
 			return
 		}
@@ -56,6 +137,7 @@ func (h *Handler) Handle(conn net.Conn) {
 			continue
 		}
 
+		sess.client.lastCommand.Store(time.Now().UnixNano())
 		h.handleCommand(value, w, sess)
 	}
 }
@@ -63,6 +145,119 @@ func (h *Handler) Handle(conn net.Conn) {
 func (h *Handler) handleCommand(value resp.Value, w *resp.Writer, sess *session) {
 	command := strings.ToUpper(value.Array[0].Bulk)
 
+	// A replica connection only receives the command stream; its writer belongs
+	// to the propagation goroutine, so all it may send back are acknowledgments.
+	if sess.replica != nil {
+		if command == "REPLCONF" && len(value.Array) == 3 && strings.EqualFold(value.Array[1].Bulk, "ACK") {
+			if offset, err := strconv.ParseInt(value.Array[2].Bulk, 10, 64); err == nil {
+				h.repl.ack(sess.replica, offset)
+			}
+		}
+		return
+	}
+
+	// A monitor connection's writer belongs to the monitor goroutine; only
+	// RESET, which leaves monitor mode, is accepted.
+	if sess.monitor != nil {
+		if command != "RESET" {
+			return
+		}
+		h.monitors.detach(sess.monitor)
+		sess.monitor = nil
+	}
+
+	h.monitors.feed(sess.conn.RemoteAddr().String(), value)
+
+	// AUTH is always allowed, so that a connection can switch to a user with
+	// more permissions.
+	if command == "AUTH" && !sess.inTx {
+		if _, errReply, ok := lookupCommand(command, len(value.Array)); !ok {
+			w.Write(errReply)
+			return
+		}
+		w.Write(h.authCommand(value.Array[1:], sess))
+		return
+	}
+	if _, known := commandTable[command]; known && command != "AUTH" && !h.acl.allowed(sess.user, command) {
+		if sess.inTx {
+			sess.txDirty = true
+		}
+		w.Write(resp.Value{Type: "error", Str: fmt.Sprintf(noPermError, sess.user, strings.ToLower(command))})
+		return
+	}
+
+	if command == "CLIENT" && !sess.inTx {
+		if _, errReply, ok := lookupCommand(command, len(value.Array)); !ok {
+			w.Write(errReply)
+			return
+		}
+		w.Write(h.clientCommand(value.Array[1:], sess))
+		return
+	}
+
+	if command == "ACL" && !sess.inTx {
+		if _, errReply, ok := lookupCommand(command, len(value.Array)); !ok {
+			w.Write(errReply)
+			return
+		}
+		w.Write(h.aclCommand(value.Array[1:], sess))
+		return
+	}
+
+	if command == "RESET" {
+		if _, errReply, ok := lookupCommand(command, len(value.Array)); !ok {
+			w.Write(errReply)
+			return
+		}
+		h.resetSession(sess)
+		w.Write(resp.Value{Type: "string", Str: "RESET"})
+		return
+	}
+
+	if command == "MONITOR" {
+		if sess.inTx {
+			w.Write(resp.Value{Type: "error", Str: "ERR MONITOR is not allowed inside a transaction"})
+			return
+		}
+		sess.monitor = h.monitors.add(sess.conn, sess.out)
+		return
+	}
+
+	if command == "SYNC" {
+		if sess.inTx {
+			w.Write(resp.Value{Type: "error", Str: "ERR SYNC is not allowed inside a transaction"})
+			return
+		}
+		// The replication stream is written to the connection directly, after
+		// any replies still queued.
+		sess.out.drain()
+		sess.replica = h.syncReplica(sess.conn)
+		return
+	}
+
+	// WAIT and WAITAOF block on acknowledgments, so they must run outside the
+	// store lock.
+	if (command == "WAIT" || command == "WAITAOF") && !sess.inTx {
+		if _, errReply, ok := lookupCommand(command, len(value.Array)); !ok {
+			w.Write(errReply)
+			return
+		}
+		if command == "WAIT" {
+			w.Write(h.waitCommand(value.Array[1:], sess, true))
+		} else {
+			w.Write(h.waitAOFCommand(value.Array[1:], sess, true))
+		}
+		return
+	}
+
+	// Replicas only accept writes from their master.
+	spec, known := commandTable[command]
+	isWrite := known && spec.hasFlag("write")
+	if isWrite && h.repl.isReplica() {
+		w.Write(resp.Value{Type: "error", Str: readOnlyError})
+		return
+	}
+
 	// Handle Transaction Control Commands
 	if command == "MULTI" {
 		if sess.inTx {
@@ -71,6 +266,7 @@ func (h *Handler) handleCommand(value resp.Value, w *resp.Writer, sess *session)
 		}
 		sess.inTx = true
 		sess.txQueue = make([]resp.Value, 0)
+		sess.txDirty = false
 		w.Write(resp.Value{Type: "string", Str: "OK"})
 		return
 	}
@@ -82,6 +278,7 @@ func (h *Handler) handleCommand(value resp.Value, w *resp.Writer, sess *session)
 		}
 		sess.inTx = false
 		sess.txQueue = nil
+		sess.txDirty = false
 		w.Write(resp.Value{Type: "string", Str: "OK"})
 		return
 	}
@@ -91,30 +288,87 @@ func (h *Handler) handleCommand(value resp.Value, w *resp.Writer, sess *session)
 			w.Write(resp.Value{Type: "error", Str: "ERR EXEC without MULTI"})
 			return
 		}
+		if sess.txDirty {
+			sess.inTx = false
+			sess.txQueue = nil
+			sess.txDirty = false
+			w.Write(resp.Value{Type: "error", Str: "EXECABORT Transaction discarded because of previous errors."})
+			return
+		}
 
 		h.execTx(w, sess)
+		h.recordWrite(sess)
+		h.maybeRewriteAOF()
 		return
 	}
 
-	// Queue commands if in transaction
+	// Queue commands if in transaction. A client that keeps queueing without
+	// calling EXEC would otherwise grow the queue without bound.
 	if sess.inTx {
+		if int64(len(sess.txQueue)) >= h.config.maxTxQueue.Load() {
+			sess.txDirty = true
+			w.Write(resp.Value{Type: "error", Str: "ERR transaction queue is full (max-tx-queue)"})
+			return
+		}
 		sess.txQueue = append(sess.txQueue, value)
 		w.Write(resp.Value{Type: "string", Str: "QUEUED"})
 		return
 	}
 
+	// MIGRATE talks to another server, which must not happen with the store
+	// locked; see Handler.migrate.
+	if command == "MIGRATE" {
+		if _, errReply, ok := lookupCommand(command, len(value.Array)); !ok {
+			w.Write(errReply)
+			return
+		}
+		w.Write(h.migrate(value))
+		h.recordWrite(sess)
+		h.maybeRewriteAOF()
+		return
+	}
+
 	// Normal execution
-	h.Execute(value, w)
+	h.execute(value, w, sess.client.noTouch.Load())
+	if isWrite {
+		h.recordWrite(sess)
+	}
+}
+
+// recordWrite notes where the replication stream and the AOF end after a
+// write by sess, for WAIT and WAITAOF.
+func (h *Handler) recordWrite(sess *session) {
+	sess.writeOffset = h.repl.currentOffset()
+	if h.aof != nil {
+		sess.aofOffset = h.aof.Offset()
+	}
+}
+
+// resetSession returns a connection to its initial state: any open
+// transaction is discarded without running its queued commands and the
+// connection is authenticated as the default user again. Monitor mode
+// is left in handleCommand before this is called.
+func (h *Handler) resetSession(sess *session) {
+	sess.inTx = false
+	sess.txQueue = nil
+	sess.txDirty = false
+	sess.user = defaultUser
+	sess.writeOffset = 0
+	sess.aofOffset = 0
 }
 
 func (h *Handler) execTx(w *resp.Writer, sess *session) {
 	// Atomically execute all commands
-	h.store.Lock()
-	defer h.store.Unlock()
+	unlock := h.lockCommands(sess.client.noTouch.Load(), sess.txQueue...)
+	defer unlock()
 
 	responses := make([]resp.Value, len(sess.txQueue))
 
 	for i, cmdValue := range sess.txQueue {
+		if reply, ok := h.executeSessionCommand(cmdValue, sess); ok {
+			responses[i] = reply
+			continue
+		}
 		responses[i] = h.executeWithoutLock(cmdValue)
 	}
 
@@ -126,629 +380,192 @@ func (h *Handler) execTx(w *resp.Writer, sess *session) {
 	w.Write(resp.Value{Type: "array", Array: responses})
 }
 
-func (h *Handler) writeAOF(value resp.Value) error {
-	if h.aof == nil {
-		return nil
+// executeSessionCommand runs a queued command that depends on the connection,
+// which handleCommand runs directly outside a transaction, and reports
+// whether value was one.
+func (h *Handler) executeSessionCommand(value resp.Value, sess *session) (resp.Value, bool) {
+	command := strings.ToUpper(value.Array[0].Bulk)
+	switch command {
+	case "AUTH", "CLIENT", "ACL", "WAIT", "WAITAOF":
+	default:
+		return resp.Value{}, false
+	}
+	if _, errReply, ok := lookupCommand(command, len(value.Array)); !ok {
+		return errReply, true
 	}
-	return h.aof.Write(value)
-}
 
-// executeWithoutLock executes a command assuming the store is ALREADY locked.
-// It returns the response value instead of writing it.
-func (h *Handler) executeWithoutLock(value resp.Value) resp.Value {
-	command := strings.ToUpper(value.Array[0].Bulk)
 	args := value.Array[1:]
-
 	switch command {
-	case "PING":
-		return resp.Value{Type: "string", Str: "PONG"}
-
-	case "ECHO":
-		if len(args) > 0 {
-			return resp.Value{Type: "bulk", Bulk: args[0].Bulk}
-		}
-		return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'echo' command"}
-
-	case "SET":
-		if len(args) != 2 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'set' command"}
-		}
-
-		if err := h.writeAOF(value); err != nil {
-			return resp.Value{Type: "error", Str: aofWriteError}
-		}
-
-		h.store.SetWithoutLock(args[0].Bulk, args[1].Bulk)
-		return resp.Value{Type: "string", Str: "OK"}
-
-	case "TSET":
-		// TSET key v1 v2 v3 ...
-		if len(args) < 2 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'tset' command"}
-		}
-		key := args[0].Bulk
-		vec := make([]float32, 0, len(args)-1)
-		for _, arg := range args[1:] {
-			val, err := strconv.ParseFloat(arg.Bulk, 32)
-			if err != nil {
-				return resp.Value{Type: "error", Str: "ERR invalid float value"}
-			}
-			vec = append(vec, float32(val))
-		}
-
-		if err := h.writeAOF(value); err != nil {
-			return resp.Value{Type: "error", Str: aofWriteError}
-		}
-
-		h.store.SetVectorWithoutLock(key, vec)
-		return resp.Value{Type: "string", Str: "OK"}
-
-	case "GET":
-		if len(args) != 1 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'get' command"}
-		}
-		val, ok := h.store.GetWithoutLock(args[0].Bulk)
-		if !ok {
-			return resp.Value{Type: "null"}
-		}
-		return resp.Value{Type: "bulk", Bulk: val}
-
-	case "TGET":
-		if len(args) != 1 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'tget' command"}
-		}
-		vec, ok := h.store.GetVectorWithoutLock(args[0].Bulk)
-		if !ok {
-			return resp.Value{Type: "null"}
-		}
+	case "AUTH":
+		return h.authCommand(args, sess), true
+	case "CLIENT":
+		return h.clientCommand(args, sess), true
+	case "ACL":
+		return h.aclCommand(args, sess), true
+	case "WAIT":
+		return h.waitCommand(args, sess, false), true
+	case "WAITAOF":
+		return h.waitAOFCommand(args, sess, false), true
+	}
+	return resp.Value{}, false
+}
 
-		// Convert []float32 to []resp.Value
-		vals := make([]resp.Value, len(vec))
-		for i, v := range vec {
-			vals[i] = resp.Value{Type: "bulk", Bulk: fmt.Sprintf("%g", v)}
-		}
-		return resp.Value{Type: "array", Array: vals}
+// writeAOF logs a write command to the AOF and, once it is durable, streams it
+// to any attached replicas. It is called with the store lock held, so replicas
+// see commands in the order they were applied. Commands call it before they
+// change the store and change nothing if it fails, so the store is never
+// ahead of the log. Each write logged counts toward the dirty counter.
+func (h *Handler) writeAOF(value resp.Value) error {
+	if err := h.logWrite(value); err != nil {
+		return err
+	}
+	h.dirty.Add(1)
+	return nil
+}
 
-	case "DEL":
-		if len(args) != 1 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'del' command"}
-		}
-		if err := h.writeAOF(value); err != nil {
-			return resp.Value{Type: "error", Str: aofWriteError}
-		}
-		deleted := h.store.DelWithoutLock(args[0].Bulk)
-		if deleted {
-			return resp.Value{Type: "integer", Num: 1}
+// logWrite is writeAOF for writes the server makes on its own, such as
+// evictions, which don't count toward the dirty counter since no client
+// asked for them.
+func (h *Handler) logWrite(value resp.Value) error {
+	if h.aof != nil {
+		if err := h.aof.Write(value); err != nil {
+			return err
 		}
-		return resp.Value{Type: "integer", Num: 0}
+	}
+	h.repl.propagate(value)
+	return nil
+}
 
-	case "EXPIRE":
-		if len(args) != 2 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'expire' command"}
-		}
-		seconds, err := strconv.Atoi(args[1].Bulk)
-		if err != nil {
-			return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
-		}
-		if err := h.writeAOF(value); err != nil {
-			return resp.Value{Type: "error", Str: aofWriteError}
-		}
-		ok := h.store.ExpireWithoutLock(args[0].Bulk, seconds)
-		if ok {
-			return resp.Value{Type: "integer", Num: 1}
-		}
-		return resp.Value{Type: "integer", Num: 0}
+// executeWithoutLock executes a command assuming the store is ALREADY locked.
+// It returns the response value instead of writing it.
+func (h *Handler) executeWithoutLock(value resp.Value) resp.Value {
+	command := strings.ToUpper(value.Array[0].Bulk)
 
-	case "TTL":
-		if len(args) != 1 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'ttl' command"}
-		}
-		ttl := h.store.TTLWithoutLock(args[0].Bulk)
-		return resp.Value{Type: "integer", Num: ttl}
+	spec, errReply, ok := lookupCommand(command, len(value.Array))
+	if !ok {
+		return errReply
+	}
+	if spec.fn == nil {
+		// Connection-level commands such as MULTI are handled in handleCommand.
+		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR '%s' is not allowed in this context", strings.ToLower(command))}
+	}
 
-	case "HSET":
-		if len(args) < 3 || len(args)%2 == 0 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hset' command"}
-		}
-		key := args[0].Bulk
-		fields := make(map[string]string, (len(args)-1)/2)
-		for i := 1; i < len(args); i += 2 {
-			fields[args[i].Bulk] = args[i+1].Bulk
-		}
-		added := h.store.HSetWithoutLock(key, fields)
-		if added == -1 {
-			return resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	if spec.hasFlag("denyoom") {
+		if errReply, ok := h.evictWithoutLock(); !ok {
+			return errReply
 		}
-		if err := h.writeAOF(value); err != nil {
-			return resp.Value{Type: "error", Str: aofWriteError}
-		}
-		return resp.Value{Type: "integer", Num: added}
+	}
 
-	case "HGET":
-		if len(args) != 2 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hget' command"}
-		}
-		val, found, typeOk := h.store.HGetWithoutLock(args[0].Bulk, args[1].Bulk)
-		if !typeOk {
-			return resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
-		}
-		if !found {
-			return resp.Value{Type: "null"}
-		}
-		return resp.Value{Type: "bulk", Bulk: val}
+	start := time.Now()
+	reply := spec.fn(h, value, value.Array[1:])
+	h.stats[command].record(time.Since(start))
+	return reply
+}
 
-	case "HDEL":
-		if len(args) < 2 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hdel' command"}
-		}
-		key := args[0].Bulk
-		fields := make([]string, len(args)-1)
-		for i, a := range args[1:] {
-			fields[i] = a.Bulk
-		}
-		removed := h.store.HDelWithoutLock(key, fields)
-		if removed == -1 {
-			return resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
-		}
-		if removed > 0 {
-			if err := h.writeAOF(value); err != nil {
-				return resp.Value{Type: "error", Str: aofWriteError}
-			}
-		}
-		return resp.Value{Type: "integer", Num: removed}
+// lockCommands locks the store shards that the commands in values need and
+// returns the function that unlocks them. A transaction passes its whole
+// queue, so it locks the shards of every key it touches, in order, and other
+// clients can use the rest of the store meanwhile. If any command has no key
+// arguments, or one may have to evict, the whole store is locked instead;
+// an empty transaction locks nothing.
+// With noTouch, for a client in CLIENT NO-TOUCH mode, reads under the locks
+// don't count as accesses to the keys read.
+func (h *Handler) lockCommands(noTouch bool, values ...resp.Value) (unlock func()) {
+	if len(values) == 0 {
+		return func() {} // an empty transaction touches nothing
+	}
+	var keys []string
+	all, mayEvict := false, false
+	for _, value := range values {
+		spec := commandTable[strings.ToUpper(value.Array[0].Bulk)]
+		cmdKeys := spec.keys(value)
+		if len(cmdKeys) == 0 || spec.allShards {
+			all = true
+			break
+		}
+		keys = append(keys, cmdKeys...)
+		mayEvict = mayEvict || spec.hasFlag("denyoom")
+	}
 
-	case "HGETALL":
-		if len(args) != 1 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hgetall' command"}
-		}
-		m, typeOk := h.store.HGetAllWithoutLock(args[0].Bulk)
-		if !typeOk {
-			return resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	if !all {
+		h.store.LockKeys(keys)
+		// maxmemory is only changed by CONFIG SET, which holds every shard, so it
+		// can't change between this check and the commands.
+		if mayEvict && h.config.maxMemory.Load() != 0 {
+			h.store.UnlockKeys(keys)
+			all = true
 		}
-		if m == nil {
-			return resp.Value{Type: "array", Array: []resp.Value{}}
+	}
+	if all {
+		keys = nil
+		h.store.Lock()
+	}
+	if noTouch {
+		h.store.SetNoTouchWithoutLock(keys, true)
+	}
+	return func() {
+		if noTouch {
+			h.store.SetNoTouchWithoutLock(keys, false)
 		}
-		arr := make([]resp.Value, 0, len(m)*2)
-		for k, v := range m {
-			arr = append(arr, resp.Value{Type: "bulk", Bulk: k}, resp.Value{Type: "bulk", Bulk: v})
+		if keys == nil {
+			h.store.Unlock()
+		} else {
+			h.store.UnlockKeys(keys)
 		}
-		return resp.Value{Type: "array", Array: arr}
+	}
+}
 
-	case "HEXISTS":
-		if len(args) != 2 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hexists' command"}
-		}
-		exists, typeOk := h.store.HExistsWithoutLock(args[0].Bulk, args[1].Bulk)
-		if !typeOk {
-			return resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
-		}
-		if exists {
-			return resp.Value{Type: "integer", Num: 1}
-		}
-		return resp.Value{Type: "integer", Num: 0}
+// evictWithoutLock frees memory under the maxmemory policy before a command
+// that may grow the dataset. Evicted keys are logged and propagated as DEL.
+// Unlike commands, eviction logs after the fact, since victims are picked as
+// memory is freed; if the log fails, replay brings them back, which is no
+// worse than not having evicted them.
+// If ok is false the command must not run and errReply says why. Replicas
+// never evict: they mirror the master's keyspace, including its evictions.
+func (h *Handler) evictWithoutLock() (errReply resp.Value, ok bool) {
+	limit := h.config.maxMemory.Load()
+	if limit == 0 || h.repl.isReplica() {
+		return resp.Value{}, true
+	}
 
-	case "HLEN":
-		if len(args) != 1 {
-			return resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hlen' command"}
-		}
-		length := h.store.HLenWithoutLock(args[0].Bulk)
-		if length == -1 {
-			return resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	evicted, ok := h.store.EvictWithoutLock(limit, h.config.evictionPolicy())
+	if len(evicted) > 0 {
+		if err := h.logWrite(bulkCommand(append([]string{"DEL"}, evicted...)...)); err != nil {
+			return resp.Value{Type: "error", Str: aofWriteError}, false
 		}
-		return resp.Value{Type: "integer", Num: length}
+	}
+	if !ok {
+		return resp.Value{Type: "error", Str: "OOM command not allowed when used memory > 'maxmemory'."}, false
+	}
+	return resp.Value{}, true
+}
 
-	default:
-		return resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown command '%s'", command)}
+// strictTypeConflictWithoutLock reports whether strict-set-type forbids
+// replacing the value at key, which holds a type other than typ. SET, TSET and
+// TMSET otherwise overwrite a key of any type, as SET does in Redis. Replicas
+// ignore the setting, so that they keep mirroring the master.
+func (h *Handler) strictTypeConflictWithoutLock(key string, typ uint8) bool {
+	if !h.config.strictSetType.Load() || h.repl.isReplica() {
+		return false
 	}
+	existing, found := h.store.TypeWithoutLock(key)
+	return found && existing != typ
 }
 
 // Execute processes a RESP command in immediate mode (locks per command).
 // If w is nil, no response is written.
 func (h *Handler) Execute(value resp.Value, w *resp.Writer) {
-	command := strings.ToUpper(value.Array[0].Bulk)
-	args := value.Array[1:]
-
-	switch command {
-	case "PING":
-		if w != nil {
-			w.Write(resp.Value{Type: "string", Str: "PONG"})
-		}
-
-	case "ECHO":
-		if len(args) > 0 {
-			if w != nil {
-				w.Write(resp.Value{Type: "bulk", Bulk: args[0].Bulk})
-			}
-		} else {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'echo' command"})
-			}
-		}
-
-	case "SET":
-		if len(args) != 2 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'set' command"})
-			}
-			return
-		}
-
-		if err := h.writeAOF(value); err != nil {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: aofWriteError})
-			}
-			return
-		}
-
-		key := args[0].Bulk
-		val := args[1].Bulk
-		h.store.Set(key, val)
-		if w != nil {
-			w.Write(resp.Value{Type: "string", Str: "OK"})
-		}
-
-	case "TSET":
-		// TSET key v1 v2 v3 ...
-		if len(args) < 2 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'tset' command"})
-			}
-			return
-		}
-		key := args[0].Bulk
-		vec := make([]float32, 0, len(args)-1)
-		for _, arg := range args[1:] {
-			val, err := strconv.ParseFloat(arg.Bulk, 32)
-			if err != nil {
-				if w != nil {
-					w.Write(resp.Value{Type: "error", Str: "ERR invalid float value"})
-				}
-				return
-			}
-			vec = append(vec, float32(val))
-		}
-
-		if err := h.writeAOF(value); err != nil {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: aofWriteError})
-			}
-			return
-		}
-
-		h.store.SetVector(key, vec)
-		if w != nil {
-			w.Write(resp.Value{Type: "string", Str: "OK"})
-		}
-
-	case "GET":
-		if len(args) != 1 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'get' command"})
-			}
-			return
-		}
-		key := args[0].Bulk
-		val, ok := h.store.Get(key)
-		if w != nil {
-			if !ok {
-				w.Write(resp.Value{Type: "null"})
-			} else {
-				w.Write(resp.Value{Type: "bulk", Bulk: val})
-			}
-		}
-
-	case "TGET":
-		if len(args) != 1 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'tget' command"})
-			}
-			return
-		}
-		vec, ok := h.store.GetVector(args[0].Bulk)
-		if w != nil {
-			if !ok {
-				w.Write(resp.Value{Type: "null"})
-			} else {
-				vals := make([]resp.Value, len(vec))
-				for i, v := range vec {
-					vals[i] = resp.Value{Type: "bulk", Bulk: fmt.Sprintf("%g", v)}
-				}
-				w.Write(resp.Value{Type: "array", Array: vals})
-			}
-		}
-
-	case "VSEARCH":
-		// VSEARCH q1 q2 ... k
-		if len(args) < 2 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'vsearch' command"})
-			}
-			return
-		}
-
-		// Last argument is K
-		kStr := args[len(args)-1].Bulk
-		k, err := strconv.Atoi(kStr)
-		if err != nil {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR invalid K value"})
-			}
-			return
-		}
-
-		// Parse query vector
-		queryVec := make([]float32, 0, len(args)-2)
-		for _, arg := range args[:len(args)-1] {
-			val, err := strconv.ParseFloat(arg.Bulk, 32)
-			if err != nil {
-				if w != nil {
-					w.Write(resp.Value{Type: "error", Str: "ERR invalid float value"})
-				}
-				return
-			}
-			queryVec = append(queryVec, float32(val))
-		}
-
-		// Perform linear search
-		// Note: GetAllVectors() locks RLock inside
-		candidates := h.store.GetAllVectors()
-
-		type result struct {
-			key   string
-			score float64
-		}
-		results := make([]result, 0, len(candidates))
-
-		for key, vec := range candidates {
-			if len(vec) != len(queryVec) {
-				continue // Skip dimension mismatch
-			}
-			dist := cosineDistance(queryVec, vec)
-			results = append(results, result{key: key, score: dist})
-		}
-
-		// Sort by distance (ascending)
-		sort.Slice(results, func(i, j int) bool {
-			return results[i].score < results[j].score
-		})
-
-		// Return top K keys
-		if k > len(results) {
-			k = len(results)
-		}
-
-		respArr := make([]resp.Value, k)
-		for i := 0; i < k; i++ {
-			respArr[i] = resp.Value{Type: "bulk", Bulk: results[i].key}
-		}
-
-		if w != nil {
-			w.Write(resp.Value{Type: "array", Array: respArr})
-		}
-
-	case "DEL":
-		if len(args) != 1 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'del' command"})
-			}
-			return
-		}
-
-		if err := h.writeAOF(value); err != nil {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: aofWriteError})
-			}
-			return
-		}
-
-		key := args[0].Bulk
-		deleted := h.store.Del(key)
-		if w != nil {
-			if deleted {
-				w.Write(resp.Value{Type: "integer", Num: 1})
-			} else {
-				w.Write(resp.Value{Type: "integer", Num: 0})
-			}
-		}
-
-	case "EXPIRE":
-		if len(args) != 2 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'expire' command"})
-			}
-			return
-		}
-
-		key := args[0].Bulk
-		seconds, err := strconv.Atoi(args[1].Bulk)
-		if err != nil {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"})
-			}
-			return
-		}
-
-		if err := h.writeAOF(value); err != nil {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: aofWriteError})
-			}
-			return
-		}
-
-		ok := h.store.Expire(key, seconds)
-		if w != nil {
-			if ok {
-				w.Write(resp.Value{Type: "integer", Num: 1})
-			} else {
-				w.Write(resp.Value{Type: "integer", Num: 0})
-			}
-		}
-
-	case "TTL":
-		if len(args) != 1 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'ttl' command"})
-			}
-			return
-		}
-		key := args[0].Bulk
-		ttl := h.store.TTL(key)
-		if w != nil {
-			w.Write(resp.Value{Type: "integer", Num: ttl})
-		}
-
-	case "HSET":
-		if len(args) < 3 || len(args)%2 == 0 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hset' command"})
-			}
-			return
-		}
-		key := args[0].Bulk
-		fields := make(map[string]string, (len(args)-1)/2)
-		for i := 1; i < len(args); i += 2 {
-			fields[args[i].Bulk] = args[i+1].Bulk
-		}
-		added := h.store.HSet(key, fields)
-		if added == -1 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"})
-			}
-			return
-		}
-		if err := h.writeAOF(value); err != nil {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: aofWriteError})
-			}
-			return
-		}
-		if w != nil {
-			w.Write(resp.Value{Type: "integer", Num: added})
-		}
-
-	case "HGET":
-		if len(args) != 2 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hget' command"})
-			}
-			return
-		}
-		val, found, typeOk := h.store.HGet(args[0].Bulk, args[1].Bulk)
-		if w != nil {
-			if !typeOk {
-				w.Write(resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"})
-			} else if !found {
-				w.Write(resp.Value{Type: "null"})
-			} else {
-				w.Write(resp.Value{Type: "bulk", Bulk: val})
-			}
-		}
-
-	case "HDEL":
-		if len(args) < 2 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hdel' command"})
-			}
-			return
-		}
-		key := args[0].Bulk
-		fields := make([]string, len(args)-1)
-		for i, a := range args[1:] {
-			fields[i] = a.Bulk
-		}
-		removed := h.store.HDel(key, fields)
-		if removed == -1 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"})
-			}
-			return
-		}
-		if removed > 0 {
-			if err := h.writeAOF(value); err != nil {
-				if w != nil {
-					w.Write(resp.Value{Type: "error", Str: aofWriteError})
-				}
-				return
-			}
-		}
-		if w != nil {
-			w.Write(resp.Value{Type: "integer", Num: removed})
-		}
-
-	case "HGETALL":
-		if len(args) != 1 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hgetall' command"})
-			}
-			return
-		}
-		m, typeOk := h.store.HGetAll(args[0].Bulk)
-		if w != nil {
-			if !typeOk {
-				w.Write(resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"})
-			} else if m == nil {
-				w.Write(resp.Value{Type: "array", Array: []resp.Value{}})
-			} else {
-				arr := make([]resp.Value, 0, len(m)*2)
-				for k, v := range m {
-					arr = append(arr, resp.Value{Type: "bulk", Bulk: k}, resp.Value{Type: "bulk", Bulk: v})
-				}
-				w.Write(resp.Value{Type: "array", Array: arr})
-			}
-		}
-
-	case "HEXISTS":
-		if len(args) != 2 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hexists' command"})
-			}
-			return
-		}
-		exists, typeOk := h.store.HExists(args[0].Bulk, args[1].Bulk)
-		if w != nil {
-			if !typeOk {
-				w.Write(resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"})
-			} else if exists {
-				w.Write(resp.Value{Type: "integer", Num: 1})
-			} else {
-				w.Write(resp.Value{Type: "integer", Num: 0})
-			}
-		}
-
-	case "HLEN":
-		if len(args) != 1 {
-			if w != nil {
-				w.Write(resp.Value{Type: "error", Str: "ERR wrong number of arguments for 'hlen' command"})
-			}
-			return
-		}
-		length := h.store.HLen(args[0].Bulk)
-		if w != nil {
-			if length == -1 {
-				w.Write(resp.Value{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"})
-			} else {
-				w.Write(resp.Value{Type: "integer", Num: length})
-			}
-		}
-
-	default:
-		if w != nil {
-			w.Write(resp.Value{Type: "error", Str: fmt.Sprintf("ERR unknown command '%s'", command)})
-		}
-	}
+	h.execute(value, w, false)
 }
 
-// cosineDistance calculates 1 - CosineSimilarity. Lower is closer.
-func cosineDistance(a, b []float32) float64 {
-	var dot, magA, magB float64
-	for i := range a {
-		dot += float64(a[i]) * float64(b[i])
-		magA += float64(a[i]) * float64(a[i])
-		magB += float64(b[i]) * float64(b[i])
-	}
-	if magA == 0 || magB == 0 {
-		return 1.0 // Maximum distance if zero vector
+// execute is Execute for a client, which may be in CLIENT NO-TOUCH mode.
+func (h *Handler) execute(value resp.Value, w *resp.Writer, noTouch bool) {
+	unlock := h.lockCommands(noTouch, value)
+	reply := h.executeWithoutLock(value)
+	unlock()
+	h.maybeRewriteAOF()
+
+	if w != nil {
+		w.Write(reply)
 	}
-	similarity := dot / (math.Sqrt(magA) * math.Sqrt(magB))
-	return 1.0 - similarity
 }
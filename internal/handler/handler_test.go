@@ -4,13 +4,22 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"maps"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"jellyfish/internal/aof"
+	"jellyfish/internal/codec"
+	serverconfig "jellyfish/internal/config"
 	"jellyfish/internal/resp"
 	"jellyfish/internal/store"
 )
@@ -300,3 +309,3731 @@ func TestHandler_AofWriteError(t *testing.T) {
 		t.Fatalf("response = %#v, want error %q", v, aofWriteError)
 	}
 }
+
+// TestHandler_AofWriteErrorLeavesStore checks that every write command
+// appends to the AOF before changing the store, so a failed append leaves
+// the dataset as it was.
+func TestHandler_AofWriteErrorLeavesStore(t *testing.T) {
+	setup := [][]string{
+		{"SET", "s", "hello"},
+		{"SET", "n", "10"},
+		{"SET", "t", "v"},
+		{"EXPIRE", "t", "100"},
+		{"TSET", "v", "1", "2"},
+		{"HSET", "h", "a", "1", "b", "2"},
+		{"HEXPIRE", "h", "100", "FIELDS", "1", "b"},
+	}
+	blob := string(codec.Encode(store.Item{Type: store.TypeString, StrVal: "x"}))
+
+	tests := [][]string{
+		{"SET", "s", "other"},
+		{"GETDEL", "s"},
+		{"GETEX", "s", "EX", "100"},
+		{"GETEX", "t", "PERSIST"},
+		{"INCR", "n"},
+		{"DECRBY", "new", "5"},
+		{"SETBIT", "s", "100", "1"},
+		{"DEL", "s", "v"},
+		{"UNLINK", "h"},
+		{"RESTORE", "s", "0", blob, "REPLACE"},
+		{"EXPIRE", "s", "100"},
+		{"EXPIRE", "s", "0"},
+		{"PEXPIREAT", "h", "1"},
+		{"PERSIST", "t"},
+		{"TSET", "v", "3", "4"},
+		{"TMSET", "v", "1", "5", "w", "1", "6"},
+		{"HSET", "h", "a", "changed"},
+		{"HDEL", "h", "a"},
+		{"HGETDEL", "h", "FIELDS", "1", "a"},
+		{"HGETEX", "h", "EX", "100", "FIELDS", "1", "a"},
+		{"HGETEX", "h", "PERSIST", "FIELDS", "1", "b"},
+		{"HEXPIRE", "h", "100", "FIELDS", "1", "a"},
+		{"HPEXPIREAT", "h", "1", "FIELDS", "1", "a"},
+		{"HPERSIST", "h", "FIELDS", "1", "b"},
+	}
+
+	for _, args := range tests {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			log := tempAOF(t)
+			h := New(store.New(), log)
+			r, w := startHandler(t, h)
+			for _, cmd := range setup {
+				do(t, r, w, cmd...)
+			}
+			before := dumpStore(h.store)
+
+			// Writes to a closed AOF fail.
+			log.Close()
+			if v := do(t, r, w, args...); v.Type != "error" || v.Str != aofWriteError {
+				t.Fatalf("reply = %#v, want error %q", v, aofWriteError)
+			}
+			if after := dumpStore(h.store); !maps.Equal(after, before) {
+				t.Errorf("store changed after the AOF write failed:\nbefore %q\nafter  %q", before, after)
+			}
+		})
+	}
+}
+
+// dumpStore returns the DUMP payload of every key in s, which covers values
+// and expiries but not access times.
+func dumpStore(s *store.Store) map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	dumped := make(map[string]string)
+	for k, item := range s.ItemsWithoutLock() {
+		dumped[k] = string(codec.Encode(item))
+	}
+	return dumped
+}
+
+// startHandler serves a single connection with h and returns the client side.
+func startHandler(t *testing.T, h *Handler) (*bufio.Reader, *resp.Writer) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go h.Handle(server)
+	return bufio.NewReader(client), resp.NewWriter(client)
+}
+
+// tempAOF opens an AOF backed by a temporary file that is removed after the test.
+func tempAOF(tb testing.TB) *aof.Aof {
+	tb.Helper()
+	f, err := os.CreateTemp("", "jellyfish_test_*.aof")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpName := f.Name()
+	f.Close()
+	tb.Cleanup(func() { os.Remove(tmpName) })
+
+	log, err := aof.New(tmpName)
+	if err != nil {
+		tb.Fatalf("Failed to open AOF: %v", err)
+	}
+	tb.Cleanup(func() { log.Close() })
+	return log
+}
+
+// do sends a command and reads back a single reply.
+func do(t *testing.T, r *bufio.Reader, w *resp.Writer, args ...string) respValue {
+	t.Helper()
+	if err := writeCommand(w, args...); err != nil {
+		t.Fatalf("write %v: %v", args, err)
+	}
+	v, err := readRespValue(r)
+	if err != nil {
+		t.Fatalf("read %v response: %v", args, err)
+	}
+	return v
+}
+
+func TestHandler_TMSET(t *testing.T) {
+	s := store.New()
+	r, w := startHandler(t, New(s, nil))
+
+	v := do(t, r, w, "TMSET", "a", "2", "1", "0", "b", "3", "0", "1", "0")
+	if v.Type != "integer" || v.Num != 2 {
+		t.Fatalf("TMSET response = %#v, want integer 2", v)
+	}
+	if vec, ok, _ := s.GetVector("a"); !ok || len(vec) != 2 {
+		t.Fatalf("GetVector(a) = %v, %v, want 2-dim vector", vec, ok)
+	}
+	if vec, ok, _ := s.GetVector("b"); !ok || len(vec) != 3 {
+		t.Fatalf("GetVector(b) = %v, %v, want 3-dim vector", vec, ok)
+	}
+
+	// A key repeated in the batch is counted once, and its last vector wins.
+	v = do(t, r, w, "TMSET", "d", "1", "1", "d", "2", "1", "2")
+	if v.Type != "integer" || v.Num != 1 {
+		t.Fatalf("TMSET with a repeated key = %#v, want integer 1", v)
+	}
+	if vec, ok, _ := s.GetVector("d"); !ok || len(vec) != 2 {
+		t.Fatalf("GetVector(d) = %v, %v, want the later 2-dim vector", vec, ok)
+	}
+
+	v = do(t, r, w, "TMSET", "c", "3", "1", "0")
+	if v.Type != "error" || v.Str != "ERR vector length does not match declared dimension" {
+		t.Fatalf("TMSET short vector response = %#v, want dimension error", v)
+	}
+	if _, ok, _ := s.GetVector("c"); ok {
+		t.Fatalf("GetVector(c) should not be found after failed TMSET")
+	}
+
+	v = do(t, r, w, "TMSET", "c", "x", "1")
+	if v.Type != "error" || v.Str != "ERR invalid dimension value" {
+		t.Fatalf("TMSET bad dim response = %#v, want invalid dimension error", v)
+	}
+}
+
+func TestHandler_VectorWrongType(t *testing.T) {
+	s := store.New()
+	r, w := startHandler(t, New(s, nil))
+	do(t, r, w, "SET", "str", "x")
+	do(t, r, w, "HSET", "h", "f", "v")
+
+	for _, args := range [][]string{
+		{"TGET", "str"},
+		{"TGET", "h"},
+		{"VSIMILAR", "h", "1"},
+	} {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != wrongTypeError {
+			t.Errorf("%v = %#v, want WRONGTYPE", args, v)
+		}
+	}
+	if v := do(t, r, w, "TGET", "missing"); v.Type != "null" {
+		t.Errorf("TGET missing = %#v, want null", v)
+	}
+
+	// TSET, like SET, replaces the whole value, so it overwrites a key of
+	// any type rather than failing.
+	for _, key := range []string{"str", "h"} {
+		if v := do(t, r, w, "TSET", key, "1", "2"); v.Type != "string" || v.Str != "OK" {
+			t.Errorf("TSET %s = %#v, want OK", key, v)
+		}
+		if vec, ok, typeOk := s.GetVector(key); !ok || !typeOk || !slices.Equal(vec, []float32{1, 2}) {
+			t.Errorf("GetVector(%s) = %v, %v, %v, want [1 2]", key, vec, ok, typeOk)
+		}
+	}
+}
+
+func TestHandler_HashFieldOrder(t *testing.T) {
+	h := New(store.New(), tempAOF(t))
+	r, w := startHandler(t, h)
+	do(t, r, w, "HSET", "h", "c", "3", "a", "1", "e", "5", "b", "2", "d", "4")
+	bulks := func(v respValue) []string {
+		t.Helper()
+		if v.Type != "array" {
+			t.Fatalf("reply = %#v, want array", v)
+		}
+		var out []string
+		for _, e := range v.Array {
+			out = append(out, e.Bulk)
+		}
+		return out
+	}
+
+	// Off, only the contents are fixed.
+	if got := bulks(do(t, r, w, "HKEYS", "h")); !slices.Equal(slices.Sorted(slices.Values(got)), []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("HKEYS = %v", got)
+	}
+	if got := bulks(do(t, r, w, "HVALS", "h")); !slices.Equal(slices.Sorted(slices.Values(got)), []string{"1", "2", "3", "4", "5"}) {
+		t.Errorf("HVALS = %v", got)
+	}
+	if got := bulks(do(t, r, w, "HGETALL", "h")); len(got) != 10 {
+		t.Errorf("HGETALL = %v", got)
+	}
+
+	do(t, r, w, "CONFIG", "SET", "sort-hash-fields", "yes")
+	for range 10 {
+		if got := bulks(do(t, r, w, "HKEYS", "h")); !slices.Equal(got, []string{"a", "b", "c", "d", "e"}) {
+			t.Fatalf("sorted HKEYS = %v", got)
+		}
+		if got := bulks(do(t, r, w, "HVALS", "h")); !slices.Equal(got, []string{"1", "2", "3", "4", "5"}) {
+			t.Fatalf("sorted HVALS = %v", got)
+		}
+		if got := bulks(do(t, r, w, "HGETALL", "h")); !slices.Equal(got, []string{"a", "1", "b", "2", "c", "3", "d", "4", "e", "5"}) {
+			t.Fatalf("sorted HGETALL = %v", got)
+		}
+	}
+
+	for _, cmd := range []string{"HKEYS", "HVALS", "HGETALL"} {
+		if got := bulks(do(t, r, w, cmd, "missing")); len(got) != 0 {
+			t.Errorf("%s missing = %v, want empty", cmd, got)
+		}
+	}
+	do(t, r, w, "SET", "s", "x")
+	for _, cmd := range []string{"HKEYS", "HVALS"} {
+		if v := do(t, r, w, cmd, "s"); v.Type != "error" || v.Str != wrongTypeError {
+			t.Errorf("%s on string = %#v, want WRONGTYPE", cmd, v)
+		}
+	}
+}
+
+func TestHandler_StrictSetType(t *testing.T) {
+	s := store.New()
+	h := New(s, tempAOF(t))
+	r, w := startHandler(t, h)
+	setup := func() {
+		t.Helper()
+		do(t, r, w, "SET", "str", "x")
+		do(t, r, w, "HSET", "h", "f", "v")
+		do(t, r, w, "TSET", "v", "1", "2")
+	}
+
+	do(t, r, w, "CONFIG", "SET", "strict-set-type", "yes")
+	setup()
+	size, _ := h.aof.Size()
+	for _, args := range [][]string{
+		{"SET", "h", "x"},
+		{"SET", "v", "x"},
+		{"TSET", "str", "1"},
+		{"TSET", "h", "FP16", "1"},
+		{"TMSET", "new", "1", "1", "h", "1", "1"},
+		{"HSET", "str", "f", "v"},
+	} {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != wrongTypeError {
+			t.Errorf("strict %v = %#v, want WRONGTYPE", args, v)
+		}
+	}
+	if got, _ := h.aof.Size(); got != size {
+		t.Errorf("rejected writes grew the AOF from %d to %d bytes", size, got)
+	}
+	if _, ok, _ := s.GetVector("new"); ok {
+		t.Error("TMSET stored part of a rejected batch")
+	}
+	// Writing the same type, or a new key, is still fine.
+	for _, args := range [][]string{
+		{"SET", "str", "y"},
+		{"SET", "fresh", "y"},
+		{"TSET", "v", "3", "4"},
+		{"TMSET", "v", "1", "5", "v2", "1", "6"},
+	} {
+		if v := do(t, r, w, args...); v.Type == "error" {
+			t.Errorf("strict %v = %#v, want success", args, v)
+		}
+	}
+
+	// Off, the default, SET and TSET replace a value of any type as in Redis.
+	r, w = startHandler(t, New(store.New(), nil))
+	setup()
+	for _, tt := range []struct {
+		args     []string
+		key      string
+		encoding string
+	}{
+		{[]string{"SET", "h", "x"}, "h", "raw"},
+		{[]string{"TSET", "str", "1"}, "str", "float32vector"},
+		{[]string{"TMSET", "v", "1", "1"}, "v", "float32vector"},
+		{[]string{"SET", "v", "x"}, "v", "raw"},
+	} {
+		if v := do(t, r, w, tt.args...); v.Type == "error" {
+			t.Errorf("%v = %#v, want success", tt.args, v)
+		}
+		if v := do(t, r, w, "OBJECT", "ENCODING", tt.key); v.Bulk != tt.encoding {
+			t.Errorf("OBJECT ENCODING %s after %v = %#v, want %s", tt.key, tt.args, v, tt.encoding)
+		}
+	}
+}
+
+func TestHandler_HashListpack(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+	if v := do(t, r, w, "CONFIG", "GET", "hash-max-listpack-*"); len(v.Array) != 4 || v.Array[1].Bulk != "128" || v.Array[3].Bulk != "64" {
+		t.Errorf("CONFIG GET hash-max-listpack-* = %#v, want defaults 128 and 64", v)
+	}
+	do(t, r, w, "CONFIG", "SET", "hash-max-listpack-entries", "2", "hash-max-listpack-value", "3")
+
+	for _, tt := range []struct {
+		args     []string
+		encoding string
+	}{
+		{[]string{"HSET", "h", "a", "1", "b", "2"}, "listpack"},
+		{[]string{"HSET", "h", "c", "3"}, "hashtable"},
+		{[]string{"HSET", "v", "a", "123"}, "listpack"},
+		{[]string{"HSET", "v", "a", "1234"}, "hashtable"},
+	} {
+		do(t, r, w, tt.args...)
+		if v := do(t, r, w, "OBJECT", "ENCODING", tt.args[1]); v.Bulk != tt.encoding {
+			t.Errorf("OBJECT ENCODING %s after %v = %#v, want %s", tt.args[1], tt.args, v, tt.encoding)
+		}
+	}
+	if v := do(t, r, w, "HLEN", "h"); v.Num != 3 {
+		t.Errorf("HLEN after conversion = %#v, want 3", v)
+	}
+}
+
+func TestHandler_NonFiniteVector(t *testing.T) {
+	s := store.New()
+	r, w := startHandler(t, New(s, nil))
+	do(t, r, w, "TSET", "ok", "1", "0")
+
+	const nonFinite = "ERR vector contains non-finite value"
+	for _, args := range [][]string{
+		{"TSET", "bad", "1", "NaN"},
+		{"TSET", "bad", "Inf", "0"},
+		{"TSET", "bad", "-inf", "0"},
+		{"TMSET", "ok2", "1", "1", "bad", "2", "0", "nan"},
+		{"VSEARCH", "NaN", "0", "1"},
+	} {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != nonFinite {
+			t.Errorf("%v = %#v, want %q", args, v, nonFinite)
+		}
+	}
+	// Nothing is stored, not even the valid vectors of a rejected TMSET.
+	for _, key := range []string{"bad", "ok2"} {
+		if _, ok := s.GetItem(key); ok {
+			t.Errorf("%s was created by a rejected command", key)
+		}
+	}
+	// Out of float32 range is still just an invalid float.
+	if v := do(t, r, w, "TSET", "bad", "1e39"); v.Type != "error" || v.Str != "ERR invalid float value" {
+		t.Errorf("TSET 1e39 = %#v, want invalid float value", v)
+	}
+}
+
+const benchVectors = 1000
+
+func benchVectorArgs(i int) []resp.Value {
+	return []resp.Value{
+		{Type: "bulk", Bulk: fmt.Sprintf("vec%d", i)},
+		{Type: "bulk", Bulk: "0.1"},
+		{Type: "bulk", Bulk: "0.2"},
+		{Type: "bulk", Bulk: "0.3"},
+		{Type: "bulk", Bulk: "0.4"},
+	}
+}
+
+func newBenchHandler(b *testing.B) *Handler {
+	b.Helper()
+	return New(store.New(), tempAOF(b))
+}
+
+func BenchmarkHandler_TSET(b *testing.B) {
+	h := newBenchHandler(b)
+	cmds := make([]resp.Value, benchVectors)
+	for i := range cmds {
+		cmds[i] = resp.Value{Type: "array", Array: append([]resp.Value{{Type: "bulk", Bulk: "TSET"}}, benchVectorArgs(i)...)}
+	}
+
+	b.ResetTimer()
+	for range b.N {
+		for _, cmd := range cmds {
+			h.Execute(cmd, nil)
+		}
+	}
+}
+
+func BenchmarkHandler_TMSET(b *testing.B) {
+	h := newBenchHandler(b)
+	arr := []resp.Value{{Type: "bulk", Bulk: "TMSET"}}
+	for i := range benchVectors {
+		args := benchVectorArgs(i)
+		arr = append(arr, args[0], resp.Value{Type: "bulk", Bulk: strconv.Itoa(len(args) - 1)})
+		arr = append(arr, args[1:]...)
+	}
+	cmd := resp.Value{Type: "array", Array: arr}
+
+	b.ResetTimer()
+	for range b.N {
+		h.Execute(cmd, nil)
+	}
+}
+
+func TestHandler_GetWrongType(t *testing.T) {
+	const wrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+	r, w := startHandler(t, New(store.New(), nil))
+
+	do(t, r, w, "TSET", "veckey", "1", "2")
+	do(t, r, w, "HSET", "hashkey", "f1", "v1")
+
+	for _, key := range []string{"veckey", "hashkey"} {
+		v := do(t, r, w, "GET", key)
+		if v.Type != "error" || v.Str != wrongType {
+			t.Errorf("GET %s = %#v, want WRONGTYPE error", key, v)
+		}
+	}
+
+	v := do(t, r, w, "GET", "missing")
+	if v.Type != "null" {
+		t.Errorf("GET missing = %#v, want null", v)
+	}
+}
+
+func TestHandler_ExpireFlags(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+
+	do(t, r, w, "SET", "k", "v")
+
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{args: []string{"EXPIRE", "k", "100", "XX"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"EXPIRE", "k", "100", "NX"}, want: respValue{Type: "integer", Num: 1}},
+		{args: []string{"EXPIRE", "k", "50", "GT"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"EXPIRE", "k", "50", "lt"}, want: respValue{Type: "integer", Num: 1}},
+		{args: []string{"EXPIRE", "k", "50", "NX", "XX"}, want: respValue{Type: "error", Str: "ERR NX and XX, GT or LT options at the same time are not compatible"}},
+		{args: []string{"EXPIRE", "k", "50", "GT", "LT"}, want: respValue{Type: "error", Str: "ERR GT and LT options at the same time are not compatible"}},
+		{args: []string{"EXPIRE", "k", "50", "BOGUS"}, want: respValue{Type: "error", Str: "ERR Unsupported option BOGUS"}},
+	}
+
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != tt.want.Type || v.Num != tt.want.Num || v.Str != tt.want.Str {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+
+	// Only SET and the two applied EXPIREs should have been logged.
+	var logged int
+	if err := log.Read(func(resp.Value) { logged++ }); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if logged != 3 {
+		t.Errorf("AOF contains %d commands, want 3", logged)
+	}
+}
+
+func TestHandler_Incr(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+
+	do(t, r, w, "SET", "s", "hello")
+	do(t, r, w, "HSET", "h", "f", "v")
+
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{args: []string{"INCR", "n"}, want: respValue{Type: "integer", Num: 1}},
+		{args: []string{"INCRBY", "n", "41"}, want: respValue{Type: "integer", Num: 42}},
+		{args: []string{"DECR", "n"}, want: respValue{Type: "integer", Num: 41}},
+		{args: []string{"DECRBY", "n", "-9"}, want: respValue{Type: "integer", Num: 50}},
+		{args: []string{"GET", "n"}, want: respValue{Type: "bulk", Bulk: "50"}},
+		{args: []string{"OBJECT", "ENCODING", "n"}, want: respValue{Type: "bulk", Bulk: "int"}},
+		{args: []string{"INCR", "s"}, want: respValue{Type: "error", Str: "ERR value is not an integer or out of range"}},
+		{args: []string{"INCR", "h"}, want: respValue{Type: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"}},
+		{args: []string{"INCRBY", "n", "1.5"}, want: respValue{Type: "error", Str: "ERR value is not an integer or out of range"}},
+		{args: []string{"DECRBY", "n", "-9223372036854775808"}, want: respValue{Type: "error", Str: "ERR value is not an integer or out of range"}},
+		{args: []string{"INCRBY", "n", "9223372036854775807"}, want: respValue{Type: "error", Str: "ERR increment or decrement would overflow"}},
+		{args: []string{"SET", "m", "10"}, want: respValue{Type: "string", Str: "OK"}},
+		{args: []string{"OBJECT", "ENCODING", "m"}, want: respValue{Type: "bulk", Bulk: "int"}},
+		{args: []string{"INCR", "m"}, want: respValue{Type: "integer", Num: 11}},
+	}
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != tt.want.Type || v.Num != tt.want.Num || v.Str != tt.want.Str || v.Bulk != tt.want.Bulk {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+
+	// Replaying the AOF rebuilds the counters; failed increments were not logged.
+	replayed := New(store.New(), nil)
+	if err := log.Read(func(v resp.Value) { replayed.Execute(v, nil) }); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	for key, want := range map[string]string{"n": "50", "m": "11", "s": "hello"} {
+		if got, _, _ := replayed.store.Get(key); got != want {
+			t.Errorf("replayed %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestHandler_MemoryUsage(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	do(t, r, w, "SET", "small", "x")
+	do(t, r, w, "SET", "large", strings.Repeat("x", 1001))
+	do(t, r, w, "HSET", "h", "f", "v")
+
+	small := do(t, r, w, "MEMORY", "USAGE", "small")
+	large := do(t, r, w, "MEMORY", "USAGE", "large")
+	if small.Type != "integer" || large.Num-small.Num != 1000 {
+		t.Errorf("MEMORY USAGE small = %#v, large = %#v, want large 1000 bytes larger", small, large)
+	}
+	if v := do(t, r, w, "MEMORY", "USAGE", "h", "SAMPLES", "0"); v.Type != "integer" || v.Num <= 0 {
+		t.Errorf("MEMORY USAGE h SAMPLES 0 = %#v, want a positive integer", v)
+	}
+	if v := do(t, r, w, "MEMORY", "USAGE", "missing"); v.Type != "null" {
+		t.Errorf("MEMORY USAGE missing = %#v, want null", v)
+	}
+	for _, args := range [][]string{
+		{"MEMORY", "USAGE", "h", "SAMPLES", "-1"},
+		{"MEMORY", "USAGE", "h", "COUNT", "1"},
+		{"MEMORY", "USAGE"},
+		{"MEMORY", "BOGUS"},
+	} {
+		if v := do(t, r, w, args...); v.Type != "error" {
+			t.Errorf("%v = %#v, want an error", args, v)
+		}
+	}
+}
+
+func TestHandler_MemoryStats(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+	do(t, r, w, "SET", "s", "hello")
+	do(t, r, w, "TSET", "v", "1", "2")
+	do(t, r, w, "EXPIRE", "s", "100")
+
+	v := do(t, r, w, "MEMORY", "STATS")
+	stats := make(map[string]int)
+	for i := 0; i+1 < len(v.Array); i += 2 {
+		stats[v.Array[i].Bulk] = v.Array[i+1].Num
+	}
+	usage := do(t, r, w, "MEMORY", "USAGE", "s").Num + do(t, r, w, "MEMORY", "USAGE", "v").Num
+	if stats["keys.count"] != 2 || stats["keys.with-ttl"] != 1 || stats["vector.keys"] != 1 || stats["hash.keys"] != 0 || stats["dataset.bytes"] != usage {
+		t.Errorf("MEMORY STATS = %v, want 2 keys, 1 with a TTL, 1 vector and %d bytes", stats, usage)
+	}
+
+	if v := do(t, r, w, "MEMORY", "DOCTOR"); v.Type != "bulk" || !strings.HasPrefix(v.Bulk, "No memory issues found") {
+		t.Errorf("MEMORY DOCTOR = %#v, want no issues", v)
+	}
+}
+
+func TestMemoryDoctor(t *testing.T) {
+	tests := []struct {
+		name      string
+		stats     store.MemoryStats
+		maxMemory int64
+		want      []string
+	}{
+		{name: "healthy", stats: store.MemoryStats{Keys: 5000, KeysWithTTL: 4000, Bytes: 100}, maxMemory: 1000},
+		{name: "few keys without TTL", stats: store.MemoryStats{Keys: 10, Bytes: 100}},
+		{name: "no TTL", stats: store.MemoryStats{Keys: 5000, KeysWithTTL: 100}, want: []string{"Many keys without TTL"}},
+		{
+			name:  "vectors",
+			stats: store.MemoryStats{Keys: 200000, KeysWithTTL: 200000, TypeKeys: map[uint8]int{store.TypeVector: 200000}},
+			want:  []string{"Vector count very high"},
+		},
+		{name: "maxmemory", stats: store.MemoryStats{Bytes: 950}, maxMemory: 1000, want: []string{"Memory almost full"}},
+	}
+	for _, tt := range tests {
+		got := memoryDoctor(tt.stats, tt.maxMemory)
+		if len(tt.want) == 0 && !strings.HasPrefix(got, "No memory issues found") {
+			t.Errorf("%s: memoryDoctor = %q, want no issues", tt.name, got)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: memoryDoctor = %q, want it to mention %q", tt.name, got, want)
+			}
+		}
+	}
+}
+
+func TestHandler_ConcurrentCommands(t *testing.T) {
+	h := New(store.New(), nil)
+	const workers, rounds = 8, 200
+
+	// Commands on one key, on keys of their own, and on the whole keyspace
+	// run side by side; the race detector checks the shard locking.
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			own := fmt.Sprintf("own%d", i)
+			for range rounds {
+				h.Execute(bulkCommand("INCR", "shared"), nil)
+				h.Execute(bulkCommand("INCR", own), nil)
+				h.Execute(bulkCommand("TSET", own+":v", "1", "0"), nil)
+				h.Execute(bulkCommand("VSEARCH", "1", "1", "0"), nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _, _ := h.store.Get("shared"); v != strconv.Itoa(workers*rounds) {
+		t.Errorf("shared = %s, want %d", v, workers*rounds)
+	}
+	if v, _, _ := h.store.Get("own0"); v != strconv.Itoa(rounds) {
+		t.Errorf("own0 = %s, want %d", v, rounds)
+	}
+}
+
+func TestHandler_TransactionShards(t *testing.T) {
+	h := New(store.New(), nil)
+	a, b := "a", "b"
+	for i := 0; h.store.ShardOf(a) == h.store.ShardOf(b); i++ {
+		b = fmt.Sprintf("b%d", i)
+	}
+
+	r1, w1 := startHandler(t, h)
+	r2, w2 := startHandler(t, h)
+	for _, args := range [][]string{{"MULTI"}, {"SET", a, "1"}, {"INCR", a}} {
+		do(t, r1, w1, args...)
+	}
+	for _, args := range [][]string{{"MULTI"}, {"SET", b, "1"}, {"INCR", b}} {
+		do(t, r2, w2, args...)
+	}
+
+	// While a's shard is held, as by a long transaction on it, a transaction
+	// on b still runs, and the one on a waits for the shard.
+	h.store.LockKeys([]string{a})
+	if err := writeCommand(w1, "EXEC"); err != nil {
+		t.Fatal(err)
+	}
+	execA := make(chan respValue, 1)
+	go func() {
+		v, _ := readRespValue(r1)
+		execA <- v
+	}()
+
+	if v := do(t, r2, w2, "EXEC"); len(v.Array) != 2 || v.Array[1].Num != 2 {
+		t.Errorf("EXEC on b = %#v, want [OK 2]", v)
+	}
+	select {
+	case v := <-execA:
+		t.Fatalf("EXEC on a = %#v while its shard was locked", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	h.store.UnlockKeys([]string{a})
+	select {
+	case v := <-execA:
+		if len(v.Array) != 2 || v.Array[1].Num != 2 {
+			t.Errorf("EXEC on a = %#v, want [OK 2]", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("EXEC on a did not finish after its shard was unlocked")
+	}
+}
+
+func TestHandler_Object(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	do(t, r, w, "SET", "s", "hello")
+	do(t, r, w, "TSET", "v", "1", "2")
+
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{args: []string{"OBJECT", "ENCODING", "s"}, want: respValue{Type: "bulk", Bulk: "raw"}},
+		{args: []string{"OBJECT", "encoding", "v"}, want: respValue{Type: "bulk", Bulk: "float32vector"}},
+		{args: []string{"OBJECT", "IDLETIME", "s"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"OBJECT", "REFCOUNT", "s"}, want: respValue{Type: "integer", Num: 1}},
+		{args: []string{"OBJECT", "ENCODING", "missing"}, want: respValue{Type: "error", Str: "ERR no such key"}},
+		{args: []string{"OBJECT", "BOGUS", "s"}, want: respValue{Type: "error", Str: "ERR unknown subcommand 'BOGUS'"}},
+	}
+
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != tt.want.Type || v.Num != tt.want.Num || v.Str != tt.want.Str || v.Bulk != tt.want.Bulk {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+}
+
+func TestHandler_Command(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	v := do(t, r, w, "COMMAND", "COUNT")
+	if v.Type != "integer" || v.Num != len(commandTable) {
+		t.Fatalf("COMMAND COUNT = %#v, want integer %d", v, len(commandTable))
+	}
+
+	v = do(t, r, w, "COMMAND")
+	if v.Type != "array" || len(v.Array) != len(commandTable) {
+		t.Fatalf("COMMAND = %#v, want array of %d entries", v, len(commandTable))
+	}
+	var get *respValue
+	for i, entry := range v.Array {
+		if len(entry.Array) != 6 {
+			t.Fatalf("COMMAND entry %d = %#v, want 6 elements", i, entry)
+		}
+		if entry.Array[0].Bulk == "get" {
+			get = &v.Array[i]
+		}
+	}
+	if get == nil {
+		t.Fatalf("COMMAND reply has no entry for get")
+	}
+	if get.Array[1].Num != 2 || get.Array[3].Num != 1 || get.Array[4].Num != 1 || get.Array[5].Num != 1 {
+		t.Errorf("COMMAND get entry = %#v, want arity 2 and key spec 1 1 1", *get)
+	}
+
+	v = do(t, r, w, "COMMAND", "DOCS", "get")
+	if v.Type != "array" || len(v.Array) != 2 || v.Array[0].Bulk != "get" || v.Array[1].Array[1].Bulk != commandTable["GET"].summary {
+		t.Errorf("COMMAND DOCS get = %#v, want get with its summary", v)
+	}
+
+	v = do(t, r, w, "COMMAND", "INFO", "set", "GET", "bogus")
+	if v.Type != "array" || len(v.Array) != 3 {
+		t.Fatalf("COMMAND INFO set GET bogus = %#v, want 3 entries", v)
+	}
+	for i, want := range []struct {
+		name  string
+		arity int
+		flag  string
+	}{{"set", 3, "write"}, {"get", 2, "readonly"}} {
+		entry := v.Array[i]
+		if len(entry.Array) != 6 || entry.Array[0].Bulk != want.name || entry.Array[1].Num != want.arity ||
+			entry.Array[3].Num != 1 || entry.Array[4].Num != 1 || entry.Array[5].Num != 1 {
+			t.Errorf("COMMAND INFO entry %d = %#v, want %s with arity %d and key spec 1 1 1", i, entry, want.name, want.arity)
+			continue
+		}
+		if len(entry.Array[2].Array) == 0 || entry.Array[2].Array[0].Str != want.flag {
+			t.Errorf("COMMAND INFO %s flags = %#v, want %s first", want.name, entry.Array[2], want.flag)
+		}
+	}
+	if v.Array[2].Type != "null" {
+		t.Errorf("COMMAND INFO bogus = %#v, want null", v.Array[2])
+	}
+	if v := do(t, r, w, "COMMAND", "INFO"); v.Type != "array" || len(v.Array) != len(commandTable) {
+		t.Errorf("COMMAND INFO without names = %#v, want every command", v)
+	}
+}
+
+func TestHandler_Arity(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"GET"}, want: "ERR wrong number of arguments for 'get' command"},
+		{args: []string{"GET", "a", "b"}, want: "ERR wrong number of arguments for 'get' command"},
+		{args: []string{"SET", "a"}, want: "ERR wrong number of arguments for 'set' command"},
+		{args: []string{"ECHO"}, want: "ERR wrong number of arguments for 'echo' command"},
+		{args: []string{"HSET", "h", "f"}, want: "ERR wrong number of arguments for 'hset' command"},
+		{args: []string{"HSET", "h", "f", "v", "g"}, want: "ERR wrong number of arguments for 'hset' command"},
+		{args: []string{"TSET", "v"}, want: "ERR wrong number of arguments for 'tset' command"},
+		{args: []string{"PING", "a", "b"}, want: "ERR wrong number of arguments for 'ping' command"},
+		{args: []string{"DEL"}, want: "ERR wrong number of arguments for 'del' command"},
+		{args: []string{"HGETDEL", "h", "FIELDS"}, want: "ERR wrong number of arguments for 'hgetdel' command"},
+		{args: []string{"VERSION", "x"}, want: "ERR wrong number of arguments for 'version' command"},
+		{args: []string{"WAIT", "0"}, want: "ERR wrong number of arguments for 'wait' command"},
+		{args: []string{"get"}, want: "ERR wrong number of arguments for 'get' command"},
+		{args: []string{"NOPE"}, want: "ERR unknown command 'NOPE'"},
+	}
+
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != "error" || v.Str != tt.want {
+			t.Errorf("%v = %#v, want error %q", tt.args, v, tt.want)
+		}
+	}
+}
+
+func TestCommandSpec_ValidArgc(t *testing.T) {
+	tests := []struct {
+		spec commandSpec
+		argc int
+		want bool
+	}{
+		{commandSpec{arity: 2}, 2, true},
+		{commandSpec{arity: 2}, 1, false},
+		{commandSpec{arity: 2}, 3, false},
+		{commandSpec{arity: -2}, 1, false},
+		{commandSpec{arity: -2}, 9, true},
+		{commandSpec{arity: -1, maxArity: 2}, 1, true},
+		{commandSpec{arity: -1, maxArity: 2}, 2, true},
+		{commandSpec{arity: -1, maxArity: 2}, 3, false},
+		{commandSpec{arity: -4, argGroup: 2}, 4, true},
+		{commandSpec{arity: -4, argGroup: 2}, 5, false},
+		{commandSpec{arity: -4, argGroup: 2}, 6, true},
+		{commandSpec{arity: -3, argGroup: 3}, 7, false},
+		{commandSpec{arity: -3, argGroup: 3}, 9, true},
+	}
+	for _, tt := range tests {
+		if got := tt.spec.validArgc(tt.argc); got != tt.want {
+			t.Errorf("%+v validArgc(%d) = %v, want %v", tt.spec, tt.argc, got, tt.want)
+		}
+	}
+}
+
+func TestHandler_TransactionParity(t *testing.T) {
+	setup := [][]string{
+		{"SET", "s", "hello"},
+		{"TSET", "v", "1", "0"},
+		{"HSET", "h", "f", "x"},
+	}
+
+	tests := [][]string{
+		{"PING"},
+		{"PING", "hello"},
+		{"PING", "a", "b"},
+		{"ECHO", "hi"},
+		{"VERSION"},
+		{"SET", "k", "v"},
+		{"GET", "s"},
+		{"GET", "h"},
+		{"GETEX", "s", "EX", "100"},
+		{"GETEX", "h"},
+		{"GETDEL", "h"},
+		{"GETDEL", "missing"},
+		{"SETBIT", "s", "3", "1"},
+		{"INCR", "n"},
+		{"INCR", "s"},
+		{"DECR", "h"},
+		{"INCRBY", "n", "5"},
+		{"INCRBY", "n", "x"},
+		{"DECRBY", "n", "5"},
+		{"GETBIT", "s", "1"},
+		{"BITCOUNT", "s"},
+		{"DEL", "s"},
+		{"UNLINK", "s", "v"},
+		{"TOUCH", "s", "v", "missing"},
+		{"EXPIRE", "s", "100"},
+		{"DUMP", "h"},
+		{"RESTORE", "s", "0", "garbage"},
+		{"MIGRATE", "127.0.0.1", "1", "missing", "0", "100"},
+		{"EXPIREAT", "s", "99999999999"},
+		{"EXPIREAT", "s", "1"},
+		{"PEXPIREAT", "s", "99999999999999"},
+		{"PERSIST", "s"},
+		{"TTL", "s"},
+		{"EXPIRETIME", "s"},
+		{"PEXPIRETIME", "s"},
+		{"TSET", "w", "1", "2"},
+		{"TMSET", "a", "1", "1", "b", "1", "2"},
+		{"TGET", "v"},
+		{"TGET", "v", "META"},
+		{"VSEARCH", "1", "0", "1"},
+		{"VSIMILAR", "v", "1"},
+		{"HSET", "h", "g", "y"},
+		{"HGET", "h", "f"},
+		{"HDEL", "h", "f"},
+		{"HGETALL", "h"},
+		{"HKEYS", "h"},
+		{"HVALS", "h"},
+		{"HEXISTS", "h", "f"},
+		{"HLEN", "h"},
+		{"HRANDFIELD", "h"},
+		{"HSCAN", "h", "0"},
+		{"SCAN", "0", "MATCH", "s", "COUNT", "100"},
+		{"HGETDEL", "h", "FIELDS", "2", "f", "nope"},
+		{"HGETEX", "h", "EX", "100", "FIELDS", "1", "f"},
+		{"HEXPIRE", "h", "100", "FIELDS", "2", "f", "nope"},
+		{"HPEXPIREAT", "h", "1", "FIELDS", "1", "f"},
+		{"HTTL", "h", "FIELDS", "1", "f"},
+		{"HPERSIST", "h", "FIELDS", "1", "f"},
+		{"OBJECT", "ENCODING", "s"},
+		{"MEMORY", "USAGE", "h", "SAMPLES", "0"},
+		{"MEMORY", "STATS"},
+		{"COMMAND", "COUNT"},
+		{"REPLICAOF", "NO", "ONE"},
+		{"CONFIG", "GET", "timeout"},
+		{"DEBUG", "OBJECT", "h"},
+		{"INFO", "nosuchsection"},
+		{"BGREWRITEAOF"},
+		{"AUTH", "anything"},
+		{"AUTH", "nobody", "x"},
+		{"CLIENT", "ID"},
+		{"CLIENT", "NOPE"},
+		{"CLIENT"},
+		{"ACL", "WHOAMI"},
+		{"WAIT", "0", "0"},
+		{"WAIT", "x", "0"},
+		{"WAITAOF", "0", "0", "0"},
+		{"VSCAN", "0"},
+		{"FLUSHALL"},
+		{"DELIFEQ", "s", "hello"},
+		{"DELIFEQ", "s", "other"},
+		{"DELIFEQ", "h", "x"},
+		{"SETIFEQ", "s", "hello", "world"},
+		{"SETIFEQ", "s", "other", "world"},
+		{"SETIFEQ", "new", "v"},
+		{"SETIFEQ", "h", "x", "y"},
+		{"FLUSHALL", "nope"},
+		{"WAITAOF", "1", "0", "0"},
+		{"REPLCONF", "ACK", "0"},
+		{"GET"},
+		{"NOPE"},
+	}
+
+	covered := make(map[string]bool)
+	for _, args := range tests {
+		covered[strings.ToUpper(args[0])] = true
+	}
+	for name := range commandTable {
+		if !covered[name] && !notQueued[name] {
+			t.Errorf("command %s has no transaction parity case", name)
+		}
+	}
+
+	for _, args := range tests {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			r, w := startHandler(t, New(store.New(), nil))
+			for _, cmd := range setup {
+				do(t, r, w, cmd...)
+			}
+			immediate := do(t, r, w, args...)
+
+			r, w = startHandler(t, New(store.New(), nil))
+			for _, cmd := range setup {
+				do(t, r, w, cmd...)
+			}
+			do(t, r, w, "MULTI")
+			do(t, r, w, args...)
+			v := do(t, r, w, "EXEC")
+			if v.Type != "array" || len(v.Array) != 1 {
+				t.Fatalf("EXEC = %#v, want array of 1 reply", v)
+			}
+
+			if fmt.Sprintf("%#v", v.Array[0]) != fmt.Sprintf("%#v", immediate) {
+				t.Errorf("MULTI reply = %#v, immediate reply = %#v", v.Array[0], immediate)
+			}
+		})
+	}
+}
+
+func TestHandler_EmptyTransaction(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+	do(t, r, w, "MULTI")
+	if v := do(t, r, w, "EXEC"); v.Type != "array" || len(v.Array) != 0 {
+		t.Fatalf("EXEC = %#v, want empty array", v)
+	}
+	if v := do(t, r, w, "SET", "k", "v"); v.Str != "OK" {
+		t.Fatalf("SET after empty EXEC = %#v", v)
+	}
+}
+
+// notQueued lists the commands that handleCommand runs or rejects straight
+// away inside MULTI instead of queueing them.
+var notQueued = map[string]bool{"MULTI": true, "EXEC": true, "DISCARD": true, "RESET": true, "MONITOR": true, "SYNC": true}
+
+// TestHandler_TransactionCoversRegistry queues every command in the table,
+// with placeholder arguments, and checks that none of them reaches EXEC as an
+// unknown command or one that only works outside a transaction.
+func TestHandler_TransactionCoversRegistry(t *testing.T) {
+	for _, name := range commandNames() {
+		spec := commandTable[name]
+		args := []string{name}
+		for range max(spec.arity, -spec.arity) - 1 {
+			args = append(args, "x")
+		}
+
+		t.Run(name, func(t *testing.T) {
+			r, w := startHandler(t, New(store.New(), nil))
+			immediate := respValue{}
+			if !notQueued[name] {
+				immediate = do(t, r, w, args...)
+			}
+
+			r, w = startHandler(t, New(store.New(), nil))
+			do(t, r, w, "MULTI")
+			queued := do(t, r, w, args...)
+			if notQueued[name] {
+				if queued.Type == "error" && strings.HasPrefix(queued.Str, "ERR unknown command") {
+					t.Errorf("%v in MULTI = %#v", args, queued)
+				}
+				return
+			}
+			if queued.Type != "string" || queued.Str != "QUEUED" {
+				t.Fatalf("%v in MULTI = %#v, want QUEUED", args, queued)
+			}
+			v := do(t, r, w, "EXEC")
+			if v.Type != "array" || len(v.Array) != 1 {
+				t.Fatalf("EXEC = %#v, want array of 1 reply", v)
+			}
+			got := v.Array[0]
+			if got.Type == "error" && strings.HasPrefix(got.Str, "ERR unknown command") {
+				t.Errorf("%v in EXEC = %#v", args, got)
+			}
+			if got.Type == "error" && strings.HasSuffix(got.Str, "is not allowed in this context") && got.Str != immediate.Str {
+				t.Errorf("%v in EXEC = %#v, but outside MULTI = %#v", args, got, immediate)
+			}
+		})
+	}
+}
+
+func TestHandler_VSearchInTransaction(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	do(t, r, w, "TSET", "far", "0", "1")
+	do(t, r, w, "MULTI")
+	for _, cmd := range [][]string{
+		{"TSET", "near", "1", "0.1"},
+		{"TSET", "exact", "1", "0"},
+		{"VSEARCH", "1", "0", "3"},
+	} {
+		if v := do(t, r, w, cmd...); v.Type != "string" || v.Str != "QUEUED" {
+			t.Fatalf("%v = %#v, want QUEUED", cmd, v)
+		}
+	}
+
+	v := do(t, r, w, "EXEC")
+	if v.Type != "array" || len(v.Array) != 3 {
+		t.Fatalf("EXEC = %#v, want array of 3 replies", v)
+	}
+	got := v.Array[2]
+	want := []string{"exact", "near", "far"}
+	if got.Type != "array" || len(got.Array) != len(want) {
+		t.Fatalf("VSEARCH reply = %#v, want %v", got, want)
+	}
+	for i, key := range want {
+		if got.Array[i].Bulk != key {
+			t.Errorf("VSEARCH result[%d] = %q, want %q", i, got.Array[i].Bulk, key)
+		}
+	}
+}
+
+// serveTCP runs h on a loopback TCP listener and returns its address.
+func serveTCP(t *testing.T, h *Handler) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go h.Handle(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// eventually polls cond until it returns true or the deadline passes.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandler_Replication(t *testing.T) {
+	masterStore := store.New()
+	master := New(masterStore, nil)
+	addr := serveTCP(t, master)
+	host, port, _ := net.SplitHostPort(addr)
+
+	mr, mw := startHandler(t, master)
+	do(t, mr, mw, "SET", "before", "1")
+	do(t, mr, mw, "HSET", "h", "f", "v")
+	do(t, mr, mw, "EXPIRE", "h", "100")
+	// Sub-second expiries survive the full sync unrounded.
+	expiresAt := strconv.FormatInt(time.Now().Add(time.Hour+123*time.Millisecond).UnixMilli(), 10)
+	do(t, mr, mw, "SET", "precise", "1")
+	do(t, mr, mw, "PEXPIREAT", "precise", expiresAt)
+
+	replicaStore := store.New()
+	replicaStore.Set("stale", "x")
+	replica := New(replicaStore, nil)
+	rr, rw := startHandler(t, replica)
+
+	if v := do(t, rr, rw, "REPLICAOF", host, port); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("REPLICAOF = %#v, want OK", v)
+	}
+
+	eventually(t, "full sync", func() bool {
+		val, found, _ := replicaStore.Get("before")
+		return found && val == "1"
+	})
+	if _, found, _ := replicaStore.HGet("h", "f"); !found {
+		t.Errorf("hash not replicated by full sync")
+	}
+	if ttl := replicaStore.TTL("h"); ttl <= 0 {
+		t.Errorf("replicated TTL = %d, want > 0", ttl)
+	}
+	if at := replicaStore.ExpireTime("precise"); strconv.FormatInt(at, 10) != expiresAt {
+		t.Errorf("replicated expiry = %d, want %s", at, expiresAt)
+	}
+	if _, found, _ := replicaStore.Get("stale"); found {
+		t.Errorf("full sync should discard the replica's previous data")
+	}
+
+	// Writes after the sync are streamed.
+	do(t, mr, mw, "SET", "after", "2")
+	do(t, mr, mw, "DEL", "before")
+	eventually(t, "streamed writes", func() bool {
+		_, afterFound, _ := replicaStore.Get("after")
+		_, beforeFound, _ := replicaStore.Get("before")
+		return afterFound && !beforeFound
+	})
+
+	// Replicas reject writes from normal clients but still serve reads.
+	if v := do(t, rr, rw, "SET", "x", "1"); v.Type != "error" || v.Str != readOnlyError {
+		t.Errorf("SET on replica = %#v, want READONLY error", v)
+	}
+	if v := do(t, rr, rw, "GET", "after"); v.Type != "bulk" || v.Bulk != "2" {
+		t.Errorf("GET on replica = %#v, want bulk 2", v)
+	}
+
+	// Promoting the replica stops the stream and re-enables writes.
+	if v := do(t, rr, rw, "REPLICAOF", "NO", "ONE"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("REPLICAOF NO ONE = %#v, want OK", v)
+	}
+	if v := do(t, rr, rw, "SET", "x", "1"); v.Type != "string" || v.Str != "OK" {
+		t.Errorf("SET after promotion = %#v, want OK", v)
+	}
+}
+
+func TestHandler_ReplicaRestart(t *testing.T) {
+	master := New(store.New(), nil)
+	addr := serveTCP(t, master)
+	host, port, _ := net.SplitHostPort(addr)
+	mr, mw := startHandler(t, master)
+	do(t, mr, mw, "SET", "kept", "1")
+
+	// The replica's AOF holds a key the master doesn't have.
+	log := tempAOF(t)
+	replica := New(store.New(), log)
+	rr, rw := startHandler(t, replica)
+	do(t, rr, rw, "CONFIG", "SET", "aof-rewrite-on-flushall", "no")
+	do(t, rr, rw, "SET", "deleted", "x")
+	do(t, rr, rw, "REPLICAOF", host, port)
+	eventually(t, "full sync", func() bool {
+		_, found, _ := replica.store.Get("kept")
+		return found
+	})
+	do(t, rr, rw, "REPLICAOF", "NO", "ONE")
+
+	// Restarting the replica replays its AOF without bringing the key back.
+	restarted := New(store.New(), nil)
+	if err := log.Read(func(v resp.Value) { restarted.Execute(v, nil) }); err != nil {
+		t.Fatalf("reading the replica's AOF: %v", err)
+	}
+	if _, found, _ := restarted.store.Get("deleted"); found {
+		t.Errorf("key flushed by the full sync came back after a restart")
+	}
+	if v, found, _ := restarted.store.Get("kept"); !found || v != "1" {
+		t.Errorf("kept after a restart = %q, %v; want 1", v, found)
+	}
+}
+
+func TestHandler_Wait(t *testing.T) {
+	master := New(store.New(), nil)
+	addr := serveTCP(t, master)
+	host, port, _ := net.SplitHostPort(addr)
+	mr, mw := startHandler(t, master)
+
+	// With no replicas and no writes the condition is trivially met.
+	if v := do(t, mr, mw, "WAIT", "0", "0"); v.Type != "integer" || v.Num != 0 {
+		t.Fatalf("WAIT 0 0 = %#v, want 0", v)
+	}
+
+	replicaStore := store.New()
+	replica := New(replicaStore, nil)
+	rr, rw := startHandler(t, replica)
+	do(t, rr, rw, "REPLICAOF", host, port)
+
+	eventually(t, "replica attached", func() bool {
+		n, _ := master.repl.countAcked(0)
+		return n == 1
+	})
+
+	do(t, mr, mw, "SET", "k", "v")
+	if v := do(t, mr, mw, "WAIT", "1", "2000"); v.Type != "integer" || v.Num != 1 {
+		t.Fatalf("WAIT 1 2000 = %#v, want 1", v)
+	}
+	if _, found, _ := replicaStore.Get("k"); !found {
+		t.Errorf("WAIT returned before the replica applied the write")
+	}
+
+	// Asking for more replicas than exist waits out the timeout.
+	start := time.Now()
+	if v := do(t, mr, mw, "WAIT", "2", "100"); v.Type != "integer" || v.Num != 1 {
+		t.Fatalf("WAIT 2 100 = %#v, want 1", v)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("WAIT 2 100 returned after %v, want at least the timeout", elapsed)
+	}
+
+	if v := do(t, mr, mw, "WAIT", "1", "-1"); v.Type != "error" {
+		t.Errorf("WAIT with negative timeout = %#v, want error", v)
+	}
+	if v := do(t, rr, rw, "WAIT", "0", "0"); v.Type != "error" {
+		t.Errorf("WAIT on replica = %#v, want error", v)
+	}
+	do(t, rr, rw, "REPLICAOF", "NO", "ONE")
+}
+
+func TestHandler_WaitAOF(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+
+	waitAOF := func(args ...string) (local, replicas int) {
+		t.Helper()
+		v := do(t, r, w, append([]string{"WAITAOF"}, args...)...)
+		if v.Type != "array" || len(v.Array) != 2 {
+			t.Fatalf("WAITAOF %v = %#v, want array of 2", args, v)
+		}
+		return v.Array[0].Num, v.Array[1].Num
+	}
+
+	// Under always every write is synced before its reply.
+	log.SetFsync(aof.FsyncAlways)
+	do(t, r, w, "SET", "k", "v")
+	if local, replicas := waitAOF("1", "0", "0"); local != 1 || replicas != 0 {
+		t.Errorf("WAITAOF under always = [%d %d], want [1 0]", local, replicas)
+	}
+
+	// Under everysec the write waits for the background sync.
+	log.SetFsync(aof.FsyncEverySec)
+	do(t, r, w, "SET", "k", "v2")
+	do(t, r, w, "MULTI")
+	do(t, r, w, "WAITAOF", "1", "0", "0")
+	if v := do(t, r, w, "EXEC"); len(v.Array) != 1 || v.Array[0].Type != "array" || v.Array[0].Array[0].Num != 0 {
+		t.Errorf("queued WAITAOF before the sync = %#v, want [0 0] without blocking", v)
+	}
+	start := time.Now()
+	if local, _ := waitAOF("1", "0", "3000"); local != 1 {
+		t.Errorf("WAITAOF under everysec = %d local, want 1", local)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("WAITAOF under everysec took %v, want about a second at most", elapsed)
+	}
+
+	// Asking for a replica that doesn't exist waits out the timeout.
+	start = time.Now()
+	if local, replicas := waitAOF("1", "1", "100"); local != 1 || replicas != 0 {
+		t.Errorf("WAITAOF 1 1 100 = [%d %d], want [1 0]", local, replicas)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("WAITAOF 1 1 100 returned after %v, want at least the timeout", elapsed)
+	}
+
+	if v := do(t, r, w, "WAITAOF", "1", "0", "-1"); v.Str != "ERR timeout is negative" {
+		t.Errorf("WAITAOF with negative timeout = %#v", v)
+	}
+
+	nr, nw := startHandler(t, New(store.New(), nil))
+	if v := do(t, nr, nw, "WAITAOF", "1", "0", "0"); v.Str != "ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled." {
+		t.Errorf("WAITAOF numlocal without an AOF = %#v", v)
+	}
+	if v := do(t, nr, nw, "WAITAOF", "0", "0", "0"); v.Type != "array" || v.Array[0].Num != 0 {
+		t.Errorf("WAITAOF 0 0 0 without an AOF = %#v, want [0 0]", v)
+	}
+}
+
+func TestHandler_Config(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+
+	v := do(t, r, w, "CONFIG", "GET", "time*")
+	if v.Type != "array" || len(v.Array) != 2 || v.Array[0].Bulk != "timeout" || v.Array[1].Bulk != "0" {
+		t.Fatalf("CONFIG GET time* = %#v, want [timeout 0]", v)
+	}
+	if v := do(t, r, w, "CONFIG", "SET", "timeout", "30"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("CONFIG SET timeout 30 = %#v, want OK", v)
+	}
+	if got := h.config.idleTimeout(); got != 30*time.Second {
+		t.Errorf("idleTimeout() = %v, want 30s", got)
+	}
+
+	errCases := [][]string{
+		{"CONFIG", "SET", "timeout", "-1"},
+		{"CONFIG", "SET", "timeout", "abc"},
+		{"CONFIG", "SET", "nope", "1"},
+		{"CONFIG", "SET", "timeout"},
+		{"CONFIG", "GET"},
+		{"CONFIG", "NOPE"},
+	}
+	for _, args := range errCases {
+		if v := do(t, r, w, args...); v.Type != "error" {
+			t.Errorf("%v = %#v, want error", args, v)
+		}
+	}
+
+	// A bad value later in the list leaves the earlier ones unapplied.
+	if v := do(t, r, w, "CONFIG", "SET", "timeout", "5", "maxclients", "bogus"); v.Type != "error" {
+		t.Fatalf("CONFIG SET timeout 5 maxclients bogus = %#v, want error", v)
+	}
+	if got := h.config.idleTimeout(); got != 30*time.Second {
+		t.Errorf("idleTimeout() after failed CONFIG SET = %v, want 30s", got)
+	}
+}
+
+func TestHandler_IdleTimeout(t *testing.T) {
+	h := New(store.New(), nil)
+	h.config.timeout.Store(1)
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		h.Handle(server)
+		close(done)
+	}()
+
+	// The connection is still usable before the deadline.
+	r, w := bufio.NewReader(client), resp.NewWriter(client)
+	if v := do(t, r, w, "PING"); v.Str != "PONG" {
+		t.Fatalf("PING = %#v, want PONG", v)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle connection was not closed after the timeout")
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("read after idle close = %v, want io.EOF", err)
+	}
+}
+
+func TestHandler_ProtoMaxBulkLen(t *testing.T) {
+	h := New(store.New(), nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	go h.Handle(server)
+	r, w := bufio.NewReader(client), resp.NewWriter(client)
+
+	if v := do(t, r, w, "CONFIG", "SET", "proto-max-bulk-len", "16"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("CONFIG SET proto-max-bulk-len = %#v, want OK", v)
+	}
+	if v := do(t, r, w, "SET", "k", "sixteen-bytes!!!"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("SET at the limit = %#v, want OK", v)
+	}
+
+	// An oversized declared length is rejected before anything is allocated.
+	go client.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1000000000\r\n"))
+	v, err := readRespValue(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if v.Type != "error" || v.Str != "ERR Protocol error: invalid bulk length" {
+		t.Fatalf("oversized bulk = %#v, want protocol error", v)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("read after protocol error = %v, want io.EOF", err)
+	}
+}
+
+func TestHandler_NestedRequest(t *testing.T) {
+	h := New(store.New(), nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	go h.Handle(server)
+	r := bufio.NewReader(client)
+
+	// A command can't contain arrays, so a nested header is refused as soon
+	// as it is read, however large it claims to be.
+	go client.Write([]byte("*1048576\r\n*1048576\r\n*1048576\r\n"))
+	v, err := readRespValue(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if v.Type != "error" || v.Str != "ERR Protocol error: nested arrays not allowed" {
+		t.Fatalf("nested request = %#v, want protocol error", v)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("read after protocol error = %v, want io.EOF", err)
+	}
+}
+
+func TestHandler_Monitor(t *testing.T) {
+	h := New(store.New(), nil)
+	mr, mw := startHandler(t, h)
+	cr, cw := startHandler(t, h)
+
+	if v := do(t, mr, mw, "MONITOR"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("MONITOR = %#v, want OK", v)
+	}
+
+	do(t, cr, cw, "SET", "key", "a \"b\"\n")
+	do(t, cr, cw, "GET", "key")
+	do(t, cr, cw, "AUTH", "default", "secret")
+
+	wants := []string{
+		`[0 pipe] "SET" "key" "a \"b\"\n"`,
+		`[0 pipe] "GET" "key"`,
+		`[0 pipe] "AUTH" "(redacted)" "(redacted)"`,
+	}
+	for _, want := range wants {
+		v, err := readRespValue(mr)
+		if err != nil {
+			t.Fatalf("read monitor line: %v", err)
+		}
+		if v.Type != "string" || !strings.HasSuffix(v.Str, want) {
+			t.Errorf("monitor line = %q, want suffix %q", v.Str, want)
+		}
+	}
+
+	// The monitoring connection no longer runs commands.
+	if err := writeCommand(mw, "SET", "other", "1"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, found, _ := h.store.Get("other"); found {
+		t.Errorf("monitor connection executed a command")
+	}
+}
+
+func TestHandler_ACL(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+	do(t, r, w, "SET", "k", "v")
+
+	if v := do(t, r, w, "ACL", "SETUSER", "reader", "on", ">secret", "+@read", "-object", "+multi", "+exec", "+reset"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("ACL SETUSER = %#v, want OK", v)
+	}
+	if v := do(t, r, w, "AUTH", "reader", "wrong"); v.Type != "error" || !strings.HasPrefix(v.Str, "WRONGPASS") {
+		t.Errorf("AUTH with a wrong password = %#v, want WRONGPASS", v)
+	}
+	if v := do(t, r, w, "AUTH", "reader", "secret"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("AUTH reader = %#v, want OK", v)
+	}
+
+	if v := do(t, r, w, "GET", "k"); v.Type != "bulk" || v.Bulk != "v" {
+		t.Errorf("GET as reader = %#v, want v", v)
+	}
+	for _, args := range [][]string{{"DEL", "k"}, {"OBJECT", "ENCODING", "k"}, {"ACL", "WHOAMI"}} {
+		want := fmt.Sprintf("NOPERM User reader has no permissions to run the '%s' command", strings.ToLower(args[0]))
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v as reader = %#v, want %q", args, v, want)
+		}
+	}
+	if _, found, _ := h.store.Get("k"); !found {
+		t.Error("DEL ran without permission")
+	}
+
+	// A forbidden command aborts the transaction it was queued in.
+	do(t, r, w, "MULTI")
+	do(t, r, w, "GET", "k")
+	do(t, r, w, "SET", "k", "x")
+	if v := do(t, r, w, "EXEC"); v.Type != "error" || !strings.HasPrefix(v.Str, "EXECABORT") {
+		t.Errorf("EXEC after a forbidden command = %#v, want EXECABORT", v)
+	}
+
+	// RESET goes back to the default user.
+	do(t, r, w, "RESET")
+	if v := do(t, r, w, "ACL", "WHOAMI"); v.Bulk != "default" {
+		t.Errorf("ACL WHOAMI after RESET = %#v, want default", v)
+	}
+	v := do(t, r, w, "ACL", "LIST")
+	want := []string{"user default on nopass +@all", "user reader on #2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}
+	if len(v.Array) != 2 || v.Array[0].Bulk != want[0] || !strings.HasPrefix(v.Array[1].Bulk, want[1]+" -@all ") || strings.Contains(v.Array[1].Bulk, "+object") {
+		t.Errorf("ACL LIST = %#v, want %q", v, want)
+	}
+
+	errs := map[string][]string{
+		"ERR Error in ACL SETUSER modifier '+nope': Unknown command or category name in ACL": {"ACL", "SETUSER", "reader", "off", "+nope"},
+		"ERR Error in ACL SETUSER modifier 'bogus': Syntax error":                            {"ACL", "SETUSER", "x", "bogus"},
+	}
+	for want, args := range errs {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v = %#v, want %q", args, v, want)
+		}
+	}
+	// A failed SETUSER changes nothing.
+	if v := do(t, r, w, "AUTH", "reader", "secret"); v.Type != "string" {
+		t.Errorf("AUTH after a rejected SETUSER = %#v, want OK", v)
+	}
+}
+
+func TestHandler_ClientKill(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+	r2, w2 := startHandler(t, h)
+	r3, w3 := startHandler(t, h)
+	id2 := do(t, r2, w2, "CLIENT", "ID").Num
+	do(t, r3, w3, "CLIENT", "ID")
+	if v := do(t, r, w, "CLIENT", "LIST"); strings.Count(v.Bulk, "\n") != 3 || !strings.Contains(v.Bulk, fmt.Sprintf("id=%d addr=pipe", id2)) {
+		t.Errorf("CLIENT LIST = %q, want three clients", v.Bulk)
+	}
+
+	if v := do(t, r, w, "CLIENT", "KILL", "ID", strconv.Itoa(id2)); v.Type != "integer" || v.Num != 1 {
+		t.Fatalf("CLIENT KILL ID = %#v, want 1", v)
+	}
+	if _, err := readRespValue(r2); err == nil {
+		t.Error("killed connection is still open")
+	}
+	if v := do(t, r, w, "CLIENT", "KILL", "ID", strconv.Itoa(id2)); v.Num != 0 {
+		t.Errorf("second CLIENT KILL ID = %#v, want 0", v)
+	}
+
+	// Every test connection has the address "pipe"; SKIPME spares the caller.
+	if v := do(t, r, w, "CLIENT", "KILL", "ADDR", "pipe"); v.Num != 1 {
+		t.Errorf("CLIENT KILL ADDR pipe = %#v, want 1", v)
+	}
+	if _, err := readRespValue(r3); err == nil {
+		t.Error("connection killed by address is still open")
+	}
+	if v := do(t, r, w, "CLIENT", "KILL", "10.0.0.1:1234"); v.Type != "error" || v.Str != "ERR No such client" {
+		t.Errorf("CLIENT KILL of an unknown address = %#v, want No such client", v)
+	}
+	if v := do(t, r, w, "CLIENT", "LIST"); strings.Count(v.Bulk, "\n") != 1 {
+		t.Errorf("CLIENT LIST after kills = %q, want only the caller", v.Bulk)
+	}
+}
+
+func TestHandler_ClientIdleReaper(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+	idle, idleW := startHandler(t, h)
+	monitor, monitorW := startHandler(t, h)
+	do(t, idle, idleW, "PING")
+	if v := do(t, monitor, monitorW, "MONITOR"); v.Str != "OK" {
+		t.Fatalf("MONITOR = %#v", v)
+	}
+
+	do(t, r, w, "CONFIG", "SET", "client-idle-limit", "1")
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if v := do(t, r, w, "PING"); v.Str != "PONG" {
+			t.Fatalf("PING from an active client = %#v", v)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := readRespValue(idle); err == nil {
+		t.Error("idle connection is still open")
+	}
+	v := do(t, r, w, "CLIENT", "LIST")
+	if strings.Count(v.Bulk, "\n") != 2 || !strings.Contains(v.Bulk, " idle=0 ") {
+		t.Errorf("CLIENT LIST = %q, want the active client and the monitor", v.Bulk)
+	}
+	if _, err := readRespValue(monitor); err != nil {
+		t.Errorf("monitor link was reaped: %v", err)
+	}
+}
+
+func TestHandler_MaxClients(t *testing.T) {
+	h := New(store.New(), nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	go h.Handle(server)
+	r, w := bufio.NewReader(client), resp.NewWriter(client)
+	if v := do(t, r, w, "CONFIG", "SET", "maxclients", "1"); v.Str != "OK" {
+		t.Fatalf("CONFIG SET maxclients = %#v", v)
+	}
+
+	refused, _ := startHandler(t, h)
+	if v, err := readRespValue(refused); err != nil || v.Type != "error" || v.Str != maxClientsError {
+		t.Fatalf("second connection got %#v, %v; want %q", v, err, maxClientsError)
+	}
+	if _, err := readRespValue(refused); err == nil {
+		t.Error("refused connection is still open")
+	}
+	if v := do(t, r, w, "PING"); v.Str != "PONG" {
+		t.Errorf("PING from the first client = %#v", v)
+	}
+
+	// Once the first client leaves, its slot is free again.
+	client.Close()
+	for deadline := time.Now().Add(time.Second); h.connected.Load() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still counted after both closed", h.connected.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r, w = startHandler(t, h)
+	if v := do(t, r, w, "PING"); v.Str != "PONG" {
+		t.Errorf("PING after the first client left = %#v", v)
+	}
+}
+
+func TestHandler_ClientNoTouch(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+	do(t, r, w, "SET", "k", "v")
+	do(t, r, w, "HSET", "h", "f", "v")
+	freq := func(key string) int {
+		t.Helper()
+		return do(t, r, w, "OBJECT", "FREQ", key).Num
+	}
+	start := freq("k")
+
+	if v := do(t, r, w, "CLIENT", "NO-TOUCH", "on"); v.Str != "OK" {
+		t.Fatalf("CLIENT NO-TOUCH on = %#v", v)
+	}
+	if v := do(t, r, w, "CLIENT", "LIST"); !strings.Contains(v.Bulk, "no-touch=on") {
+		t.Errorf("CLIENT LIST = %q, want no-touch=on", v.Bulk)
+	}
+	for range 20 {
+		do(t, r, w, "GET", "k")
+	}
+	do(t, r, w, "MULTI")
+	do(t, r, w, "GET", "k")
+	do(t, r, w, "HGET", "h", "f")
+	do(t, r, w, "EXEC")
+	if got := freq("k"); got != start {
+		t.Errorf("OBJECT FREQ after no-touch reads = %d, want %d", got, start)
+	}
+	if got := freq("h"); got != start {
+		t.Errorf("OBJECT FREQ of hash after no-touch read = %d, want %d", got, start)
+	}
+
+	// TOUCH still counts, and so do other clients' reads.
+	do(t, r, w, "TOUCH", "k")
+	if got := freq("k"); got == start {
+		t.Error("TOUCH in no-touch mode didn't count as an access")
+	}
+	r2, w2 := startHandler(t, h)
+	do(t, r2, w2, "HGET", "h", "f")
+	if got := freq("h"); got == start {
+		t.Error("read by another client didn't count as an access")
+	}
+
+	do(t, r, w, "CLIENT", "NO-TOUCH", "off")
+	do(t, r, w, "SET", "j", "v")
+	do(t, r, w, "GET", "j")
+	if got := freq("j"); got == start {
+		t.Error("read after CLIENT NO-TOUCH off didn't count as an access")
+	}
+	if v := do(t, r, w, "CLIENT", "NO-TOUCH", "maybe"); v.Type != "error" {
+		t.Errorf("CLIENT NO-TOUCH maybe = %#v, want an error", v)
+	}
+}
+
+func TestHandler_ClientOutputBufferLimit(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+	do(t, r, w, "CONFIG", "SET", "client-output-buffer-limit", "1kb")
+	payload := strings.Repeat("x", 100)
+
+	// A client that exempts itself can leave its replies unread.
+	do(t, r, w, "CLIENT", "NO-EVICT", "on")
+	for i := 0; i < 50; i++ {
+		if err := writeCommand(w, "ECHO", payload); err != nil {
+			t.Fatalf("write with NO-EVICT on: %v", err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if v, err := readRespValue(r); err != nil || v.Bulk != payload {
+			t.Fatalf("reply %d with NO-EVICT on = %#v, %v", i, v, err)
+		}
+	}
+
+	// A client that stops reading is disconnected once its unsent replies
+	// pass the limit.
+	r2, w2 := startHandler(t, h)
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		err = writeCommand(w2, "ECHO", payload)
+	}
+	if err == nil {
+		t.Fatal("stalled client was not disconnected")
+	}
+	if _, err := readRespValue(r2); err == nil {
+		t.Error("stalled client can still read after being disconnected")
+	}
+}
+
+func TestHandler_Help(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	tests := map[string]string{
+		"OBJECT":  "ENCODING <key>",
+		"CLIENT":  "NO-EVICT (ON|OFF)",
+		"CONFIG":  "RESETSTAT",
+		"ACL":     "WHOAMI",
+		"DEBUG":   "OBJECT <key>",
+		"MEMORY":  "STATS",
+		"COMMAND": "COUNT",
+	}
+	for command, sub := range tests {
+		v := do(t, r, w, command, "help")
+		if v.Type != "array" || len(v.Array) < 4 {
+			t.Errorf("%s HELP = %#v, want an array of lines", command, v)
+			continue
+		}
+		lines := make([]string, len(v.Array))
+		for i, line := range v.Array {
+			lines[i] = line.Bulk
+		}
+		if !strings.HasPrefix(lines[0], command+" <subcommand>") {
+			t.Errorf("%s HELP starts with %q", command, lines[0])
+		}
+		if i := slices.Index(lines, sub); i < 0 || !strings.HasPrefix(lines[i+1], "    ") {
+			t.Errorf("%s HELP = %q, want %q followed by its description", command, lines, sub)
+		}
+		if lines[len(lines)-2] != "HELP" {
+			t.Errorf("%s HELP does not end with HELP itself: %q", command, lines)
+		}
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	tests := map[string]string{
+		"plain":    `"plain"`,
+		`a"b\c`:    `"a\"b\\c"`,
+		"\r\n\t":   `"\r\n\t"`,
+		"\x00\xff": `"\x00\xff"`,
+		"":         `""`,
+	}
+	for in, want := range tests {
+		if got := quoteArg(in); got != want {
+			t.Errorf("quoteArg(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestHandler_InfoCommandStats(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	do(t, r, w, "SET", "k", "v")
+	do(t, r, w, "GET", "k")
+	do(t, r, w, "GET", "k")
+
+	v := do(t, r, w, "INFO", "commandstats")
+	if v.Type != "bulk" || !strings.HasPrefix(v.Bulk, "# Commandstats\r\n") {
+		t.Fatalf("INFO commandstats = %#v", v)
+	}
+	for _, want := range []string{"cmdstat_set:calls=1,usec=", "cmdstat_get:calls=2,usec=", ",usec_per_call=", ",usec_max="} {
+		if !strings.Contains(v.Bulk, want) {
+			t.Errorf("INFO commandstats missing %q:\n%s", want, v.Bulk)
+		}
+	}
+	if strings.Contains(v.Bulk, "cmdstat_hget") {
+		t.Errorf("INFO commandstats lists an uncalled command:\n%s", v.Bulk)
+	}
+
+	do(t, r, w, "CONFIG", "RESETSTAT")
+	v = do(t, r, w, "INFO", "commandstats")
+	if strings.Contains(v.Bulk, "cmdstat_get") {
+		t.Errorf("stats survived CONFIG RESETSTAT:\n%s", v.Bulk)
+	}
+}
+
+func TestHandler_Scan(t *testing.T) {
+	s := store.New()
+	for i := range 20000 {
+		s.Set("key:"+strconv.Itoa(i), "v")
+	}
+	for _, k := range []string{"special:a", "special:b", "special:c"} {
+		s.Set(k, "v")
+	}
+	r, w := startHandler(t, New(s, nil))
+
+	// Each call examines about COUNT keys however few match, so it returns
+	// quickly with a small or empty batch and a cursor to carry on from.
+	var found []string
+	cursor, calls := "0", 0
+	for {
+		v := do(t, r, w, "SCAN", cursor, "MATCH", "special:*", "COUNT", "100")
+		if len(v.Array) != 2 {
+			t.Fatalf("SCAN %s = %#v, want cursor and keys", cursor, v)
+		}
+		for _, k := range v.Array[1].Array {
+			found = append(found, k.Bulk)
+		}
+		calls++
+		next := v.Array[0].Bulk
+		if next != "0" && next == cursor {
+			t.Fatalf("SCAN cursor stuck at %s", cursor)
+		}
+		if cursor = next; cursor == "0" {
+			break
+		}
+	}
+	slices.Sort(found)
+	if !slices.Equal(found, []string{"special:a", "special:b", "special:c"}) {
+		t.Errorf("SCAN MATCH special:* found %v", found)
+	}
+	if calls < 200 {
+		t.Errorf("SCAN took %d calls over 20003 keys with COUNT 100, want at least 200", calls)
+	}
+
+	errCases := map[string][]string{
+		"ERR invalid cursor": {"SCAN", "x"},
+		"ERR syntax error":   {"SCAN", "0", "COUNT", "0"},
+	}
+	for want, args := range errCases {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v = %#v, want %q", args, v, want)
+		}
+	}
+}
+
+func TestHandler_ScanType(t *testing.T) {
+	s := store.New()
+	var vectors []string
+	for i := range 300 {
+		key := "k" + strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			s.Set(key, "v")
+		case 1:
+			s.HSet(key, map[string]string{"f": "v"})
+		case 2:
+			s.SetVector(key, []float32{1, 2})
+			vectors = append(vectors, key)
+		}
+	}
+	r, w := startHandler(t, New(s, nil))
+
+	walk := func(args ...string) []string {
+		t.Helper()
+		var found []string
+		cursor := "0"
+		for {
+			v := do(t, r, w, append([]string{"SCAN", cursor, "COUNT", "10"}, args...)...)
+			if len(v.Array) != 2 {
+				t.Fatalf("SCAN %s %v = %#v, want cursor and keys", cursor, args, v)
+			}
+			if len(v.Array[1].Array) > 10 {
+				t.Errorf("SCAN returned %d keys with COUNT 10", len(v.Array[1].Array))
+			}
+			for _, k := range v.Array[1].Array {
+				found = append(found, k.Bulk)
+			}
+			if cursor = v.Array[0].Bulk; cursor == "0" {
+				return slices.Sorted(slices.Values(found))
+			}
+		}
+	}
+
+	if got := walk("TYPE", "vector"); !slices.Equal(got, slices.Sorted(slices.Values(vectors))) {
+		t.Errorf("SCAN TYPE vector found %d keys, want the %d vectors: %v", len(got), len(vectors), got)
+	}
+	if got := walk("MATCH", "k1?", "TYPE", "HASH"); !slices.Equal(got, []string{"k10", "k13", "k16", "k19"}) {
+		t.Errorf("SCAN MATCH k1? TYPE HASH = %v, want [k10 k13 k16 k19]", got)
+	}
+
+	if v := do(t, r, w, "SCAN", "0", "TYPE", "set"); v.Type != "error" || v.Str != "ERR unknown type name 'set'" {
+		t.Errorf("SCAN TYPE set = %#v, want unknown type name", v)
+	}
+	if v := do(t, r, w, "HSCAN", "k1", "0", "TYPE", "string"); v.Type != "error" || v.Str != "ERR syntax error" {
+		t.Errorf("HSCAN TYPE = %#v, want syntax error", v)
+	}
+}
+
+func TestHandler_VScan(t *testing.T) {
+	s := store.New()
+	want := map[string]int{}
+	for i := range 300 {
+		key := "k" + strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			s.Set(key, "v")
+		case 1:
+			s.HSet(key, map[string]string{"f": "v"})
+		case 2:
+			vec := make([]float32, 1+i%7)
+			vec[0] = 1
+			s.SetVector(key, vec)
+			want[key] = len(vec)
+		}
+	}
+	s.SetHalfVector("half", []float32{1, 2, 3})
+	want["half"] = 3
+	r, w := startHandler(t, New(s, nil))
+
+	got := map[string]int{}
+	cursor := "0"
+	for {
+		v := do(t, r, w, "VSCAN", cursor, "COUNT", "10")
+		if len(v.Array) != 2 || len(v.Array[1].Array)%2 != 0 {
+			t.Fatalf("VSCAN %s = %#v, want cursor and key/dimension pairs", cursor, v)
+		}
+		pairs := v.Array[1].Array
+		for i := 0; i < len(pairs); i += 2 {
+			if pairs[i+1].Type != "integer" {
+				t.Fatalf("VSCAN dimension of %s = %#v, want integer", pairs[i].Bulk, pairs[i+1])
+			}
+			got[pairs[i].Bulk] = pairs[i+1].Num
+		}
+		if cursor = v.Array[0].Bulk; cursor == "0" {
+			break
+		}
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("VSCAN found %v, want %v", got, want)
+	}
+
+	v := do(t, r, w, "VSCAN", "0", "MATCH", "k2?", "COUNT", "1000")
+	if pairs := v.Array[1].Array; len(pairs) != 8 || v.Array[0].Bulk != "0" {
+		t.Errorf("VSCAN MATCH k2? = %#v, want k20, k23, k26, k29 and their dimensions", v)
+	}
+	if v := do(t, r, w, "VSCAN", "0", "TYPE", "vector"); v.Type != "error" || v.Str != "ERR syntax error" {
+		t.Errorf("VSCAN TYPE = %#v, want syntax error", v)
+	}
+}
+
+func TestHandler_HScan(t *testing.T) {
+	s := store.New()
+	s.HSet("h", map[string]string{"a": "1", "b": "2", "c": "3"})
+	s.Set("str", "x")
+	r, w := startHandler(t, New(s, nil))
+
+	v := do(t, r, w, "HSCAN", "h", "0", "COUNT", "2")
+	if len(v.Array) != 2 || v.Array[0].Bulk != "2" || len(v.Array[1].Array) != 4 {
+		t.Fatalf("HSCAN h 0 COUNT 2 = %#v, want cursor 2 and 2 pairs", v)
+	}
+	v = do(t, r, w, "HSCAN", "h", "2", "COUNT", "2")
+	if len(v.Array) != 2 || v.Array[0].Bulk != "0" || len(v.Array[1].Array) != 2 || v.Array[1].Array[0].Bulk != "c" {
+		t.Fatalf("HSCAN h 2 COUNT 2 = %#v, want cursor 0 and [c 3]", v)
+	}
+	v = do(t, r, w, "HSCAN", "h", "0", "MATCH", "[ab]")
+	if len(v.Array) != 2 || len(v.Array[1].Array) != 4 {
+		t.Errorf("HSCAN MATCH [ab] = %#v, want 2 pairs", v)
+	}
+	v = do(t, r, w, "HSCAN", "missing", "0")
+	if len(v.Array) != 2 || v.Array[0].Bulk != "0" || len(v.Array[1].Array) != 0 {
+		t.Errorf("HSCAN missing = %#v, want cursor 0 and no pairs", v)
+	}
+
+	errCases := map[string][]string{
+		wrongTypeError:       {"HSCAN", "str", "0"},
+		"ERR invalid cursor": {"HSCAN", "h", "x"},
+		"ERR syntax error":   {"HSCAN", "h", "0", "COUNT", "0"},
+		"ERR value is not an integer or out of range": {"HSCAN", "h", "0", "COUNT", "x"},
+	}
+	for want, args := range errCases {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v = %#v, want %q", args, v, want)
+		}
+	}
+	if v := do(t, r, w, "HSCAN", "h", "0", "MATCH"); v.Type != "error" {
+		t.Errorf("HSCAN with dangling MATCH = %#v, want error", v)
+	}
+}
+
+func TestHandler_HRandField(t *testing.T) {
+	s := store.New()
+	s.HSet("h", map[string]string{"f": "v"})
+	s.Set("str", "x")
+	r, w := startHandler(t, New(s, nil))
+
+	if v := do(t, r, w, "HRANDFIELD", "h"); v.Type != "bulk" || v.Bulk != "f" {
+		t.Errorf("HRANDFIELD h = %#v, want bulk f", v)
+	}
+	if v := do(t, r, w, "HRANDFIELD", "missing"); v.Type != "null" {
+		t.Errorf("HRANDFIELD missing = %#v, want null", v)
+	}
+	if v := do(t, r, w, "HRANDFIELD", "h", "-3", "WITHVALUES"); len(v.Array) != 6 || v.Array[1].Bulk != "v" {
+		t.Errorf("HRANDFIELD h -3 WITHVALUES = %#v, want 3 repeated pairs", v)
+	}
+	if v := do(t, r, w, "HRANDFIELD", "missing", "2"); v.Type != "array" || len(v.Array) != 0 {
+		t.Errorf("HRANDFIELD missing 2 = %#v, want empty array", v)
+	}
+
+	errCases := map[string][]string{
+		wrongTypeError: {"HRANDFIELD", "str"},
+		"ERR value is not an integer or out of range": {"HRANDFIELD", "h", "x"},
+		"ERR syntax error": {"HRANDFIELD", "h", "1", "NOPE"},
+	}
+	// Repeated samples are built in memory, so huge negative counts are
+	// refused rather than allocated.
+	for _, count := range []string{strconv.Itoa(math.MinInt64), "-4000000000"} {
+		if v := do(t, r, w, "HRANDFIELD", "h", count); v.Type != "error" || v.Str != "ERR value is out of range" {
+			t.Errorf("HRANDFIELD h %s = %#v, want out of range error", count, v)
+		}
+	}
+	for want, args := range errCases {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v = %#v, want %q", args, v, want)
+		}
+	}
+}
+
+func TestHandler_Bitmap(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+
+	if v := do(t, r, w, "SETBIT", "bm", "10", "1"); v.Type != "integer" || v.Num != 0 {
+		t.Errorf("SETBIT bm 10 1 = %#v, want 0", v)
+	}
+	if v := do(t, r, w, "SETBIT", "bm", "10", "1"); v.Num != 1 {
+		t.Errorf("second SETBIT bm 10 1 = %#v, want 1", v)
+	}
+	if v := do(t, r, w, "GETBIT", "bm", "10"); v.Num != 1 {
+		t.Errorf("GETBIT bm 10 = %#v, want 1", v)
+	}
+	if v := do(t, r, w, "BITCOUNT", "bm"); v.Num != 1 {
+		t.Errorf("BITCOUNT bm = %#v, want 1", v)
+	}
+	if v := do(t, r, w, "BITCOUNT", "bm", "0", "0"); v.Num != 0 {
+		t.Errorf("BITCOUNT bm 0 0 = %#v, want 0", v)
+	}
+
+	errCases := map[string][]string{
+		"ERR bit offset is not an integer or out of range": {"SETBIT", "bm", "-1", "1"},
+		"ERR bit is not an integer or out of range":        {"SETBIT", "bm", "0", "2"},
+		"ERR syntax error": {"BITCOUNT", "bm", "0"},
+	}
+	for want, args := range errCases {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v = %#v, want %q", args, v, want)
+		}
+	}
+	if v := do(t, r, w, "GETBIT", "bm", "4294967296"); v.Type != "error" {
+		t.Errorf("GETBIT beyond 2^32-1 = %#v, want error", v)
+	}
+
+	// Replaying the AOF rebuilds the bitmap.
+	replayed := store.New()
+	replay := New(replayed, nil)
+	log.Read(func(v resp.Value) { replay.Execute(v, nil) })
+	if bit := replayed.GetBit("bm", 10); bit != 1 {
+		t.Errorf("replayed GETBIT bm 10 = %d, want 1", bit)
+	}
+}
+
+func TestHandler_TGetMeta(t *testing.T) {
+	s := store.New()
+	s.SetVector("v", []float32{3, -4, 0})
+	s.Set("str", "x")
+	r, w := startHandler(t, New(s, nil))
+
+	v := do(t, r, w, "TGET", "v", "meta")
+	want := []string{"dim", "", "l2norm", "5", "min", "-4", "max", "3"}
+	if v.Type != "array" || len(v.Array) != len(want) {
+		t.Fatalf("TGET v META = %#v, want %d elements", v, len(want))
+	}
+	if v.Array[1].Type != "integer" || v.Array[1].Num != 3 {
+		t.Errorf("dim = %#v, want integer 3", v.Array[1])
+	}
+	for i, field := range want {
+		if field != "" && v.Array[i].Bulk != field {
+			t.Errorf("TGET v META[%d] = %q, want %q", i, v.Array[i].Bulk, field)
+		}
+	}
+
+	if v := do(t, r, w, "TGET", "missing", "META"); v.Type != "null" {
+		t.Errorf("TGET missing META = %#v, want null", v)
+	}
+	if v := do(t, r, w, "TGET", "str", "META"); v.Type != "error" || v.Str != wrongTypeError {
+		t.Errorf("TGET str META = %#v, want WRONGTYPE", v)
+	}
+	if v := do(t, r, w, "TGET", "v", "NOPE"); v.Type != "error" || v.Str != "ERR syntax error" {
+		t.Errorf("TGET v NOPE = %#v, want syntax error", v)
+	}
+	// Plain TGET is unchanged.
+	if v := do(t, r, w, "TGET", "v"); len(v.Array) != 3 || v.Array[1].Bulk != "-4" {
+		t.Errorf("TGET v = %#v, want [3 -4 0]", v)
+	}
+}
+
+func TestHandler_TGetPrecision(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	do(t, r, w, "TSET", "v", "0.1", "0.2", "1e-7", "3.4028235e+38")
+	want := []string{"0.1", "0.2", "1e-07", "3.4028235e+38"}
+
+	// The transaction path formats replies the same way.
+	do(t, r, w, "MULTI")
+	do(t, r, w, "TGET", "v")
+	tx := do(t, r, w, "EXEC")
+
+	for _, v := range []respValue{do(t, r, w, "TGET", "v"), tx.Array[0]} {
+		if len(v.Array) != len(want) {
+			t.Fatalf("TGET v = %#v, want %v", v, want)
+		}
+		for i := range want {
+			if v.Array[i].Bulk != want[i] {
+				t.Errorf("TGET v[%d] = %q, want %q", i, v.Array[i].Bulk, want[i])
+			}
+		}
+	}
+}
+
+// vectorKeys extracts the keys from a VSEARCH-style reply.
+func vectorKeys(v respValue) []string {
+	keys := make([]string, len(v.Array))
+	for i, e := range v.Array {
+		keys[i] = e.Bulk
+	}
+	return keys
+}
+
+func TestHandler_VSearchCache(t *testing.T) {
+	s := store.New()
+	s.SetVector("a", []float32{1, 0})
+	s.SetVector("b", []float32{1, 2})
+	h := New(s, nil)
+	r, w := startHandler(t, h)
+	search := func(args ...string) []string {
+		t.Helper()
+		v := do(t, r, w, append([]string{"VSEARCH"}, args...)...)
+		if v.Type != "array" {
+			t.Fatalf("VSEARCH %v = %#v, want array", args, v)
+		}
+		return vectorKeys(v)
+	}
+	cached := func() int {
+		h.searchCache.mu.Lock()
+		defer h.searchCache.mu.Unlock()
+		return h.searchCache.order.Len()
+	}
+
+	// Off by default.
+	search("1", "0", "2")
+	if n := cached(); n != 0 {
+		t.Fatalf("%d replies cached with vsearch-cache off", n)
+	}
+
+	do(t, r, w, "CONFIG", "SET", "vsearch-cache", "yes")
+	first := search("0", "1", "2")
+	gen := s.VectorGeneration()
+	// A repeat, and the same query at another magnitude, hit the cached reply.
+	for _, args := range [][]string{{"0", "1", "2"}, {"0", "3", "2"}} {
+		if got := search(args...); !slices.Equal(got, first) {
+			t.Errorf("VSEARCH %v = %v, want cached %v", args, got, first)
+		}
+	}
+	if n := cached(); n != 1 || s.VectorGeneration() != gen {
+		t.Errorf("%d replies cached, generation %d -> %d, want 1 entry and no change", n, gen, s.VectorGeneration())
+	}
+	// K, OFFSET and EXCLUDE are part of the key.
+	if got := search("0", "1", "2", "EXCLUDE", "b"); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("VSEARCH EXCLUDE b = %v, want [a]", got)
+	}
+
+	// A TSET between queries busts the cache.
+	do(t, r, w, "TSET", "c", "0", "1")
+	if got := search("0", "1", "2"); !slices.Equal(got, []string{"c", "b"}) {
+		t.Errorf("VSEARCH after TSET = %v, want [c b]", got)
+	}
+	do(t, r, w, "DEL", "c")
+	if got := search("0", "1", "2"); !slices.Equal(got, first) {
+		t.Errorf("VSEARCH after DEL = %v, want %v", got, first)
+	}
+
+	// So does a ranked vector expiring, though nothing is written.
+	s.ExpireAtIf("b", time.Now().Add(20*time.Millisecond), 0)
+	if got := search("0", "1", "2"); !slices.Equal(got, first) {
+		t.Errorf("VSEARCH before expiry = %v, want %v", got, first)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if got := search("0", "1", "2"); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("VSEARCH after expiry = %v, want [a]", got)
+	}
+
+	// The size bounds the entries kept.
+	do(t, r, w, "CONFIG", "SET", "vsearch-cache-size", "2")
+	for _, x := range []string{"1", "2", "3"} {
+		search(x, "1", "1")
+	}
+	if n := cached(); n != 2 {
+		t.Errorf("%d replies cached, want vsearch-cache-size 2", n)
+	}
+	if v := do(t, r, w, "CONFIG", "SET", "vsearch-cache-size", "0"); v.Type != "error" {
+		t.Errorf("CONFIG SET vsearch-cache-size 0 = %#v, want error", v)
+	}
+
+	// Turning the cache off drops what it holds, and searches made while it
+	// is off don't fill it again.
+	do(t, r, w, "CONFIG", "SET", "vsearch-cache", "no")
+	if n := cached(); n != 0 {
+		t.Errorf("%d replies cached after vsearch-cache no", n)
+	}
+	search("1", "0", "1")
+	if n := cached(); n != 0 {
+		t.Errorf("%d replies cached by a search with vsearch-cache off", n)
+	}
+}
+
+func TestHandler_HalfVector(t *testing.T) {
+	s := store.New()
+	r, w := startHandler(t, New(s, nil))
+
+	if v := do(t, r, w, "TSET", "h", "fp16", "0.1", "0.2", "0.3"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("TSET FP16 = %#v, want OK", v)
+	}
+	if v := do(t, r, w, "OBJECT", "ENCODING", "h"); v.Bulk != "float16vector" {
+		t.Errorf("OBJECT ENCODING = %#v, want float16vector", v)
+	}
+	v := do(t, r, w, "TGET", "h")
+	if v.Type != "array" || len(v.Array) != 3 {
+		t.Fatalf("TGET = %#v, want 3 components", v)
+	}
+	for i, want := range []float64{0.1, 0.2, 0.3} {
+		got, _ := strconv.ParseFloat(v.Array[i].Bulk, 64)
+		if math.Abs(got-want) > want/(1<<11) {
+			t.Errorf("TGET[%d] = %s, want %g within float16 precision", i, v.Array[i].Bulk, want)
+		}
+	}
+
+	// float16 and float32 vectors rank together; the precision lost is far
+	// smaller than the gaps between these angles.
+	do(t, r, w, "TSET", "a", "FP16", "1", "0")
+	do(t, r, w, "TSET", "b", "1", "0.5")
+	do(t, r, w, "TSET", "c", "FP16", "1", "2")
+	do(t, r, w, "TSET", "d", "0", "1")
+	if got := vectorKeys(do(t, r, w, "VSEARCH", "1", "0", "4")); !slices.Equal(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("VSEARCH = %v, want [a b c d]", got)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"TSET", "x", "FP16", "65505"}, "ERR vector value out of range for FP16"},
+		{[]string{"TSET", "x", "FP16", "-1e6"}, "ERR vector value out of range for FP16"},
+		{[]string{"TSET", "x", "FP16"}, "ERR wrong number of arguments for 'tset' command"},
+		{[]string{"TSET", "x", "FP16", "NaN"}, "ERR vector contains non-finite value"},
+	} {
+		if v := do(t, r, w, tt.args...); v.Type != "error" || v.Str != tt.want {
+			t.Errorf("%v = %#v, want %q", tt.args, v, tt.want)
+		}
+	}
+	if _, ok, _ := s.GetVector("x"); ok {
+		t.Error("x was created by a rejected TSET")
+	}
+}
+
+func TestHandler_TSetDim(t *testing.T) {
+	s := store.New()
+	r, w := startHandler(t, New(s, nil))
+
+	if v := do(t, r, w, "TSET", "a", "DIM", "3", "1", "2", "3"); v.Str != "OK" {
+		t.Fatalf("TSET DIM 3 with 3 components = %#v, want OK", v)
+	}
+	if v := do(t, r, w, "TSET", "b", "fp16", "dim", "2", "1", "2"); v.Str != "OK" {
+		t.Fatalf("TSET FP16 DIM 2 = %#v, want OK", v)
+	}
+	if v := do(t, r, w, "OBJECT", "ENCODING", "b"); v.Bulk != "float16vector" {
+		t.Errorf("OBJECT ENCODING after TSET FP16 DIM = %#v, want float16vector", v)
+	}
+	if vec, ok, _ := s.GetVector("a"); !ok || !slices.Equal(vec, []float32{1, 2, 3}) {
+		t.Errorf("a = %v, %v, want [1 2 3]", vec, ok)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"TSET", "x", "DIM", "3", "1", "2"}, "ERR vector length does not match declared dimension"},
+		{[]string{"TSET", "x", "DIM", "1", "1", "2"}, "ERR vector length does not match declared dimension"},
+		{[]string{"TSET", "x", "DIM", "0", "1"}, "ERR invalid dimension value"},
+		{[]string{"TSET", "x", "DIM", "two", "1", "2"}, "ERR invalid dimension value"},
+		{[]string{"TSET", "x", "DIM", "2"}, "ERR wrong number of arguments for 'tset' command"},
+		{[]string{"TSET", "x", "DIM"}, "ERR syntax error"},
+		{[]string{"TSET", "x", "DIM", "2", "DIM", "2", "1", "2"}, "ERR syntax error"},
+		{[]string{"TSET", "x", "DIM", "2", "FP16", "dim", "3", "1", "2", "3"}, "ERR syntax error"},
+		{[]string{"TSET", "x", "FP16", "fp16", "1", "2"}, "ERR syntax error"},
+	} {
+		if v := do(t, r, w, tt.args...); v.Type != "error" || v.Str != tt.want {
+			t.Errorf("%v = %#v, want %q", tt.args, v, tt.want)
+		}
+	}
+	if _, ok, _ := s.GetVector("x"); ok {
+		t.Error("x was created by a rejected TSET")
+	}
+}
+
+func TestHandler_VSimilar(t *testing.T) {
+	s := store.New()
+	s.SetVector("doc", []float32{1, 0})
+	s.SetVector("near", []float32{0.9, 0.1})
+	s.SetVector("far", []float32{0, 1})
+	s.SetVector("other-dim", []float32{1, 0, 0})
+	s.Set("str", "x")
+	r, w := startHandler(t, New(s, nil))
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"VSEARCH", "1", "0", "2"}, []string{"doc", "near"}},
+		{[]string{"VSEARCH", "1", "0", "2", "EXCLUDE", "doc"}, []string{"near", "far"}},
+		{[]string{"VSEARCH", "1", "0", "5", "exclude", "missing"}, []string{"doc", "near", "far"}},
+		{[]string{"VSIMILAR", "doc", "5"}, []string{"near", "far"}},
+		{[]string{"VSIMILAR", "doc", "1"}, []string{"near"}},
+	}
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if got := vectorKeys(v); !slices.Equal(got, tt.want) {
+			t.Errorf("%v = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	errCases := map[string][]string{
+		wrongTypeError:        {"VSIMILAR", "str", "1"},
+		"ERR no such key":     {"VSIMILAR", "missing", "1"},
+		"ERR invalid K value": {"VSIMILAR", "doc", "x"},
+		"ERR syntax error":    {"VSEARCH", "1", "0", "1", "EXCLUDE"},
+	}
+	for want, args := range errCases {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v = %#v, want %q", args, v, want)
+		}
+	}
+}
+
+func TestHandler_VSearchOffset(t *testing.T) {
+	s := store.New()
+	// Vectors at increasing angles from (1, 0), so the ranking is a, b, c, d.
+	s.SetVector("a", []float32{1, 0})
+	s.SetVector("b", []float32{1, 0.5})
+	s.SetVector("c", []float32{1, 2})
+	s.SetVector("d", []float32{0, 1})
+	r, w := startHandler(t, New(s, nil))
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"VSEARCH", "1", "0", "2", "OFFSET", "0"}, []string{"a", "b"}},
+		{[]string{"VSEARCH", "1", "0", "2", "OFFSET", "2"}, []string{"c", "d"}},
+		{[]string{"VSEARCH", "1", "0", "2", "OFFSET", "3"}, []string{"d"}},
+		{[]string{"VSEARCH", "1", "0", "2", "OFFSET", "10"}, []string{}},
+		{[]string{"VSEARCH", "1", "0", "2", "OFFSET", "1", "EXCLUDE", "b"}, []string{"c", "d"}},
+		{[]string{"VSIMILAR", "a", "2", "OFFSET", "1"}, []string{"c", "d"}},
+	}
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != "array" {
+			t.Errorf("%v = %#v, want array", tt.args, v)
+			continue
+		}
+		if got := vectorKeys(v); !slices.Equal(got, tt.want) {
+			t.Errorf("%v = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"VSEARCH", "1", "0", "2", "OFFSET", "-1"},
+		{"VSEARCH", "1", "0", "2", "OFFSET", "x"},
+		{"VSIMILAR", "a", "2", "OFFSET"},
+	} {
+		if v := do(t, r, w, args...); v.Type != "error" {
+			t.Errorf("%v = %#v, want error", args, v)
+		}
+	}
+}
+
+func TestHandler_DelAndUnlink(t *testing.T) {
+	log := tempAOF(t)
+	s := store.New()
+	r, w := startHandler(t, New(s, log))
+
+	do(t, r, w, "SET", "a", "1")
+	do(t, r, w, "TSET", "b", "1", "0")
+	do(t, r, w, "HSET", "c", "f", "v")
+	do(t, r, w, "SET", "keep", "1")
+
+	if v := do(t, r, w, "DEL", "a", "missing", "b", "c"); v.Type != "integer" || v.Num != 3 {
+		t.Fatalf("DEL a missing b c = %#v, want 3", v)
+	}
+	if v := do(t, r, w, "DEL", "missing"); v.Num != 0 {
+		t.Errorf("DEL missing = %#v, want 0", v)
+	}
+	do(t, r, w, "SET", "u1", "1")
+	do(t, r, w, "HSET", "u2", "f", "v")
+	if v := do(t, r, w, "UNLINK", "u1", "u2", "missing"); v.Type != "integer" || v.Num != 2 {
+		t.Fatalf("UNLINK u1 u2 missing = %#v, want 2", v)
+	}
+
+	// Only the keys that existed are logged, and a DEL of nothing isn't.
+	var dels []string
+	log.Read(func(v resp.Value) {
+		if v.Array[0].Bulk == "DEL" {
+			var args []string
+			for _, a := range v.Array {
+				args = append(args, a.Bulk)
+			}
+			dels = append(dels, strings.Join(args, " "))
+		}
+	})
+	if want := []string{"DEL a b c", "DEL u1 u2"}; !slices.Equal(dels, want) {
+		t.Errorf("logged DELs = %q, want %q", dels, want)
+	}
+
+	// Replay removes every key named in the logged DEL.
+	replayed := store.New()
+	replay := New(replayed, nil)
+	log.Read(func(v resp.Value) { replay.Execute(v, nil) })
+	for _, key := range []string{"a", "b", "c", "u1", "u2"} {
+		if _, found := replayed.Type(key); found {
+			t.Errorf("replayed store still has %q", key)
+		}
+	}
+	if _, found := replayed.Type("keep"); !found {
+		t.Error("replayed store lost an undeleted key")
+	}
+}
+
+func TestHandler_Touch(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+
+	do(t, r, w, "SET", "s", "x")
+	do(t, r, w, "HSET", "h", "f", "v")
+	if v := do(t, r, w, "TOUCH", "s", "h", "missing"); v.Type != "integer" || v.Num != 2 {
+		t.Errorf("TOUCH s h missing = %#v, want 2", v)
+	}
+
+	// Only the SET and HSET are logged.
+	n := 0
+	log.Read(func(resp.Value) { n++ })
+	if n != 2 {
+		t.Errorf("AOF has %d entries, want 2", n)
+	}
+}
+
+func TestHandler_NullAndEmptyArrays(t *testing.T) {
+	h := New(store.New(), nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	go h.Handle(server)
+	r, w := bufio.NewReader(client), resp.NewWriter(client)
+
+	// Null and empty arrays are skipped without a reply or a disconnect.
+	if _, err := client.Write([]byte("*-1\r\n*0\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if v := do(t, r, w, "PING"); v.Type != "string" || v.Str != "PONG" {
+		t.Fatalf("PING after null and empty arrays = %#v, want PONG", v)
+	}
+}
+
+func TestHandler_Ping(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{[]string{"PING"}, respValue{Type: "string", Str: "PONG"}},
+		{[]string{"PING", "hello world"}, respValue{Type: "bulk", Bulk: "hello world"}},
+		{[]string{"PING", "a", "b"}, respValue{Type: "error", Str: "ERR wrong number of arguments for 'ping' command"}},
+	}
+	for _, tt := range tests {
+		if v := do(t, r, w, tt.args...); v.Type != tt.want.Type || v.Str != tt.want.Str || v.Bulk != tt.want.Bulk {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+}
+
+func TestHandler_Version(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "v9.8.7"
+	r, w := startHandler(t, New(store.New(), nil))
+
+	want := "jellyfish v9.8.7 " + runtime.Version()
+	if v := do(t, r, w, "VERSION"); v.Type != "bulk" || v.Bulk != want {
+		t.Errorf("VERSION = %#v, want %q", v, want)
+	}
+	do(t, r, w, "MULTI")
+	do(t, r, w, "VERSION")
+	if v := do(t, r, w, "EXEC"); len(v.Array) != 1 || v.Array[0].Bulk != want {
+		t.Errorf("VERSION in EXEC = %#v, want [%q]", v, want)
+	}
+	if v := do(t, r, w, "VERSION", "x"); v.Type != "error" {
+		t.Errorf("VERSION x = %#v, want an arity error", v)
+	}
+}
+
+func TestHandler_Reset(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+
+	// RESET discards an open transaction without running it.
+	do(t, r, w, "MULTI")
+	do(t, r, w, "SET", "queued", "1")
+	if v := do(t, r, w, "RESET"); v.Type != "string" || v.Str != "RESET" {
+		t.Fatalf("RESET = %#v, want +RESET", v)
+	}
+	if _, found, _ := h.store.Get("queued"); found {
+		t.Error("RESET executed a queued command")
+	}
+	if v := do(t, r, w, "EXEC"); v.Type != "error" || v.Str != "ERR EXEC without MULTI" {
+		t.Errorf("EXEC after RESET = %#v, want EXEC without MULTI", v)
+	}
+
+	// RESET leaves monitor mode, and the connection runs commands again.
+	do(t, r, w, "MONITOR")
+	if v := do(t, r, w, "RESET"); v.Type != "string" || v.Str != "RESET" {
+		t.Fatalf("RESET in monitor mode = %#v, want +RESET", v)
+	}
+	if v := do(t, r, w, "SET", "k", "v"); v.Type != "string" || v.Str != "OK" {
+		t.Errorf("SET after leaving monitor mode = %#v, want OK", v)
+	}
+	if n := len(h.monitors.set); n != 0 {
+		t.Errorf("%d monitors registered after RESET, want 0", n)
+	}
+}
+
+func TestHandler_MaxTxQueue(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+	do(t, r, w, "CONFIG", "SET", "max-tx-queue", "2")
+
+	do(t, r, w, "MULTI")
+	for i := range 2 {
+		if v := do(t, r, w, "SET", fmt.Sprintf("k%d", i), "v"); v.Type != "string" || v.Str != "QUEUED" {
+			t.Fatalf("SET %d = %#v, want QUEUED", i, v)
+		}
+	}
+	if v := do(t, r, w, "SET", "k2", "v"); v.Type != "error" {
+		t.Fatalf("SET past max-tx-queue = %#v, want an error", v)
+	}
+	if v := do(t, r, w, "EXEC"); v.Type != "error" || !strings.HasPrefix(v.Str, "EXECABORT") {
+		t.Fatalf("EXEC = %#v, want EXECABORT", v)
+	}
+	if _, found, _ := h.store.Get("k0"); found {
+		t.Error("aborted transaction ran a queued command")
+	}
+
+	// The next transaction starts clean.
+	do(t, r, w, "MULTI")
+	do(t, r, w, "SET", "k", "v")
+	if v := do(t, r, w, "EXEC"); v.Type != "array" || len(v.Array) != 1 {
+		t.Errorf("EXEC after abort = %#v, want one reply", v)
+	}
+}
+
+func TestHandler_GetDel(t *testing.T) {
+	log := tempAOF(t)
+	h := New(store.New(), log)
+	r, w := startHandler(t, h)
+
+	do(t, r, w, "SET", "token", "secret")
+	do(t, r, w, "HSET", "h", "f", "x")
+
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{args: []string{"GETDEL", "token"}, want: respValue{Type: "bulk", Bulk: "secret"}},
+		{args: []string{"GETDEL", "token"}, want: respValue{Type: "null"}},
+		{args: []string{"GET", "token"}, want: respValue{Type: "null"}},
+		{args: []string{"GETDEL", "h"}, want: respValue{Type: "error", Str: wrongTypeError}},
+		{args: []string{"HGET", "h", "f"}, want: respValue{Type: "bulk", Bulk: "x"}},
+		{args: []string{"GETDEL"}, want: respValue{Type: "error", Str: "ERR wrong number of arguments for 'getdel' command"}},
+	}
+
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != tt.want.Type || v.Num != tt.want.Num || v.Str != tt.want.Str || v.Bulk != tt.want.Bulk {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+
+	// Only the GETDEL that found the key is logged, as DEL.
+	var logged []string
+	log.Read(func(v resp.Value) { logged = append(logged, strings.ToUpper(v.Array[0].Bulk)) })
+	if want := []string{"SET", "HSET", "DEL"}; !slices.Equal(logged, want) {
+		t.Errorf("AOF = %v, want %v", logged, want)
+	}
+}
+
+func TestHandler_DelIfEq(t *testing.T) {
+	log := tempAOF(t)
+	h := New(store.New(), log)
+	r, w := startHandler(t, h)
+
+	do(t, r, w, "SET", "lock", "owner-1")
+	do(t, r, w, "HSET", "h", "f", "x")
+
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{args: []string{"DELIFEQ", "lock", "owner-2"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"GET", "lock"}, want: respValue{Type: "bulk", Bulk: "owner-1"}},
+		{args: []string{"DELIFEQ", "lock", "owner-1"}, want: respValue{Type: "integer", Num: 1}},
+		{args: []string{"GET", "lock"}, want: respValue{Type: "null"}},
+		{args: []string{"DELIFEQ", "lock", "owner-1"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"DELIFEQ", "h", "x"}, want: respValue{Type: "error", Str: wrongTypeError}},
+		{args: []string{"DELIFEQ", "lock"}, want: respValue{Type: "error", Str: "ERR wrong number of arguments for 'delifeq' command"}},
+	}
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != tt.want.Type || v.Num != tt.want.Num || v.Str != tt.want.Str || v.Bulk != tt.want.Bulk {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+
+	// Only the DELIFEQ that deleted the key is logged, as DEL.
+	var logged []string
+	log.Read(func(v resp.Value) { logged = append(logged, strings.ToUpper(v.Array[0].Bulk)) })
+	if want := []string{"SET", "HSET", "DEL"}; !slices.Equal(logged, want) {
+		t.Errorf("AOF = %v, want %v", logged, want)
+	}
+}
+
+func TestHandler_SetIfEq(t *testing.T) {
+	log := tempAOF(t)
+	h := New(store.New(), log)
+	r, w := startHandler(t, h)
+
+	do(t, r, w, "SET", "counter", "1")
+	do(t, r, w, "HSET", "h", "f", "x")
+
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{args: []string{"SETIFEQ", "counter", "2", "3"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"GET", "counter"}, want: respValue{Type: "bulk", Bulk: "1"}},
+		{args: []string{"SETIFEQ", "counter", "1", "2"}, want: respValue{Type: "integer", Num: 1}},
+		{args: []string{"GET", "counter"}, want: respValue{Type: "bulk", Bulk: "2"}},
+		{args: []string{"SETIFEQ", "missing", "1", "2"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"SETIFEQ", "counter", "9"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"SETIFEQ", "flag", "on"}, want: respValue{Type: "integer", Num: 1}},
+		{args: []string{"GET", "flag"}, want: respValue{Type: "bulk", Bulk: "on"}},
+		{args: []string{"SETIFEQ", "h", "x", "y"}, want: respValue{Type: "error", Str: wrongTypeError}},
+		{args: []string{"SETIFEQ", "h", "y"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"SETIFEQ", "counter"}, want: respValue{Type: "error", Str: "ERR wrong number of arguments for 'setifeq' command"}},
+		{args: []string{"SETIFEQ", "counter", "2", "3", "4"}, want: respValue{Type: "error", Str: "ERR wrong number of arguments for 'setifeq' command"}},
+	}
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != tt.want.Type || v.Num != tt.want.Num || v.Str != tt.want.Str || v.Bulk != tt.want.Bulk {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+
+	// Only the SETIFEQs that set the key are logged, as SET.
+	var logged []string
+	log.Read(func(v resp.Value) { logged = append(logged, strings.ToUpper(v.Array[0].Bulk)) })
+	if want := []string{"SET", "HSET", "SET", "SET"}; !slices.Equal(logged, want) {
+		t.Errorf("AOF = %v, want %v", logged, want)
+	}
+}
+
+func TestHandler_ExpireOverflow(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+	do(t, r, w, "SET", "k", "v")
+	do(t, r, w, "HSET", "h", "f", "v")
+
+	// Times too far off for a time.Duration are rejected instead of wrapping
+	// around into the past and deleting the key.
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"EXPIRE", "k", "9999999999999"}, "ERR invalid expire time in 'expire' command"},
+		{[]string{"EXPIRE", "k", "-9999999999999"}, "ERR invalid expire time in 'expire' command"},
+		{[]string{"HEXPIRE", "h", "9999999999999", "FIELDS", "1", "f"}, "ERR invalid expire time in 'hexpire' command"},
+		{[]string{"GETEX", "k", "EX", "9999999999999"}, "ERR invalid expire time in 'getex' command"},
+		{[]string{"GETEX", "k", "PX", "9999999999999999"}, "ERR invalid expire time in 'getex' command"},
+		// Absolute times so far off that they would wrap around, or that a
+		// TTL counted to them would.
+		{[]string{"EXPIREAT", "k", "9223372036854775807"}, "ERR invalid expire time in 'expireat' command"},
+		{[]string{"EXPIREAT", "k", "9223372036854775"}, "ERR invalid expire time in 'expireat' command"},
+		{[]string{"PEXPIREAT", "k", "9223372036854775807"}, "ERR invalid expire time in 'pexpireat' command"},
+		{[]string{"HPEXPIREAT", "h", "9223372036854775807", "FIELDS", "1", "f"}, "ERR invalid expire time in 'hpexpireat' command"},
+		{[]string{"GETEX", "k", "EXAT", "9223372036854775807"}, "ERR invalid expire time in 'getex' command"},
+		{[]string{"GETEX", "k", "PXAT", "9223372036854775807"}, "ERR invalid expire time in 'getex' command"},
+	} {
+		if v := do(t, r, w, tt.args...); v.Type != "error" || v.Str != tt.want {
+			t.Errorf("%v = %#v, want %q", tt.args, v, tt.want)
+		}
+	}
+	if v := do(t, r, w, "GET", "k"); v.Bulk != "v" {
+		t.Errorf("GET k = %#v, want v", v)
+	}
+	if v := do(t, r, w, "TTL", "k"); v.Num != -1 {
+		t.Errorf("TTL k = %#v, want -1", v)
+	}
+	if v := do(t, r, w, "HGET", "h", "f"); v.Bulk != "v" {
+		t.Errorf("HGET h f = %#v, want v", v)
+	}
+
+	var logged []string
+	log.Read(func(v resp.Value) { logged = append(logged, strings.ToUpper(v.Array[0].Bulk)) })
+	if want := []string{"SET", "HSET"}; !slices.Equal(logged, want) {
+		t.Errorf("AOF = %v, want %v", logged, want)
+	}
+}
+
+func TestHandler_ExpiryUsesStoreClock(t *testing.T) {
+	// The store's clock is years behind the wall clock, so any expiry the
+	// handler computed from time.Now() would be far off from what the store
+	// reports.
+	now := time.UnixMilli(1_000_000_000_000)
+	s := store.New()
+	s.SetClock(func() time.Time { return now })
+	r, w := startHandler(t, New(s, nil))
+	ms := now.UnixMilli()
+
+	do(t, r, w, "SET", "k", "v")
+	do(t, r, w, "EXPIRE", "k", "10")
+	if at := s.ExpireTime("k"); at != ms+10_000 {
+		t.Errorf("EXPIRE k 10: expire time = %d, want %d", at, ms+10_000)
+	}
+	do(t, r, w, "GETEX", "k", "PX", "500")
+	if at := s.ExpireTime("k"); at != ms+500 {
+		t.Errorf("GETEX k PX 500: expire time = %d, want %d", at, ms+500)
+	}
+	payload := do(t, r, w, "DUMP", "k").Bulk
+	do(t, r, w, "RESTORE", "copy", "2000", payload)
+	if at := s.ExpireTime("copy"); at != ms+2000 {
+		t.Errorf("RESTORE copy 2000: expire time = %d, want %d", at, ms+2000)
+	}
+
+	// A timestamp in the store's future keeps the key even though it is in
+	// the wall clock's past.
+	do(t, r, w, "SET", "at", "v")
+	if v := do(t, r, w, "EXPIREAT", "at", strconv.FormatInt(now.Unix()+60, 10)); v.Num != 1 {
+		t.Errorf("EXPIREAT = %#v, want 1", v)
+	}
+	if v := do(t, r, w, "GET", "at"); v.Bulk != "v" {
+		t.Errorf("GET at = %#v, want v", v)
+	}
+
+	do(t, r, w, "HSET", "h", "f", "v")
+	do(t, r, w, "HEXPIRE", "h", "100", "FIELDS", "1", "f")
+	if v := do(t, r, w, "HTTL", "h", "FIELDS", "1", "f"); len(v.Array) != 1 || v.Array[0].Num != 100 {
+		t.Errorf("HTTL h = %#v, want [100]", v)
+	}
+}
+
+func TestHandler_GetEx(t *testing.T) {
+	log := tempAOF(t)
+	h := New(store.New(), log)
+	r, w := startHandler(t, h)
+
+	do(t, r, w, "SET", "k", "v")
+	do(t, r, w, "HSET", "h", "f", "x")
+
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{args: []string{"GETEX", "k"}, want: respValue{Type: "bulk", Bulk: "v"}},
+		{args: []string{"GETEX", "missing", "EX", "10"}, want: respValue{Type: "null"}},
+		{args: []string{"GETEX", "h"}, want: respValue{Type: "error", Str: wrongTypeError}},
+		{args: []string{"GETEX", "k", "EX", "0"}, want: respValue{Type: "error", Str: "ERR invalid expire time in 'getex' command"}},
+		{args: []string{"GETEX", "k", "EX", "x"}, want: respValue{Type: "error", Str: "ERR value is not an integer or out of range"}},
+		{args: []string{"GETEX", "k", "EX", "10", "PERSIST"}, want: respValue{Type: "error", Str: "ERR syntax error"}},
+		{args: []string{"GETEX", "k", "BOGUS"}, want: respValue{Type: "error", Str: "ERR syntax error"}},
+		{args: []string{"GETEX", "k", "ex", "100"}, want: respValue{Type: "bulk", Bulk: "v"}},
+		{args: []string{"TTL", "k"}, want: respValue{Type: "integer", Num: 100}},
+		{args: []string{"GETEX", "k", "PERSIST"}, want: respValue{Type: "bulk", Bulk: "v"}},
+		{args: []string{"TTL", "k"}, want: respValue{Type: "integer", Num: -1}},
+		{args: []string{"GETEX", "k", "PERSIST"}, want: respValue{Type: "bulk", Bulk: "v"}},
+		{args: []string{"GETEX", "k", "PX", "5000000"}, want: respValue{Type: "bulk", Bulk: "v"}},
+	}
+
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != tt.want.Type || v.Num != tt.want.Num || v.Str != tt.want.Str || v.Bulk != tt.want.Bulk {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+
+	// SET, HSET, one PEXPIREAT per TTL change and the one PERSIST that
+	// removed a TTL are logged; plain reads are not.
+	var logged []string
+	log.Read(func(v resp.Value) { logged = append(logged, strings.ToUpper(v.Array[0].Bulk)) })
+	if want := []string{"SET", "HSET", "PEXPIREAT", "PERSIST", "PEXPIREAT"}; !slices.Equal(logged, want) {
+		t.Errorf("AOF = %v, want %v", logged, want)
+	}
+
+	// Replay restores the same absolute expiry.
+	replayed := store.New()
+	replay := New(replayed, nil)
+	log.Read(func(v resp.Value) { replay.Execute(v, nil) })
+	if got, want := replayed.TTL("k"), h.store.TTL("k"); got != want {
+		t.Errorf("replayed TTL = %d, want %d", got, want)
+	}
+}
+
+func TestHandler_MaxMemory(t *testing.T) {
+	log := tempAOF(t)
+	h := New(store.New(), log)
+	r, w := startHandler(t, h)
+
+	do(t, r, w, "SET", "k1", "v")
+	do(t, r, w, "SET", "k2", "v")
+	limit := strconv.FormatInt(h.store.UsedMemory(), 10)
+
+	if v := do(t, r, w, "CONFIG", "SET", "maxmemory-policy", "volatile-lru"); v.Type != "error" {
+		t.Errorf("CONFIG SET maxmemory-policy volatile-lru = %#v, want error", v)
+	}
+	if v := do(t, r, w, "CONFIG", "GET", "maxmemory-policy"); len(v.Array) != 2 || v.Array[1].Bulk != "noeviction" {
+		t.Errorf("default maxmemory-policy = %#v, want noeviction", v)
+	}
+
+	// With noeviction, writes that grow the dataset fail once the limit is
+	// reached, while reads and deletes still work.
+	do(t, r, w, "CONFIG", "SET", "maxmemory", limit)
+	do(t, r, w, "SET", "k3", "v")
+	want := "OOM command not allowed when used memory > 'maxmemory'."
+	if v := do(t, r, w, "SET", "k4", "v"); v.Type != "error" || v.Str != want {
+		t.Errorf("SET over maxmemory = %#v, want OOM error", v)
+	}
+	if v := do(t, r, w, "GET", "k1"); v.Bulk != "v" {
+		t.Errorf("GET over maxmemory = %#v, want v", v)
+	}
+	if v := do(t, r, w, "DEL", "k3"); v.Num != 1 {
+		t.Errorf("DEL over maxmemory = %#v, want 1", v)
+	}
+
+	// With allkeys-lfu the less frequently read key makes room.
+	do(t, r, w, "CONFIG", "SET", "maxmemory-policy", "allkeys-lfu")
+	for range 50 {
+		do(t, r, w, "GET", "k1")
+	}
+	if v := do(t, r, w, "OBJECT", "FREQ", "k1"); v.Type != "integer" || v.Num <= 5 {
+		t.Errorf("OBJECT FREQ k1 = %#v, want more than 5", v)
+	}
+	do(t, r, w, "SET", "k3", "v")
+	if v := do(t, r, w, "SET", "k4", "v"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("SET with allkeys-lfu = %#v, want OK", v)
+	}
+	if _, found, _ := h.store.Get("k1"); !found {
+		t.Error("frequently read key k1 was evicted")
+	}
+
+	// Evictions are logged as DEL so replay ends with the same keys.
+	replayed := store.New()
+	replay := New(replayed, nil)
+	log.Read(func(v resp.Value) { replay.Execute(v, nil) })
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		_, want, _ := h.store.Get(key)
+		if _, got, _ := replayed.Get(key); got != want {
+			t.Errorf("replayed %s exists = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestHandler_ExpireTime(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+	do(t, r, w, "SET", "k", "v")
+	do(t, r, w, "SET", "persistent", "v")
+	do(t, r, w, "HSET", "h", "f", "v")
+	do(t, r, w, "PEXPIREAT", "k", "4102444800999")
+	do(t, r, w, "EXPIRE", "h", "100")
+	size, _ := log.Size()
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"EXPIRETIME", "k"}, 4102444800},
+		{[]string{"PEXPIRETIME", "k"}, 4102444800999},
+		{[]string{"EXPIRETIME", "persistent"}, -1},
+		{[]string{"PEXPIRETIME", "persistent"}, -1},
+		{[]string{"EXPIRETIME", "missing"}, -2},
+		{[]string{"PEXPIRETIME", "missing"}, -2},
+	}
+	for _, tt := range tests {
+		if v := do(t, r, w, tt.args...); v.Type != "integer" || v.Num != tt.want {
+			t.Errorf("%v = %#v, want %d", tt.args, v, tt.want)
+		}
+	}
+
+	// Any type of key, within a second of the relative expiry it was given.
+	want := int(time.Now().Add(100 * time.Second).UnixMilli())
+	if got := do(t, r, w, "PEXPIRETIME", "h").Num; got < want-1000 || got > want {
+		t.Errorf("PEXPIRETIME of a hash with EXPIRE 100 = %d, want about %d", got, want)
+	}
+	if got, _ := log.Size(); got != size {
+		t.Errorf("EXPIRETIME and PEXPIRETIME grew the AOF from %d to %d bytes", size, got)
+	}
+}
+
+func TestHandler_ExpireReplay(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+
+	do(t, r, w, "SET", "short", "v")
+	do(t, r, w, "SET", "long", "v")
+	do(t, r, w, "SET", "gone", "v")
+	do(t, r, w, "EXPIRE", "short", "1")
+	do(t, r, w, "EXPIREAT", "long", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	do(t, r, w, "EXPIRE", "gone", "0")
+
+	// Expiries are logged with their absolute time, and an expiry in the past
+	// as the DEL it amounts to.
+	var logged []string
+	log.Read(func(v resp.Value) { logged = append(logged, strings.ToUpper(v.Array[0].Bulk)) })
+	if want := []string{"SET", "SET", "SET", "PEXPIREAT", "PEXPIREAT", "DEL"}; !slices.Equal(logged, want) {
+		t.Errorf("AOF = %v, want %v", logged, want)
+	}
+
+	// Replaying after the short TTL has run out must not start a new one.
+	time.Sleep(1100 * time.Millisecond)
+	replayed := store.New()
+	replay := New(replayed, nil)
+	log.Read(func(v resp.Value) { replay.Execute(v, nil) })
+
+	if _, found, _ := replayed.Get("short"); found {
+		t.Error("key whose TTL ran out before the replay was restored")
+	}
+	if _, found, _ := replayed.Get("gone"); found {
+		t.Error("key expired with EXPIRE 0 was restored")
+	}
+	if ttl := replayed.TTL("long"); ttl < 3500 || ttl > 3600 {
+		t.Errorf("replayed TTL of long = %d, want about 3600", ttl)
+	}
+}
+
+// TestHandler_BinarySafe checks that keys, fields and values holding NUL
+// bytes, CRLF and bytes that aren't UTF-8 round-trip through the commands and
+// the AOF, and that an error quoting such an argument doesn't break the reply
+// stream.
+func TestHandler_BinarySafe(t *testing.T) {
+	const key, field, val = "k\x00\r\n", "f\r\n\x00", "\x00\r\nv\xff\r\n"
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+
+	do(t, r, w, "SET", key, val)
+	do(t, r, w, "HSET", "h\r\n", field, val)
+	if v := do(t, r, w, "GET", key); v.Type != "bulk" || v.Bulk != val {
+		t.Errorf("GET = %#v, want %q", v, val)
+	}
+	if v := do(t, r, w, "HGET", "h\r\n", field); v.Type != "bulk" || v.Bulk != val {
+		t.Errorf("HGET = %#v, want %q", v, val)
+	}
+	if v := do(t, r, w, "SCAN", "0", "MATCH", "k\x00*"); len(v.Array) != 2 || len(v.Array[1].Array) != 1 || v.Array[1].Array[0].Bulk != key {
+		t.Errorf("SCAN MATCH = %#v, want [%q]", v, key)
+	}
+
+	if v := do(t, r, w, "NO\r\n+OK"); v.Type != "error" || v.Str != "ERR unknown command 'NO  +OK'" {
+		t.Errorf("unknown command with CRLF = %#v", v)
+	}
+	if v := do(t, r, w, "PING"); v.Type != "string" || v.Str != "PONG" {
+		t.Errorf("PING after error with CRLF = %#v, want PONG", v)
+	}
+
+	replayed := store.New()
+	replay := New(replayed, nil)
+	if err := log.Read(func(v resp.Value) { replay.Execute(v, nil) }); err != nil {
+		t.Fatal(err)
+	}
+	if got, found, _ := replayed.Get(key); !found || got != val {
+		t.Errorf("replayed GET = %q, %v; want %q", got, found, val)
+	}
+	if got, found, _ := replayed.HGet("h\r\n", field); !found || got != val {
+		t.Errorf("replayed HGET = %q, %v; want %q", got, found, val)
+	}
+}
+
+func TestHandler_HashFieldExpiry(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+	do(t, r, w, "HSET", "h", "a", "1", "b", "2", "c", "3")
+	do(t, r, w, "SET", "str", "v")
+
+	ints := func(v respValue) []int {
+		var ns []int
+		for _, e := range v.Array {
+			ns = append(ns, e.Num)
+		}
+		return ns
+	}
+	tests := []struct {
+		args []string
+		want []int
+	}{
+		{[]string{"HEXPIRE", "h", "100", "FIELDS", "2", "a", "nope"}, []int{1, -2}},
+		{[]string{"HEXPIRE", "h", "200", "NX", "FIELDS", "2", "a", "b"}, []int{0, 1}},
+		{[]string{"HEXPIRE", "h", "0", "FIELDS", "1", "c"}, []int{2}},
+		{[]string{"HTTL", "h", "FIELDS", "3", "a", "b", "c"}, []int{100, 200, -2}},
+		{[]string{"HPERSIST", "h", "FIELDS", "2", "a", "a"}, []int{1, -1}},
+		{[]string{"HTTL", "missing", "FIELDS", "1", "a"}, []int{-2}},
+	}
+	for _, tt := range tests {
+		if v := do(t, r, w, tt.args...); v.Type != "array" || !slices.Equal(ints(v), tt.want) {
+			t.Errorf("%v = %#v, want %v", tt.args, v, tt.want)
+		}
+	}
+
+	errs := map[string][]string{
+		wrongTypeError: {"HTTL", "str", "FIELDS", "1", "a"},
+		"ERR Mandatory argument FIELDS is missing or not at the right position": {"HPERSIST", "h", "NX", "FIELDS", "1", "a"},
+		"ERR The `numfields` parameter must match the number of arguments":      {"HEXPIRE", "h", "1", "FIELDS", "2", "a"},
+		"ERR Parameter `numFields` should be greater than 0":                    {"HEXPIRE", "h", "1", "FIELDS", "0", "a"},
+	}
+	for want, args := range errs {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v = %#v, want %q", args, v, want)
+		}
+	}
+
+	// Relative field TTLs are logged with their absolute time, and only for
+	// the fields they changed.
+	var logged [][]string
+	log.Read(func(v resp.Value) {
+		var args []string
+		for _, a := range v.Array {
+			args = append(args, a.Bulk)
+		}
+		logged = append(logged, args)
+	})
+	for _, cmd := range logged {
+		if cmd[0] == "HEXPIRE" {
+			t.Errorf("AOF holds relative %v", cmd)
+		}
+	}
+	if n := len(logged); n != 6 || !slices.Equal(logged[3][3:], []string{"FIELDS", "1", "b"}) {
+		t.Errorf("AOF = %v, want HSET, SET, three HPEXPIREAT and HPERSIST", logged)
+	}
+
+	replayed := store.New()
+	replay := New(replayed, nil)
+	log.Read(func(v resp.Value) { replay.Execute(v, nil) })
+	if ttls, _ := replayed.HTTL("h", []string{"a", "b", "c"}); !slices.Equal(ttls[:1], []int{-1}) || ttls[1] < 199 || ttls[2] != -2 {
+		t.Errorf("replayed field TTLs = %v, want [-1 ~200 -2]", ttls)
+	}
+}
+
+func TestHandler_HGetDelAndHGetEx(t *testing.T) {
+	log := tempAOF(t)
+	r, w := startHandler(t, New(store.New(), log))
+	do(t, r, w, "HSET", "h", "a", "1", "b", "2", "c", "3")
+	do(t, r, w, "SET", "str", "v")
+
+	bulks := func(v respValue) []string {
+		var out []string
+		for _, e := range v.Array {
+			if e.Type == "null" {
+				out = append(out, "<nil>")
+			} else {
+				out = append(out, e.Bulk)
+			}
+		}
+		return out
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"HGETDEL", "h", "FIELDS", "3", "a", "nope", "a"}, []string{"1", "<nil>", "<nil>"}},
+		{[]string{"HGETEX", "h", "EX", "100", "FIELDS", "2", "b", "nope"}, []string{"2", "<nil>"}},
+		{[]string{"HGETEX", "h", "FIELDS", "1", "c"}, []string{"3"}},
+		{[]string{"HGETEX", "h", "PERSIST", "FIELDS", "2", "b", "c"}, []string{"2", "3"}},
+		{[]string{"HGETDEL", "h", "FIELDS", "2", "b", "c"}, []string{"2", "3"}},
+		{[]string{"HGETDEL", "h", "FIELDS", "1", "b"}, []string{"<nil>"}},
+	}
+	for _, tt := range tests {
+		if v := do(t, r, w, tt.args...); v.Type != "array" || !slices.Equal(bulks(v), tt.want) {
+			t.Errorf("%v = %#v, want %v", tt.args, v, tt.want)
+		}
+	}
+	// Removing the last fields deleted the hash.
+	if v := do(t, r, w, "TTL", "h"); v.Num != -2 {
+		t.Errorf("TTL h after deleting every field = %d, want -2", v.Num)
+	}
+
+	errs := map[string][]string{
+		wrongTypeError:     {"HGETDEL", "str", "FIELDS", "1", "a"},
+		"ERR syntax error": {"HGETEX", "h", "EX", "FIELDS", "1", "a"},
+		"ERR invalid expire time in 'hgetex' command": {"HGETEX", "h", "EX", "0", "FIELDS", "1", "a"},
+	}
+	for want, args := range errs {
+		if v := do(t, r, w, args...); v.Type != "error" || v.Str != want {
+			t.Errorf("%v = %#v, want %q", args, v, want)
+		}
+	}
+
+	var logged []string
+	log.Read(func(v resp.Value) { logged = append(logged, strings.ToUpper(v.Array[0].Bulk)) })
+	if want := []string{"HSET", "SET", "HDEL", "HPEXPIREAT", "HPERSIST", "HDEL"}; !slices.Equal(logged, want) {
+		t.Errorf("AOF = %v, want %v", logged, want)
+	}
+}
+
+func TestHandler_UseConfig(t *testing.T) {
+	h := New(store.New(), nil)
+	cfg := serverconfig.Default()
+	cfg.Port = 6380
+	cfg.AppendOnly = false
+	cfg.MaxMemory = 1 << 20
+	cfg.MaxMemoryPolicy = store.AllKeysLRU
+	h.UseConfig(cfg)
+	r, w := startHandler(t, h)
+
+	want := map[string]string{
+		"port":             "6380",
+		"bind":             "",
+		"dir":              ".",
+		"appendonly":       "no",
+		"appendfilename":   "database.aof",
+		"appendfsync":      "everysec",
+		"maxmemory":        "1048576",
+		"maxmemory-policy": "allkeys-lru",
+	}
+	for name, value := range want {
+		v := do(t, r, w, "CONFIG", "GET", name)
+		if len(v.Array) != 2 || v.Array[1].Bulk != value {
+			t.Errorf("CONFIG GET %s = %#v, want %q", name, v, value)
+		}
+	}
+
+	// Startup settings are read-only; runtime parameters still accept units.
+	if v := do(t, r, w, "CONFIG", "SET", "port", "7000"); v.Type != "error" || !strings.Contains(v.Str, "can't set immutable config") {
+		t.Errorf("CONFIG SET port = %#v, want immutable config error", v)
+	}
+	do(t, r, w, "CONFIG", "SET", "maxmemory", "2mb")
+	if v := do(t, r, w, "CONFIG", "GET", "maxmemory"); len(v.Array) != 2 || v.Array[1].Bulk != "2097152" {
+		t.Errorf("CONFIG GET maxmemory after SET 2mb = %#v, want 2097152", v)
+	}
+}
+
+func TestHandler_DumpRestore(t *testing.T) {
+	log := tempAOF(t)
+	h := New(store.New(), log)
+	r, w := startHandler(t, h)
+
+	do(t, r, w, "SET", "s", "hello")
+	do(t, r, w, "TSET", "v", "0.5", "1.5")
+	do(t, r, w, "HSET", "h", "f1", "a", "f2", "b")
+	do(t, r, w, "EXPIRE", "s", "100")
+
+	if v := do(t, r, w, "DUMP", "missing"); v.Type != "null" {
+		t.Errorf("DUMP missing = %#v, want null", v)
+	}
+
+	// Each type round-trips into a new key, keeping the TTL from the payload.
+	for _, key := range []string{"s", "v", "h"} {
+		dump := do(t, r, w, "DUMP", key)
+		if dump.Type != "bulk" {
+			t.Fatalf("DUMP %s = %#v, want bulk", key, dump)
+		}
+		if v := do(t, r, w, "RESTORE", key+"-copy", "0", dump.Bulk); v.Str != "OK" {
+			t.Fatalf("RESTORE %s-copy = %#v, want OK", key, v)
+		}
+		orig, _ := h.store.GetItem(key)
+		restored, _ := h.store.GetItem(key + "-copy")
+		if string(codec.Encode(orig)) != string(codec.Encode(restored)) {
+			t.Errorf("restored %s = %+v, want %+v", key, restored, orig)
+		}
+
+		want := "BUSYKEY Target key name already exists."
+		if v := do(t, r, w, "RESTORE", key, "0", dump.Bulk); v.Type != "error" || v.Str != want {
+			t.Errorf("RESTORE over existing %s = %#v, want BUSYKEY", key, v)
+		}
+	}
+	if ttl := h.store.TTL("s-copy"); ttl < 99 || ttl > 100 {
+		t.Errorf("TTL of restored string = %d, want 100", ttl)
+	}
+
+	// REPLACE overwrites, and a positive ttl replaces the payload's expiry.
+	dump := do(t, r, w, "DUMP", "h")
+	if v := do(t, r, w, "RESTORE", "s", "5000", dump.Bulk, "REPLACE"); v.Str != "OK" {
+		t.Fatalf("RESTORE REPLACE = %#v, want OK", v)
+	}
+	if v := do(t, r, w, "HGET", "s", "f2"); v.Bulk != "b" {
+		t.Errorf("HGET s f2 after RESTORE REPLACE = %#v, want b", v)
+	}
+	if ttl := h.store.TTL("s"); ttl < 4 || ttl > 5 {
+		t.Errorf("TTL after RESTORE with ttl 5000 = %d, want 5", ttl)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"RESTORE", "x", "0", "garbage"}, "ERR DUMP payload version or checksum are wrong"},
+		{[]string{"RESTORE", "x", "-1", dump.Bulk}, "ERR Invalid TTL value, must be >= 0"},
+		{[]string{"RESTORE", "x", "9223372036854775807", dump.Bulk}, "ERR Invalid TTL value, must be >= 0"},
+		{[]string{"RESTORE", "x", "0", dump.Bulk, "BOGUS"}, "ERR syntax error"},
+	}
+	for _, tt := range tests {
+		if v := do(t, r, w, tt.args...); v.Type != "error" || v.Str != tt.want {
+			t.Errorf("%v = %#v, want %q", tt.args[:2], v, tt.want)
+		}
+	}
+
+	// Replay recreates the restored keys with the same expiry.
+	replayed := store.New()
+	replay := New(replayed, nil)
+	log.Read(func(v resp.Value) { replay.Execute(v, nil) })
+	for _, key := range []string{"s", "v-copy", "h-copy", "s-copy"} {
+		want, _ := h.store.GetItem(key)
+		got, ok := replayed.GetItem(key)
+		if !ok || string(codec.Encode(got)) != string(codec.Encode(want)) {
+			t.Errorf("replayed %s = %+v, want %+v", key, got, want)
+		}
+	}
+}
+
+func TestHandler_Migrate(t *testing.T) {
+	log := tempAOF(t)
+	src := New(store.New(), log)
+	dst := New(store.New(), nil)
+	host, port, _ := net.SplitHostPort(serveTCP(t, dst))
+	r, w := startHandler(t, src)
+
+	do(t, r, w, "SET", "moved", "v")
+	do(t, r, w, "EXPIRE", "moved", "100")
+	do(t, r, w, "HSET", "copied", "f", "x")
+
+	if v := do(t, r, w, "MIGRATE", host, port, "moved", "0", "1000"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("MIGRATE = %#v, want OK", v)
+	}
+	if _, found, _ := src.store.Get("moved"); found {
+		t.Error("migrated key still exists on the source")
+	}
+	if val, _, _ := dst.store.Get("moved"); val != "v" {
+		t.Errorf("migrated key on the target = %q, want v", val)
+	}
+	if ttl := dst.store.TTL("moved"); ttl < 99 || ttl > 100 {
+		t.Errorf("TTL of migrated key = %d, want 100", ttl)
+	}
+
+	// COPY leaves the source alone; without REPLACE an existing key on the
+	// target is an error that keeps the source key as well.
+	if v := do(t, r, w, "MIGRATE", host, port, "copied", "0", "1000", "COPY"); v.Str != "OK" {
+		t.Fatalf("MIGRATE COPY = %#v, want OK", v)
+	}
+	if v := do(t, r, w, "MIGRATE", host, port, "copied", "0", "1000"); v.Type != "error" || !strings.Contains(v.Str, "BUSYKEY") {
+		t.Errorf("MIGRATE onto an existing key = %#v, want BUSYKEY error", v)
+	}
+	do(t, r, w, "HSET", "copied", "g", "y")
+	if v := do(t, r, w, "MIGRATE", host, port, "copied", "0", "1000", "REPLACE"); v.Str != "OK" {
+		t.Fatalf("MIGRATE REPLACE = %#v, want OK", v)
+	}
+	if val, _, _ := dst.store.HGet("copied", "g"); val != "y" {
+		t.Errorf("HGET copied g on the target = %q, want y", val)
+	}
+
+	if v := do(t, r, w, "MIGRATE", host, port, "missing", "0", "1000"); v.Type != "string" || v.Str != "NOKEY" {
+		t.Errorf("MIGRATE missing = %#v, want NOKEY", v)
+	}
+	if v := do(t, r, w, "MIGRATE", host, port, "moved", "1", "1000"); v.Type != "error" || v.Str != "ERR DB index is out of range" {
+		t.Errorf("MIGRATE to db 1 = %#v, want DB index error", v)
+	}
+
+	// A deleted source key is logged, so replay doesn't bring it back.
+	replayed := store.New()
+	replay := New(replayed, nil)
+	log.Read(func(v resp.Value) { replay.Execute(v, nil) })
+	if _, found, _ := replayed.Get("moved"); found {
+		t.Error("migrated key reappeared after replay")
+	}
+}
+
+func TestHandler_MigrateUnlocked(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+	do(t, r, w, "SET", "k", "old")
+
+	// A target that holds its reply until released.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	received, release := make(chan resp.Value, 1), make(chan struct{})
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		v, _ := resp.NewReader(conn).Read()
+		received <- v
+		<-release
+		conn.Write([]byte("+OK\r\n"))
+	}()
+	host, port, _ := net.SplitHostPort(target.Addr().String())
+
+	// A timeout too long for a time.Duration is clamped, not wrapped around.
+	done := make(chan respValue, 1)
+	go func() { done <- do(t, r, w, "MIGRATE", host, port, "k", "0", "9223372036854775807") }()
+	if v := <-received; len(v.Array) < 2 || v.Array[1].Bulk != "k" {
+		t.Fatalf("target received %#v, want RESTORE k", v)
+	}
+
+	// The key's shard isn't locked while the target is slow to reply, and a
+	// value written meanwhile isn't deleted when the migration finishes.
+	r2, w2 := startHandler(t, h)
+	if v := do(t, r2, w2, "SET", "k", "new"); v.Str != "OK" {
+		t.Errorf("SET during MIGRATE = %#v, want OK", v)
+	}
+	close(release)
+	if v := <-done; v.Type != "string" || v.Str != "OK" {
+		t.Errorf("MIGRATE = %#v, want OK", v)
+	}
+	if val, _, _ := h.store.Get("k"); val != "new" {
+		t.Errorf("k after MIGRATE = %q, want the value written during it", val)
+	}
+}
+
+func TestHandler_MigrateFailure(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+	do(t, r, w, "SET", "k", "v")
+
+	// Nothing listening: the dial fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	host, closedPort, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	if v := do(t, r, w, "MIGRATE", host, closedPort, "k", "0", "500"); v.Type != "error" || !strings.HasPrefix(v.Str, "IOERR") {
+		t.Errorf("MIGRATE to a closed port = %#v, want IOERR", v)
+	}
+
+	// A target that accepts but never replies: the timeout expires.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	_, silentPort, _ := net.SplitHostPort(silent.Addr().String())
+	start := time.Now()
+	if v := do(t, r, w, "MIGRATE", host, silentPort, "k", "0", "100"); v.Type != "error" || !strings.HasPrefix(v.Str, "IOERR") {
+		t.Errorf("MIGRATE to a silent target = %#v, want IOERR", v)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("MIGRATE took %v with a 100ms timeout", elapsed)
+	}
+
+	if val, _, _ := h.store.Get("k"); val != "v" {
+		t.Errorf("source key after failed migrations = %q, want v", val)
+	}
+}
+
+func TestHandler_ExpiredKeysAcrossTypes(t *testing.T) {
+	h := New(store.New(), nil)
+	r, w := startHandler(t, h)
+
+	soon := time.Now().Add(50 * time.Millisecond)
+	h.store.SetItem("s", store.Item{Type: store.TypeString, StrVal: "v", ExpiresAt: soon})
+	h.store.SetItem("v", store.Item{Type: store.TypeVector, VecVal: []float32{1, 0}, ExpiresAt: soon})
+	h.store.SetItem("h", store.Item{Type: store.TypeHash, HashVal: map[string]string{"f": "x"}, ExpiresAt: soon})
+	do(t, r, w, "TSET", "live", "1", "0")
+	time.Sleep(60 * time.Millisecond)
+
+	// Expired keys read as missing, never as the wrong type.
+	tests := []struct {
+		args []string
+		want respValue
+	}{
+		{args: []string{"GET", "s"}, want: respValue{Type: "null"}},
+		{args: []string{"TGET", "v"}, want: respValue{Type: "null"}},
+		{args: []string{"HGET", "h", "f"}, want: respValue{Type: "null"}},
+		{args: []string{"HLEN", "h"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"TTL", "v"}, want: respValue{Type: "integer", Num: -2}},
+		{args: []string{"EXPIRE", "h", "10"}, want: respValue{Type: "integer", Num: 0}},
+		{args: []string{"DEL", "s", "v", "h"}, want: respValue{Type: "integer", Num: 0}},
+	}
+	for _, tt := range tests {
+		v := do(t, r, w, tt.args...)
+		if v.Type != tt.want.Type || v.Num != tt.want.Num || v.Str != tt.want.Str {
+			t.Errorf("%v = %#v, want %#v", tt.args, v, tt.want)
+		}
+	}
+	if keys := vectorKeys(do(t, r, w, "VSEARCH", "1", "0", "10")); !slices.Equal(keys, []string{"live"}) {
+		t.Errorf("VSEARCH after expiry = %v, want [live]", keys)
+	}
+}
+
+// persistenceInfo returns the fields of INFO persistence.
+func persistenceInfo(t *testing.T, r *bufio.Reader, w *resp.Writer) map[string]string {
+	t.Helper()
+	v := do(t, r, w, "INFO", "persistence")
+	fields := make(map[string]string)
+	for _, line := range strings.Split(v.Bulk, "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// waitForRewrites waits until n AOF rewrites have completed.
+func waitForRewrites(t *testing.T, h *Handler, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.rewrites.count.Load() < n || h.aof.Rewriting() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d AOF rewrites completed, want %d", h.rewrites.count.Load(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandler_BgRewriteAOF(t *testing.T) {
+	h := New(store.New(), tempAOF(t))
+	r, w := startHandler(t, h)
+	do(t, r, w, "CONFIG", "SET", "auto-aof-rewrite-percentage", "0")
+
+	for i := range 100 {
+		do(t, r, w, "SET", "s", strconv.Itoa(i))
+	}
+	do(t, r, w, "SET", "gone", "x")
+	do(t, r, w, "DEL", "gone")
+	do(t, r, w, "HSET", "h", "a", "1", "b", "2")
+	do(t, r, w, "HEXPIRE", "h", "100", "FIELDS", "1", "b")
+	do(t, r, w, "TSET", "v", "1", "2")
+	do(t, r, w, "EXPIRE", "v", "100")
+	grown, _ := h.aof.Size()
+
+	if v := do(t, r, w, "BGREWRITEAOF"); v.Type != "string" {
+		t.Fatalf("BGREWRITEAOF = %#v, want status", v)
+	}
+	waitForRewrites(t, h, 1)
+	current, base := h.aof.Size()
+	if current >= grown || base != current {
+		t.Errorf("AOF size after rewrite = %d (base %d), want below %d and equal to base", current, base, grown)
+	}
+
+	// Writes after the rewrite go to the new file, and replaying it gives the
+	// same dataset.
+	do(t, r, w, "SET", "after", "y")
+	before := dumpStore(h.store)
+	if v := do(t, r, w, "DEBUG", "RELOAD"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("DEBUG RELOAD = %#v, want OK", v)
+	}
+	if after := dumpStore(h.store); !maps.Equal(after, before) {
+		t.Errorf("dataset changed across rewrite and reload:\nbefore %q\nafter  %q", before, after)
+	}
+
+	info := persistenceInfo(t, r, w)
+	for field, want := range map[string]string{
+		"rdb_changes_since_last_save": "1",
+		"aof_enabled":                 "1",
+		"aof_rewrite_in_progress":     "0",
+		"aof_rewrites":                "1",
+		"aof_last_bgrewrite_status":   "ok",
+		"aof_last_auto_rewrite_time":  "0",
+	} {
+		if info[field] != want {
+			t.Errorf("INFO persistence %s = %q, want %q", field, info[field], want)
+		}
+	}
+
+	r, w = startHandler(t, New(store.New(), nil))
+	if v := do(t, r, w, "BGREWRITEAOF"); v.Type != "error" {
+		t.Errorf("BGREWRITEAOF without an AOF = %#v, want error", v)
+	}
+}
+
+func TestHandler_FlushAll(t *testing.T) {
+	for _, rewrite := range []string{"yes", "no"} {
+		t.Run("aof-rewrite-on-flushall "+rewrite, func(t *testing.T) {
+			h := New(store.New(), tempAOF(t))
+			r, w := startHandler(t, h)
+			do(t, r, w, "CONFIG", "SET", "auto-aof-rewrite-percentage", "0")
+			do(t, r, w, "CONFIG", "SET", "aof-rewrite-on-flushall", rewrite)
+
+			do(t, r, w, "SET", "s", "v")
+			do(t, r, w, "HSET", "h", "f", "v")
+			do(t, r, w, "TSET", "v", "1", "2")
+			if v := do(t, r, w, "FLUSHALL"); v.Str != "OK" {
+				t.Fatalf("FLUSHALL = %#v, want OK", v)
+			}
+			if left := dumpStore(h.store); len(left) != 0 {
+				t.Fatalf("keys left after FLUSHALL: %q", left)
+			}
+
+			if rewrite == "yes" {
+				waitForRewrites(t, h, 1)
+				if current, _ := h.aof.Size(); current != 0 {
+					t.Errorf("AOF size after FLUSHALL = %d, want 0", current)
+				}
+			} else if h.rewrites.count.Load() != 0 || h.aof.Rewriting() {
+				t.Errorf("FLUSHALL rewrote the AOF with aof-rewrite-on-flushall no")
+			}
+
+			// Either way, loading the AOF again gives an empty dataset.
+			do(t, r, w, "SET", "after", "x")
+			restarted := New(store.New(), nil)
+			if err := h.aof.Read(func(v resp.Value) { restarted.Execute(v, nil) }); err != nil {
+				t.Fatalf("reading the AOF: %v", err)
+			}
+			if got := dumpStore(restarted.store); len(got) != 1 || got["after"] == "" {
+				t.Errorf("dataset loaded from the AOF = %q, want only after", got)
+			}
+		})
+	}
+
+	r, w := startHandler(t, New(store.New(), nil))
+	do(t, r, w, "SET", "k", "v")
+	if v := do(t, r, w, "FLUSHALL", "async"); v.Str != "OK" {
+		t.Errorf("FLUSHALL ASYNC = %#v, want OK", v)
+	}
+	if v := do(t, r, w, "GET", "k"); v.Type != "null" {
+		t.Errorf("GET after FLUSHALL = %#v, want null", v)
+	}
+	if v := do(t, r, w, "FLUSHALL", "later"); v.Str != "ERR syntax error" {
+		t.Errorf("FLUSHALL later = %#v, want syntax error", v)
+	}
+}
+
+func TestHandler_FlushAllRewriteFails(t *testing.T) {
+	dir := t.TempDir()
+	log, err := aof.New(filepath.Join(dir, "database.aof"))
+	if err != nil {
+		t.Fatalf("Failed to open AOF: %v", err)
+	}
+	t.Cleanup(func() { log.Close() })
+	h := New(store.New(), log)
+	r, w := startHandler(t, h)
+	do(t, r, w, "CONFIG", "SET", "auto-aof-rewrite-percentage", "0")
+	do(t, r, w, "SET", "k", "v")
+
+	// With its directory gone the new AOF can't be created, so the old
+	// dataset stays in the log and FLUSHALL has to say so.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if v := do(t, r, w, "FLUSHALL"); v.Type != "error" || !strings.Contains(v.Str, "rewrite") {
+		t.Fatalf("FLUSHALL with a failing rewrite = %#v, want rewrite error", v)
+	}
+	if got := persistenceInfo(t, r, w)["aof_last_bgrewrite_status"]; got != "err" {
+		t.Errorf("aof_last_bgrewrite_status = %q, want err", got)
+	}
+}
+
+func TestHandler_DirtyCounter(t *testing.T) {
+	h := New(store.New(), tempAOF(t))
+	r, w := startHandler(t, h)
+	do(t, r, w, "CONFIG", "SET", "auto-aof-rewrite-percentage", "0")
+
+	changes := func() string { return persistenceInfo(t, r, w)["rdb_changes_since_last_save"] }
+	if got := changes(); got != "0" {
+		t.Fatalf("rdb_changes_since_last_save at start = %q, want 0", got)
+	}
+	do(t, r, w, "SET", "a", "1")
+	do(t, r, w, "INCR", "a")
+	do(t, r, w, "HSET", "h", "f", "v")
+	do(t, r, w, "GET", "a")
+	if got := changes(); got != "3" {
+		t.Errorf("rdb_changes_since_last_save after 3 writes = %q, want 3", got)
+	}
+
+	do(t, r, w, "BGREWRITEAOF")
+	waitForRewrites(t, h, 1)
+	if got := changes(); got != "0" {
+		t.Errorf("rdb_changes_since_last_save after BGREWRITEAOF = %q, want 0", got)
+	}
+	do(t, r, w, "SET", "b", "1")
+	if got := changes(); got != "1" {
+		t.Errorf("rdb_changes_since_last_save after another write = %q, want 1", got)
+	}
+
+	// Keys evicted to make room for a write aren't client writes themselves.
+	do(t, r, w, "CONFIG", "SET", "maxmemory-policy", "allkeys-lru")
+	do(t, r, w, "CONFIG", "SET", "maxmemory", strconv.FormatInt(h.store.UsedMemory(), 10))
+	do(t, r, w, "SET", "c", "1")
+	do(t, r, w, "SET", "d", "1")
+	evicted := 0
+	for _, key := range []string{"a", "h", "b"} {
+		if _, found := h.store.Type(key); !found {
+			evicted++
+		}
+	}
+	if evicted == 0 {
+		t.Fatal("SET over maxmemory evicted nothing")
+	}
+	if got := changes(); got != "3" {
+		t.Errorf("rdb_changes_since_last_save after writes that evicted = %q, want 3", got)
+	}
+}
+
+func TestHandler_AutoRewriteAOF(t *testing.T) {
+	h := New(store.New(), tempAOF(t))
+	r, w := startHandler(t, h)
+	do(t, r, w, "CONFIG", "SET", "auto-aof-rewrite-min-size", "1kb")
+	do(t, r, w, "CONFIG", "SET", "auto-aof-rewrite-percentage", "100")
+
+	// Below the minimum size nothing happens, however much the file grew.
+	do(t, r, w, "SET", "k", "v")
+	if h.aof.Rewriting() || h.rewrites.count.Load() != 0 {
+		t.Fatal("AOF rewritten below auto-aof-rewrite-min-size")
+	}
+
+	// Overwriting one key past 1kb triggers a rewrite that shrinks the file
+	// back to the single key.
+	start := time.Now().Unix()
+	for i := 0; h.rewrites.count.Load() == 0 && !h.aof.Rewriting(); i++ {
+		if i == 1000 {
+			t.Fatal("no automatic rewrite after 1000 writes")
+		}
+		do(t, r, w, "SET", "k", strconv.Itoa(i))
+	}
+	waitForRewrites(t, h, 1)
+	if current, _ := h.aof.Size(); current >= 1024 {
+		t.Errorf("AOF size after automatic rewrite = %d, want below 1024", current)
+	}
+	info := persistenceInfo(t, r, w)
+	if at, _ := strconv.ParseInt(info["aof_last_auto_rewrite_time"], 10, 64); at < start {
+		t.Errorf("aof_last_auto_rewrite_time = %q, want at least %d", info["aof_last_auto_rewrite_time"], start)
+	}
+
+	// With no minimum, the next one waits for the file to double from its
+	// rewritten size.
+	do(t, r, w, "CONFIG", "SET", "auto-aof-rewrite-min-size", "0")
+	_, base := h.aof.Size()
+	const setLen = int64(len("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nx\r\n"))
+	for {
+		before, _ := h.aof.Size()
+		do(t, r, w, "SET", "k", "x")
+		if h.rewrites.count.Load() > 1 || h.aof.Rewriting() {
+			if size := before + setLen; size < 2*base || before >= 2*base {
+				t.Fatalf("second rewrite started at %d bytes, want it once the file reaches %d", size, 2*base)
+			}
+			break
+		}
+	}
+	waitForRewrites(t, h, 2)
+}
+
+func TestHandler_DebugReload(t *testing.T) {
+	h := New(store.New(), tempAOF(t))
+	r, w := startHandler(t, h)
+
+	for _, cmd := range [][]string{
+		{"SET", "s", "hello"},
+		{"SET", "gone", "x"},
+		{"DEL", "gone"},
+		{"INCRBY", "n", "42"},
+		{"SETBIT", "bits", "9", "1"},
+		{"SET", "ttl", "v"},
+		{"EXPIRE", "ttl", "100"},
+		{"TSET", "v", "1", "2", "3"},
+		{"TMSET", "v2", "2", "0.5", "-1", "v3", "1", "7"},
+		{"TSET", "v16", "FP16", "0.1", "-2"},
+		{"HSET", "h", "a", "1", "b", "2", "c", "3"},
+		{"HDEL", "h", "c"},
+		{"HEXPIRE", "h", "100", "FIELDS", "1", "b"},
+	} {
+		if v := do(t, r, w, cmd...); v.Type == "error" {
+			t.Fatalf("%v: %s", cmd, v.Str)
+		}
+	}
+	before, used := dumpStore(h.store), h.store.UsedMemory()
+
+	if v := do(t, r, w, "DEBUG", "RELOAD"); v.Type != "string" || v.Str != "OK" {
+		t.Fatalf("DEBUG RELOAD = %#v, want OK", v)
+	}
+	if after := dumpStore(h.store); !maps.Equal(after, before) {
+		t.Errorf("dataset changed across DEBUG RELOAD:\nbefore %q\nafter  %q", before, after)
+	}
+	if got := h.store.UsedMemory(); got != used {
+		t.Errorf("used memory after DEBUG RELOAD = %d, want %d", got, used)
+	}
+	if v := do(t, r, w, "OBJECT", "ENCODING", "n"); v.Bulk != "int" {
+		t.Errorf("OBJECT ENCODING n after reload = %#v, want int", v)
+	}
+
+	r, w = startHandler(t, New(store.New(), nil))
+	if v := do(t, r, w, "DEBUG", "RELOAD"); v.Type != "error" {
+		t.Errorf("DEBUG RELOAD without an AOF = %#v, want error", v)
+	}
+}
+
+func TestHandler_DebugObject(t *testing.T) {
+	r, w := startHandler(t, New(store.New(), nil))
+
+	do(t, r, w, "SET", "s", "hello")
+	do(t, r, w, "SET", "n", "42")
+	do(t, r, w, "TSET", "v", "1", "2", "3")
+	do(t, r, w, "HSET", "h", "a", "1", "b", "2")
+
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{"s", []string{"type:string", "encoding:raw", "lru_seconds_idle:0"}},
+		{"n", []string{"type:string", "encoding:int"}},
+		{"v", []string{"type:vector", "encoding:float32vector", "dim:3"}},
+		{"h", []string{"type:hash", "encoding:listpack", "fields:2"}},
+	}
+	for _, tt := range tests {
+		v := do(t, r, w, "DEBUG", "OBJECT", tt.key)
+		if v.Type != "string" {
+			t.Fatalf("DEBUG OBJECT %s = %#v, want status string", tt.key, v)
+		}
+		fields := strings.Fields(v.Str)
+		for _, want := range tt.want {
+			if !slices.Contains(fields, want) {
+				t.Errorf("DEBUG OBJECT %s = %q, missing %q", tt.key, v.Str, want)
+			}
+		}
+	}
+
+	// serializedlength is the length of the DUMP payload.
+	dump := do(t, r, w, "DUMP", "v")
+	v := do(t, r, w, "DEBUG", "OBJECT", "v")
+	if want := fmt.Sprintf("serializedlength:%d", len(dump.Bulk)); !strings.Contains(v.Str, want) {
+		t.Errorf("DEBUG OBJECT v = %q, want %s", v.Str, want)
+	}
+
+	if v := do(t, r, w, "DEBUG", "OBJECT", "missing"); v.Type != "error" || v.Str != "ERR no such key" {
+		t.Errorf("DEBUG OBJECT missing = %#v, want no such key", v)
+	}
+	if v := do(t, r, w, "DEBUG", "NOPE"); v.Type != "error" {
+		t.Errorf("DEBUG NOPE = %#v, want error", v)
+	}
+}
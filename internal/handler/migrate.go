@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"fmt"
+	"jellyfish/internal/codec"
+	"jellyfish/internal/resp"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMigrateTimeout is used when MIGRATE is given a timeout of 0, as in Redis.
+const defaultMigrateTimeout = time.Second
+
+// migration is a parsed MIGRATE command.
+type migration struct {
+	addr, key        string
+	timeout          time.Duration
+	copyKey, replace bool
+}
+
+// parseMigrate parses the arguments of MIGRATE host port key destination-db
+// timeout [COPY] [REPLACE], returning an error reply if they are invalid.
+func parseMigrate(args []resp.Value) (migration, resp.Value, bool) {
+	port, err := strconv.Atoi(args[1].Bulk)
+	if err != nil || port <= 0 || port > 65535 {
+		return migration{}, resp.Value{Type: "error", Str: "ERR Invalid port"}, false
+	}
+	m := migration{addr: net.JoinHostPort(args[0].Bulk, strconv.Itoa(port)), key: args[2].Bulk}
+
+	db, err := strconv.Atoi(args[3].Bulk)
+	if err != nil {
+		return migration{}, resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}, false
+	}
+	if db != 0 {
+		return migration{}, resp.Value{Type: "error", Str: "ERR DB index is out of range"}, false
+	}
+	ms, err := strconv.ParseInt(args[4].Bulk, 10, 64)
+	if err != nil {
+		return migration{}, resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}, false
+	}
+	// Timeouts too long for a time.Duration are clamped to the longest one
+	// rather than wrapping around.
+	m.timeout = time.Duration(min(ms, math.MaxInt64/int64(time.Millisecond))) * time.Millisecond
+	if m.timeout <= 0 {
+		m.timeout = defaultMigrateTimeout
+	}
+
+	for _, arg := range args[5:] {
+		switch strings.ToUpper(arg.Bulk) {
+		case "COPY":
+			m.copyKey = true
+		case "REPLACE":
+			m.replace = true
+		default:
+			return migration{}, resp.Value{Type: "error", Str: "ERR syntax error"}, false
+		}
+	}
+	return m, resp.Value{}, true
+}
+
+// restoreWithoutLock returns the RESTORE command that recreates the key on the
+// target, with the remaining TTL so the two clocks don't need to agree, and
+// the key's serialized value. ok is false if the key doesn't exist. Caller
+// must hold the lock.
+func (m migration) restoreWithoutLock(h *Handler) (restore resp.Value, payload string, ok bool) {
+	item, ok := h.store.GetItemWithoutLock(m.key)
+	if !ok {
+		return resp.Value{}, "", false
+	}
+	ttl := int64(0)
+	if !item.ExpiresAt.IsZero() {
+		ttl = max(item.ExpiresAt.Sub(h.store.Now()).Milliseconds(), 1)
+	}
+	payload = string(codec.Encode(item))
+	restore = bulkCommand("RESTORE", m.key, strconv.FormatInt(ttl, 10), payload)
+	if m.replace {
+		restore.Array = append(restore.Array, resp.Value{Type: "bulk", Bulk: "REPLACE"})
+	}
+	return restore, payload, true
+}
+
+// send sends restore to the target and returns an error reply unless the
+// target accepted it.
+func (m migration) send(restore resp.Value) (resp.Value, bool) {
+	reply, err := sendCommand(m.addr, m.timeout, restore)
+	if err != nil {
+		return resp.Value{Type: "error", Str: fmt.Sprintf("IOERR error or timeout talking to target instance: %v", err)}, false
+	}
+	if reply.Type == "error" {
+		return resp.Value{Type: "error", Str: "ERR Target instance replied with error: " + reply.Str}, false
+	}
+	return resp.Value{}, true
+}
+
+// deleteWithoutLock deletes the migrated key from this server, unless COPY
+// was given. Caller must hold the lock.
+func (m migration) deleteWithoutLock(h *Handler) resp.Value {
+	if !m.copyKey {
+		if err := h.writeAOF(bulkCommand("DEL", m.key)); err != nil {
+			return resp.Value{Type: "error", Str: aofWriteError}
+		}
+		h.store.DelWithoutLock(m.key)
+	}
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// MIGRATE host port key destination-db timeout [COPY] [REPLACE]
+//
+// The key is serialized as for DUMP and sent to the target as a RESTORE.
+// Unless COPY is given the local key is deleted once the target has accepted
+// it. A client's MIGRATE is run by Handler.migrate, which talks to the target
+// without holding the store lock; this is MIGRATE inside a transaction, which
+// keeps its keys locked until the target replies or timeout milliseconds pass.
+func migrateCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	m, errReply, ok := parseMigrate(args)
+	if !ok {
+		return errReply
+	}
+	restore, _, ok := m.restoreWithoutLock(h)
+	if !ok {
+		return resp.Value{Type: "string", Str: "NOKEY"}
+	}
+	if errReply, ok := m.send(restore); !ok {
+		return errReply
+	}
+	return m.deleteWithoutLock(h)
+}
+
+// migrate runs MIGRATE for a client outside a transaction. The key is read
+// under its shard lock, but the lock is released while talking to the
+// target, so that a slow target doesn't stall every client using the shard.
+// The key is deleted afterwards only if it still holds the value that was
+// sent; if it was written meanwhile, the newer value is kept.
+func (h *Handler) migrate(value resp.Value) resp.Value {
+	start := time.Now()
+	defer func() { h.stats["MIGRATE"].record(time.Since(start)) }()
+
+	m, errReply, ok := parseMigrate(value.Array[1:])
+	if !ok {
+		return errReply
+	}
+	keys := []string{m.key}
+	h.store.LockKeys(keys)
+	restore, payload, ok := m.restoreWithoutLock(h)
+	h.store.UnlockKeys(keys)
+	if !ok {
+		return resp.Value{Type: "string", Str: "NOKEY"}
+	}
+	if errReply, ok := m.send(restore); !ok {
+		return errReply
+	}
+
+	h.store.LockKeys(keys)
+	defer h.store.UnlockKeys(keys)
+	if item, ok := h.store.PeekItemWithoutLock(m.key); !ok || string(codec.Encode(item)) != payload {
+		return resp.Value{Type: "string", Str: "OK"}
+	}
+	return m.deleteWithoutLock(h)
+}
+
+// sendCommand sends one command to the server at addr over a new connection
+// and returns its reply. The whole exchange must finish within timeout.
+func sendCommand(addr string, timeout time.Duration, cmd resp.Value) (resp.Value, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return resp.Value{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := resp.NewWriter(conn).Write(cmd); err != nil {
+		return resp.Value{}, err
+	}
+	return resp.NewReader(conn).Read()
+}
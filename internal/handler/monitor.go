@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"jellyfish/internal/resp"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// monitorBacklog is how many lines may be queued for a monitor before it is
+// considered too slow and disconnected, so monitors never block command processing.
+const monitorBacklog = 10000
+
+// monitors is the set of connections that issued MONITOR.
+type monitors struct {
+	mu  sync.Mutex
+	set map[*monitor]struct{}
+}
+
+// monitor is a connection receiving a line for every command the server runs.
+type monitor struct {
+	conn net.Conn
+	ch   chan string
+	done chan struct{} // closed when the writer goroutine exits
+	once sync.Once
+}
+
+func newMonitors() *monitors {
+	return &monitors{set: make(map[*monitor]struct{})}
+}
+
+// add registers conn as a monitor and starts writing lines to out, the
+// connection's output buffer. The OK reply to MONITOR is written by the same
+// goroutine, after registration, so the client can't issue a command that the
+// monitor misses once it has seen OK.
+func (m *monitors) add(conn net.Conn, out io.Writer) *monitor {
+	mon := &monitor{conn: conn, ch: make(chan string, monitorBacklog), done: make(chan struct{})}
+
+	m.mu.Lock()
+	m.set[mon] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		defer close(mon.done)
+		w := resp.NewWriter(out)
+		if err := w.Write(resp.Value{Type: "string", Str: "OK"}); err != nil {
+			m.remove(mon)
+			return
+		}
+		for line := range mon.ch {
+			if err := w.Write(resp.Value{Type: "string", Str: line}); err != nil {
+				m.remove(mon)
+				return
+			}
+		}
+	}()
+	return mon
+}
+
+// unregisterWithoutLock removes mon from the set and stops its writer.
+// Caller must hold m.mu.
+func (m *monitors) unregisterWithoutLock(mon *monitor) {
+	if _, ok := m.set[mon]; ok {
+		delete(m.set, mon)
+		close(mon.ch)
+	}
+}
+
+// remove unregisters mon and closes its connection.
+func (m *monitors) remove(mon *monitor) {
+	m.mu.Lock()
+	m.unregisterWithoutLock(mon)
+	m.mu.Unlock()
+	mon.close()
+}
+
+// detach unregisters mon but keeps its connection open, returning once the
+// writer goroutine has flushed and exited so the caller can write to the
+// connection again.
+func (m *monitors) detach(mon *monitor) {
+	m.mu.Lock()
+	m.unregisterWithoutLock(mon)
+	m.mu.Unlock()
+	<-mon.done
+}
+
+func (mon *monitor) close() {
+	mon.once.Do(func() { mon.conn.Close() })
+}
+
+// feed sends a command issued by the client at addr to every monitor. A
+// monitor whose backlog is full is dropped rather than blocking the caller.
+func (m *monitors) feed(addr string, value resp.Value) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.set) == 0 {
+		return
+	}
+
+	line := monitorLine(time.Now(), addr, value)
+	for mon := range m.set {
+		select {
+		case mon.ch <- line:
+		default:
+			m.unregisterWithoutLock(mon)
+			mon.close()
+		}
+	}
+}
+
+// monitorLine formats a command the way Redis MONITOR does:
+// 1339518083.107412 [0 127.0.0.1:60866] "set" "key" "value"
+func monitorLine(now time.Time, addr string, value resp.Value) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d.%06d [0 %s]", now.Unix(), now.Nanosecond()/1000, addr)
+	for i, arg := range value.Array {
+		b.WriteByte(' ')
+		if isSecretArg(value, i) {
+			b.WriteString(`"(redacted)"`)
+			continue
+		}
+		b.WriteString(quoteArg(arg.Bulk))
+	}
+	return b.String()
+}
+
+// quoteArg renders s in double quotes, escaping quotes, backslashes and
+// non-printable bytes so binary arguments stay on one line.
+func quoteArg(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errOutputLimit is returned for writes to a connection closed because its
+// pending output passed client-output-buffer-limit.
+var errOutputLimit = errors.New("client output buffer limit reached")
+
+// outputDrainTimeout bounds how long closing a connection waits for its
+// pending output to be sent.
+const outputDrainTimeout = time.Second
+
+// outputBuffer queues the replies for one connection and sends them from its
+// own goroutine, so a client that stops reading never blocks the server. Once
+// more than the limit is pending, the connection is closed instead of letting
+// the queue grow; a client that reads its replies keeps the queue short and is
+// never affected.
+type outputBuffer struct {
+	conn    net.Conn
+	limit   func() int64 // current limit in bytes, 0 for none
+	noEvict atomic.Bool  // set by CLIENT NO-EVICT to ignore the limit
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      []byte // queued, not yet handed to conn
+	inFlight int    // bytes being written to conn
+	closed   bool
+	err      error         // set once conn failed or was closed for the limit
+	done     chan struct{} // closed when the writer goroutine exits
+}
+
+func newOutputBuffer(conn net.Conn, limit func() int64) *outputBuffer {
+	b := &outputBuffer{conn: conn, limit: limit, done: make(chan struct{})}
+	b.cond = sync.NewCond(&b.mu)
+	go b.writeLoop()
+	return b
+}
+
+// Write queues p for the connection.
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	if limit := b.limit(); limit > 0 && !b.noEvict.Load() && int64(len(b.buf)+b.inFlight+len(p)) > limit {
+		b.fail(errOutputLimit)
+		b.conn.Close()
+		return 0, b.err
+	}
+	b.buf = append(b.buf, p...)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// pending returns the number of bytes queued or being written.
+func (b *outputBuffer) pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buf) + b.inFlight
+}
+
+// drain waits until everything queued has been written, so that the caller
+// can write to the connection directly. It returns early if the connection fails.
+func (b *outputBuffer) drain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for (len(b.buf) > 0 || b.inFlight > 0) && b.err == nil {
+		b.cond.Wait()
+	}
+}
+
+// close stops the writer goroutine once the queue is empty, waiting up to
+// outputDrainTimeout for the last replies to be sent.
+func (b *outputBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-time.After(outputDrainTimeout):
+	}
+}
+
+// fail records err and drops the queue. Caller must hold b.mu.
+func (b *outputBuffer) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+	b.buf = nil
+	b.cond.Broadcast()
+}
+
+func (b *outputBuffer) writeLoop() {
+	defer close(b.done)
+	for {
+		b.mu.Lock()
+		for len(b.buf) == 0 && !b.closed && b.err == nil {
+			b.cond.Wait()
+		}
+		if len(b.buf) == 0 || b.err != nil {
+			b.mu.Unlock()
+			return
+		}
+		data := b.buf
+		b.buf = nil
+		b.inFlight = len(data)
+		b.mu.Unlock()
+
+		_, err := b.conn.Write(data)
+
+		b.mu.Lock()
+		b.inFlight = 0
+		if err != nil {
+			b.fail(err)
+		}
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,492 @@
+package handler
+
+import (
+	"fmt"
+	"jellyfish/internal/codec"
+	"jellyfish/internal/resp"
+	"jellyfish/internal/store"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicaBacklog bounds the commands buffered for a replica that is not
+	// keeping up. A replica that overflows it is disconnected and must resync.
+	replicaBacklog = 10000
+
+	// replicaRetryInterval is how long a replica waits before reconnecting to
+	// its master after the link drops.
+	replicaRetryInterval = time.Second
+
+	// replicaAckInterval is how often a replica reports its applied offset to
+	// the master when it hasn't been asked to.
+	replicaAckInterval = time.Second
+
+	readOnlyError = "READONLY You can't write against a read only replica."
+)
+
+// replication holds both sides of the replication state for a Handler: the
+// replicas attached to this server and, if this server is itself a replica,
+// the link to its master.
+//
+// The replication offset counts the commands streamed to replicas. Replicas
+// report the offset they have applied with REPLCONF ACK, which WAIT uses to
+// tell which of them have seen a client's writes.
+type replication struct {
+	mu       sync.Mutex
+	replicas map[*replica]struct{}
+	master   *masterLink
+	offset   int64
+	acked    chan struct{} // closed and replaced whenever a replica acks
+}
+
+// replica is a downstream connection that receives every AOF-logged command.
+type replica struct {
+	conn      net.Conn
+	ch        chan resp.Value
+	once      sync.Once
+	ackOffset int64 // guarded by replication.mu
+}
+
+// masterLink is the replica-side connection to an upstream master.
+type masterLink struct {
+	addr string
+	done chan struct{}
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newReplication() *replication {
+	return &replication{
+		replicas: make(map[*replica]struct{}),
+		acked:    make(chan struct{}),
+	}
+}
+
+// isReplica reports whether this server is following a master.
+func (r *replication) isReplica() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.master != nil
+}
+
+// propagate fans value out to every attached replica without blocking. A
+// replica whose backlog is full is dropped.
+func (r *replication) propagate(value resp.Value) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.replicas) == 0 {
+		return
+	}
+	r.offset++
+
+	for rep := range r.replicas {
+		select {
+		case rep.ch <- value:
+		default:
+			fmt.Println("replica backlog full, disconnecting", rep.conn.RemoteAddr())
+			delete(r.replicas, rep)
+			rep.close()
+		}
+	}
+}
+
+// currentOffset returns the offset of the last command streamed to replicas.
+func (r *replication) currentOffset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.offset
+}
+
+// ack records that rep has applied the stream up to offset and wakes WAIT callers.
+func (r *replication) ack(rep *replica, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if offset > rep.ackOffset {
+		rep.ackOffset = offset
+	}
+	close(r.acked)
+	r.acked = make(chan struct{})
+}
+
+// countAcked returns how many replicas have acknowledged offset, and a channel
+// that is closed on the next acknowledgment.
+func (r *replication) countAcked(offset int64) (int, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for rep := range r.replicas {
+		if rep.ackOffset >= offset {
+			n++
+		}
+	}
+	return n, r.acked
+}
+
+// wait blocks until numReplicas replicas have acknowledged offset or the
+// timeout elapses (0 waits forever), returning how many have acknowledged.
+func (r *replication) wait(offset int64, numReplicas int, timeout time.Duration) int {
+	n, acked := r.countAcked(offset)
+	if n >= numReplicas {
+		return n
+	}
+
+	// Ask replicas to report their offset now instead of at their next tick.
+	r.propagate(bulkCommand("REPLCONF", "GETACK", "*"))
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-acked:
+		case <-expired:
+			n, _ = r.countAcked(offset)
+			return n
+		}
+		if n, acked = r.countAcked(offset); n >= numReplicas {
+			return n
+		}
+	}
+}
+
+func (rep *replica) close() {
+	rep.once.Do(func() {
+		close(rep.ch)
+		rep.conn.Close()
+	})
+}
+
+// syncReplica turns conn into a replica: it captures the dataset and registers
+// the replica under the store lock so no write can slip between the snapshot
+// and the start of the stream, then sends the snapshot followed by every
+// propagated command until the connection fails.
+//
+// The stream opens with FULLRESYNC <offset> <count>, giving the replication
+// offset the snapshot corresponds to and the number of snapshot commands.
+func (h *Handler) syncReplica(conn net.Conn) *replica {
+	rep := &replica{conn: conn, ch: make(chan resp.Value, replicaBacklog)}
+
+	h.store.Lock()
+	snapshot := snapshotCommands(h.store.ItemsWithoutLock())
+	h.repl.mu.Lock()
+	h.repl.replicas[rep] = struct{}{}
+	rep.ackOffset = h.repl.offset
+	offset := h.repl.offset
+	h.repl.mu.Unlock()
+	h.store.Unlock()
+
+	go func() {
+		w := resp.NewWriter(conn)
+		defer h.dropReplica(rep)
+
+		header := bulkCommand("FULLRESYNC", strconv.FormatInt(offset, 10), strconv.Itoa(len(snapshot)))
+		if err := w.Write(header); err != nil {
+			return
+		}
+		for _, cmd := range snapshot {
+			if err := w.Write(cmd); err != nil {
+				return
+			}
+		}
+		for cmd := range rep.ch {
+			if err := w.Write(cmd); err != nil {
+				return
+			}
+		}
+	}()
+
+	return rep
+}
+
+func (h *Handler) dropReplica(rep *replica) {
+	h.repl.mu.Lock()
+	delete(h.repl.replicas, rep)
+	h.repl.mu.Unlock()
+	rep.close()
+}
+
+// snapshotCommands renders items as one RESTORE per key carrying its value
+// and absolute expiry, ordered by key so the output is deterministic. It is
+// both the full sync sent to replicas and the content of a rewritten AOF.
+func snapshotCommands(items map[string]store.Item) []resp.Value {
+	cmds := make([]resp.Value, 0, len(items))
+	for _, key := range slices.Sorted(maps.Keys(items)) {
+		cmds = append(cmds, bulkCommand("RESTORE", key, "0", string(codec.Encode(items[key])), "REPLACE"))
+	}
+	return cmds
+}
+
+// bulkCommand builds a RESP command array from plain strings.
+func bulkCommand(args ...string) resp.Value {
+	arr := make([]resp.Value, len(args))
+	for i, a := range args {
+		arr[i] = resp.Value{Type: "bulk", Bulk: a}
+	}
+	return resp.Value{Type: "array", Array: arr}
+}
+
+// REPLICAOF host port | REPLICAOF NO ONE
+func replicaofCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	if strings.EqualFold(args[0].Bulk, "NO") && strings.EqualFold(args[1].Bulk, "ONE") {
+		h.repl.mu.Lock()
+		link := h.repl.master
+		h.repl.master = nil
+		h.repl.mu.Unlock()
+		if link != nil {
+			link.stop()
+		}
+		return resp.Value{Type: "string", Str: "OK"}
+	}
+
+	port, err := strconv.Atoi(args[1].Bulk)
+	if err != nil || port <= 0 || port > 65535 {
+		return resp.Value{Type: "error", Str: "ERR Invalid master port"}
+	}
+	addr := net.JoinHostPort(args[0].Bulk, strconv.Itoa(port))
+
+	h.repl.mu.Lock()
+	old := h.repl.master
+	if old != nil && old.addr == addr {
+		h.repl.mu.Unlock()
+		return resp.Value{Type: "string", Str: "OK Already connected to specified master"}
+	}
+	link := &masterLink{addr: addr, done: make(chan struct{})}
+	h.repl.master = link
+	h.repl.mu.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+	go h.followMaster(link)
+	return resp.Value{Type: "string", Str: "OK"}
+}
+
+// stop ends the link and closes its connection so the reader unblocks.
+func (l *masterLink) stop() {
+	close(l.done)
+	l.mu.Lock()
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	l.mu.Unlock()
+}
+
+func (l *masterLink) stopped() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// followMaster keeps a replica in sync with its master until the link is
+// stopped, reconnecting and resyncing whenever the connection drops.
+func (h *Handler) followMaster(link *masterLink) {
+	for !link.stopped() {
+		if err := h.syncFromMaster(link); err != nil && !link.stopped() {
+			fmt.Println("replication error:", err)
+		}
+
+		select {
+		case <-link.done:
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// syncFromMaster performs a full sync from the master and then applies its
+// command stream until the connection fails or the link is stopped.
+func (h *Handler) syncFromMaster(link *masterLink) error {
+	conn, err := net.DialTimeout("tcp", link.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	link.mu.Lock()
+	if link.stopped() {
+		link.mu.Unlock()
+		return nil
+	}
+	link.conn = conn
+	link.mu.Unlock()
+
+	// The read loop and the periodic ack both write to the master.
+	var wmu sync.Mutex
+	w := resp.NewWriter(conn)
+	send := func(v resp.Value) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		return w.Write(v)
+	}
+
+	if err := send(bulkCommand("SYNC")); err != nil {
+		return err
+	}
+
+	r := resp.NewReader(conn)
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+	if len(header.Array) != 3 || header.Array[0].Bulk != "FULLRESYNC" {
+		return fmt.Errorf("unexpected sync header from master")
+	}
+	start, err1 := strconv.ParseInt(header.Array[1].Bulk, 10, 64)
+	count, err2 := strconv.Atoi(header.Array[2].Bulk)
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("malformed sync header from master")
+	}
+
+	// A full sync replaces whatever this replica held before. The flush goes
+	// through FLUSHALL so that it is logged to the replica's own AOF too, and
+	// a restart doesn't bring back keys the snapshot no longer has.
+	h.Execute(bulkCommand("FLUSHALL"), nil)
+
+	for range count {
+		value, err := r.Read()
+		if err != nil {
+			return err
+		}
+		if value.Type == "array" && len(value.Array) > 0 {
+			h.Execute(value, nil)
+		}
+	}
+
+	var offset atomic.Int64
+	offset.Store(start)
+	ack := func() error {
+		return send(bulkCommand("REPLCONF", "ACK", strconv.FormatInt(offset.Load(), 10)))
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(replicaAckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if ack() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		value, err := r.Read()
+		if err != nil {
+			return err
+		}
+		if value.Type != "array" || len(value.Array) == 0 {
+			continue
+		}
+
+		if strings.EqualFold(value.Array[0].Bulk, "REPLCONF") {
+			offset.Add(1)
+			if err := ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		h.Execute(value, nil)
+		offset.Add(1)
+	}
+}
+
+// WAIT numreplicas timeout
+// Inside a transaction, which holds the store lock, WAIT doesn't block: it
+// replies at once with the number of replicas that have already acknowledged.
+func (h *Handler) waitCommand(args []resp.Value, sess *session, block bool) resp.Value {
+	if h.repl.isReplica() {
+		return resp.Value{Type: "error", Str: "ERR WAIT cannot be used with replica instances"}
+	}
+	numReplicas, err := strconv.Atoi(args[0].Bulk)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	timeout, err := strconv.Atoi(args[1].Bulk)
+	if err != nil || timeout < 0 {
+		return resp.Value{Type: "error", Str: "ERR timeout is negative"}
+	}
+
+	if !block {
+		n, _ := h.repl.countAcked(sess.writeOffset)
+		return resp.Value{Type: "integer", Num: n}
+	}
+	n := h.repl.wait(sess.writeOffset, numReplicas, time.Duration(timeout)*time.Millisecond)
+	return resp.Value{Type: "integer", Num: n}
+}
+
+// WAITAOF numlocal numreplicas timeout
+// Replies with the number of AOFs, local (0 or 1) and on replicas, that hold
+// the client's writes. The local AOF counts once they are synced to disk.
+// Replicas don't report their own fsyncs, so a replica counts once it has
+// acknowledged them, as for WAIT. Inside a transaction WAITAOF doesn't block.
+func (h *Handler) waitAOFCommand(args []resp.Value, sess *session, block bool) resp.Value {
+	if h.repl.isReplica() {
+		return resp.Value{Type: "error", Str: "ERR WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated."}
+	}
+	numLocal, err := strconv.Atoi(args[0].Bulk)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	numReplicas, err := strconv.Atoi(args[1].Bulk)
+	if err != nil {
+		return resp.Value{Type: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	timeout, err := strconv.Atoi(args[2].Bulk)
+	if err != nil || timeout < 0 {
+		return resp.Value{Type: "error", Str: "ERR timeout is negative"}
+	}
+	if numLocal > 0 && h.aof == nil {
+		return resp.Value{Type: "error", Str: "ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled."}
+	}
+
+	reply := func(local bool, replicas int) resp.Value {
+		n := 0
+		if local {
+			n = 1
+		}
+		return resp.Value{Type: "array", Array: []resp.Value{{Type: "integer", Num: n}, {Type: "integer", Num: replicas}}}
+	}
+	local := h.aof != nil && h.aof.SyncedOffset() >= sess.aofOffset
+	if !block || numReplicas <= 0 && (local || numLocal <= 0) {
+		n, _ := h.repl.countAcked(sess.writeOffset)
+		return reply(local, n)
+	}
+
+	// The local AOF and the replicas share the timeout.
+	wait := time.Duration(timeout) * time.Millisecond
+	deadline := time.Now().Add(wait)
+	if !local && numLocal > 0 {
+		local = h.aof.WaitSynced(sess.aofOffset, wait)
+	}
+	if wait > 0 {
+		wait = max(time.Until(deadline), time.Millisecond)
+	}
+	return reply(local, h.repl.wait(sess.writeOffset, numReplicas, wait))
+}
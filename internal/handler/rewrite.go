@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"io"
+	"jellyfish/internal/resp"
+	"sync/atomic"
+	"time"
+)
+
+// AOF rewriting.
+//
+// BGREWRITEAOF replaces the append-only file with the shortest one that
+// rebuilds the current dataset: one RESTORE per key, carrying its absolute
+// expiry the way RESTORE itself is logged. The dataset is encoded with every
+// shard locked, then written out in the background while commands keep
+// running; their writes still go to the old file, and are appended to the new
+// one before it takes its place.
+//
+// With auto-aof-rewrite-percentage above 0, a rewrite also starts by itself
+// once the file has grown by that percentage over its size after the last
+// rewrite and is at least auto-aof-rewrite-min-size. This is checked after
+// every command.
+
+const (
+	defaultAutoAOFRewritePercentage = 100      // auto-aof-rewrite-percentage
+	defaultAutoAOFRewriteMinSize    = 64 << 20 // auto-aof-rewrite-min-size
+
+	// autoRewriteRetryDelay is how long an automatic rewrite waits after one
+	// that failed, so that a full disk doesn't start one after every command.
+	autoRewriteRetryDelay = time.Minute
+)
+
+// aofRewrites records the outcome of rewrites for INFO persistence.
+type aofRewrites struct {
+	count      atomic.Int64 // rewrites completed
+	lastFailed atomic.Bool  // whether the last rewrite failed
+	lastStart  atomic.Int64 // unix nanoseconds the last rewrite started
+	lastAuto   atomic.Int64 // unix seconds the last automatic rewrite started, 0 for never
+}
+
+// BGREWRITEAOF
+// BGREWRITEAOF has no key arguments, so it runs with every shard locked.
+func bgrewriteaofCommand(h *Handler, value resp.Value, args []resp.Value) resp.Value {
+	if h.aof == nil {
+		return resp.Value{Type: "error", Str: "ERR BGREWRITEAOF needs appendonly persistence to rewrite"}
+	}
+	if err := h.startAOFRewriteWithoutLock(); err != nil {
+		return resp.Value{Type: "error", Str: "ERR Background append only file rewriting already in progress"}
+	}
+	return resp.Value{Type: "string", Str: "Background append only file rewriting started"}
+}
+
+// startAOFRewriteWithoutLock snapshots the dataset and starts writing it to a
+// new AOF in the background. It fails if a rewrite is already running. Caller
+// must hold every shard's lock.
+func (h *Handler) startAOFRewriteWithoutLock() error {
+	finish, err := h.beginAOFRewriteWithoutLock()
+	if err != nil {
+		return err
+	}
+	go finish()
+	return nil
+}
+
+// beginAOFRewriteWithoutLock snapshots the dataset and returns the function
+// that writes it to the new AOF, which need not hold the lock. It fails if a
+// rewrite is already running. Caller must hold every shard's lock.
+func (h *Handler) beginAOFRewriteWithoutLock() (finish func() error, err error) {
+	if err := h.aof.StartRewrite(); err != nil {
+		return nil, err
+	}
+	h.rewrites.lastStart.Store(time.Now().UnixNano())
+	// The snapshot holds every write counted so far. Once it is on disk they
+	// no longer count as unsaved, but writes made meanwhile still do.
+	dirty := h.dirty.Load()
+
+	// Items share their values with the store, so they are encoded now,
+	// while the lock is held.
+	cmds := snapshotCommands(h.store.ItemsWithoutLock())
+
+	return func() error {
+		err := h.aof.FinishRewrite(func(w io.Writer) error {
+			rw := resp.NewWriter(w)
+			for _, cmd := range cmds {
+				if err := rw.Write(cmd); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		h.rewrites.lastFailed.Store(err != nil)
+		if err == nil {
+			h.rewrites.count.Add(1)
+			h.dirty.Add(-dirty)
+		}
+		return err
+	}, nil
+}
+
+// maybeRewriteAOF starts a rewrite if the AOF has grown past the
+// auto-aof-rewrite thresholds. Caller must not hold any shard's lock.
+func (h *Handler) maybeRewriteAOF() {
+	if h.aof == nil || !h.autoRewriteDue() {
+		return
+	}
+	h.store.Lock()
+	defer h.store.Unlock()
+	if h.autoRewriteDue() && h.startAOFRewriteWithoutLock() == nil {
+		h.rewrites.lastAuto.Store(time.Now().Unix())
+	}
+}
+
+// autoRewriteDue reports whether the AOF has grown enough for an automatic
+// rewrite and none is running.
+func (h *Handler) autoRewriteDue() bool {
+	percentage := h.config.autoAOFRewritePercentage.Load()
+	current, base := h.aof.Size()
+	if percentage == 0 || current < h.config.autoAOFRewriteMinSize.Load() {
+		return false
+	}
+	if (current-base)*100 < percentage*max(base, 1) {
+		return false
+	}
+	if h.rewrites.lastFailed.Load() && time.Since(time.Unix(0, h.rewrites.lastStart.Load())) < autoRewriteRetryDelay {
+		return false
+	}
+	return !h.aof.Rewriting()
+}
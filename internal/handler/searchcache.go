@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"container/list"
+	"encoding/binary"
+	"jellyfish/internal/resp"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VSEARCH result cache.
+//
+// VSEARCH ranks every stored vector, so a read-heavy workload repeating the
+// same queries does the same work over and over. With vsearch-cache enabled,
+// replies are kept in an LRU cache of vsearch-cache-size entries, keyed by the
+// query normalized to unit length (cosine distance ignores magnitude), K,
+// OFFSET and EXCLUDE. Each entry records the store's vector generation, which
+// changes on every vector write or delete, and the earliest expiry among the
+// vectors ranked, so an entry is only used while neither has moved on.
+
+const defaultSearchCacheSize = 1024 // vsearch-cache-size
+
+type searchCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // of *searchEntry, most recently used first
+}
+
+type searchEntry struct {
+	key        string
+	gen        uint64    // store.VectorGeneration when the reply was computed
+	validUntil time.Time // earliest vector expiry, zero for none
+	reply      resp.Value
+}
+
+func newSearchCache() *searchCache {
+	return &searchCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the cached reply for key if it was computed at generation gen
+// and no vector it ranked has expired by now.
+func (c *searchCache) get(key string, gen uint64, now time.Time) (resp.Value, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return resp.Value{}, false
+	}
+	e := el.Value.(*searchEntry)
+	if e.gen != gen || (!e.validUntil.IsZero() && !now.Before(e.validUntil)) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return resp.Value{}, false
+	}
+	c.order.MoveToFront(el)
+	return e.reply, true
+}
+
+// put caches reply under key, evicting the least recently used entries to
+// keep at most size.
+func (c *searchCache) put(key string, gen uint64, validUntil time.Time, reply resp.Value, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&searchEntry{key: key, gen: gen, validUntil: validUntil, reply: reply})
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*searchEntry).key)
+	}
+}
+
+// reset empties the cache.
+func (c *searchCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.order.Len() > 0 {
+		clear(c.entries)
+		c.order.Init()
+	}
+}
+
+// searchCacheKey identifies a VSEARCH query for the cache. The query is
+// scaled to unit length first, so queries that differ only in magnitude,
+// which rank vectors the same way, share an entry.
+func searchCacheKey(query []float32, k int, opts vsearchOptions) string {
+	var sumSq float64
+	for _, v := range query {
+		sumSq += float64(v) * float64(v)
+	}
+	norm := math.Sqrt(sumSq)
+	if norm == 0 {
+		norm = 1
+	}
+
+	b := make([]byte, 0, 4*len(query)+32+len(opts.exclude))
+	b = binary.AppendUvarint(b, uint64(len(query)))
+	for _, v := range query {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(float64(v)/norm)))
+	}
+	b = strconv.AppendInt(b, int64(k), 10)
+	b = strconv.AppendInt(append(b, ' '), int64(opts.offset), 10)
+	if opts.hasExclude {
+		b = append(append(b, ' '), opts.exclude...)
+	}
+	return string(b)
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// commandStats accumulates call counts and latency for one command. Counters
+// are atomic so recording a call never takes a lock.
+type commandStats struct {
+	calls   atomic.Int64
+	usec    atomic.Int64
+	usecMax atomic.Int64
+}
+
+// record adds one call that took elapsed.
+func (s *commandStats) record(elapsed time.Duration) {
+	usec := elapsed.Microseconds()
+	s.calls.Add(1)
+	s.usec.Add(usec)
+	for {
+		max := s.usecMax.Load()
+		if usec <= max || s.usecMax.CompareAndSwap(max, usec) {
+			return
+		}
+	}
+}
+
+func (s *commandStats) reset() {
+	s.calls.Store(0)
+	s.usec.Store(0)
+	s.usecMax.Store(0)
+}
+
+// newCommandStats allocates a counter for every command in the table. The map
+// itself is never modified afterwards, so it can be read without locking.
+func newCommandStats() map[string]*commandStats {
+	stats := make(map[string]*commandStats, len(commandTable))
+	for name := range commandTable {
+		stats[name] = &commandStats{}
+	}
+	return stats
+}
+
+// infoSection renders one section of the INFO reply.
+type infoSection struct {
+	name   string
+	render func(h *Handler) string
+}
+
+// infoSections lists the INFO sections in output order.
+var infoSections = []infoSection{
+	{name: "persistence", render: renderPersistence},
+	{name: "commandstats", render: renderCommandStats},
+}
+
+// renderPersistence reports on the AOF and its rewrites. The file sizes are
+// only shown with appendonly on. There is no RDB, so rdb_changes_since_last_save
+// counts the writes since the last AOF rewrite snapshot, which like an RDB
+// save holds the whole dataset.
+func renderPersistence(h *Handler) string {
+	var b strings.Builder
+	b.WriteString("# Persistence\r\n")
+	enabled, inProgress, status := 0, 0, "ok"
+	if h.aof != nil {
+		enabled = 1
+		if h.aof.Rewriting() {
+			inProgress = 1
+		}
+	}
+	if h.rewrites.lastFailed.Load() {
+		status = "err"
+	}
+	fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", h.dirty.Load())
+	fmt.Fprintf(&b, "aof_enabled:%d\r\n", enabled)
+	fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", inProgress)
+	fmt.Fprintf(&b, "aof_rewrites:%d\r\n", h.rewrites.count.Load())
+	fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", status)
+	fmt.Fprintf(&b, "aof_last_auto_rewrite_time:%d\r\n", h.rewrites.lastAuto.Load())
+	if h.aof != nil {
+		current, base := h.aof.Size()
+		fmt.Fprintf(&b, "aof_current_size:%d\r\n", current)
+		fmt.Fprintf(&b, "aof_base_size:%d\r\n", base)
+	}
+	return b.String()
+}
+
+// renderCommandStats formats per-command latency like Redis:
+// cmdstat_get:calls=2,usec=15,usec_per_call=7.50,usec_max=10
+func renderCommandStats(h *Handler) string {
+	var b strings.Builder
+	b.WriteString("# Commandstats\r\n")
+	for _, name := range commandNames() {
+		s := h.stats[name]
+		calls := s.calls.Load()
+		if calls == 0 {
+			continue
+		}
+		usec := s.usec.Load()
+		fmt.Fprintf(&b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,usec_max=%d\r\n",
+			strings.ToLower(name), calls, usec, float64(usec)/float64(calls), s.usecMax.Load())
+	}
+	return b.String()
+}
+
+// infoReply renders the requested INFO sections; no sections, "all", "default"
+// or "everything" select every section.
+func infoReply(h *Handler, sections []string) string {
+	want := make(map[string]bool)
+	for _, s := range sections {
+		want[strings.ToLower(s)] = true
+	}
+	all := len(want) == 0 || want["all"] || want["default"] || want["everything"]
+
+	var parts []string
+	for _, sec := range infoSections {
+		if all || want[sec.name] {
+			parts = append(parts, sec.render(h))
+		}
+	}
+	return strings.Join(parts, "\r\n")
+}
@@ -2,32 +2,112 @@ package resp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
+	"unsafe"
 )
 
+const (
+	// DefaultMaxBulkLen is the default limit on a single bulk string (512MB).
+	DefaultMaxBulkLen = 512 * 1024 * 1024
+	// MaxArrayLen caps the number of elements in an array.
+	MaxArrayLen = 1024 * 1024
+	// MaxLineLen caps a line, such as a simple string or a length, so input
+	// without a newline can't grow the buffer without bound.
+	MaxLineLen = 64 * 1024
+
+	// maxArrayPrealloc is the most elements allocated for an array before they
+	// arrive, so that a declared length can't force a huge allocation on its
+	// own. Longer arrays grow as their elements are read.
+	maxArrayPrealloc = 1024
+)
+
+// ErrProtocol is wrapped by errors caused by malformed or oversized input, as
+// opposed to I/O failures. The connection can't be resynchronized after one.
+var ErrProtocol = errors.New("Protocol error")
+
 type Reader struct {
-	reader *bufio.Reader
+	reader     *bufio.Reader
+	maxBulkLen int
+	maxDepth   int // how deeply arrays may nest, 0 for no limit
+	depth      int // arrays being read
+	intern     InternTable
+}
+
+// maxInternLen is the longest bulk string looked up in an InternTable.
+const maxInternLen = 32
+
+// InternTable holds strings, such as command names, that a reader returns a
+// shared copy of instead of allocating a new string each time one is read.
+type InternTable map[string]string
+
+// NewInternTable returns a table of tokens. Tokens longer than 32 bytes are
+// never looked up and are left out.
+func NewInternTable(tokens ...string) InternTable {
+	t := make(InternTable, len(tokens))
+	for _, tok := range tokens {
+		if len(tok) <= maxInternLen {
+			t[tok] = tok
+		}
+	}
+	return t
 }
 
 func NewReader(rd io.Reader) *Reader {
-	return &Reader{reader: bufio.NewReader(rd)}
+	return &Reader{reader: bufio.NewReader(rd), maxBulkLen: DefaultMaxBulkLen}
+}
+
+// NewReaderSize is like NewReader but buffers at least size bytes of input,
+// which makes reading a large file such as the AOF faster.
+func NewReaderSize(rd io.Reader, size int) *Reader {
+	return &Reader{reader: bufio.NewReaderSize(rd, size), maxBulkLen: DefaultMaxBulkLen}
+}
+
+// SetInternTable makes the reader return the strings in t for bulk strings
+// equal to one of them. t must not be modified afterwards.
+func (r *Reader) SetInternTable(t InternTable) {
+	r.intern = t
+}
+
+// SetMaxBulkLen sets the largest bulk string length the reader accepts.
+func (r *Reader) SetMaxBulkLen(n int) {
+	r.maxBulkLen = n
 }
 
+// SetMaxDepth sets how deeply arrays may nest, counting an array that isn't
+// inside another as depth 1. 0, the default, sets no limit.
+func (r *Reader) SetMaxDepth(n int) {
+	r.maxDepth = n
+}
+
+// ReadLine reads up to the next newline and returns the line without its
+// CRLF, along with the number of bytes consumed. The line is only valid until
+// the next read.
 func (r *Reader) ReadLine() (line []byte, n int, err error) {
-	for {
-		b, err := r.reader.ReadByte()
-		if err != nil {
-			return nil, 0, err
+	line, err = r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Longer than the buffer, which ReadSlice can't return whole.
+		long := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(long) <= MaxLineLen {
+			line, err = r.reader.ReadSlice('\n')
+			long = append(long, line...)
 		}
-		n += 1
-		line = append(line, b)
-		if len(line) >= 2 && line[len(line)-2] == '\r' {
-			break
+		if len(long) > MaxLineLen {
+			return nil, 0, fmt.Errorf("%w: too big line", ErrProtocol)
 		}
+		line = long
 	}
-	return line[:len(line)-2], n, nil
+	if err != nil {
+		return nil, 0, err
+	}
+	n = len(line)
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, n, nil
 }
 
 func (r *Reader) ReadInteger() (x int, n int, err error) {
@@ -42,6 +122,21 @@ func (r *Reader) ReadInteger() (x int, n int, err error) {
 	return int(i64), n, nil
 }
 
+// ReadAll reads values until the input ends, calling fn with each one. It
+// returns nil at the end of the input, and otherwise the first error.
+func (r *Reader) ReadAll(fn func(Value)) error {
+	for {
+		v, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(v)
+	}
+}
+
 func (r *Reader) Read() (Value, error) {
 	_type, err := r.reader.ReadByte()
 	if err != nil {
@@ -53,6 +148,25 @@ func (r *Reader) Read() (Value, error) {
 		return r.readArray()
 	case BULK:
 		return r.readBulk()
+	case STRING, ERROR:
+		line, _, err := r.ReadLine()
+		if err != nil {
+			return Value{}, err
+		}
+		if _type == ERROR {
+			return Value{Type: "error", Str: string(line)}, nil
+		}
+		return Value{Type: "string", Str: string(line)}, nil
+	case INTEGER:
+		n, _, err := r.ReadInteger()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Type: "integer", Num: n}, nil
+	case BIGNUMBER:
+		return r.readBigNumber()
+	case VERBATIM:
+		return r.readVerbatim()
 	default:
 		fmt.Printf("Unknown type: %v\n", string(_type))
 		return Value{}, fmt.Errorf("unknown type: %v", string(_type))
@@ -63,20 +177,33 @@ func (r *Reader) readArray() (Value, error) {
 	v := Value{}
 	v.Type = "array"
 
+	r.depth++
+	defer func() { r.depth-- }()
+	if r.maxDepth > 0 && r.depth > r.maxDepth {
+		return v, fmt.Errorf("%w: nested arrays not allowed", ErrProtocol)
+	}
+
 	// read length of array
 	len, _, err := r.ReadInteger()
 	if err != nil {
 		return v, err
 	}
+	if len == -1 {
+		v.Type = "null_array"
+		return v, nil
+	}
+	if len < -1 || len > MaxArrayLen {
+		return v, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
 
 	// foreach line, read valid RESP
-	v.Array = make([]Value, len)
-	for i := range len {
+	v.Array = make([]Value, 0, min(len, maxArrayPrealloc))
+	for range len {
 		val, err := r.Read()
 		if err != nil {
 			return v, err
 		}
-		v.Array[i] = val
+		v.Array = append(v.Array, val)
 	}
 
 	return v, nil
@@ -95,20 +222,76 @@ func (r *Reader) readBulk() (Value, error) {
 		v.Type = "null"
 		return v, nil
 	}
-	if len < -1 {
-		return v, fmt.Errorf("invalid bulk length: %d", len)
+	if len < -1 || len > r.maxBulkLen {
+		return v, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+
+	if r.intern != nil && len <= maxInternLen {
+		if b, err := r.reader.Peek(len); err == nil {
+			if s, ok := r.intern[string(b)]; ok {
+				r.reader.Discard(len)
+				v.Bulk = s
+				return v, r.readCRLF()
+			}
+		}
 	}
 
+	// bulk is never written to again, so the string can share its memory
+	// instead of copying it.
 	bulk := make([]byte, len)
 	if _, err := io.ReadFull(r.reader, bulk); err != nil {
 		return v, err
 	}
-	v.Bulk = string(bulk)
+	v.Bulk = unsafe.String(unsafe.SliceData(bulk), len)
 
-	// Read the trailing CRLF
-	if _, _, err := r.ReadLine(); err != nil {
-		return v, err
+	return v, r.readCRLF()
+}
+
+// readCRLF reads the CRLF that ends a bulk string.
+func (r *Reader) readCRLF() error {
+	// The payload must be followed by exactly CRLF; anything else means the
+	// declared length was wrong and the stream is out of sync.
+	crlf, err := r.reader.Peek(2)
+	if err != nil {
+		return err
 	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return fmt.Errorf("%w: expected CRLF after bulk string", ErrProtocol)
+	}
+	_, err = r.reader.Discard(2)
+	return err
+}
 
-	return v, nil
+// readBigNumber reads a RESP3 big number: an optional sign and decimal digits.
+func (r *Reader) readBigNumber() (Value, error) {
+	line, _, err := r.ReadLine()
+	if err != nil {
+		return Value{}, err
+	}
+	digits := line
+	if len(digits) > 0 && (digits[0] == '-' || digits[0] == '+') {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return Value{}, fmt.Errorf("%w: invalid big number", ErrProtocol)
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return Value{}, fmt.Errorf("%w: invalid big number", ErrProtocol)
+		}
+	}
+	return Value{Type: "bignumber", Str: string(line)}, nil
+}
+
+// readVerbatim reads a RESP3 verbatim string, whose payload is a three-letter
+// format, a colon and the text.
+func (r *Reader) readVerbatim() (Value, error) {
+	v, err := r.readBulk()
+	if err != nil {
+		return Value{}, err
+	}
+	if v.Type != "bulk" || len(v.Bulk) < 4 || v.Bulk[3] != ':' {
+		return Value{}, fmt.Errorf("%w: invalid verbatim string", ErrProtocol)
+	}
+	return Value{Type: "verbatim", Str: v.Bulk[:3], Bulk: v.Bulk[4:]}, nil
 }
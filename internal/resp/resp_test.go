@@ -2,9 +2,15 @@ package resp
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"unsafe"
 )
 
 func TestReader_Read(t *testing.T) {
@@ -37,6 +43,31 @@ func TestReader_Read(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:  "Null array",
+			input: "*-1\r\n",
+			want:  Value{Type: "null_array"},
+		},
+		{
+			name:  "Empty array",
+			input: "*0\r\n",
+			want:  Value{Type: "array", Array: []Value{}},
+		},
+		{
+			name:  "Simple string reply",
+			input: "+OK\r\n",
+			want:  Value{Type: "string", Str: "OK"},
+		},
+		{
+			name:  "Error reply",
+			input: "-BUSYKEY Target key name already exists.\r\n",
+			want:  Value{Type: "error", Str: "BUSYKEY Target key name already exists."},
+		},
+		{
+			name:  "Integer reply",
+			input: ":-42\r\n",
+			want:  Value{Type: "integer", Num: -42},
+		},
 		{
 			name:  "Null bulk",
 			input: "*2\r\n$4\r\nECHO\r\n$-1\r\n",
@@ -64,6 +95,9 @@ func TestReader_Read(t *testing.T) {
 			if got.Type != tt.want.Type {
 				t.Errorf("got type %v, want %v", got.Type, tt.want.Type)
 			}
+			if got.Str != tt.want.Str || got.Num != tt.want.Num {
+				t.Errorf("got %q/%d, want %q/%d", got.Str, got.Num, tt.want.Str, tt.want.Num)
+			}
 			if len(got.Array) != len(tt.want.Array) {
 				t.Errorf("got array len %v, want %v", len(got.Array), len(tt.want.Array))
 			}
@@ -112,6 +146,131 @@ func TestReader_Read_Chunked(t *testing.T) {
 	}
 }
 
+func TestReader_ReadAll(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n+OK\r\n*2\r\n$4\r\nECHO\r\n$5\r\nhello\r\n"
+	var got []string
+	r := NewReaderSize(&slowReader{r: strings.NewReader(input), n: 3}, 64)
+	err := r.ReadAll(func(v Value) {
+		if v.Type == "array" {
+			got = append(got, v.Array[len(v.Array)-1].Bulk)
+		} else {
+			got = append(got, v.Str)
+		}
+	})
+	if err != nil || !slices.Equal(got, []string{"PING", "OK", "hello"}) {
+		t.Errorf("ReadAll() = %q, %v, want [PING OK hello], nil", got, err)
+	}
+
+	// Errors other than the end of the input are returned.
+	r = NewReader(strings.NewReader("+OK\r\n*1\r\n$-2\r\n"))
+	n := 0
+	if err := r.ReadAll(func(Value) { n++ }); !errors.Is(err, ErrProtocol) || n != 1 {
+		t.Errorf("ReadAll() of bad input = %v after %d values, want ErrProtocol after 1", err, n)
+	}
+}
+
+func TestReader_Intern(t *testing.T) {
+	r := NewReader(&slowReader{r: strings.NewReader("*3\r\n$3\r\nset\r\n$3\r\nSET\r\n$3\r\nset\r\n$3\r\nsex\r\n"), n: 2})
+	r.SetInternTable(NewInternTable("set", strings.Repeat("x", 40)))
+	v, err := r.Read()
+	if err != nil || len(v.Array) != 3 {
+		t.Fatalf("Reader.Read() = %#v, %v", v, err)
+	}
+	if got := []string{v.Array[0].Bulk, v.Array[1].Bulk, v.Array[2].Bulk}; !slices.Equal(got, []string{"set", "SET", "set"}) {
+		t.Errorf("got %q, want [set SET set]", got)
+	}
+	if unsafe.StringData(v.Array[0].Bulk) != unsafe.StringData(v.Array[2].Bulk) {
+		t.Error("interned token read twice has two copies")
+	}
+	if v, err := r.Read(); err != nil || v.Bulk != "sex" {
+		t.Errorf("Reader.Read() after interned tokens = %#v, %v", v, err)
+	}
+
+	// An interned token must still be followed by CRLF.
+	r = NewReader(strings.NewReader("$3\r\nsetXX"))
+	r.SetInternTable(NewInternTable("set"))
+	if _, err := r.Read(); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Reader.Read() of a bad terminator error = %v, want ErrProtocol", err)
+	}
+}
+
+func TestReader_Read_ProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"oversized bulk", "*1\r\n$1000000000\r\n"},
+		{"negative bulk", "*1\r\n$-2\r\n"},
+		{"oversized array", "*1000000000\r\n"},
+		{"negative array", "*-2\r\n"},
+		{"bad bulk terminator", "*1\r\n$3\r\nabcXX*1\r\n$4\r\nPING\r\n"},
+		{"short bulk terminator", "*1\r\n$3\r\nabc\rX"},
+		{"big number with letters", "(12a4\r\n"},
+		{"empty big number", "(-\r\n"},
+		{"verbatim without format", "=3\r\nabc\r\n"},
+		{"verbatim without colon", "=7\r\ntxtxabc\r\n"},
+		{"null verbatim", "=-1\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.input))
+			r.SetMaxBulkLen(1024)
+			if _, err := r.Read(); !errors.Is(err, ErrProtocol) {
+				t.Errorf("Reader.Read() error = %v, want ErrProtocol", err)
+			}
+		})
+	}
+
+	// A line longer than the read buffer is read whole, up to MaxLineLen.
+	long := strings.Repeat("x", MaxLineLen/2)
+	r := NewReader(&slowReader{r: strings.NewReader("+" + long + "\r\n:7\r\n"), n: 100})
+	if v, err := r.Read(); err != nil || v.Str != long {
+		t.Errorf("Reader.Read() of a long line = %d bytes, %v", len(v.Str), err)
+	}
+	if v, err := r.Read(); err != nil || v.Num != 7 {
+		t.Errorf("Reader.Read() after a long line = %#v, %v", v, err)
+	}
+	r = NewReader(strings.NewReader("+" + strings.Repeat("x", MaxLineLen+1) + "\r\n"))
+	if _, err := r.Read(); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Reader.Read() of a line over MaxLineLen error = %v, want ErrProtocol", err)
+	}
+
+	// Bulks up to the limit are still accepted.
+	r = NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\n"))
+	r.SetMaxBulkLen(4)
+	if _, err := r.Read(); err != nil {
+		t.Errorf("Reader.Read() at the limit error = %v", err)
+	}
+}
+
+func TestReader_Read_NestedArrays(t *testing.T) {
+	// Declared lengths alone don't allocate their elements: five nested
+	// headers at MaxArrayLen, with nothing after them, would otherwise take
+	// hundreds of megabytes.
+	nested := strings.Repeat("*"+strconv.Itoa(MaxArrayLen)+"\r\n", 5)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := NewReader(strings.NewReader(nested)).Read(); err != io.EOF {
+		t.Errorf("Reader.Read() of truncated nested arrays error = %v, want io.EOF", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("reading nested array headers allocated %d bytes", n)
+	}
+
+	r := NewReader(strings.NewReader(nested))
+	r.SetMaxDepth(1)
+	if _, err := r.Read(); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Reader.Read() over the max depth error = %v, want ErrProtocol", err)
+	}
+	r = NewReader(strings.NewReader("*2\r\n*1\r\n:1\r\n:2\r\n"))
+	r.SetMaxDepth(2)
+	if v, err := r.Read(); err != nil || len(v.Array) != 2 || v.Array[0].Array[0].Num != 1 {
+		t.Errorf("Reader.Read() at the max depth = %#v, %v", v, err)
+	}
+}
+
 func TestWriter_Write(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -135,6 +294,36 @@ func TestWriter_Write(t *testing.T) {
 			},
 			want: "$5\r\nhello\r\n",
 		},
+		{
+			name:  "Binary Bulk String",
+			value: Value{Type: "bulk", Bulk: "a\x00\r\nb"},
+			want:  "$5\r\na\x00\r\nb\r\n",
+		},
+		{
+			name:  "Simple String With CRLF",
+			value: Value{Type: "string", Str: "a\r\nb"},
+			want:  "+a  b\r\n",
+		},
+		{
+			name:  "Error With CRLF",
+			value: Value{Type: "error", Str: "ERR unknown command 'a\r\n+OK'"},
+			want:  "-ERR unknown command 'a  +OK'\r\n",
+		},
+		{
+			name:  "Null Bulk String",
+			value: Value{Type: "null"},
+			want:  "$-1\r\n",
+		},
+		{
+			name:  "Null Array",
+			value: Value{Type: "null_array"},
+			want:  "*-1\r\n",
+		},
+		{
+			name:  "Null Array Element",
+			value: Value{Type: "array", Array: []Value{{Type: "null_array"}, {Type: "null"}}},
+			want:  "*2\r\n*-1\r\n$-1\r\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -151,3 +340,98 @@ func TestWriter_Write(t *testing.T) {
 		})
 	}
 }
+
+func TestWriter_RESP3Types(t *testing.T) {
+	values := []Value{
+		{Type: "bignumber", Str: "3492890328409238509324850943850943825024385"},
+		{Type: "bignumber", Str: "-1"},
+		{Type: "verbatim", Str: "txt", Bulk: "Some string"},
+		{Type: "verbatim", Str: "mkd", Bulk: ""},
+	}
+	resp2 := []string{
+		"$43\r\n3492890328409238509324850943850943825024385\r\n",
+		"$2\r\n-1\r\n",
+		"$11\r\nSome string\r\n",
+		"$0\r\n\r\n",
+	}
+	resp3 := []string{
+		"(3492890328409238509324850943850943825024385\r\n",
+		"(-1\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"=4\r\nmkd:\r\n",
+	}
+
+	for i, v := range values {
+		var b bytes.Buffer
+		if err := NewWriter(&b).Write(v); err != nil || b.String() != resp2[i] {
+			t.Errorf("RESP2 Write(%#v) = %q, %v, want %q", v, b.String(), err, resp2[i])
+		}
+
+		b.Reset()
+		w := NewWriter(&b)
+		w.SetRESP3(true)
+		if err := w.Write(Value{Type: "array", Array: []Value{v}}); err != nil || b.String() != "*1\r\n"+resp3[i] {
+			t.Errorf("RESP3 Write(%#v) = %q, %v, want %q", v, b.String(), err, resp3[i])
+		}
+
+		got, err := NewReader(&b).Read()
+		if err != nil || len(got.Array) != 1 || !reflect.DeepEqual(got.Array[0], v) {
+			t.Errorf("round trip of %#v = %#v, %v", v, got, err)
+		}
+	}
+}
+
+// BenchmarkReader_Read parses a pipeline of small commands.
+func BenchmarkReader_Read(b *testing.B) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	const commands = 1000
+	for i := range commands {
+		w.Write(Value{Type: "array", Array: []Value{
+			{Type: "bulk", Bulk: "SET"},
+			{Type: "bulk", Bulk: "key:" + strconv.Itoa(i)},
+			{Type: "bulk", Bulk: "value"},
+		}})
+	}
+	input := buf.Bytes()
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for range b.N {
+		r := NewReader(bytes.NewReader(input))
+		for range commands {
+			if _, err := r.Read(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkReader_ReadInterned is BenchmarkReader_Read with the command name
+// interned.
+func BenchmarkReader_ReadInterned(b *testing.B) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	const commands = 1000
+	for i := range commands {
+		w.Write(Value{Type: "array", Array: []Value{
+			{Type: "bulk", Bulk: "SET"},
+			{Type: "bulk", Bulk: "key:" + strconv.Itoa(i)},
+			{Type: "bulk", Bulk: "value"},
+		}})
+	}
+	input := buf.Bytes()
+	intern := NewInternTable("SET", "set")
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for range b.N {
+		r := NewReader(bytes.NewReader(input))
+		r.SetInternTable(intern)
+		for range commands {
+			if _, err := r.Read(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
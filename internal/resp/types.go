@@ -7,6 +7,13 @@ const (
 	INTEGER = ':'
 	BULK    = '$'
 	ARRAY   = '*'
+
+	// RESP3 types, sent only to connections that negotiated RESP3. A big
+	// number value keeps its decimal digits in Str; a verbatim string keeps
+	// its three-letter format, such as "txt" or "mkd", in Str and its text in
+	// Bulk.
+	BIGNUMBER = '('
+	VERBATIM  = '='
 )
 
 // Value represents the data structure of a RESP message
@@ -7,18 +7,25 @@ import (
 
 type Writer struct {
 	writer io.Writer
+	resp3  bool
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{writer: w}
 }
 
+// SetRESP3 sets whether the peer negotiated RESP3. Until it has, big numbers
+// and verbatim strings are sent as plain bulk strings, as Redis does.
+func (w *Writer) SetRESP3(on bool) {
+	w.resp3 = on
+}
+
 func (w *Writer) Write(v Value) error {
 	var bytes []byte
 
 	switch v.Type {
 	case "array":
-		bytes = v.marshalArray()
+		bytes = v.marshalArray(w.resp3)
 	case "bulk":
 		bytes = v.marshalBulk()
 	case "string":
@@ -27,8 +34,14 @@ func (w *Writer) Write(v Value) error {
 		bytes = v.marshalInteger()
 	case "null":
 		bytes = v.marshalNull()
+	case "null_array":
+		bytes = v.marshalNullArray()
 	case "error":
 		bytes = v.marshalError()
+	case "bignumber":
+		bytes = v.marshalBigNumber(w.resp3)
+	case "verbatim":
+		bytes = v.marshalVerbatim(w.resp3)
 	default:
 		// Default to string for unknown types for now, or could return error
 		bytes = []byte{}
@@ -41,7 +54,7 @@ func (w *Writer) Write(v Value) error {
 func (v Value) marshalString() []byte {
 	var bytes []byte
 	bytes = append(bytes, STRING)
-	bytes = append(bytes, v.Str...)
+	bytes = appendLine(bytes, v.Str)
 	bytes = append(bytes, '\r', '\n')
 	return bytes
 }
@@ -56,7 +69,7 @@ func (v Value) marshalBulk() []byte {
 	return bytes
 }
 
-func (v Value) marshalArray() []byte {
+func (v Value) marshalArray(resp3 bool) []byte {
 	len := len(v.Array)
 	var bytes []byte
 	bytes = append(bytes, ARRAY)
@@ -64,7 +77,7 @@ func (v Value) marshalArray() []byte {
 	bytes = append(bytes, '\r', '\n')
 
 	for i := range len {
-		bytes = append(bytes, v.Array[i].marshal()...)
+		bytes = append(bytes, v.Array[i].marshal(resp3)...)
 	}
 
 	return bytes
@@ -73,15 +86,64 @@ func (v Value) marshalArray() []byte {
 func (v Value) marshalError() []byte {
 	var bytes []byte
 	bytes = append(bytes, ERROR)
-	bytes = append(bytes, v.Str...)
+	bytes = appendLine(bytes, v.Str)
 	bytes = append(bytes, '\r', '\n')
 	return bytes
 }
 
+// appendLine appends s to b for a simple string or error, which end at the
+// first CRLF, replacing any CR or LF with a space as Redis does. Errors often
+// quote what the client sent, such as an unknown command name, and a
+// newline there would otherwise split the reply in two.
+func appendLine(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' {
+			b = append(b, ' ')
+		} else {
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
 func (v Value) marshalNull() []byte {
 	return []byte("$-1\r\n")
 }
 
+// marshalNullArray encodes the null array, which Redis sends where a whole
+// reply is absent, such as EXEC of a transaction aborted by WATCH.
+func (v Value) marshalNullArray() []byte {
+	return []byte("*-1\r\n")
+}
+
+// marshalBigNumber encodes a RESP3 big number, or for RESP2 a bulk string of
+// its digits.
+func (v Value) marshalBigNumber(resp3 bool) []byte {
+	if !resp3 {
+		return Value{Bulk: v.Str}.marshalBulk()
+	}
+	bytes := []byte{BIGNUMBER}
+	bytes = append(bytes, v.Str...)
+	bytes = append(bytes, '\r', '\n')
+	return bytes
+}
+
+// marshalVerbatim encodes a RESP3 verbatim string, or for RESP2 a bulk string
+// of its text without the format.
+func (v Value) marshalVerbatim(resp3 bool) []byte {
+	if !resp3 {
+		return Value{Bulk: v.Bulk}.marshalBulk()
+	}
+	bytes := []byte{VERBATIM}
+	bytes = append(bytes, strconv.Itoa(len(v.Str)+1+len(v.Bulk))...)
+	bytes = append(bytes, '\r', '\n')
+	bytes = append(bytes, v.Str...)
+	bytes = append(bytes, ':')
+	bytes = append(bytes, v.Bulk...)
+	bytes = append(bytes, '\r', '\n')
+	return bytes
+}
+
 func (v Value) marshalInteger() []byte {
 	var bytes []byte
 	bytes = append(bytes, INTEGER)
@@ -91,10 +153,10 @@ func (v Value) marshalInteger() []byte {
 }
 
 // Helper for recursive array marshalling
-func (v Value) marshal() []byte {
+func (v Value) marshal(resp3 bool) []byte {
 	switch v.Type {
 	case "array":
-		return v.marshalArray()
+		return v.marshalArray(resp3)
 	case "bulk":
 		return v.marshalBulk()
 	case "string":
@@ -103,8 +165,14 @@ func (v Value) marshal() []byte {
 		return v.marshalInteger()
 	case "null":
 		return v.marshalNull()
+	case "null_array":
+		return v.marshalNullArray()
 	case "error":
 		return v.marshalError()
+	case "bignumber":
+		return v.marshalBigNumber(resp3)
+	case "verbatim":
+		return v.marshalVerbatim(resp3)
 	default:
 		return []byte{}
 	}
@@ -0,0 +1,119 @@
+package store
+
+import "math/bits"
+
+// Bitmaps are ordinary strings addressed bit by bit. As in Redis, bit 0 is
+// the most significant bit of the first byte.
+
+// SetBitWithoutLock sets or clears the bit at offset in the string at key,
+// growing the string with zero bytes as needed and keeping any TTL. A missing
+// key is created. Returns the previous bit, or -1 if the key holds a non-string value.
+func (s *Store) SetBitWithoutLock(key string, offset int, on bool) int {
+	item, ok := s.lookup(key)
+	if ok && item.Type != TypeString {
+		return -1
+	}
+	if !ok {
+		item = s.replacing(key, Item{Type: TypeString})
+	}
+
+	buf := []byte(item.Str())
+	byteIdx := offset / 8
+	if byteIdx >= len(buf) {
+		buf = append(buf, make([]byte, byteIdx-len(buf)+1)...)
+	}
+
+	mask := byte(0x80) >> (offset % 8)
+	prev := 0
+	if buf[byteIdx]&mask != 0 {
+		prev = 1
+	}
+	if on {
+		buf[byteIdx] |= mask
+	} else {
+		buf[byteIdx] &^= mask
+	}
+
+	item.StrVal = string(buf)
+	item.IntVal, item.IntEncoded = 0, false
+	s.put(key, item)
+	return prev
+}
+
+// GetBitWithoutLock returns the bit at offset in the string at key; bits past
+// the end of the string and bits of missing keys are 0. Returns -1 if the key
+// holds a non-string value.
+func (s *Store) GetBitWithoutLock(key string, offset int) int {
+	item, ok := s.lookup(key)
+	if !ok {
+		return 0
+	}
+	if item.Type != TypeString {
+		return -1
+	}
+	str := item.Str()
+
+	byteIdx := offset / 8
+	if byteIdx >= len(str) {
+		return 0
+	}
+	if str[byteIdx]&(byte(0x80)>>(offset%8)) != 0 {
+		return 1
+	}
+	return 0
+}
+
+// BitCountWithoutLock counts the set bits in bytes start through end of the
+// string at key. Negative indexes count back from the end, as in GETRANGE;
+// pass 0, -1 for the whole string. Returns -1 if the key holds a non-string value.
+func (s *Store) BitCountWithoutLock(key string, start, end int) int {
+	item, ok := s.lookup(key)
+	if !ok {
+		return 0
+	}
+	if item.Type != TypeString {
+		return -1
+	}
+	str := item.Str()
+
+	n := len(str)
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = n + end
+	}
+	end = min(end, n-1)
+	if start > end {
+		return 0
+	}
+
+	count := 0
+	for i := start; i <= end; i++ {
+		count += bits.OnesCount8(str[i])
+	}
+	return count
+}
+
+// --- Public Bitmap API (acquires the lock) ---
+
+func (s *Store) SetBit(key string, offset int, on bool) int {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.SetBitWithoutLock(key, offset, on)
+}
+
+func (s *Store) GetBit(key string, offset int) int {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.GetBitWithoutLock(key, offset)
+}
+
+func (s *Store) BitCount(key string, start, end int) int {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.BitCountWithoutLock(key, start, end)
+}
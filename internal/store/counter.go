@@ -0,0 +1,115 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Counters.
+//
+// A string holding a canonical decimal integer that fits in an int64 is kept
+// int encoded, as in Redis: the number lives in IntVal and StrVal is empty, so
+// INCR and friends add to it directly instead of parsing and formatting the
+// string every time. Readers see no difference, since Str renders the number
+// back, and OBJECT ENCODING reports the encoding as int.
+
+// Errors returned by IncrByWithoutLock.
+var (
+	ErrWrongType  = errors.New("key holds a non-string value")
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	ErrOverflow   = errors.New("increment or decrement would overflow")
+)
+
+// Str returns the value of a string item, whichever its encoding.
+func (item Item) Str() string {
+	if item.IntEncoded {
+		return strconv.FormatInt(item.IntVal, 10)
+	}
+	return item.StrVal
+}
+
+// SetStr sets the value of a string item to v, int encoding it if possible.
+func (item *Item) SetStr(v string) {
+	n, ok := parseCanonicalInt(v)
+	item.IntEncoded = ok
+	item.IntVal = n
+	if ok {
+		item.StrVal = ""
+	} else {
+		item.StrVal = v
+	}
+}
+
+// parseCanonicalInt parses v as an int64 if formatting the result gives back
+// v exactly, so that int encoding never changes what a client reads back:
+// "007", "+1" and "-0" stay raw.
+func parseCanonicalInt(v string) (int64, bool) {
+	if len(v) == 0 || len(v) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != v {
+		return 0, false
+	}
+	return n, true
+}
+
+// IncrByWithoutLock adds delta to the integer stored at key, treating a
+// missing key as 0, and returns the result, which is kept int encoded. The
+// key's TTL is kept. It fails with ErrWrongType, ErrNotInteger if the string
+// is not a canonical integer, or ErrOverflow. Caller must hold the lock.
+func (s *Store) IncrByWithoutLock(key string, delta int64) (int64, error) {
+	item, ok := s.lookup(key)
+	n, err := incrResult(item, ok, delta)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		item = s.replacing(key, Item{Type: TypeString, IntEncoded: true})
+	}
+
+	item.StrVal = ""
+	item.IntEncoded = true
+	item.IntVal = n
+	s.put(key, item)
+	return n, nil
+}
+
+// IncrByResultWithoutLock returns what IncrByWithoutLock would return for the
+// same arguments, without changing anything or counting as an access. Caller
+// must hold the lock.
+func (s *Store) IncrByResultWithoutLock(key string, delta int64) (int64, error) {
+	item, ok := s.peek(key)
+	return incrResult(item, ok, delta)
+}
+
+// incrResult adds delta to the counter in item, which is 0 if the key does
+// not exist.
+func incrResult(item Item, exists bool, delta int64) (int64, error) {
+	if !exists {
+		item = Item{Type: TypeString, IntEncoded: true}
+	}
+	if item.Type != TypeString {
+		return 0, ErrWrongType
+	}
+
+	n := item.IntVal
+	if !item.IntEncoded {
+		var valid bool
+		if n, valid = parseCanonicalInt(item.StrVal); !valid {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	return n + delta, nil
+}
+
+func (s *Store) IncrBy(key string, delta int64) (int64, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.IncrByWithoutLock(key, delta)
+}
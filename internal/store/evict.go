@@ -0,0 +1,363 @@
+package store
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Memory accounting and eviction.
+//
+// The store keeps a running estimate of the memory its keys use, updated on
+// every write, so that a maxmemory limit can be enforced without walking the
+// keyspace. The estimate counts key and value bytes plus a fixed overhead per
+// key and per hash field; it is not what the Go runtime reports.
+
+const (
+	keyOverhead         = 96 // map entry and Item header
+	fieldOverhead       = 32 // map entry and string headers of one hash field
+	fieldExpiryOverhead = 40 // map entry and time of one hash field expiry
+)
+
+// itemSize estimates the memory used by item stored at key.
+func itemSize(key string, item Item) int64 {
+	n := int64(keyOverhead + len(key))
+	switch item.Type {
+	case TypeString:
+		if item.IntEncoded {
+			n += 8
+		} else {
+			n += int64(len(item.StrVal))
+		}
+	case TypeVector:
+		n += 4*int64(len(item.VecVal)) + 2*int64(len(item.HalfVal))
+	case TypeHash:
+		for f, v := range item.hashAll() {
+			n += int64(fieldOverhead + len(f) + len(v))
+		}
+		n += fieldExpiryOverhead * int64(len(item.FieldExpiresAt))
+	}
+	return n
+}
+
+// put stores item at key, replacing any previous item, and updates the
+// memory estimate. Caller must hold the lock.
+func (s *Store) put(key string, item Item) {
+	sh := s.shard(key)
+	if old, ok := sh.data[key]; ok {
+		sh.used -= itemSize(key, old)
+		s.vectorChanged(old)
+	}
+	sh.data[key] = item
+	sh.used += itemSize(key, item)
+	s.vectorChanged(item)
+}
+
+// remove deletes item from key and updates the memory estimate. Caller must hold the lock.
+func (s *Store) remove(key string, item Item) {
+	sh := s.shard(key)
+	delete(sh.data, key)
+	sh.used -= itemSize(key, item)
+	s.vectorChanged(item)
+}
+
+// UsedMemoryWithoutLock returns the estimated memory used by all keys. Caller must hold the lock.
+func (s *Store) UsedMemoryWithoutLock() int64 {
+	var used int64
+	for _, sh := range s.shards {
+		used += sh.used
+	}
+	return used
+}
+
+// MemoryUsageWithoutLock returns the estimated memory used by key, as counted
+// against maxmemory, and false if the key does not exist. It does not count
+// as an access. Caller must hold the lock.
+func (s *Store) MemoryUsageWithoutLock(key string) (int64, bool) {
+	return s.MemoryUsageSampledWithoutLock(key, 0)
+}
+
+// MemoryUsageSampledWithoutLock is MemoryUsageWithoutLock for MEMORY USAGE
+// with SAMPLES: a hash table with more than samples fields is estimated from
+// the average size of samples of them, picked at random. 0 samples means every
+// field, and a listpack, which is small, is always counted in full. Caller
+// must hold the lock.
+func (s *Store) MemoryUsageSampledWithoutLock(key string, samples int) (int64, bool) {
+	item, ok := s.peek(key)
+	if !ok {
+		return 0, false
+	}
+	if item.Type != TypeHash || item.ListpackEncoded || samples <= 0 || len(item.HashVal) <= samples {
+		return itemSize(key, item), true
+	}
+
+	var sampled int64
+	seen := 0
+	for f, v := range item.HashVal { // map order is random
+		if seen == samples {
+			break
+		}
+		sampled += int64(fieldOverhead + len(f) + len(v))
+		seen++
+	}
+	n := int64(keyOverhead+len(key)) + sampled*int64(len(item.HashVal))/int64(samples)
+	return n + fieldExpiryOverhead*int64(len(item.FieldExpiresAt)), true
+}
+
+// MemoryStats summarizes the keyspace for MEMORY STATS and MEMORY DOCTOR.
+type MemoryStats struct {
+	Keys        int
+	KeysWithTTL int
+	Bytes       int64           // sum of the estimates of every key
+	TypeKeys    map[uint8]int   // keys of each type
+	TypeBytes   map[uint8]int64 // estimated bytes of each type
+}
+
+// MemoryStatsWithoutLock walks every key to build a MemoryStats, so it takes
+// time proportional to the size of the keyspace and holds the lock throughout;
+// on a large dataset it should be called sparingly. Expired keys that have
+// not yet been removed are deleted. Caller must hold the lock.
+func (s *Store) MemoryStatsWithoutLock() MemoryStats {
+	stats := MemoryStats{TypeKeys: make(map[uint8]int), TypeBytes: make(map[uint8]int64)}
+	now := s.now()
+	for _, sh := range s.shards {
+		for key, item := range sh.data {
+			if s.removeIfExpired(key, item, now) {
+				continue
+			}
+			n := itemSize(key, item)
+			stats.Keys++
+			if !item.ExpiresAt.IsZero() {
+				stats.KeysWithTTL++
+			}
+			stats.Bytes += n
+			stats.TypeKeys[item.Type]++
+			stats.TypeBytes[item.Type] += n
+		}
+	}
+	return stats
+}
+
+// LFU access frequency.
+//
+// Each item carries an 8-bit logarithmic (Morris) counter, as in Redis: new
+// keys start at lfuInitVal, every access increments the counter with a
+// probability that falls as it grows, and it loses one point for every
+// lfuDecayTime the key goes unaccessed.
+
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+// lfuIncr returns counter after one access.
+func lfuIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	base := max(float64(counter)-lfuInitVal, 0)
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// lfuDecay returns counter reduced by one for every lfuDecayTime that has
+// passed between last and now.
+func lfuDecay(counter uint8, last, now time.Time) uint8 {
+	periods := now.Sub(last) / lfuDecayTime
+	if periods >= time.Duration(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+// markAccess records a read or write of item: the frequency counter is
+// decayed for the time since the last access and then incremented.
+func markAccess(item *Item, now time.Time) {
+	item.Freq = lfuIncr(lfuDecay(item.Freq, item.LastAccess, now))
+	item.LastAccess = now
+}
+
+// replacing prepares item to overwrite whatever is stored at key. Overwriting
+// a live key counts as an access to it and keeps its frequency; a new key
+// starts with the initial frequency. Caller must hold the lock.
+func (s *Store) replacing(key string, item Item) Item {
+	now := s.now()
+	if old, ok := s.shard(key).data[key]; ok && (old.ExpiresAt.IsZero() || now.Before(old.ExpiresAt)) {
+		item.Freq, item.LastAccess = old.Freq, old.LastAccess
+		markAccess(&item, now)
+		return item
+	}
+	item.Freq, item.LastAccess = lfuInitVal, now
+	return item
+}
+
+// FreqWithoutLock returns the access frequency counter of key, as shown by
+// OBJECT FREQ. It does not count as an access. Caller must hold the lock.
+func (s *Store) FreqWithoutLock(key string) (int, bool) {
+	item, ok := s.peek(key)
+	if !ok {
+		return 0, false
+	}
+	return int(lfuDecay(item.Freq, item.LastAccess, s.now())), true
+}
+
+// EvictionPolicy selects which keys are removed when memory use exceeds the limit.
+type EvictionPolicy uint8
+
+const (
+	NoEviction EvictionPolicy = iota // reject writes instead of evicting
+	AllKeysLRU                       // evict the least recently used keys
+	AllKeysLFU                       // evict the least frequently used keys
+)
+
+var evictionPolicyNames = []string{
+	NoEviction: "noeviction",
+	AllKeysLRU: "allkeys-lru",
+	AllKeysLFU: "allkeys-lfu",
+}
+
+// ParseEvictionPolicy returns the policy for a maxmemory-policy value.
+func ParseEvictionPolicy(name string) (EvictionPolicy, bool) {
+	for p, n := range evictionPolicyNames {
+		if n == name {
+			return EvictionPolicy(p), true
+		}
+	}
+	return 0, false
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+const (
+	evictionSamples  = 5  // keys sampled per eviction, like maxmemory-samples
+	evictionPoolSize = 16 // best candidates kept between evictions
+)
+
+// EvictWithoutLock removes keys chosen by policy until the estimated memory
+// use is at most limit. Victims are approximate, as in Redis: each eviction
+// samples a few keys, adds them to a small pool of candidates carried over
+// from earlier evictions, and removes the worst candidate in the pool.
+// Expired keys are always evicted first.
+//
+// It returns the evicted keys and whether memory use is now within limit,
+// which is never the case for NoEviction once the limit is exceeded. Caller
+// must hold the lock.
+func (s *Store) EvictWithoutLock(limit int64, policy EvictionPolicy) ([]string, bool) {
+	var evicted []string
+	for s.UsedMemoryWithoutLock() > limit {
+		if policy == NoEviction || s.lenWithoutLock() == 0 {
+			return evicted, false
+		}
+		key := s.evictionCandidate(policy)
+		s.remove(key, s.shard(key).data[key])
+		evicted = append(evicted, key)
+	}
+	return evicted, true
+}
+
+// evictionCandidate refills the eviction pool with a fresh sample and takes
+// the best victim out of it. Caller must hold the lock and ensure the store
+// is not empty.
+func (s *Store) evictionCandidate(policy EvictionPolicy) string {
+	// Walk the shards from a random one until enough keys are sampled. Map
+	// iteration starts at a random position, which is enough of a sample
+	// within a shard.
+	n := 0
+	first := rand.IntN(len(s.shards))
+	for i := range s.shards {
+		for key := range s.shards[(first+i)%len(s.shards)].data {
+			if n == evictionSamples {
+				break
+			}
+			if !slices.Contains(s.evictionPool, key) {
+				s.evictionPool = append(s.evictionPool, key)
+			}
+			n++
+		}
+		if n == evictionSamples {
+			break
+		}
+	}
+
+	// Pooled keys may have been deleted or accessed since they were sampled,
+	// so drop the missing ones and rank the rest by their current state.
+	s.evictionPool = slices.DeleteFunc(s.evictionPool, func(key string) bool {
+		_, ok := s.shard(key).data[key]
+		return !ok
+	})
+	now := s.now()
+	sort.Slice(s.evictionPool, func(i, j int) bool {
+		a, b := s.evictionPool[i], s.evictionPool[j]
+		return evictsBefore(s.shard(a).data[a], s.shard(b).data[b], policy, now)
+	})
+	if len(s.evictionPool) > evictionPoolSize {
+		s.evictionPool = s.evictionPool[:evictionPoolSize]
+	}
+
+	key := s.evictionPool[0]
+	s.evictionPool = s.evictionPool[1:]
+	return key
+}
+
+// evictsBefore reports whether a is a better eviction victim than b.
+func evictsBefore(a, b Item, policy EvictionPolicy, now time.Time) bool {
+	aExpired := expired(a, now)
+	bExpired := expired(b, now)
+	if aExpired != bExpired {
+		return aExpired
+	}
+	if policy == AllKeysLFU {
+		af, bf := lfuDecay(a.Freq, a.LastAccess, now), lfuDecay(b.Freq, b.LastAccess, now)
+		if af != bf {
+			return af < bf
+		}
+	}
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+// --- Public Memory API (acquires the lock) ---
+
+func (s *Store) UsedMemory() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.UsedMemoryWithoutLock()
+}
+
+func (s *Store) Freq(key string) (int, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.FreqWithoutLock(key)
+}
+
+func (s *Store) Evict(limit int64, policy EvictionPolicy) ([]string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.EvictWithoutLock(limit, policy)
+}
+
+func (s *Store) MemoryUsage(key string) (int64, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.MemoryUsageWithoutLock(key)
+}
+
+func (s *Store) MemoryUsageSampled(key string, samples int) (int64, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.MemoryUsageSampledWithoutLock(key, samples)
+}
+
+func (s *Store) MemoryStats() MemoryStats {
+	s.Lock()
+	defer s.Unlock()
+	return s.MemoryStatsWithoutLock()
+}
@@ -0,0 +1,97 @@
+package store
+
+import "math"
+
+// Half-precision vectors.
+//
+// TSET FP16 stores a vector's components as IEEE 754 half-precision floats in
+// HalfVal, at two bytes each instead of four, and VecVal is nil. Components
+// are rounded to the nearest float16, which keeps about three significant
+// decimal digits and must lie within ±MaxHalf. Readers get float32s back from
+// Vec, so only the precision differs, and OBJECT ENCODING reports the
+// encoding as float16vector.
+
+// MaxHalf is the largest magnitude a float16 component can hold.
+const MaxHalf = 65504
+
+// Vec returns the components of a vector item, whichever its encoding. For a
+// float16 vector they are converted into a new slice.
+func (item Item) Vec() []float32 {
+	if !item.HalfEncoded {
+		return item.VecVal
+	}
+	vec := make([]float32, len(item.HalfVal))
+	for i, h := range item.HalfVal {
+		vec[i] = halfToFloat32(h)
+	}
+	return vec
+}
+
+// SetHalfVec sets the value of a vector item to vec, rounded to float16.
+// Components must be within ±MaxHalf.
+func (item *Item) SetHalfVec(vec []float32) {
+	item.HalfEncoded = true
+	item.VecVal = nil
+	item.HalfVal = make([]uint16, len(vec))
+	for i, v := range vec {
+		item.HalfVal[i] = halfFromFloat32(v)
+	}
+}
+
+// Dim returns the number of components of a vector item.
+func (item Item) Dim() int {
+	if item.HalfEncoded {
+		return len(item.HalfVal)
+	}
+	return len(item.VecVal)
+}
+
+// halfFromFloat32 rounds f to the nearest float16, ties to even. Magnitudes
+// that round past MaxHalf become infinite.
+func halfFromFloat32(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int(b>>23&0xff) - 127 + 15
+	mant := b & 0x7fffff
+
+	switch {
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	case exp <= 0:
+		// Subnormal: the implicit leading 1 is shifted into the mantissa.
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		half, rem, halfway := mant>>shift, mant&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > halfway || rem == halfway && half&1 == 1 {
+			half++
+		}
+		return sign | uint16(half)
+	default:
+		// A carry out of the mantissa correctly bumps the exponent.
+		half, rem := uint32(exp)<<10|mant>>13, mant&0x1fff
+		if rem > 0x1000 || rem == 0x1000 && half&1 == 1 {
+			half++
+		}
+		return sign | uint16(half)
+	}
+}
+
+// halfToFloat32 converts a float16 to float32, which is exact.
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case 0:
+		// Zero or subnormal: mant * 2^-24.
+		return math.Float32frombits(sign | math.Float32bits(float32(mant)/(1<<24)))
+	default:
+		return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+	}
+}
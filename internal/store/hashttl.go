@@ -0,0 +1,211 @@
+package store
+
+import "time"
+
+// Hash field expiry.
+//
+// Like Redis 7.4, individual hash fields may carry their own expiry, kept in
+// the item's FieldExpiresAt alongside its fields. Expired fields are deleted
+// lazily whenever the hash is looked up, and a hash whose last field expires
+// is deleted with it. Setting a field's value with HSET clears its expiry.
+
+// Per-field results of HExpireAtWithoutLock, HTTLWithoutLock and
+// HPersistWithoutLock, matching the integers Redis replies with.
+const (
+	FieldMissing = -2 // the key or field does not exist
+	FieldNoTTL   = -1 // HTTL, HPERSIST: the field has no expiry
+	FieldSkipped = 0  // HEXPIRE: an NX/XX/GT/LT condition was not met
+	FieldUpdated = 1  // HEXPIRE: the expiry was set; HPERSIST: it was removed
+	FieldDeleted = 2  // HEXPIRE: the time had already passed, so the field was deleted
+)
+
+// deleteField removes field f from the hash item stored at key, along with its
+// expiry, and updates the memory estimate. Caller must hold the lock.
+func (s *Store) deleteField(key string, item *Item, f string) {
+	v, ok := item.hashDel(f)
+	if !ok {
+		return
+	}
+	s.shard(key).used -= int64(fieldOverhead + len(f) + len(v))
+	s.clearFieldExpiry(key, item, f)
+}
+
+// clearFieldExpiry removes the expiry of field f of the hash item stored at
+// key, if it has one. Caller must hold the lock.
+func (s *Store) clearFieldExpiry(key string, item *Item, f string) {
+	if _, ok := item.FieldExpiresAt[f]; !ok {
+		return
+	}
+	delete(item.FieldExpiresAt, f)
+	s.shard(key).used -= fieldExpiryOverhead
+	if len(item.FieldExpiresAt) == 0 {
+		item.FieldExpiresAt = nil
+	}
+}
+
+// expireFields deletes the fields of the hash at key whose expiry has passed,
+// and the key itself if no field is left. It reports whether the key still
+// exists. Caller must hold the lock.
+func (s *Store) expireFields(key string, item *Item) bool {
+	now := s.now()
+	for f, at := range item.FieldExpiresAt {
+		if now.After(at) {
+			s.deleteField(key, item, f)
+		}
+	}
+	if item.HashLen() == 0 {
+		s.remove(key, *item)
+		return false
+	}
+	s.shard(key).data[key] = *item
+	return true
+}
+
+// HExpireAtWithoutLock sets the expiry of each of fields in the hash at key
+// to expiresAt, subject to flags as for ExpireAtIfWithoutLock. A time that is
+// not in the future deletes the field. It returns one of FieldMissing,
+// FieldSkipped, FieldUpdated or FieldDeleted per field, and false on WRONGTYPE.
+// Caller must hold the lock.
+func (s *Store) HExpireAtWithoutLock(key string, fields []string, expiresAt time.Time, flags ExpireFlags) ([]int, bool) {
+	item, ok := s.peek(key)
+	if ok && item.Type != TypeHash {
+		return nil, false
+	}
+	results := s.fieldExpireResults(item, fields, expiresAt, flags)
+	if !ok {
+		return results, true
+	}
+
+	for i, f := range fields {
+		switch results[i] {
+		case FieldDeleted:
+			s.deleteField(key, &item, f)
+		case FieldUpdated:
+			if item.FieldExpiresAt == nil {
+				item.FieldExpiresAt = make(map[string]time.Time)
+			}
+			if _, had := item.FieldExpiresAt[f]; !had {
+				s.shard(key).used += fieldExpiryOverhead
+			}
+			item.FieldExpiresAt[f] = expiresAt
+		}
+	}
+
+	if item.HashLen() == 0 {
+		s.remove(key, item)
+	} else {
+		s.shard(key).data[key] = item
+	}
+	return results, true
+}
+
+// HExpireAtResultsWithoutLock returns what HExpireAtWithoutLock would return
+// for the same arguments, without changing anything. Caller must hold the lock.
+func (s *Store) HExpireAtResultsWithoutLock(key string, fields []string, expiresAt time.Time, flags ExpireFlags) ([]int, bool) {
+	item, ok := s.peek(key)
+	if ok && item.Type != TypeHash {
+		return nil, false
+	}
+	return s.fieldExpireResults(item, fields, expiresAt, flags), true
+}
+
+// fieldExpireResults works out the HExpireAtWithoutLock result for each of
+// fields of the hash item. A field named again after being deleted is missing
+// the second time.
+func (s *Store) fieldExpireResults(item Item, fields []string, expiresAt time.Time, flags ExpireFlags) []int {
+	results := make([]int, len(fields))
+	expired := !expiresAt.After(s.now())
+	var deleted map[string]bool
+	for i, f := range fields {
+		switch _, exists := item.HashGet(f); {
+		case !exists || deleted[f]:
+			results[i] = FieldMissing
+		case !expireAllowed(item.FieldExpiresAt[f], expiresAt, flags):
+			results[i] = FieldSkipped
+		case expired:
+			if deleted == nil {
+				deleted = make(map[string]bool)
+			}
+			deleted[f] = true
+			results[i] = FieldDeleted
+		default:
+			results[i] = FieldUpdated
+		}
+	}
+	return results
+}
+
+// HTTLWithoutLock returns the remaining time to live in seconds of each of
+// fields in the hash at key, or FieldMissing or FieldNoTTL, and false on
+// WRONGTYPE. It does not count as an access. Caller must hold the lock.
+func (s *Store) HTTLWithoutLock(key string, fields []string) ([]int, bool) {
+	results := make([]int, len(fields))
+	item, ok := s.peek(key)
+	if ok && item.Type != TypeHash {
+		return nil, false
+	}
+	for i, f := range fields {
+		_, exists := item.HashGet(f)
+		at, hasTTL := item.FieldExpiresAt[f]
+		switch {
+		case !exists:
+			results[i] = FieldMissing
+		case !hasTTL:
+			results[i] = FieldNoTTL
+		default:
+			results[i] = ttlSeconds(at.Sub(s.now()))
+		}
+	}
+	return results, true
+}
+
+// HPersistWithoutLock removes the expiry of each of fields in the hash at
+// key. It returns one of FieldMissing, FieldNoTTL or FieldUpdated per field,
+// and false on WRONGTYPE. Caller must hold the lock.
+func (s *Store) HPersistWithoutLock(key string, fields []string) ([]int, bool) {
+	results := make([]int, len(fields))
+	item, ok := s.peek(key)
+	if ok && item.Type != TypeHash {
+		return nil, false
+	}
+	for i, f := range fields {
+		_, exists := item.HashGet(f)
+		_, hasTTL := item.FieldExpiresAt[f]
+		switch {
+		case !exists:
+			results[i] = FieldMissing
+		case !hasTTL:
+			results[i] = FieldNoTTL
+		default:
+			s.clearFieldExpiry(key, &item, f)
+			results[i] = FieldUpdated
+		}
+	}
+	if ok {
+		s.shard(key).data[key] = item
+	}
+	return results, true
+}
+
+// --- Public Hash Field Expiry API (acquires the lock) ---
+
+func (s *Store) HExpireAt(key string, fields []string, expiresAt time.Time, flags ExpireFlags) ([]int, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.HExpireAtWithoutLock(key, fields, expiresAt, flags)
+}
+
+func (s *Store) HTTL(key string, fields []string) ([]int, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.HTTLWithoutLock(key, fields)
+}
+
+func (s *Store) HPersist(key string, fields []string) ([]int, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.HPersistWithoutLock(key, fields)
+}
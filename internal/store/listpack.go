@@ -0,0 +1,170 @@
+package store
+
+import (
+	"iter"
+	"maps"
+	"slices"
+)
+
+// Listpack encoded hashes.
+//
+// As in Redis, a small hash is kept as a flat slice of alternating fields and
+// values in HashPairs instead of a map in HashVal, which saves the map's
+// buckets in the common case of many small hashes. HSET creates a hash this
+// way and converts it to a map for good once it has more than
+// hash-max-listpack-entries fields or a field or value longer than
+// hash-max-listpack-value bytes; a hash set by RESTORE is encoded the same way.
+// Finding a field in a listpack is a linear scan, which for so few fields is
+// about as fast as hashing. Fields stay in the order they were added, and
+// OBJECT ENCODING reports the encoding as listpack or hashtable. The memory
+// estimate counts a field the same in both encodings.
+
+// Defaults of SetHashListpackLimits, as in Redis.
+const (
+	DefaultHashMaxListpackEntries = 128
+	DefaultHashMaxListpackValue   = 64
+)
+
+// SetHashListpackLimits sets the most fields, and the longest field or value
+// in bytes, a hash may have and still be listpack encoded. 0 entries keeps
+// every new hash in a map. Hashes already stored are converted the next time
+// HSET adds to them.
+func (s *Store) SetHashListpackLimits(entries, value int64) {
+	s.hashMaxListpackEntries.Store(entries)
+	s.hashMaxListpackValue.Store(value)
+}
+
+// HashListpackLimits returns the limits set by SetHashListpackLimits.
+func (s *Store) HashListpackLimits() (entries, value int64) {
+	return s.hashMaxListpackEntries.Load(), s.hashMaxListpackValue.Load()
+}
+
+// fitsListpack reports whether a hash of n fields may hold field and value
+// and stay listpack encoded.
+func (s *Store) fitsListpack(n int, field, value string) bool {
+	entries, maxLen := s.HashListpackLimits()
+	return int64(n) <= entries && int64(len(field)) <= maxLen && int64(len(value)) <= maxLen
+}
+
+// compactHash listpack encodes a hash item held in a map if it fits the
+// limits, with its fields in sorted order.
+func (s *Store) compactHash(item *Item) {
+	if item.Type != TypeHash || item.ListpackEncoded {
+		return
+	}
+	for f, v := range item.HashVal {
+		if !s.fitsListpack(len(item.HashVal), f, v) {
+			return
+		}
+	}
+	pairs := make([]string, 0, 2*len(item.HashVal))
+	for _, f := range slices.Sorted(maps.Keys(item.HashVal)) {
+		pairs = append(pairs, f, item.HashVal[f])
+	}
+	item.ListpackEncoded, item.HashPairs, item.HashVal = true, pairs, nil
+}
+
+// Hash returns the fields and values of a hash item, whichever its encoding.
+// For a listpack they are copied into a new map.
+func (item Item) Hash() map[string]string {
+	if !item.ListpackEncoded {
+		return item.HashVal
+	}
+	return maps.Collect(item.hashAll())
+}
+
+// HashLen returns the number of fields of a hash item.
+func (item Item) HashLen() int {
+	if item.ListpackEncoded {
+		return len(item.HashPairs) / 2
+	}
+	return len(item.HashVal)
+}
+
+// hashAll iterates over the fields and values of a hash item: in the order
+// they were added for a listpack, in no particular order for a map.
+func (item Item) hashAll() iter.Seq2[string, string] {
+	if !item.ListpackEncoded {
+		return maps.All(item.HashVal)
+	}
+	return func(yield func(string, string) bool) {
+		for i := 0; i < len(item.HashPairs); i += 2 {
+			if !yield(item.HashPairs[i], item.HashPairs[i+1]) {
+				return
+			}
+		}
+	}
+}
+
+// hashFields returns the fields of a hash item in a new slice.
+func (item Item) hashFields() []string {
+	if !item.ListpackEncoded {
+		return slices.Collect(maps.Keys(item.HashVal))
+	}
+	fields := make([]string, 0, item.HashLen())
+	for i := 0; i < len(item.HashPairs); i += 2 {
+		fields = append(fields, item.HashPairs[i])
+	}
+	return fields
+}
+
+// hashIndex returns the index in HashPairs of field of a listpack, or -1.
+func (item Item) hashIndex(field string) int {
+	for i := 0; i < len(item.HashPairs); i += 2 {
+		if item.HashPairs[i] == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// HashGet returns the value of field of a hash item, whichever its encoding.
+func (item Item) HashGet(field string) (string, bool) {
+	if !item.ListpackEncoded {
+		v, ok := item.HashVal[field]
+		return v, ok
+	}
+	if i := item.hashIndex(field); i >= 0 {
+		return item.HashPairs[i+1], true
+	}
+	return "", false
+}
+
+// hashSet sets field of a hash item to value and returns its old value, if
+// it had one. It doesn't convert a listpack that outgrows the limits.
+func (item *Item) hashSet(field, value string) (string, bool) {
+	if !item.ListpackEncoded {
+		old, ok := item.HashVal[field]
+		item.HashVal[field] = value
+		return old, ok
+	}
+	if i := item.hashIndex(field); i >= 0 {
+		old := item.HashPairs[i+1]
+		item.HashPairs[i+1] = value
+		return old, true
+	}
+	item.HashPairs = append(item.HashPairs, field, value)
+	return "", false
+}
+
+// hashDel removes field from a hash item and returns its value, if it had one.
+func (item *Item) hashDel(field string) (string, bool) {
+	if !item.ListpackEncoded {
+		old, ok := item.HashVal[field]
+		delete(item.HashVal, field)
+		return old, ok
+	}
+	i := item.hashIndex(field)
+	if i < 0 {
+		return "", false
+	}
+	old := item.HashPairs[i+1]
+	item.HashPairs = slices.Delete(item.HashPairs, i, i+2)
+	return old, true
+}
+
+// toHashtable converts a listpack hash item to a map.
+func (item *Item) toHashtable() {
+	item.HashVal = item.Hash()
+	item.ListpackEncoded, item.HashPairs = false, nil
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"maps"
+	"slices"
+	"sort"
+)
+
+// Cursor-based iteration.
+//
+// Go maps have no stable iteration order, so scans walk a sorted snapshot of
+// the names and the cursor is simply the position in that order. Names added
+// or removed between calls can shift positions: an element present for the
+// whole scan is returned at least once unless elements sorting before it are
+// deleted mid-scan, and may be returned twice if elements sorting before it
+// are added. Each call costs O(n log n) in the size of the collection; for
+// the keyspace, in the size of each shard it visits.
+
+// scanSorted returns the names in sorted position [cursor, cursor+count) that
+// match pattern (empty matches everything) and the cursor for the next call,
+// which is 0 once the iteration is complete. Like Redis, COUNT bounds the
+// work done, so a call may return fewer than count names, or none.
+func scanSorted(names []string, cursor int, pattern string, count int) (int, []string) {
+	sort.Strings(names)
+	if cursor < 0 || cursor >= len(names) {
+		return 0, nil
+	}
+
+	end := min(cursor+count, len(names))
+	var out []string
+	for _, name := range names[cursor:end] {
+		if pattern == "" || MatchGlob(pattern, name) {
+			out = append(out, name)
+		}
+	}
+	if end == len(names) {
+		end = 0
+	}
+	return end, out
+}
+
+// ScanWithoutLock returns the next batch of keys for SCAN and the cursor for
+// the call after it, which is 0 once every shard has been walked. The cursor
+// packs a shard index and a position in that shard's sorted keys, so a call
+// sorts only the shards it visits rather than the whole keyspace. count bounds
+// how many keys are examined, matching or not, so a pattern that matches few
+// keys yields small or empty batches instead of one long call; a call moves
+// on to the next shard only while its budget lasts. Expired keys are deleted.
+// Caller must hold every shard's lock.
+func (s *Store) ScanWithoutLock(cursor int, pattern string, count int) (int, []string) {
+	n := len(s.shards)
+	shard, pos := cursor%n, cursor/n
+	now := s.now()
+	var keys []string
+	for examined := 0; shard < n && examined < count; shard, pos = shard+1, 0 {
+		sh := s.shards[shard]
+		names := slices.Collect(maps.Keys(sh.data))
+		next, picked := scanSorted(names, pos, pattern, count-examined)
+		for _, key := range picked {
+			if !s.removeIfExpired(key, sh.data[key], now) {
+				keys = append(keys, key)
+			}
+		}
+		if next != 0 {
+			return next*n + shard, keys
+		}
+		examined += max(len(names)-pos, 0)
+	}
+	if shard == n {
+		return 0, keys
+	}
+	return shard, keys
+}
+
+// MatchGlob reports whether s matches the Redis-style glob pattern. It
+// supports * (any run of bytes), ? (any one byte), [abc], [^abc], [a-z] and
+// \ to escape the next character. Unlike path.Match, / is not special.
+func MatchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if MatchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			matched, rest := matchClass(pattern[1:], s[0])
+			if !matched {
+				return false
+			}
+			s = s[1:]
+			pattern = rest
+
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against a bracket expression whose opening [ has been
+// consumed, returning whether it matched and the pattern after the closing ].
+// An unterminated class extends to the end of the pattern, as in Redis.
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			if pattern[1] == c {
+				matched = true
+			}
+			pattern = pattern[2:]
+		case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			pattern = pattern[3:]
+		default:
+			if pattern[0] == c {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:] // closing ]
+	}
+	return matched != negate, pattern
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+)
+
+// Sharding.
+//
+// The keyspace is split into shards by a hash of the key, each with its own
+// map, memory estimate and lock, so that commands on keys in different shards
+// run in parallel. Commands lock the shards of the keys they name with
+// LockKeys, while anything that walks the whole keyspace takes every shard
+// with Lock. Shards are always locked in index order, so two callers locking
+// overlapping sets can't deadlock.
+
+// DefaultShards is the number of shards used by New.
+const DefaultShards = 16
+
+type shard struct {
+	mu      sync.RWMutex
+	data    map[string]Item
+	used    int64 // estimated memory used by data, see itemSize
+	noTouch bool  // reads don't count as accesses, see SetNoTouchWithoutLock
+}
+
+// shard returns the shard holding key.
+func (s *Store) shard(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// ShardOf returns the index of the shard holding key.
+func (s *Store) ShardOf(key string) int {
+	return s.shardIndex(key)
+}
+
+func (s *Store) shardIndex(key string) int {
+	return int(maphash.String(s.seed, key) % uint64(len(s.shards)))
+}
+
+// Lock locks every shard for writing, for callers that need the whole
+// keyspace, such as transactions touching unknown keys.
+func (s *Store) Lock() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+}
+
+// Unlock unlocks every shard.
+func (s *Store) Unlock() {
+	for _, sh := range s.shards {
+		sh.mu.Unlock()
+	}
+}
+
+// LockKeys locks the shards holding keys for writing, each once and in index
+// order. The WithoutLock methods may then be called for those keys only.
+func (s *Store) LockKeys(keys []string) {
+	for _, i := range s.shardIndexes(keys) {
+		s.shards[i].mu.Lock()
+	}
+}
+
+// UnlockKeys unlocks the shards locked by LockKeys(keys).
+func (s *Store) UnlockKeys(keys []string) {
+	for _, i := range s.shardIndexes(keys) {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+// SetNoTouchWithoutLock sets whether reading a key in the shards of keys, or
+// in every shard if keys is nil, leaves its access time and frequency alone,
+// for clients in CLIENT NO-TOUCH mode. TOUCH and writes still count as
+// accesses. Caller must hold the locks of those shards and turn the setting
+// off again before releasing them.
+func (s *Store) SetNoTouchWithoutLock(keys []string, on bool) {
+	if keys == nil {
+		for _, sh := range s.shards {
+			sh.noTouch = on
+		}
+		return
+	}
+	for _, i := range s.shardIndexes(keys) {
+		s.shards[i].noTouch = on
+	}
+}
+
+// shardIndexes returns the distinct shards of keys in ascending order.
+func (s *Store) shardIndexes(keys []string) []int {
+	idx := make([]int, len(keys))
+	for i, key := range keys {
+		idx[i] = s.shardIndex(key)
+	}
+	slices.Sort(idx)
+	return slices.Compact(idx)
+}
+
+// Shards returns the number of shards.
+func (s *Store) Shards() int {
+	return len(s.shards)
+}
+
+// lenWithoutLock returns the number of keys, including expired ones not yet
+// removed. Caller must hold every shard's lock.
+func (s *Store) lenWithoutLock() int {
+	n := 0
+	for _, sh := range s.shards {
+		n += len(sh.data)
+	}
+	return n
+}
@@ -1,8 +1,13 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"hash/maphash"
 	"maps"
-	"sync"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,271 +17,863 @@ const (
 	TypeHash   = 2
 )
 
+// ErrInvalidItem is returned by Load for an item that no command could have
+// created, such as one of an unknown type.
+var ErrInvalidItem = errors.New("invalid item")
+
+// ExpireFlags restricts when EXPIRE applies, mirroring the Redis 7 NX/XX/GT/LT options.
+type ExpireFlags uint8
+
+const (
+	ExpireNX ExpireFlags = 1 << iota // only if the key has no expiry
+	ExpireXX                         // only if the key already has an expiry
+	ExpireGT                         // only if the new expiry is later than the current one
+	ExpireLT                         // only if the new expiry is earlier than the current one
+)
+
 type Item struct {
-	Type      uint8
-	StrVal    string
-	VecVal    []float32
-	HashVal   map[string]string
-	ExpiresAt time.Time // Zero value means no expiration
+	Type            uint8
+	StrVal          string
+	IntVal          int64 // The value of an int encoded string, see SetStr
+	IntEncoded      bool
+	VecVal          []float32
+	HalfVal         []uint16 // The value of a float16 encoded vector, see SetHalfVec
+	HalfEncoded     bool
+	HashVal         map[string]string
+	HashPairs       []string // The fields and values of a listpack encoded hash, see listpack.go
+	ListpackEncoded bool
+	FieldExpiresAt  map[string]time.Time // Expiry of the hash fields that have one, nil if none do
+	ExpiresAt       time.Time            // Zero value means no expiration
+	LastAccess      time.Time            // Updated whenever the key is read or written
+	Freq            uint8                // Logarithmic access frequency for LFU eviction, see markAccess
 }
 
+// Store is the in-memory keyspace, split into shards (see shard.go).
+//
+// Methods with a WithoutLock suffix assume the caller already holds the locks
+// they need and never lock themselves: methods on a key need its shard, taken
+// with LockKeys, and methods that walk the whole keyspace (ItemsWithoutLock,
+// FlushWithoutLock, GetAllVectorsWithoutLock, the memory and eviction methods)
+// need every shard, taken with Lock. Every other exported method acquires the
+// locks on its own. sync.RWMutex is not reentrant, so calling a locking method
+// while the lock is held deadlocks.
 type Store struct {
-	mu   sync.RWMutex
-	data map[string]Item
+	shards []*shard
+	seed   maphash.Seed
+
+	evictionPool []string // eviction candidates carried between evictions
+
+	vectorGen atomic.Uint64 // see VectorGeneration
+
+	hashMaxListpackEntries atomic.Int64 // see SetHashListpackLimits
+	hashMaxListpackValue   atomic.Int64
+
+	now func() time.Time // the clock expiry and access times are read from, see SetClock
 }
 
+// New returns an empty store with DefaultShards shards.
 func New() *Store {
-	return &Store{
-		data: make(map[string]Item),
+	return NewSharded(DefaultShards)
+}
+
+// NewSharded returns an empty store split into n shards; n below 1 means 1.
+func NewSharded(n int) *Store {
+	s := &Store{shards: make([]*shard, max(n, 1)), seed: maphash.MakeSeed(), now: time.Now}
+	for i := range s.shards {
+		s.shards[i] = &shard{data: make(map[string]Item)}
 	}
+	s.SetHashListpackLimits(DefaultHashMaxListpackEntries, DefaultHashMaxListpackValue)
+	return s
 }
 
-// Lock manually locks the store for writing. Used for transactions.
-func (s *Store) Lock() {
-	s.mu.Lock()
+// SetClock makes the store read the current time from now instead of
+// time.Now, so that tests can move time forward without sleeping. It must be
+// called before the store is used.
+func (s *Store) SetClock(now func() time.Time) {
+	s.now = now
 }
 
-// Unlock manually unlocks the store.
-func (s *Store) Unlock() {
-	s.mu.Unlock()
+// Now returns the current time on the store's clock, which callers that
+// compute absolute expiries must use so that they agree with the store.
+func (s *Store) Now() time.Time {
+	return s.now()
+}
+
+// expired reports whether item's TTL had passed at now.
+func expired(item Item, now time.Time) bool {
+	return !item.ExpiresAt.IsZero() && now.After(item.ExpiresAt)
+}
+
+// removeIfExpired deletes the item stored at key if it had expired at now and
+// reports whether it did. Keys are expired lazily, so this is where every
+// expired key of every type is deleted: by peek when the key is looked up, and
+// by the methods that walk the keyspace for any they come across. Caller must
+// hold the lock.
+func (s *Store) removeIfExpired(key string, item Item, now time.Time) bool {
+	if !expired(item, now) {
+		return false
+	}
+	s.remove(key, item)
+	return true
+}
+
+// peek returns the item stored at key, deleting it first if it has expired.
+// It does not update the access time. Caller must hold the lock.
+func (s *Store) peek(key string) (Item, bool) {
+	item, ok := s.shard(key).data[key]
+	if !ok {
+		return Item{}, false
+	}
+
+	if s.removeIfExpired(key, item, s.now()) {
+		return Item{}, false
+	}
+	if item.FieldExpiresAt != nil && !s.expireFields(key, &item) {
+		return Item{}, false
+	}
+
+	return item, true
+}
+
+// lookup is like peek but records the access for OBJECT IDLETIME and OBJECT FREQ,
+// unless the key's shard is in no-touch mode. Caller must hold the lock.
+func (s *Store) lookup(key string) (Item, bool) {
+	item, ok := s.peek(key)
+	if !ok {
+		return Item{}, false
+	}
+	if sh := s.shard(key); !sh.noTouch {
+		markAccess(&item, s.now())
+		sh.data[key] = item
+	}
+	return item, true
 }
 
 // SetWithoutLock writes to the store without locking. Caller must hold the lock.
 func (s *Store) SetWithoutLock(key, value string) {
-	s.data[key] = Item{
-		Type:   TypeString,
-		StrVal: value,
+	item := Item{Type: TypeString}
+	item.SetStr(value)
+	s.put(key, s.replacing(key, item))
+}
+
+// SetIfEqWithoutLock sets key to value, as SetWithoutLock, if it holds the
+// string expected. It returns 1 if it did and 0 otherwise, and false if key
+// holds another type. Caller must hold the lock.
+func (s *Store) SetIfEqWithoutLock(key, expected, value string) (int, bool) {
+	item, ok := s.peek(key)
+	if ok && item.Type != TypeString {
+		return 0, false
 	}
+	if !ok || item.Str() != expected {
+		return 0, true
+	}
+	s.SetWithoutLock(key, value)
+	return 1, true
+}
+
+// SetIfAbsentWithoutLock sets key to value if it doesn't exist, returning 1
+// if it did and 0 otherwise. Caller must hold the lock.
+func (s *Store) SetIfAbsentWithoutLock(key, value string) int {
+	if _, ok := s.peek(key); ok {
+		return 0
+	}
+	s.SetWithoutLock(key, value)
+	return 1
 }
 
 // SetVectorWithoutLock writes a vector to the store.
 func (s *Store) SetVectorWithoutLock(key string, vec []float32) {
-	s.data[key] = Item{
+	s.put(key, s.replacing(key, Item{
 		Type:   TypeVector,
 		VecVal: vec,
+	}))
+}
+
+// SetHalfVectorWithoutLock writes a vector to the store float16 encoded.
+// Components must be within ±MaxHalf. Caller must hold the lock.
+func (s *Store) SetHalfVectorWithoutLock(key string, vec []float32) {
+	item := Item{Type: TypeVector}
+	item.SetHalfVec(vec)
+	s.put(key, s.replacing(key, item))
+}
+
+// MSetVectorWithoutLock writes several vectors at once. Caller must hold the lock.
+func (s *Store) MSetVectorWithoutLock(vecs map[string][]float32) {
+	for key, vec := range vecs {
+		s.SetVectorWithoutLock(key, vec)
 	}
 }
 
-// GetWithoutLock reads from the store without locking. Caller must hold the lock.
-func (s *Store) GetWithoutLock(key string) (string, bool) {
-	item, ok := s.data[key]
+// GetWithoutLock reads a string without locking. Caller must hold the lock.
+// Returns (value, found, typeOk); typeOk is false if the key holds a non-string value.
+func (s *Store) GetWithoutLock(key string) (string, bool, bool) {
+	item, ok := s.lookup(key)
 	if !ok {
-		return "", false
+		return "", false, true
 	}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
-		return "", false
+	if item.Type != TypeString {
+		return "", false, false
+	}
+
+	return item.Str(), true, true
+}
+
+// GetDelWithoutLock reads a string and deletes its key. Returns (value, found,
+// typeOk); a key of another type is left in place. Caller must hold the lock.
+func (s *Store) GetDelWithoutLock(key string) (string, bool, bool) {
+	item, ok := s.lookup(key)
+	if !ok {
+		return "", false, true
 	}
 
 	if item.Type != TypeString {
-		// Redis protocol usually returns error for wrong type, but here we return nil/false or handle it upper layer.
-		// For simplicity, we return empty string and true, but let's stick to "not found" behavior for wrong type
-		// or let the handler check type?
-		// Better: Return the raw item or check type.
-		// To match existing API signature `(string, bool)`, we return false if it's not a string.
-		return "", false
+		return "", false, false
 	}
 
-	return item.StrVal, true
+	s.remove(key, item)
+	return item.Str(), true, true
 }
 
-// GetVectorWithoutLock reads a vector.
-func (s *Store) GetVectorWithoutLock(key string) ([]float32, bool) {
-	item, ok := s.data[key]
-	if !ok {
-		return nil, false
+// DelIfEqWithoutLock deletes key if it holds the string expected and returns
+// 1 if it did, 0 otherwise; a key of another type never matches. Caller must
+// hold the lock.
+func (s *Store) DelIfEqWithoutLock(key, expected string) int {
+	item, ok := s.peek(key)
+	if !ok || item.Type != TypeString || item.Str() != expected {
+		return 0
 	}
+	s.remove(key, item)
+	return 1
+}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
-		return nil, false
+// GetVectorWithoutLock reads a vector. Returns (vector, found, typeOk); typeOk
+// is false if the key holds a non-vector value. Caller must hold the lock.
+func (s *Store) GetVectorWithoutLock(key string) ([]float32, bool, bool) {
+	item, ok := s.lookup(key)
+	if !ok {
+		return nil, false, true
 	}
 
 	if item.Type != TypeVector {
-		return nil, false
+		return nil, false, false
 	}
 
-	return item.VecVal, true
+	return item.Vec(), true, true
 }
 
-// DelWithoutLock deletes without locking. Caller must hold the lock.
+// DelWithoutLock deletes without locking and reports whether a live key was
+// removed; an expired key is cleaned up but not counted. Caller must hold the lock.
 func (s *Store) DelWithoutLock(key string) bool {
-	_, exists := s.data[key]
+	item, exists := s.peek(key)
 	if exists {
-		delete(s.data, key)
+		s.remove(key, item)
 	}
 	return exists
 }
 
+// DelManyWithoutLock deletes every key in keys and returns how many of them
+// existed. Caller must hold the lock.
+func (s *Store) DelManyWithoutLock(keys []string) int {
+	deleted := 0
+	for _, key := range keys {
+		if s.DelWithoutLock(key) {
+			deleted++
+		}
+	}
+	return deleted
+}
+
 // ExpireWithoutLock sets expiration without locking. Caller must hold the lock.
 func (s *Store) ExpireWithoutLock(key string, seconds int) bool {
-	item, ok := s.data[key]
+	return s.ExpireIfWithoutLock(key, seconds, 0)
+}
+
+// ExpireIfWithoutLock sets expiration if the conditions in flags hold. A key without
+// an expiry is treated as having an infinite TTL for GT and LT, and a non-positive
+// TTL deletes the key. Returns true if the expiry was applied. Caller must hold the lock.
+func (s *Store) ExpireIfWithoutLock(key string, seconds int, flags ExpireFlags) bool {
+	return s.ExpireAtIfWithoutLock(key, s.now().Add(time.Duration(seconds)*time.Second), flags)
+}
+
+// ExpireAtIfWithoutLock is ExpireIfWithoutLock with an absolute expiry time;
+// a time that is not in the future deletes the key. Caller must hold the lock.
+func (s *Store) ExpireAtIfWithoutLock(key string, expiresAt time.Time, flags ExpireFlags) bool {
+	item, ok := s.peek(key)
 	if !ok {
 		return false
 	}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
+	if !expireAllowed(item.ExpiresAt, expiresAt, flags) {
+		return false
+	}
+
+	// An expiry that has already passed deletes the key right away instead of
+	// leaving an already-expired item behind for lazy expiry to find.
+	if !expiresAt.After(s.now()) {
+		s.remove(key, item)
+		return true
+	}
+
+	item.ExpiresAt = expiresAt
+	s.shard(key).data[key] = item
+	s.vectorChanged(item)
+	return true
+}
+
+// ExpireAllowedWithoutLock reports whether ExpireAtIfWithoutLock would change
+// key, without changing it. Caller must hold the lock.
+func (s *Store) ExpireAllowedWithoutLock(key string, expiresAt time.Time, flags ExpireFlags) bool {
+	item, ok := s.peek(key)
+	return ok && expireAllowed(item.ExpiresAt, expiresAt, flags)
+}
+
+// expireAllowed reports whether flags permit replacing the expiry current
+// (zero for none) with expiresAt.
+func expireAllowed(current, expiresAt time.Time, flags ExpireFlags) bool {
+	hasTTL := !current.IsZero()
+
+	if flags&ExpireNX != 0 && hasTTL {
+		return false
+	}
+	if flags&ExpireXX != 0 && !hasTTL {
+		return false
+	}
+	if flags&ExpireGT != 0 && (!hasTTL || !expiresAt.After(current)) {
+		return false
+	}
+	if flags&ExpireLT != 0 && hasTTL && !expiresAt.Before(current) {
 		return false
 	}
+	return true
+}
 
-	item.ExpiresAt = time.Now().Add(time.Duration(seconds) * time.Second)
-	s.data[key] = item
+// PersistWithoutLock removes the expiry from key. Returns true if the key
+// existed and had an expiry. Caller must hold the lock.
+func (s *Store) PersistWithoutLock(key string) bool {
+	item, ok := s.peek(key)
+	if !ok || item.ExpiresAt.IsZero() {
+		return false
+	}
+	item.ExpiresAt = time.Time{}
+	s.shard(key).data[key] = item
+	s.vectorChanged(item)
 	return true
 }
 
 // TTLWithoutLock returns the TTL without locking. Caller must hold the lock.
 func (s *Store) TTLWithoutLock(key string) int {
-	item, ok := s.data[key]
+	item, ok := s.peek(key)
 	if !ok {
 		return -2
 	}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
-		return -2
+	if item.ExpiresAt.IsZero() {
+		return -1
 	}
 
+	return ttlSeconds(item.ExpiresAt.Sub(s.now()))
+}
+
+// ExpireTimeWithoutLock returns the time key expires at as a Unix time in
+// milliseconds, -1 if it has no expiry and -2 if it doesn't exist. It does not
+// count as an access. Caller must hold the lock.
+func (s *Store) ExpireTimeWithoutLock(key string) int64 {
+	item, ok := s.peek(key)
+	if !ok {
+		return -2
+	}
 	if item.ExpiresAt.IsZero() {
 		return -1
 	}
+	return item.ExpiresAt.UnixMilli()
+}
+
+// ttlSeconds rounds a remaining duration up to whole seconds, so a key that
+// has not yet expired never reports a TTL of 0.
+func ttlSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// EncodingWithoutLock reports the internal representation of the value at key,
+// as shown by OBJECT ENCODING. It does not count as an access. Caller must hold the lock.
+func (s *Store) EncodingWithoutLock(key string) (string, bool) {
+	item, ok := s.peek(key)
+	if !ok {
+		return "", false
+	}
+
+	switch item.Type {
+	case TypeString:
+		if item.IntEncoded {
+			return "int", true
+		}
+		return "raw", true
+	case TypeVector:
+		if item.HalfEncoded {
+			return "float16vector", true
+		}
+		return "float32vector", true
+	case TypeHash:
+		if item.ListpackEncoded {
+			return "listpack", true
+		}
+		return "hashtable", true
+	default:
+		return "unknown", true
+	}
+}
+
+// TouchWithoutLock records an access to key without reading its value, even
+// in no-touch mode, and reports whether the key exists. Caller must hold the lock.
+func (s *Store) TouchWithoutLock(key string) bool {
+	item, ok := s.peek(key)
+	if ok {
+		markAccess(&item, s.now())
+		s.shard(key).data[key] = item
+	}
+	return ok
+}
+
+// TypeWithoutLock returns the type of the value at key (TypeString, TypeVector
+// or TypeHash). It does not count as an access. Caller must hold the lock.
+func (s *Store) TypeWithoutLock(key string) (uint8, bool) {
+	item, ok := s.peek(key)
+	if !ok {
+		return 0, false
+	}
+	return item.Type, true
+}
 
-	return int(time.Until(item.ExpiresAt).Seconds())
+// IdleTimeWithoutLock returns the number of seconds since key was last read or written.
+// It does not count as an access. Caller must hold the lock.
+func (s *Store) IdleTimeWithoutLock(key string) (int, bool) {
+	item, ok := s.peek(key)
+	if !ok {
+		return 0, false
+	}
+	return int(s.now().Sub(item.LastAccess).Seconds()), true
 }
 
-// --- Public Thread-Safe API ---
+// GetItemWithoutLock returns the item stored at key, counting as an access.
+// Its vector or hash value is shared with the store, so it must only be read
+// while the lock is still held. Caller must hold the lock.
+func (s *Store) GetItemWithoutLock(key string) (Item, bool) {
+	return s.lookup(key)
+}
+
+// PeekItemWithoutLock is GetItemWithoutLock without counting as an access.
+// Caller must hold the lock.
+func (s *Store) PeekItemWithoutLock(key string) (Item, bool) {
+	return s.peek(key)
+}
+
+// SetItemWithoutLock stores item at key as a new value, replacing any previous
+// one, with the item's type, value and expiry. An expiry that has already
+// passed leaves the key deleted. Caller must hold the lock.
+func (s *Store) SetItemWithoutLock(key string, item Item) {
+	if !item.ExpiresAt.IsZero() && !item.ExpiresAt.After(s.now()) {
+		s.DelWithoutLock(key)
+		return
+	}
+	s.compactHash(&item)
+	s.put(key, s.replacing(key, item))
+}
+
+// --- Public Thread-Safe API (acquires the locks) ---
 
 func (s *Store) Set(key, value string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	s.SetWithoutLock(key, value)
 }
 
 func (s *Store) SetVector(key string, vec []float32) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	s.SetVectorWithoutLock(key, vec)
 }
 
-func (s *Store) Get(key string) (string, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Store) SetHalfVector(key string, vec []float32) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	s.SetHalfVectorWithoutLock(key, vec)
+}
+
+func (s *Store) MSetVector(vecs map[string][]float32) {
+	s.Lock()
+	defer s.Unlock()
+	s.MSetVectorWithoutLock(vecs)
+}
+
+func (s *Store) GetItem(key string) (Item, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.GetItemWithoutLock(key)
+}
+
+func (s *Store) SetItem(key string, item Item) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	s.SetItemWithoutLock(key, item)
+}
+
+func (s *Store) Get(key string) (string, bool, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.GetWithoutLock(key)
 }
 
-func (s *Store) GetVector(key string) ([]float32, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Store) GetDel(key string) (string, bool, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.GetDelWithoutLock(key)
+}
+
+func (s *Store) DelIfEq(key, expected string) int {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.DelIfEqWithoutLock(key, expected)
+}
+
+func (s *Store) SetIfEq(key, expected, value string) (int, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.SetIfEqWithoutLock(key, expected, value)
+}
+
+func (s *Store) SetIfAbsent(key, value string) int {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.SetIfAbsentWithoutLock(key, value)
+}
+
+func (s *Store) GetVector(key string) ([]float32, bool, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.GetVectorWithoutLock(key)
 }
 
 func (s *Store) Del(key string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.DelWithoutLock(key)
 }
 
+func (s *Store) DelMany(keys []string) int {
+	s.LockKeys(keys)
+	defer s.UnlockKeys(keys)
+	return s.DelManyWithoutLock(keys)
+}
+
 func (s *Store) Expire(key string, seconds int) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.ExpireWithoutLock(key, seconds)
 }
 
+func (s *Store) ExpireIf(key string, seconds int, flags ExpireFlags) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.ExpireIfWithoutLock(key, seconds, flags)
+}
+
+func (s *Store) ExpireAtIf(key string, expiresAt time.Time, flags ExpireFlags) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.ExpireAtIfWithoutLock(key, expiresAt, flags)
+}
+
+func (s *Store) Persist(key string) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.PersistWithoutLock(key)
+}
+
+func (s *Store) Encoding(key string) (string, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.EncodingWithoutLock(key)
+}
+
+func (s *Store) Touch(key string) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.TouchWithoutLock(key)
+}
+
+func (s *Store) Type(key string) (uint8, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.TypeWithoutLock(key)
+}
+
+func (s *Store) IdleTime(key string) (int, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.IdleTimeWithoutLock(key)
+}
+
 func (s *Store) TTL(key string) int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.TTLWithoutLock(key)
 }
 
-// HSetWithoutLock sets fields on a hash. Returns the number of new fields added, or -1 on WRONGTYPE.
-func (s *Store) HSetWithoutLock(key string, fields map[string]string) int {
-	item, ok := s.data[key]
-	if ok {
-		if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-			delete(s.data, key)
-			ok = false
+func (s *Store) ExpireTime(key string) int64 {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.ExpireTimeWithoutLock(key)
+}
+
+// Snapshot returns a copy of every live item, taken with the store locked so
+// it is consistent. Values are deep copies, so the snapshot stays as it was
+// however the store changes afterwards. Expired keys are left out, and
+// deleted as ItemsWithoutLock does.
+func (s *Store) Snapshot() map[string]Item {
+	s.Lock()
+	defer s.Unlock()
+	items := s.ItemsWithoutLock()
+	for k, item := range items {
+		items[k] = item.clone()
+	}
+	return items
+}
+
+// Load replaces the whole keyspace with deep copies of data, as returned by
+// Snapshot. Items keep their access time and frequency, except that those
+// with a zero LastAccess start out as new keys. Expired items are left out.
+// If any item is invalid, Load returns an error wrapping ErrInvalidItem and
+// the store is left unchanged.
+func (s *Store) Load(data map[string]Item) error {
+	for k, item := range data {
+		if err := item.validate(); err != nil {
+			return fmt.Errorf("%w: key %q: %v", ErrInvalidItem, k, err)
 		}
 	}
 
+	s.Lock()
+	defer s.Unlock()
+	s.FlushWithoutLock()
+	now := s.now()
+	for k, item := range data {
+		if expired(item, now) {
+			continue
+		}
+		item = item.clone()
+		if item.LastAccess.IsZero() {
+			item.Freq, item.LastAccess = lfuInitVal, now
+		}
+		s.put(k, item)
+	}
+	return nil
+}
+
+// validate checks that item's value matches its type.
+func (item Item) validate() error {
+	switch item.Type {
+	case TypeString:
+		if item.IntEncoded && item.StrVal != "" {
+			return errors.New("int encoded string with a raw value")
+		}
+	case TypeVector:
+		if item.HalfEncoded && item.VecVal != nil {
+			return errors.New("float16 vector with float32 components")
+		}
+	case TypeHash:
+		if item.HashLen() == 0 {
+			return errors.New("hash with no fields")
+		}
+		if item.ListpackEncoded && item.HashVal != nil {
+			return errors.New("listpack hash with a map")
+		}
+		for f := range item.FieldExpiresAt {
+			if _, ok := item.HashGet(f); !ok {
+				return fmt.Errorf("expiry for missing field %q", f)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %d", item.Type)
+	}
+	return nil
+}
+
+// clone returns a copy of item that shares no memory with it.
+func (item Item) clone() Item {
+	item.VecVal = slices.Clone(item.VecVal)
+	item.HalfVal = slices.Clone(item.HalfVal)
+	item.HashVal = maps.Clone(item.HashVal)
+	item.HashPairs = slices.Clone(item.HashPairs)
+	item.FieldExpiresAt = maps.Clone(item.FieldExpiresAt)
+	return item
+}
+
+// ForEach calls fn with the name, type and expiry (zero for none) of every
+// live key, in no particular order, until fn returns false. Every shard is
+// read-locked for the whole walk, so fn sees a consistent keyspace and
+// writers wait until it returns; fn must not call back into the store, which
+// would deadlock. Expired keys are skipped, not deleted, and the walk does not
+// count as an access.
+func (s *Store) ForEach(fn func(key string, typ uint8, expiresAt time.Time) bool) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mu.RUnlock()
+		}
+	}()
+
+	now := s.now()
+	for _, sh := range s.shards {
+		for k, item := range sh.data {
+			if expired(item, now) {
+				continue
+			}
+			if !fn(k, item.Type, item.ExpiresAt) {
+				return
+			}
+		}
+	}
+}
+
+// HSetWithoutLock sets fields on a hash. Returns the number of new fields added, or -1 on WRONGTYPE.
+func (s *Store) HSetWithoutLock(key string, fields map[string]string) int {
+	item, ok := s.lookup(key)
 	if ok && item.Type != TypeHash {
 		return -1
 	}
 
+	sh := s.shard(key)
 	if !ok {
-		item = Item{Type: TypeHash, HashVal: make(map[string]string)}
+		item = Item{Type: TypeHash, ListpackEncoded: true, LastAccess: s.now(), Freq: lfuInitVal}
+		sh.used += itemSize(key, item)
 	}
 
 	added := 0
 	for f, v := range fields {
-		if _, exists := item.HashVal[f]; !exists {
+		if item.ListpackEncoded {
+			n := item.HashLen()
+			if _, exists := item.HashGet(f); !exists {
+				n++
+			}
+			if !s.fitsListpack(n, f, v) {
+				item.toHashtable()
+			}
+		}
+		if old, exists := item.hashSet(f, v); exists {
+			sh.used -= int64(len(old))
+			s.clearFieldExpiry(key, &item, f)
+		} else {
+			sh.used += int64(fieldOverhead + len(f))
 			added++
 		}
-		item.HashVal[f] = v
+		sh.used += int64(len(v))
 	}
 
-	s.data[key] = item
+	sh.data[key] = item
 	return added
 }
 
 // HGetWithoutLock returns the value of a hash field. Returns (value, found, typeOk).
 func (s *Store) HGetWithoutLock(key, field string) (string, bool, bool) {
-	item, ok := s.data[key]
+	item, ok := s.lookup(key)
 	if !ok {
 		return "", false, true
 	}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
-		return "", false, true
-	}
-
 	if item.Type != TypeHash {
 		return "", false, false
 	}
 
-	val, exists := item.HashVal[field]
+	val, exists := item.HashGet(field)
 	return val, exists, true
 }
 
-// HDelWithoutLock deletes fields from a hash. Returns the number of fields removed, or -1 on WRONGTYPE.
+// HDelWithoutLock deletes fields from a hash; a hash left with no fields is
+// deleted. Returns the number of fields removed, or -1 on WRONGTYPE.
 func (s *Store) HDelWithoutLock(key string, fields []string) int {
-	item, ok := s.data[key]
+	item, ok := s.lookup(key)
 	if !ok {
 		return 0
 	}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
-		return 0
-	}
-
 	if item.Type != TypeHash {
 		return -1
 	}
 
 	removed := 0
 	for _, f := range fields {
-		if _, exists := item.HashVal[f]; exists {
-			delete(item.HashVal, f)
+		if _, exists := item.HashGet(f); exists {
+			s.deleteField(key, &item, f)
 			removed++
 		}
 	}
 
-	s.data[key] = item
+	if item.HashLen() == 0 {
+		s.remove(key, item)
+	} else {
+		s.shard(key).data[key] = item
+	}
 	return removed
 }
 
-// HGetAllWithoutLock returns all fields and values of a hash. Returns (map, typeOk).
-// nil map + true = key not found. non-nil map + true = success. nil + false = WRONGTYPE.
-func (s *Store) HGetAllWithoutLock(key string) (map[string]string, bool) {
-	item, ok := s.data[key]
+// HGetDelWithoutLock removes fields from a hash and returns the removed
+// fields with their values; a hash left with no fields is deleted. Returns
+// (removed, typeOk), where removed is nil if the key does not exist.
+func (s *Store) HGetDelWithoutLock(key string, fields []string) (map[string]string, bool) {
+	item, ok := s.lookup(key)
 	if !ok {
 		return nil, true
 	}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
+	if item.Type != TypeHash {
+		return nil, false
+	}
+
+	removed := make(map[string]string)
+	for _, f := range fields {
+		if v, exists := item.HashGet(f); exists {
+			removed[f] = v
+			s.deleteField(key, &item, f)
+		}
+	}
+
+	if item.HashLen() == 0 {
+		s.remove(key, item)
+	} else {
+		s.shard(key).data[key] = item
+	}
+	return removed, true
+}
+
+// HGetAllWithoutLock returns all fields and values of a hash. Returns (map, typeOk).
+// nil map + true = key not found. non-nil map + true = success. nil + false = WRONGTYPE.
+func (s *Store) HGetAllWithoutLock(key string) (map[string]string, bool) {
+	item, ok := s.lookup(key)
+	if !ok {
 		return nil, true
 	}
 
@@ -284,105 +881,251 @@ func (s *Store) HGetAllWithoutLock(key string) (map[string]string, bool) {
 		return nil, false
 	}
 
-	result := make(map[string]string, len(item.HashVal))
-	maps.Copy(result, item.HashVal)
+	result := make(map[string]string, item.HashLen())
+	maps.Insert(result, item.hashAll())
 	return result, true
 }
 
 // HExistsWithoutLock checks if a field exists in a hash. Returns (exists, typeOk).
 func (s *Store) HExistsWithoutLock(key, field string) (bool, bool) {
-	item, ok := s.data[key]
+	item, ok := s.lookup(key)
 	if !ok {
 		return false, true
 	}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
-		return false, true
-	}
-
 	if item.Type != TypeHash {
 		return false, false
 	}
 
-	_, exists := item.HashVal[field]
+	_, exists := item.HashGet(field)
 	return exists, true
 }
 
 // HLenWithoutLock returns the number of fields in a hash, or -1 on WRONGTYPE.
 func (s *Store) HLenWithoutLock(key string) int {
-	item, ok := s.data[key]
+	item, ok := s.lookup(key)
 	if !ok {
 		return 0
 	}
 
-	if !item.ExpiresAt.IsZero() && time.Now().After(item.ExpiresAt) {
-		delete(s.data, key)
-		return 0
+	if item.Type != TypeHash {
+		return -1
+	}
+
+	return item.HashLen()
+}
+
+// HScanWithoutLock returns up to count fields of a hash starting at cursor,
+// as alternating field/value pairs, along with the next cursor (0 when done).
+// Fields are filtered by the glob pattern after they are picked, so a call may
+// return fewer than count. A missing key yields cursor 0 and no pairs. See
+// scanSorted for the guarantees across concurrent modification.
+// Returns (nextCursor, pairs, typeOk).
+func (s *Store) HScanWithoutLock(key string, cursor int, pattern string, count int) (int, []string, bool) {
+	item, ok := s.lookup(key)
+	if !ok {
+		return 0, nil, true
 	}
 
 	if item.Type != TypeHash {
-		return -1
+		return 0, nil, false
+	}
+
+	next, picked := scanSorted(item.hashFields(), cursor, pattern, count)
+	pairs := make([]string, 0, len(picked)*2)
+	for _, f := range picked {
+		v, _ := item.HashGet(f)
+		pairs = append(pairs, f, v)
+	}
+	return next, pairs, true
+}
+
+// HRandFieldWithoutLock returns random fields from a hash, following Redis
+// HRANDFIELD: a positive count returns up to count distinct fields, a negative
+// count returns exactly -count fields that may repeat. With withValues each
+// field is followed by its value. A missing key yields no fields. -count
+// fields are allocated up front, so callers must bound a negative count.
+// Returns (fields, typeOk).
+func (s *Store) HRandFieldWithoutLock(key string, count int, withValues bool) ([]string, bool) {
+	item, ok := s.lookup(key)
+	if !ok {
+		return nil, true
+	}
+
+	if item.Type != TypeHash {
+		return nil, false
 	}
 
-	return len(item.HashVal)
+	fields := item.hashFields()
+	var picked []string
+	if count >= 0 {
+		// Partial Fisher-Yates shuffle for distinct fields.
+		n := min(count, len(fields))
+		for i := range n {
+			j := i + rand.IntN(len(fields)-i)
+			fields[i], fields[j] = fields[j], fields[i]
+		}
+		picked = fields[:n]
+	} else {
+		picked = make([]string, -count)
+		for i := range picked {
+			picked[i] = fields[rand.IntN(len(fields))]
+		}
+	}
+
+	if !withValues {
+		return picked, true
+	}
+	pairs := make([]string, 0, len(picked)*2)
+	for _, f := range picked {
+		v, _ := item.HashGet(f)
+		pairs = append(pairs, f, v)
+	}
+	return pairs, true
 }
 
-// --- Public Hash API ---
+// --- Public Hash API (acquires the lock) ---
 
 func (s *Store) HSet(key string, fields map[string]string) int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.HSetWithoutLock(key, fields)
 }
 
 func (s *Store) HGet(key, field string) (string, bool, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.HGetWithoutLock(key, field)
 }
 
 func (s *Store) HDel(key string, fields []string) int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.HDelWithoutLock(key, fields)
 }
 
+func (s *Store) HGetDel(key string, fields []string) (map[string]string, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.HGetDelWithoutLock(key, fields)
+}
+
 func (s *Store) HGetAll(key string) (map[string]string, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.HGetAllWithoutLock(key)
 }
 
 func (s *Store) HExists(key, field string) (bool, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.HExistsWithoutLock(key, field)
 }
 
 func (s *Store) HLen(key string) int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 	return s.HLenWithoutLock(key)
 }
 
-// GetAllVectors returns a map of all valid vectors (for search).
-func (s *Store) GetAllVectors() map[string][]float32 {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Store) HRandField(key string, count int, withValues bool) ([]string, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.HRandFieldWithoutLock(key, count, withValues)
+}
 
-	// Create a copy to avoid race conditions during iteration by caller if they were to use the map directly
-	// Actually, we should return a snapshot.
-	vectors := make(map[string][]float32)
-	now := time.Now()
+func (s *Store) HScan(key string, cursor int, pattern string, count int) (int, []string, bool) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.HScanWithoutLock(key, cursor, pattern, count)
+}
 
-	for k, v := range s.data {
-		if !v.ExpiresAt.IsZero() && now.After(v.ExpiresAt) {
-			continue // Don't return expired items (cleanup happens on Get/Del usually)
-		}
-		if v.Type == TypeVector {
-			vectors[k] = v.VecVal
+// ItemsWithoutLock returns the live items in the store, deleting expired ones.
+// The items share their vector and hash values with the store, so they must
+// only be read while the lock is still held. Caller must hold every shard's lock.
+func (s *Store) ItemsWithoutLock() map[string]Item {
+	items := make(map[string]Item, s.lenWithoutLock())
+	now := s.now()
+
+	for _, sh := range s.shards {
+		for k, v := range sh.data {
+			if s.removeIfExpired(k, v, now) {
+				continue
+			}
+			items[k] = v
 		}
 	}
+	return items
+}
+
+// FlushWithoutLock removes every key. Caller must hold every shard's lock.
+func (s *Store) FlushWithoutLock() {
+	for _, sh := range s.shards {
+		sh.data = make(map[string]Item)
+		sh.used = 0
+	}
+	s.evictionPool = nil
+	s.vectorGen.Add(1)
+}
+
+// GetAllVectorsWithoutLock returns a snapshot of all live vectors (for search).
+// Expired keys it comes across, vectors or not, are deleted. Caller must hold
+// every shard's lock.
+func (s *Store) GetAllVectorsWithoutLock() map[string][]float32 {
+	vectors, _ := s.VectorsWithoutLock()
 	return vectors
 }
+
+// VectorsWithoutLock is GetAllVectorsWithoutLock that also returns the
+// earliest expiry among the vectors, or the zero time if none of them expires.
+// Together with VectorGeneration it tells how long a search result stays
+// valid. Caller must hold every shard's lock.
+func (s *Store) VectorsWithoutLock() (map[string][]float32, time.Time) {
+	vectors := make(map[string][]float32)
+	var next time.Time
+	now := s.now()
+
+	for _, sh := range s.shards {
+		for k, v := range sh.data {
+			if s.removeIfExpired(k, v, now) || v.Type != TypeVector {
+				continue
+			}
+			vectors[k] = v.Vec()
+			if !v.ExpiresAt.IsZero() && (next.IsZero() || v.ExpiresAt.Before(next)) {
+				next = v.ExpiresAt
+			}
+		}
+	}
+	return vectors, next
+}
+
+// VectorGeneration returns a counter that changes whenever a vector is
+// written, deleted or has its expiry changed, and when the store is flushed.
+// Vectors reaching their expiry time don't change it; see VectorsWithoutLock.
+func (s *Store) VectorGeneration() uint64 {
+	return s.vectorGen.Load()
+}
+
+// vectorChanged advances the vector generation if item is a vector.
+func (s *Store) vectorChanged(item Item) {
+	if item.Type == TypeVector {
+		s.vectorGen.Add(1)
+	}
+}
+
+// GetAllVectors returns a map of all valid vectors (for search). It takes the
+// locks, so callers already holding the lock must use GetAllVectorsWithoutLock.
+func (s *Store) GetAllVectors() map[string][]float32 {
+	s.Lock()
+	defer s.Unlock()
+	return s.GetAllVectorsWithoutLock()
+}
@@ -1,6 +1,15 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -12,7 +21,7 @@ func TestStore_SetGet(t *testing.T) {
 
 	s.Set(key, val)
 
-	got, found := s.Get(key)
+	got, found, _ := s.Get(key)
 	if !found {
 		t.Errorf("Get(%q) should be found", key)
 	}
@@ -21,6 +30,77 @@ func TestStore_SetGet(t *testing.T) {
 	}
 }
 
+func TestStore_GetWrongType(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(s *Store)
+		wantFound  bool
+		wantTypeOk bool
+	}{
+		{
+			name:       "missing key",
+			wantFound:  false,
+			wantTypeOk: true,
+		},
+		{
+			name: "vector key",
+			setup: func(s *Store) {
+				s.SetVector("k", []float32{1.0, 2.0})
+			},
+			wantFound:  false,
+			wantTypeOk: false,
+		},
+		{
+			name: "hash key",
+			setup: func(s *Store) {
+				s.HSet("k", map[string]string{"f1": "v1"})
+			},
+			wantFound:  false,
+			wantTypeOk: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			_, found, typeOk := s.Get("k")
+			if found != tt.wantFound {
+				t.Errorf("Get() found = %v, want %v", found, tt.wantFound)
+			}
+			if typeOk != tt.wantTypeOk {
+				t.Errorf("Get() typeOk = %v, want %v", typeOk, tt.wantTypeOk)
+			}
+		})
+	}
+}
+
+func TestStore_GetVectorWrongType(t *testing.T) {
+	s := New()
+	s.Set("str", "x")
+	s.HSet("h", map[string]string{"f": "v"})
+	s.SetVector("v", []float32{1, 2})
+
+	tests := []struct {
+		key        string
+		wantFound  bool
+		wantTypeOk bool
+	}{
+		{"missing", false, true},
+		{"str", false, false},
+		{"h", false, false},
+		{"v", true, true},
+	}
+	for _, tt := range tests {
+		_, found, typeOk := s.GetVector(tt.key)
+		if found != tt.wantFound || typeOk != tt.wantTypeOk {
+			t.Errorf("GetVector(%s) = %v, %v; want %v, %v", tt.key, found, typeOk, tt.wantFound, tt.wantTypeOk)
+		}
+	}
+}
+
 func TestStore_Del(t *testing.T) {
 	s := New()
 	key := "foo"
@@ -35,7 +115,7 @@ func TestStore_Del(t *testing.T) {
 	}
 
 	// Verify key is gone
-	_, found := s.Get(key)
+	_, found, _ := s.Get(key)
 	if found {
 		t.Errorf("Get(%q) should not be found after Del", key)
 	}
@@ -47,8 +127,96 @@ func TestStore_Del(t *testing.T) {
 	}
 }
 
+func TestStore_GetDel(t *testing.T) {
+	s := New()
+	s.Set("k", "v")
+	s.IncrBy("n", 42)
+	s.HSet("h", map[string]string{"f": "x"})
+
+	if val, found, typeOk := s.GetDel("k"); val != "v" || !found || !typeOk {
+		t.Errorf("GetDel = %q, %v, %v; want v, true, true", val, found, typeOk)
+	}
+	if _, found, typeOk := s.GetDel("k"); found || !typeOk {
+		t.Errorf("GetDel of a deleted key = %v, %v; want false, true", found, typeOk)
+	}
+	if val, _, _ := s.GetDel("n"); val != "42" {
+		t.Errorf("GetDel of a counter = %q, want 42", val)
+	}
+	if _, _, typeOk := s.GetDel("h"); typeOk {
+		t.Error("GetDel on a hash should be WRONGTYPE")
+	}
+	if _, ok := s.Type("h"); !ok {
+		t.Error("GetDel on a hash deleted it")
+	}
+	assertConsistent(t, s)
+}
+
+func TestStore_DelIfEq(t *testing.T) {
+	s := New()
+	s.Set("lock", "owner-1")
+	s.IncrBy("n", 7)
+	s.HSet("h", map[string]string{"f": "owner-1"})
+
+	if n := s.DelIfEq("lock", "owner-2"); n != 0 {
+		t.Errorf("DelIfEq with another value = %d, want 0", n)
+	}
+	if v, found, _ := s.Get("lock"); !found || v != "owner-1" {
+		t.Errorf("lock after a mismatched DelIfEq = %q, %v; want owner-1", v, found)
+	}
+	if n := s.DelIfEq("lock", "owner-1"); n != 1 {
+		t.Errorf("DelIfEq with the value = %d, want 1", n)
+	}
+	if _, found, _ := s.Get("lock"); found {
+		t.Error("lock still exists after DelIfEq")
+	}
+	if n := s.DelIfEq("lock", "owner-1"); n != 0 {
+		t.Errorf("DelIfEq of a missing key = %d, want 0", n)
+	}
+	if n := s.DelIfEq("n", "7"); n != 1 {
+		t.Errorf("DelIfEq of a counter = %d, want 1", n)
+	}
+	if n := s.DelIfEq("h", "owner-1"); n != 0 {
+		t.Errorf("DelIfEq of a hash = %d, want 0", n)
+	}
+	assertConsistent(t, s)
+}
+
+func TestStore_SetIfEq(t *testing.T) {
+	s := New()
+	s.Set("flag", "off")
+	s.HSet("h", map[string]string{"f": "off"})
+
+	if n, typeOk := s.SetIfEq("flag", "on", "x"); n != 0 || !typeOk {
+		t.Errorf("SetIfEq with another value = %d, %v; want 0, true", n, typeOk)
+	}
+	if n, typeOk := s.SetIfEq("flag", "off", "on"); n != 1 || !typeOk {
+		t.Errorf("SetIfEq with the value = %d, %v; want 1, true", n, typeOk)
+	}
+	if v, _, _ := s.Get("flag"); v != "on" {
+		t.Errorf("flag after SetIfEq = %q, want on", v)
+	}
+	if n, typeOk := s.SetIfEq("missing", "", "x"); n != 0 || !typeOk {
+		t.Errorf("SetIfEq of a missing key = %d, %v; want 0, true", n, typeOk)
+	}
+	if _, typeOk := s.SetIfEq("h", "off", "on"); typeOk {
+		t.Error("SetIfEq on a hash should be WRONGTYPE")
+	}
+
+	if n := s.SetIfAbsent("flag", "x"); n != 0 {
+		t.Errorf("SetIfAbsent of an existing key = %d, want 0", n)
+	}
+	if n := s.SetIfAbsent("new", "x"); n != 1 {
+		t.Errorf("SetIfAbsent of a missing key = %d, want 1", n)
+	}
+	if v, found, _ := s.Get("new"); !found || v != "x" {
+		t.Errorf("new after SetIfAbsent = %q, %v; want x", v, found)
+	}
+	assertConsistent(t, s)
+}
+
 func TestStore_Expire(t *testing.T) {
 	s := New()
+	clock := useFakeClock(s)
 	key := "expire_key"
 	val := "expire_val"
 
@@ -66,11 +234,10 @@ func TestStore_Expire(t *testing.T) {
 		t.Errorf("TTL(%q) should be >= 0, got %d", key, ttl)
 	}
 
-	// Wait for expiration
-	time.Sleep(2100 * time.Millisecond)
+	clock.advance(2100 * time.Millisecond)
 
 	// Test Lazy Expiration on Get
-	_, found := s.Get(key)
+	_, found, _ := s.Get(key)
 	if found {
 		t.Errorf("Get(%q) should not be found after expiration", key)
 	}
@@ -82,6 +249,54 @@ func TestStore_Expire(t *testing.T) {
 	}
 }
 
+func TestStore_Clock(t *testing.T) {
+	s := New()
+	clock := useFakeClock(s)
+	s.Set("k", "v")
+	s.Expire("k", 10)
+	s.HSet("h", map[string]string{"a": "1", "b": "2"})
+	s.HExpireAt("h", []string{"a"}, clock.t.Add(5*time.Second), 0)
+	s.Set("idle", "v")
+
+	// Far in the real future, but nothing has moved on the fake clock.
+	clock.advance(9 * time.Second)
+	if ttl := s.TTL("k"); ttl != 1 {
+		t.Errorf("TTL after 9s of 10s = %d, want 1", ttl)
+	}
+	if _, found, _ := s.HGet("h", "a"); found {
+		t.Error("hash field outlived its 5s expiry")
+	}
+	if idle, _ := s.IdleTime("idle"); idle != 9 {
+		t.Errorf("IdleTime after 9s = %d, want 9", idle)
+	}
+
+	clock.advance(2 * time.Second)
+	if _, found, _ := s.Get("k"); found {
+		t.Error("key outlived its 10s expiry")
+	}
+	if ok := s.Expire("idle", 1); !ok {
+		t.Fatal("Expire on a live key = false")
+	}
+	if ttl := s.TTL("idle"); ttl != 1 {
+		t.Errorf("TTL of a key expiring 1s from the fake now = %d, want 1", ttl)
+	}
+
+	// LFU frequency decays by a point per idle minute on the same clock.
+	freq, _ := s.Freq("h")
+	clock.advance(3 * lfuDecayTime)
+	if decayed, _ := s.Freq("h"); decayed != freq-3 {
+		t.Errorf("Freq after 3 fake idle minutes = %d, want %d", decayed, freq-3)
+	}
+	var keys []string
+	s.ForEach(func(key string, _ uint8, _ time.Time) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if !slices.Equal(keys, []string{"h"}) {
+		t.Errorf("keys after the clock passed every expiry = %v, want [h]", keys)
+	}
+}
+
 func TestStore_HSetHGet(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -451,6 +666,7 @@ func TestStore_HLen(t *testing.T) {
 
 func TestStore_HashExpiry(t *testing.T) {
 	s := New()
+	clock := useFakeClock(s)
 	s.HSet("h", map[string]string{"f1": "v1"})
 	s.Expire("h", 1)
 
@@ -460,7 +676,7 @@ func TestStore_HashExpiry(t *testing.T) {
 		t.Fatalf("HGet before expiry: val=%q found=%v typeOk=%v", val, found, typeOk)
 	}
 
-	time.Sleep(1100 * time.Millisecond)
+	clock.advance(1100 * time.Millisecond)
 
 	// After expiry, should behave as key not found
 	val, found, typeOk = s.HGet("h", "f1")
@@ -470,6 +686,276 @@ func TestStore_HashExpiry(t *testing.T) {
 	if !typeOk {
 		t.Errorf("HGet after expiry should have typeOk=true (key gone, not wrong type)")
 	}
+
+	// The other hash accessors agree that the key is gone, not mistyped.
+	s.HSet("h2", map[string]string{"f1": "v1"})
+	s.Expire("h2", 100)
+	expireNow(s, "h2")
+	if n := s.HLen("h2"); n != 0 {
+		t.Errorf("HLen after expiry = %d, want 0", n)
+	}
+	if exists, typeOk := s.HExists("h2", "f1"); exists || !typeOk {
+		t.Errorf("HExists after expiry = %v, %v; want false, true", exists, typeOk)
+	}
+	if m, typeOk := s.HGetAll("h2"); m != nil || !typeOk {
+		t.Errorf("HGetAll after expiry = %v, %v; want nil, true", m, typeOk)
+	}
+	// A write after expiry starts a fresh hash.
+	if added := s.HSet("h2", map[string]string{"f2": "v2"}); added != 1 {
+		t.Errorf("HSet after expiry added %d fields, want 1", added)
+	}
+	if n := s.HLen("h2"); n != 1 {
+		t.Errorf("HLen of recreated hash = %d, want 1", n)
+	}
+	assertConsistent(t, s)
+}
+
+// TestStore_HashExpiredReuse checks that every hash accessor sees a hash
+// recreated after its key expired, or after its last field did, as new: no
+// dead field, key TTL or field TTL carries over.
+func TestStore_HashExpiredReuse(t *testing.T) {
+	s := New()
+	clock := useFakeClock(s)
+	s.HSet("h", map[string]string{"f1": "old", "f2": "old"})
+	s.Expire("h", 1)
+	s.HSet("fields", map[string]string{"f1": "old"})
+	s.HExpireAt("fields", []string{"f1"}, clock.t.Add(time.Second), 0)
+	clock.advance(2 * time.Second)
+
+	for _, key := range []string{"h", "fields"} {
+		if n := s.HDel(key, []string{"f1"}); n != 0 {
+			t.Errorf("HDel(%s) of expired hash = %d, want 0", key, n)
+		}
+		if added := s.HSet(key, map[string]string{"f1": "new", "f3": "new"}); added != 2 {
+			t.Errorf("HSet(%s) on expired hash added %d fields, want 2", key, added)
+		}
+		if v, found, _ := s.HGet(key, "f1"); !found || v != "new" {
+			t.Errorf("HGet(%s, f1) after recreation = %q, %v; want new", key, v, found)
+		}
+		if exists, _ := s.HExists(key, "f2"); exists {
+			t.Errorf("HExists(%s, f2) after recreation = true, want false", key)
+		}
+		if n := s.HLen(key); n != 2 {
+			t.Errorf("HLen(%s) after recreation = %d, want 2", key, n)
+		}
+		if ttl := s.TTL(key); ttl != -1 {
+			t.Errorf("TTL(%s) after recreation = %d, want -1", key, ttl)
+		}
+		if ttls, _ := s.HTTL(key, []string{"f1"}); ttls[0] != FieldNoTTL {
+			t.Errorf("HTTL(%s, f1) after recreation = %d, want %d", key, ttls[0], FieldNoTTL)
+		}
+	}
+
+	// Deleting the last field deletes the hash, so the next HSET starts over.
+	if n := s.HDel("h", []string{"f1", "f3"}); n != 2 {
+		t.Fatalf("HDel of every field = %d, want 2", n)
+	}
+	if _, ok := s.Type("h"); ok {
+		t.Error("hash with no fields left still exists")
+	}
+	if added := s.HSet("h", map[string]string{"f1": "again"}); added != 1 {
+		t.Errorf("HSet after emptying hash added %d fields, want 1", added)
+	}
+	assertConsistent(t, s)
+}
+
+func TestStore_HashListpack(t *testing.T) {
+	s := New()
+	s.SetHashListpackLimits(3, 4)
+	encoding := func(key string) string {
+		enc, _ := s.Encoding(key)
+		return enc
+	}
+
+	s.HSet("h", map[string]string{"a": "1", "b": "2"})
+	s.HSet("h", map[string]string{"c": "3", "a": "one"})
+	if got := encoding("h"); got != "listpack" {
+		t.Fatalf("encoding of 3 short fields = %q, want listpack", got)
+	}
+	if n := s.HDel("h", []string{"b"}); n != 1 {
+		t.Errorf("HDel from listpack = %d, want 1", n)
+	}
+	s.HSet("h", map[string]string{"d": "4"})
+	if m, _ := s.HGetAll("h"); !maps.Equal(m, map[string]string{"a": "one", "c": "3", "d": "4"}) {
+		t.Errorf("HGetAll of listpack = %v", m)
+	}
+
+	// A fourth field passes hash-max-listpack-entries, and the hash stays a
+	// table after shrinking again.
+	s.HSet("h", map[string]string{"e": "5"})
+	if got := encoding("h"); got != "hashtable" {
+		t.Errorf("encoding of 4 fields = %q, want hashtable", got)
+	}
+	s.HDel("h", []string{"d", "e"})
+	if got := encoding("h"); got != "hashtable" {
+		t.Errorf("encoding after shrinking = %q, want hashtable", got)
+	}
+	if m, _ := s.HGetAll("h"); !maps.Equal(m, map[string]string{"a": "one", "c": "3"}) {
+		t.Errorf("HGetAll after conversion = %v", m)
+	}
+
+	// So does a field or value longer than hash-max-listpack-value.
+	s.HSet("longval", map[string]string{"f": "1234"})
+	if got := encoding("longval"); got != "listpack" {
+		t.Errorf("encoding with a 4 byte value = %q, want listpack", got)
+	}
+	s.HSet("longval", map[string]string{"f": "12345"})
+	if got := encoding("longval"); got != "hashtable" {
+		t.Errorf("encoding with a 5 byte value = %q, want hashtable", got)
+	}
+	s.HSet("longfield", map[string]string{"field": "v"})
+	if got := encoding("longfield"); got != "hashtable" {
+		t.Errorf("encoding with a 5 byte field = %q, want hashtable", got)
+	}
+
+	// A restored hash gets the encoding it fits.
+	s.SetItem("restored", Item{Type: TypeHash, HashVal: map[string]string{"b": "2", "a": "1"}})
+	if got := encoding("restored"); got != "listpack" {
+		t.Errorf("encoding of restored small hash = %q, want listpack", got)
+	}
+	if v, found, _ := s.HGet("restored", "a"); !found || v != "1" {
+		t.Errorf("HGet(restored, a) = %q, %v", v, found)
+	}
+
+	s.SetHashListpackLimits(0, 4)
+	s.HSet("table", map[string]string{"f": "v"})
+	if got := encoding("table"); got != "hashtable" {
+		t.Errorf("encoding with hash-max-listpack-entries 0 = %q, want hashtable", got)
+	}
+	assertConsistent(t, s)
+}
+
+func TestStore_HashFieldExpiry(t *testing.T) {
+	s := New()
+	s.HSet("h", map[string]string{"a": "1", "b": "2", "c": "3"})
+	soon := time.Now().Add(time.Hour)
+
+	if got, _ := s.HExpireAt("h", []string{"a", "b", "nope"}, soon, 0); !slices.Equal(got, []int{FieldUpdated, FieldUpdated, FieldMissing}) {
+		t.Errorf("HExpireAt = %v", got)
+	}
+	if got, _ := s.HExpireAt("h", []string{"a", "c"}, soon.Add(time.Hour), ExpireGT); !slices.Equal(got, []int{FieldUpdated, FieldSkipped}) {
+		t.Errorf("HExpireAt GT = %v", got)
+	}
+	assertConsistent(t, s)
+
+	// Expired fields are absent from every accessor and deleted on access.
+	expireFieldNow(s, "h", "a")
+	if m, _ := s.HGetAll("h"); len(m) != 2 || m["a"] != "" {
+		t.Errorf("HGetAll with an expired field = %v, want b and c", m)
+	}
+	if _, found, _ := s.HGet("h", "a"); found {
+		t.Error("HGet found an expired field")
+	}
+	if n := s.HLen("h"); n != 2 {
+		t.Errorf("HLen = %d, want 2", n)
+	}
+	if _, ok := s.shard("h").data["h"].FieldExpiresAt["a"]; ok {
+		t.Error("expired field's expiry was not removed")
+	}
+	assertConsistent(t, s)
+
+	// HSET of a field drops its expiry; HPERSIST reports fields without one.
+	s.HSet("h", map[string]string{"b": "new"})
+	if got, _ := s.HTTL("h", []string{"b", "c", "a"}); !slices.Equal(got, []int{FieldNoTTL, FieldNoTTL, FieldMissing}) {
+		t.Errorf("HTTL after HSET = %v", got)
+	}
+	s.HExpireAt("h", []string{"c"}, soon, 0)
+	if got, _ := s.HPersist("h", []string{"c", "b"}); !slices.Equal(got, []int{FieldUpdated, FieldNoTTL}) {
+		t.Errorf("HPersist = %v", got)
+	}
+	if s.shard("h").data["h"].FieldExpiresAt != nil {
+		t.Error("FieldExpiresAt not cleared once no field has an expiry")
+	}
+
+	// A time in the past deletes the field, and the last field takes the key with it.
+	if got, _ := s.HExpireAt("h", []string{"b"}, time.Now().Add(-time.Second), 0); !slices.Equal(got, []int{FieldDeleted}) {
+		t.Errorf("HExpireAt in the past = %v", got)
+	}
+	s.HExpireAt("h", []string{"c"}, soon, 0)
+	expireFieldNow(s, "h", "c")
+	if m, typeOk := s.HGetAll("h"); m != nil || !typeOk {
+		t.Errorf("HGetAll once every field expired = %v, %v; want nil, true", m, typeOk)
+	}
+	if _, ok := s.Type("h"); ok {
+		t.Error("hash with no fields left still exists")
+	}
+	assertConsistent(t, s)
+
+	s.Set("str", "v")
+	if _, typeOk := s.HExpireAt("str", []string{"a"}, soon, 0); typeOk {
+		t.Error("HExpireAt on a string should be WRONGTYPE")
+	}
+}
+
+func TestStore_HGetDel(t *testing.T) {
+	s := New()
+	s.HSet("h", map[string]string{"a": "1", "b": "2"})
+	s.HExpireAt("h", []string{"b"}, time.Now().Add(time.Hour), 0)
+
+	removed, typeOk := s.HGetDel("h", []string{"a", "nope"})
+	if !typeOk || len(removed) != 1 || removed["a"] != "1" {
+		t.Errorf("HGetDel = %v, %v; want map[a:1], true", removed, typeOk)
+	}
+	assertConsistent(t, s)
+
+	// Removing the last field deletes the hash, along with the field's expiry.
+	if removed, _ := s.HGetDel("h", []string{"b"}); removed["b"] != "2" {
+		t.Errorf("HGetDel b = %v, want map[b:2]", removed)
+	}
+	if _, ok := s.Type("h"); ok {
+		t.Error("hash with no fields left still exists")
+	}
+	assertConsistent(t, s)
+
+	if removed, typeOk := s.HGetDel("h", []string{"a"}); removed != nil || !typeOk {
+		t.Errorf("HGetDel on a missing key = %v, %v; want nil, true", removed, typeOk)
+	}
+	s.Set("str", "v")
+	if _, typeOk := s.HGetDel("str", []string{"a"}); typeOk {
+		t.Error("HGetDel on a string should be WRONGTYPE")
+	}
+}
+
+// TestStore_Results checks that the functions reporting what a write would do
+// agree with the write and change nothing themselves.
+func TestStore_Results(t *testing.T) {
+	s := New()
+	s.Set("n", "10")
+	s.Set("str", "abc")
+	s.HSet("h", map[string]string{"a": "1", "b": "2"})
+	s.HExpireAt("h", []string{"b"}, time.Now().Add(time.Hour), 0)
+	s.Lock()
+	defer s.Unlock()
+
+	for _, key := range []string{"n", "str", "missing"} {
+		n, err := s.IncrByResultWithoutLock(key, 5)
+		if key == "missing" {
+			if _, ok := s.TypeWithoutLock(key); ok {
+				t.Error("IncrByResult created the key")
+			}
+		}
+		if n2, err2 := s.IncrByWithoutLock(key, 5); n != n2 || err != err2 {
+			t.Errorf("IncrByResult(%s) = %d, %v; IncrBy = %d, %v", key, n, err, n2, err2)
+		}
+	}
+
+	past := time.Now().Add(-time.Second)
+	fields := []string{"a", "b", "nope", "a"}
+	results, _ := s.HExpireAtResultsWithoutLock("h", fields, past, ExpireNX)
+	if got, _ := s.HTTLWithoutLock("h", []string{"a", "b"}); !slices.Equal(got, []int{FieldNoTTL, 3600}) {
+		t.Errorf("HExpireAtResults changed the hash: HTTL = %v", got)
+	}
+	if want, _ := s.HExpireAtWithoutLock("h", fields, past, ExpireNX); !slices.Equal(results, want) {
+		t.Errorf("HExpireAtResults = %v, HExpireAt = %v", results, want)
+	}
+
+	if !s.ExpireAllowedWithoutLock("str", past, 0) || s.ExpireAllowedWithoutLock("str", past, ExpireXX) {
+		t.Error("ExpireAllowed disagrees with the flags")
+	}
+	if _, ok := s.TypeWithoutLock("str"); !ok {
+		t.Error("ExpireAllowed deleted the key")
+	}
+	assertConsistent(t, s)
 }
 
 func TestStore_TTL(t *testing.T) {
@@ -487,3 +973,1255 @@ func TestStore_TTL(t *testing.T) {
 		t.Errorf("Expected TTL -2 for missing key, got %d", ttl)
 	}
 }
+
+func TestStore_ExpireTime(t *testing.T) {
+	s := New()
+	s.Set("k", "v")
+	s.Set("persistent", "v")
+	at := time.UnixMilli(4102444800123)
+	s.ExpireAtIf("k", at, 0)
+
+	for key, want := range map[string]int64{"k": at.UnixMilli(), "persistent": -1, "missing": -2} {
+		if got := s.ExpireTime(key); got != want {
+			t.Errorf("ExpireTime(%q) = %d, want %d", key, got, want)
+		}
+	}
+	expireNow(s, "k")
+	if got := s.ExpireTime("k"); got != -2 {
+		t.Errorf("ExpireTime of an expired key = %d, want -2", got)
+	}
+}
+
+func TestStore_TTLRoundsUp(t *testing.T) {
+	s := New()
+	clock := useFakeClock(s)
+	s.Set("k", "v")
+	s.Expire("k", 1)
+
+	clock.advance(100 * time.Millisecond)
+
+	if ttl := s.TTL("k"); ttl != 1 {
+		t.Errorf("TTL after 100ms of a 1s expiry = %d, want 1", ttl)
+	}
+}
+
+func TestTTLSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{d: time.Nanosecond, want: 1},
+		{d: 900 * time.Millisecond, want: 1},
+		{d: time.Second, want: 1},
+		{d: time.Second + time.Nanosecond, want: 2},
+		{d: 2 * time.Second, want: 2},
+		{d: 10 * time.Second, want: 10},
+	}
+
+	for _, tt := range tests {
+		if got := ttlSeconds(tt.d); got != tt.want {
+			t.Errorf("ttlSeconds(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestStore_ExpireIf(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     int // existing TTL in seconds, 0 for none
+		seconds int
+		flags   ExpireFlags
+		want    bool
+	}{
+		{name: "NX without ttl", seconds: 10, flags: ExpireNX, want: true},
+		{name: "NX with ttl", ttl: 10, seconds: 20, flags: ExpireNX, want: false},
+		{name: "XX without ttl", seconds: 10, flags: ExpireXX, want: false},
+		{name: "XX with ttl", ttl: 10, seconds: 20, flags: ExpireXX, want: true},
+		{name: "GT without ttl", seconds: 10, flags: ExpireGT, want: false},
+		{name: "GT greater", ttl: 10, seconds: 20, flags: ExpireGT, want: true},
+		{name: "GT lesser", ttl: 20, seconds: 10, flags: ExpireGT, want: false},
+		{name: "LT without ttl", seconds: 10, flags: ExpireLT, want: true},
+		{name: "LT lesser", ttl: 20, seconds: 10, flags: ExpireLT, want: true},
+		{name: "LT greater", ttl: 10, seconds: 20, flags: ExpireLT, want: false},
+		{name: "XX GT greater", ttl: 10, seconds: 20, flags: ExpireXX | ExpireGT, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			s.Set("k", "v")
+			if tt.ttl > 0 {
+				s.Expire("k", tt.ttl)
+			}
+			before := s.TTL("k")
+
+			got := s.ExpireIf("k", tt.seconds, tt.flags)
+			if got != tt.want {
+				t.Fatalf("ExpireIf() = %v, want %v", got, tt.want)
+			}
+
+			after := s.TTL("k")
+			if tt.want && after != tt.seconds {
+				t.Errorf("TTL after applied ExpireIf = %d, want %d", after, tt.seconds)
+			}
+			if !tt.want && after != before {
+				t.Errorf("TTL after rejected ExpireIf = %d, want unchanged %d", after, before)
+			}
+		})
+	}
+
+	s := New()
+	if s.ExpireIf("missing", 10, 0) {
+		t.Errorf("ExpireIf() on missing key should return false")
+	}
+}
+
+func TestStore_ExpireNonPositiveDeletes(t *testing.T) {
+	for _, seconds := range []int{0, -1, -100} {
+		s := New()
+		s.SetVector("v", []float32{1.0, 2.0})
+
+		if !s.Expire("v", seconds) {
+			t.Errorf("Expire(v, %d) = false, want true", seconds)
+		}
+		if _, ok := s.GetAllVectors()["v"]; ok {
+			t.Errorf("Expire(v, %d): key still returned by GetAllVectors", seconds)
+		}
+		if s.lenWithoutLock() != 0 {
+			t.Errorf("Expire(v, %d): store holds %d items, want 0", seconds, s.lenWithoutLock())
+		}
+		if s.Expire("v", seconds) {
+			t.Errorf("Expire(v, %d) on deleted key = true, want false", seconds)
+		}
+	}
+}
+
+func TestStore_Encoding(t *testing.T) {
+	s := New()
+	s.Set("int", "12345")
+	s.Set("padded", "007")
+	s.Set("raw", "hello")
+	s.SetVector("vec", []float32{1.0})
+	s.SetHalfVector("vec16", []float32{1.0})
+	s.HSet("hash", map[string]string{"f": "v"})
+	s.HSet("bighash", map[string]string{"f": strings.Repeat("v", DefaultHashMaxListpackValue+1)})
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "int", want: "int"},
+		{key: "padded", want: "raw"},
+		{key: "raw", want: "raw"},
+		{key: "vec", want: "float32vector"},
+		{key: "vec16", want: "float16vector"},
+		{key: "hash", want: "listpack"},
+		{key: "bighash", want: "hashtable"},
+	}
+
+	for _, tt := range tests {
+		got, ok := s.Encoding(tt.key)
+		if !ok || got != tt.want {
+			t.Errorf("Encoding(%q) = %q, %v, want %q", tt.key, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := s.Encoding("missing"); ok {
+		t.Errorf("Encoding(missing) should not be found")
+	}
+}
+
+func TestStore_IncrBy(t *testing.T) {
+	s := New()
+	s.Set("raw", "41")
+	s.Set("padded", "007")
+	s.Set("max", "9223372036854775807")
+	s.HSet("hash", map[string]string{"f": "v"})
+	s.Expire("raw", 100)
+
+	tests := []struct {
+		key   string
+		delta int64
+		want  int64
+		err   error
+	}{
+		{key: "new", delta: 5, want: 5},
+		{key: "new", delta: -7, want: -2},
+		{key: "raw", delta: 1, want: 42},
+		{key: "padded", delta: 1, err: ErrNotInteger},
+		{key: "max", delta: 1, err: ErrOverflow},
+		{key: "max", delta: -1, want: 9223372036854775806},
+		{key: "hash", delta: 1, err: ErrWrongType},
+	}
+	for _, tt := range tests {
+		got, err := s.IncrBy(tt.key, tt.delta)
+		if got != tt.want || err != tt.err {
+			t.Errorf("IncrBy(%q, %d) = %d, %v, want %d, %v", tt.key, tt.delta, got, err, tt.want, tt.err)
+		}
+	}
+
+	if v, _, _ := s.Get("raw"); v != "42" {
+		t.Errorf("Get(raw) = %q, want 42", v)
+	}
+	if enc, _ := s.Encoding("raw"); enc != "int" {
+		t.Errorf("Encoding(raw) after IncrBy = %q, want int", enc)
+	}
+	if ttl := s.TTL("raw"); ttl <= 0 {
+		t.Errorf("TTL(raw) after IncrBy = %d, want the TTL kept", ttl)
+	}
+	if v, _, _ := s.Get("padded"); v != "007" {
+		t.Errorf("failed IncrBy changed padded to %q", v)
+	}
+
+	// SETBIT turns a counter back into a raw string.
+	s.SetBit("raw", 7, true)
+	if v, _, _ := s.Get("raw"); v != "52" {
+		t.Errorf("Get(raw) after SetBit = %q, want 52", v)
+	}
+	if enc, _ := s.Encoding("raw"); enc != "raw" {
+		t.Errorf("Encoding(raw) after SetBit = %q, want raw", enc)
+	}
+	assertConsistent(t, s)
+}
+
+func BenchmarkStore_IncrBy(b *testing.B) {
+	s := New()
+	for range b.N {
+		s.IncrBy("counter", 1)
+	}
+}
+
+// BenchmarkStore_IncrByString is the baseline for BenchmarkStore_IncrBy:
+// incrementing a counter kept as a decimal string.
+func BenchmarkStore_IncrByString(b *testing.B) {
+	s := New()
+	s.put("counter", Item{Type: TypeString, StrVal: "0"})
+	sh := s.shard("counter")
+	for range b.N {
+		sh.mu.Lock()
+		item, _ := s.lookup("counter")
+		n, _ := strconv.ParseInt(item.StrVal, 10, 64)
+		item.StrVal = strconv.FormatInt(n+1, 10)
+		s.put("counter", item)
+		sh.mu.Unlock()
+	}
+}
+
+func TestStore_MemoryUsage(t *testing.T) {
+	s := New()
+	s.Set("small", strings.Repeat("x", 10))
+	s.Set("large", strings.Repeat("x", 1000))
+	s.SetVector("vec", make([]float32, 100))
+	fields := make(map[string]string)
+	for i := range 1000 {
+		fields[fmt.Sprintf("f%04d", i)] = "value"
+	}
+	s.HSet("hash", fields)
+
+	small, _ := s.MemoryUsage("small")
+	large, _ := s.MemoryUsage("large")
+	if large-small != 990 {
+		t.Errorf("MemoryUsage(large) - MemoryUsage(small) = %d, want 990", large-small)
+	}
+	if vec, _ := s.MemoryUsage("vec"); vec < 400 {
+		t.Errorf("MemoryUsage(vec) = %d, want at least 4 bytes per dimension", vec)
+	}
+
+	// Every field has the same size, so sampling gives the exact total.
+	exact, _ := s.MemoryUsage("hash")
+	if sampled, _ := s.MemoryUsageSampled("hash", 5); sampled != exact {
+		t.Errorf("MemoryUsageSampled(hash, 5) = %d, want %d", sampled, exact)
+	}
+	if exact < 1000*int64(len("f0000value")) {
+		t.Errorf("MemoryUsage(hash) = %d, want at least the field and value bytes", exact)
+	}
+	if total := s.UsedMemory(); total != small+large+exact+mustUsage(t, s, "vec") {
+		t.Errorf("UsedMemory = %d, want the sum of MemoryUsage", total)
+	}
+
+	if _, ok := s.MemoryUsage("missing"); ok {
+		t.Error("MemoryUsage(missing) should not be found")
+	}
+}
+
+func TestStore_MemoryStats(t *testing.T) {
+	s := New()
+	s.Set("a", "1")
+	s.Set("b", "hello")
+	s.SetVector("v", []float32{1, 2, 3})
+	s.HSet("h", map[string]string{"f": "v"})
+	s.Expire("b", 100)
+	s.Set("gone", "x")
+	s.Expire("gone", 100)
+	expireNow(s, "gone")
+
+	stats := s.MemoryStats()
+	if stats.Keys != 4 || stats.KeysWithTTL != 1 {
+		t.Errorf("Keys, KeysWithTTL = %d, %d, want 4, 1", stats.Keys, stats.KeysWithTTL)
+	}
+	if stats.TypeKeys[TypeString] != 2 || stats.TypeKeys[TypeVector] != 1 || stats.TypeKeys[TypeHash] != 1 {
+		t.Errorf("TypeKeys = %v, want 2 strings, 1 vector and 1 hash", stats.TypeKeys)
+	}
+	if want := mustUsage(t, s, "v"); stats.TypeBytes[TypeVector] != want {
+		t.Errorf("TypeBytes[TypeVector] = %d, want %d", stats.TypeBytes[TypeVector], want)
+	}
+	s.Del("gone")
+	if used := s.UsedMemory(); stats.Bytes != used {
+		t.Errorf("Bytes = %d, want UsedMemory %d", stats.Bytes, used)
+	}
+}
+
+func mustUsage(t *testing.T, s *Store, key string) int64 {
+	t.Helper()
+	n, ok := s.MemoryUsage(key)
+	if !ok {
+		t.Fatalf("MemoryUsage(%q) not found", key)
+	}
+	return n
+}
+
+func TestStore_IdleTime(t *testing.T) {
+	s := New()
+	s.Set("k", "v")
+
+	item := s.shard("k").data["k"]
+	item.LastAccess = time.Now().Add(-5 * time.Second)
+	s.shard("k").data["k"] = item
+
+	if idle, ok := s.IdleTime("k"); !ok || idle != 5 {
+		t.Errorf("IdleTime() = %d, %v, want 5", idle, ok)
+	}
+
+	// IdleTime itself must not count as an access, but a read does.
+	if idle, _ := s.IdleTime("k"); idle != 5 {
+		t.Errorf("IdleTime() after IdleTime = %d, want 5", idle)
+	}
+	s.Get("k")
+	if idle, _ := s.IdleTime("k"); idle != 0 {
+		t.Errorf("IdleTime() after Get = %d, want 0", idle)
+	}
+
+	if _, ok := s.IdleTime("missing"); ok {
+		t.Errorf("IdleTime(missing) should not be found")
+	}
+}
+
+func TestStore_GetAllVectorsWithoutLockWhileLocked(t *testing.T) {
+	s := New()
+	s.SetVector("v", []float32{1.0, 2.0})
+
+	s.Lock()
+	defer s.Unlock()
+
+	done := make(chan map[string][]float32)
+	go func() {
+		done <- s.GetAllVectorsWithoutLock()
+	}()
+
+	select {
+	case vecs := <-done:
+		if len(vecs) != 1 {
+			t.Errorf("GetAllVectorsWithoutLock() returned %d vectors, want 1", len(vecs))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetAllVectorsWithoutLock() blocked while the store lock was held")
+	}
+}
+
+func TestStore_GetAllVectorsPurgesExpired(t *testing.T) {
+	s := New()
+	s.SetVector("v", []float32{1, 2})
+	s.SetVector("dead", []float32{3, 4})
+	s.Set("str", "x")
+	s.ExpireAtIf("dead", time.Now().Add(time.Millisecond), 0)
+	s.ExpireAtIf("str", time.Now().Add(time.Millisecond), 0)
+	time.Sleep(2 * time.Millisecond)
+
+	if vecs := s.GetAllVectors(); len(vecs) != 1 || vecs["v"] == nil {
+		t.Errorf("GetAllVectors = %v, want only v", vecs)
+	}
+	// Expired keys the walk came across are gone from the map, not just
+	// left out of the result, whatever their type.
+	for _, key := range []string{"dead", "str"} {
+		if _, ok := s.shard(key).data[key]; ok {
+			t.Errorf("expired key %s is still stored", key)
+		}
+	}
+	if want := itemSize("v", Item{Type: TypeVector, VecVal: []float32{1, 2}}); s.UsedMemory() != want {
+		t.Errorf("UsedMemory = %d, want %d for v alone", s.UsedMemory(), want)
+	}
+	assertConsistent(t, s)
+}
+
+func TestStore_VectorGeneration(t *testing.T) {
+	s := New()
+	s.Set("str", "x")
+	s.HSet("h", map[string]string{"f": "v"})
+	gen := s.VectorGeneration()
+
+	steps := []struct {
+		name   string
+		op     func()
+		bumped bool
+	}{
+		{"SET string", func() { s.Set("str", "y") }, false},
+		{"EXPIRE string", func() { s.ExpireAtIf("str", time.Now().Add(time.Hour), 0) }, false},
+		{"SetVector", func() { s.SetVector("v", []float32{1, 2}) }, true},
+		{"SetVector overwrite", func() { s.SetVector("v", []float32{3, 4}) }, true},
+		{"EXPIRE vector", func() { s.ExpireAtIf("v", time.Now().Add(time.Hour), 0) }, true},
+		{"PERSIST vector", func() { s.Persist("v") }, true},
+		{"SET over vector", func() { s.Set("v", "x") }, true},
+		{"SET over string", func() { s.Set("v", "y") }, false},
+		{"SetVector over string", func() { s.SetVector("v", []float32{1}) }, true},
+		{"Del vector", func() { s.Del("v") }, true},
+		{"Del hash", func() { s.Del("h") }, false},
+		{"Flush", func() { s.Lock(); s.FlushWithoutLock(); s.Unlock() }, true},
+	}
+	for _, step := range steps {
+		step.op()
+		if got := s.VectorGeneration(); (got != gen) != step.bumped {
+			t.Errorf("%s: generation %d -> %d, want changed = %v", step.name, gen, got, step.bumped)
+		}
+		gen = s.VectorGeneration()
+	}
+}
+
+func TestHalfFloat(t *testing.T) {
+	tests := []struct {
+		f    float32
+		want uint16
+	}{
+		{0, 0x0000},
+		{float32(math.Copysign(0, -1)), 0x8000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{MaxHalf, 0x7bff},
+		{0.5, 0x3800},
+		{1.0 / (1 << 24), 0x0001},               // smallest subnormal
+		{1.0 / (1 << 25), 0x0000},               // halfway to it, ties to even
+		{1.5 / (1 << 24), 0x0002},               // halfway between 1 and 2 ulps, ties to even
+		{1.0 / (1 << 14), 0x0400},               // smallest normal
+		{1 + 1.0/(1<<11), 0x3c00},               // halfway above 1, ties to even
+		{1 + 3.0/(1<<11), 0x3c02},               // halfway above 1+ulp, ties to even
+		{1 + 1.0/(1<<11) + 1.0/(1<<20), 0x3c01}, // just past halfway rounds up
+		{65520, 0x7c00},                         // rounds past MaxHalf
+	}
+	for _, tt := range tests {
+		if got := halfFromFloat32(tt.f); got != tt.want {
+			t.Errorf("halfFromFloat32(%g) = %#04x, want %#04x", tt.f, got, tt.want)
+		}
+	}
+
+	// Every float16 but NaN converts to float32 and back unchanged.
+	for h := range 1 << 16 {
+		if f := halfToFloat32(uint16(h)); f == f && halfFromFloat32(f) != uint16(h) {
+			t.Errorf("halfFromFloat32(halfToFloat32(%#04x)) = %#04x", h, halfFromFloat32(f))
+		}
+	}
+}
+
+func TestStore_HalfVector(t *testing.T) {
+	s := New()
+	vec := []float32{0.1, -3.14159, 1000.5, 1e-3, 0}
+	s.SetHalfVector("v", vec)
+
+	got, ok, _ := s.GetVector("v")
+	if !ok || len(got) != len(vec) {
+		t.Fatalf("GetVector = %v, %v, want %d components", got, ok, len(vec))
+	}
+	// float16 keeps 11 significant bits, so normal values are within a
+	// relative 2^-11 of the original.
+	for i := range vec {
+		if diff := math.Abs(float64(got[i] - vec[i])); diff > math.Abs(float64(vec[i]))/(1<<11) {
+			t.Errorf("component %d = %g, want %g within float16 precision", i, got[i], vec[i])
+		}
+	}
+	if vecs := s.GetAllVectors(); !slices.Equal(vecs["v"], got) {
+		t.Errorf("GetAllVectors[v] = %v, want %v", vecs["v"], got)
+	}
+	if want := itemSize("v", Item{Type: TypeVector, VecVal: make([]float32, len(vec))}) - 2*int64(len(vec)); s.UsedMemory() != want {
+		t.Errorf("UsedMemory = %d, want %d at 2 bytes per component", s.UsedMemory(), want)
+	}
+
+	s.SetVector("v", vec)
+	if enc, _ := s.Encoding("v"); enc != "float32vector" {
+		t.Errorf("Encoding after SetVector = %q, want float32vector", enc)
+	}
+	assertConsistent(t, s)
+}
+
+func TestStore_ForEach(t *testing.T) {
+	s := New()
+	expiry := time.Now().Add(time.Hour)
+	s.Set("s", "x")
+	s.ExpireAtIf("s", expiry, 0)
+	s.SetVector("v", []float32{1})
+	s.HSet("h", map[string]string{"f": "v"})
+	s.Set("dead", "x")
+	s.ExpireAtIf("dead", time.Now().Add(time.Millisecond), 0)
+	time.Sleep(2 * time.Millisecond)
+
+	type entry struct {
+		typ       uint8
+		expiresAt time.Time
+	}
+	seen := make(map[string]entry)
+	s.ForEach(func(key string, typ uint8, expiresAt time.Time) bool {
+		seen[key] = entry{typ, expiresAt}
+		return true
+	})
+	want := map[string]entry{
+		"s": {TypeString, expiry},
+		"v": {TypeVector, time.Time{}},
+		"h": {TypeHash, time.Time{}},
+	}
+	if !maps.EqualFunc(seen, want, func(a, b entry) bool { return a.typ == b.typ && a.expiresAt.Equal(b.expiresAt) }) {
+		t.Errorf("ForEach visited %v, want %v", seen, want)
+	}
+
+	// Returning false stops the walk at once.
+	calls := 0
+	s.ForEach(func(string, uint8, time.Time) bool {
+		calls++
+		return calls < 2
+	})
+	if calls != 2 {
+		t.Errorf("ForEach made %d calls after fn returned false on the 2nd, want 2", calls)
+	}
+
+	// Expired keys are only skipped, and the locks are released afterwards.
+	if _, ok := s.shard("dead").data["dead"]; !ok {
+		t.Error("ForEach deleted an expired key")
+	}
+	s.Set("after", "x")
+	assertConsistent(t, s)
+}
+
+func TestStore_Snapshot(t *testing.T) {
+	s := New()
+	s.Set("s", "x")
+	s.SetVector("v", []float32{1, 2})
+	s.SetHalfVector("v16", []float32{1, 2})
+	s.HSet("h", map[string]string{"a": "1", "b": "2"})
+	s.HExpireAt("h", []string{"b"}, time.Now().Add(time.Hour), 0)
+	s.Set("dead", "x")
+	s.ExpireAtIf("dead", time.Now().Add(time.Millisecond), 0)
+	time.Sleep(2 * time.Millisecond)
+
+	snap := s.Snapshot()
+	if _, ok := snap["dead"]; ok {
+		t.Error("Snapshot includes an expired key")
+	}
+	want := make(map[string]string, len(snap))
+	for k, item := range snap {
+		want[k] = fmt.Sprint(item.Str(), item.Vec(), item.HashVal, item.FieldExpiresAt)
+	}
+
+	// Change every value in place, through the store and through the items
+	// it hands out, then delete the keys.
+	s.Set("s", "y")
+	v, _, _ := s.GetVector("v")
+	v[0] = 99
+	item, _ := s.GetItem("v16")
+	item.HalfVal[0] = 0
+	s.HSet("h", map[string]string{"a": "changed", "c": "3"})
+	s.HPersist("h", []string{"b"})
+	for k := range want {
+		s.Del(k)
+	}
+
+	if len(snap) != len(want) {
+		t.Errorf("Snapshot has %d keys, want %d", len(snap), len(want))
+	}
+	for k, item := range snap {
+		if got := fmt.Sprint(item.Str(), item.Vec(), item.HashVal, item.FieldExpiresAt); got != want[k] {
+			t.Errorf("snapshot of %s changed to %s, was %s", k, got, want[k])
+		}
+	}
+	assertConsistent(t, s)
+}
+
+func TestStore_Load(t *testing.T) {
+	s := New()
+	s.Set("s", "x")
+	s.Set("n", "42")
+	s.ExpireAtIf("n", time.Now().Add(time.Hour), 0)
+	s.SetVector("v", []float32{1, 2})
+	s.SetHalfVector("v16", []float32{0.5})
+	s.HSet("h", map[string]string{"a": "1", "b": "2"})
+	s.HExpireAt("h", []string{"b"}, time.Now().Add(time.Hour), 0)
+	snap := s.Snapshot()
+
+	loaded := NewSharded(3)
+	loaded.Set("stale", "gone after Load")
+	if err := loaded.Load(snap); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := loaded.Snapshot(); !reflect.DeepEqual(got, snap) {
+		t.Errorf("Snapshot after Load = %+v, want %+v", got, snap)
+	}
+	if loaded.UsedMemory() != s.UsedMemory() {
+		t.Errorf("UsedMemory after Load = %d, want %d", loaded.UsedMemory(), s.UsedMemory())
+	}
+	assertConsistent(t, loaded)
+
+	// The loaded store doesn't share values with the caller's map.
+	snap["v"].VecVal[0] = 99
+	snap["h"].HashPairs[1] = "changed"
+	if v, _, _ := loaded.GetVector("v"); v[0] != 1 {
+		t.Errorf("GetVector(v) = %v after changing the loaded map", v)
+	}
+	if v, _, _ := loaded.HGet("h", "a"); v != "1" {
+		t.Errorf("HGet(h, a) = %q after changing the loaded map", v)
+	}
+
+	// Expired items are left out, and new items start with a fresh access time.
+	err := loaded.Load(map[string]Item{
+		"dead":  {Type: TypeString, StrVal: "x", ExpiresAt: time.Now().Add(-time.Second)},
+		"fresh": {Type: TypeString, StrVal: "x"},
+	})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, ok := loaded.GetItem("dead"); ok {
+		t.Error("Load stored an expired item")
+	}
+	if idle, ok := loaded.IdleTime("fresh"); !ok || idle != 0 {
+		t.Errorf("IdleTime(fresh) = %d, %v, want 0", idle, ok)
+	}
+
+	// Invalid items are rejected without touching the store.
+	for name, item := range map[string]Item{
+		"unknown type":  {Type: 9},
+		"empty hash":    {Type: TypeHash, HashVal: map[string]string{}},
+		"orphan expiry": {Type: TypeHash, HashVal: map[string]string{"a": "1"}, FieldExpiresAt: map[string]time.Time{"b": time.Now()}},
+		"mixed vector":  {Type: TypeVector, VecVal: []float32{1}, HalfVal: []uint16{1}, HalfEncoded: true},
+		"mixed int":     {Type: TypeString, StrVal: "x", IntEncoded: true},
+	} {
+		if err := loaded.Load(map[string]Item{"bad": item}); !errors.Is(err, ErrInvalidItem) {
+			t.Errorf("Load(%s) = %v, want ErrInvalidItem", name, err)
+		}
+	}
+	if _, ok := loaded.GetItem("fresh"); !ok {
+		t.Error("a rejected Load changed the store")
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "a/b", true},
+		{"user:*", "user:1", true},
+		{"user:*", "item:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*b*d", "abcd", true},
+		{"*b*d", "abce", false},
+		{"a", "ab", false},
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestStore_HScan(t *testing.T) {
+	s := New()
+	fields := make(map[string]string)
+	for i := range 25 {
+		fields[fmt.Sprintf("f%02d", i)] = strconv.Itoa(i)
+	}
+	s.HSet("h", fields)
+
+	seen := make(map[string]string)
+	cursor, calls := 0, 0
+	for {
+		next, pairs, typeOk := s.HScan("h", cursor, "", 10)
+		if !typeOk {
+			t.Fatal("HScan reported WRONGTYPE for a hash")
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			if _, dup := seen[pairs[i]]; dup {
+				t.Errorf("field %s returned twice", pairs[i])
+			}
+			seen[pairs[i]] = pairs[i+1]
+		}
+		calls++
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if calls != 3 || len(seen) != 25 || seen["f07"] != "7" {
+		t.Errorf("scan took %d calls and saw %d fields, want 3 and 25", calls, len(seen))
+	}
+
+	// MATCH filters the examined batch.
+	if next, pairs, _ := s.HScan("h", 0, "f1*", 100); next != 0 || len(pairs) != 20 {
+		t.Errorf("HScan MATCH f1* = %d, %d pairs; want 0, 20", next, len(pairs))
+	}
+	if next, pairs, typeOk := s.HScan("missing", 0, "", 10); next != 0 || len(pairs) != 0 || !typeOk {
+		t.Errorf("HScan missing = %d, %v, %v; want 0, [], true", next, pairs, typeOk)
+	}
+	s.Set("str", "x")
+	if _, _, typeOk := s.HScan("str", 0, "", 10); typeOk {
+		t.Error("HScan on a string should report WRONGTYPE")
+	}
+}
+
+func TestStore_Scan(t *testing.T) {
+	s := NewSharded(4)
+	for i := range 1000 {
+		s.Set(fmt.Sprintf("key:%03d", i), "v")
+	}
+	s.Set("dead", "v")
+	s.ExpireAtIf("dead", time.Now().Add(time.Millisecond), 0)
+	time.Sleep(2 * time.Millisecond)
+	s.Lock()
+	defer s.Unlock()
+
+	// COUNT bounds the keys examined per call, matching or not, so a pattern
+	// that matches few keys still takes about len/count calls to walk.
+	seen := make(map[string]bool)
+	cursor, calls := 0, 0
+	for {
+		next, keys := s.ScanWithoutLock(cursor, "key:00*", 10)
+		for _, k := range keys {
+			if seen[k] {
+				t.Errorf("key %s returned twice", k)
+			}
+			seen[k] = true
+		}
+		calls++
+		if next != 0 && next == cursor {
+			t.Fatalf("cursor did not move from %d", cursor)
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != 10 || !seen["key:007"] {
+		t.Errorf("scan saw %v, want key:000 to key:009", seen)
+	}
+	if calls < 100 || calls > 110 {
+		t.Errorf("scan took %d calls, want about 1000/10", calls)
+	}
+
+	// A large COUNT walks every shard in one call; expired keys are skipped.
+	if next, keys := s.ScanWithoutLock(0, "", 2000); next != 0 || len(keys) != 1000 || slices.Contains(keys, "dead") {
+		t.Errorf("Scan COUNT 2000 = %d, %d keys; want 0, 1000 live keys", next, len(keys))
+	}
+}
+
+func TestStore_HRandField(t *testing.T) {
+	s := New()
+	s.HSet("h", map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	fields, typeOk := s.HRandField("h", 2, false)
+	if !typeOk || len(fields) != 2 || fields[0] == fields[1] {
+		t.Errorf("HRandField(2) = %v, want 2 distinct fields", fields)
+	}
+	if fields, _ := s.HRandField("h", 10, false); len(fields) != 3 {
+		t.Errorf("HRandField(10) = %v, want all 3 fields", fields)
+	}
+	if fields, _ := s.HRandField("h", -10, false); len(fields) != 10 {
+		t.Errorf("HRandField(-10) returned %d fields, want 10", len(fields))
+	}
+	pairs, _ := s.HRandField("h", -5, true)
+	if len(pairs) != 10 {
+		t.Fatalf("HRandField(-5, withValues) returned %d elements, want 10", len(pairs))
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		if want, _, _ := s.HGet("h", pairs[i]); pairs[i+1] != want {
+			t.Errorf("field %s paired with %q, want %q", pairs[i], pairs[i+1], want)
+		}
+	}
+
+	if fields, typeOk := s.HRandField("missing", -3, false); len(fields) != 0 || !typeOk {
+		t.Errorf("HRandField on missing key = %v, %v; want empty, true", fields, typeOk)
+	}
+	s.Set("str", "x")
+	if _, typeOk := s.HRandField("str", 1, false); typeOk {
+		t.Error("HRandField on a string should report WRONGTYPE")
+	}
+}
+
+func TestStore_Bitmap(t *testing.T) {
+	s := New()
+
+	if prev := s.SetBit("bm", 7, true); prev != 0 {
+		t.Errorf("SetBit on new key returned %d, want 0", prev)
+	}
+	if val, _, _ := s.Get("bm"); val != "\x01" {
+		t.Errorf("bitmap after SetBit(7) = %q, want \\x01", val)
+	}
+	if prev := s.SetBit("bm", 7, false); prev != 1 {
+		t.Errorf("clearing a set bit returned %d, want 1", prev)
+	}
+
+	// Growing pads with zero bytes.
+	s.SetBit("bm", 0, true)
+	s.SetBit("bm", 23, true)
+	if val, _, _ := s.Get("bm"); val != "\x80\x00\x01" {
+		t.Errorf("bitmap = %q, want \\x80\\x00\\x01", val)
+	}
+	if bit := s.GetBit("bm", 0); bit != 1 {
+		t.Errorf("GetBit(0) = %d, want 1", bit)
+	}
+	if bit := s.GetBit("bm", 1000); bit != 0 {
+		t.Errorf("GetBit past the end = %d, want 0", bit)
+	}
+
+	s.Set("str", "foobar")
+	tests := []struct {
+		start, end, want int
+	}{
+		{0, -1, 26},
+		{0, 0, 4},
+		{1, 1, 6},
+		{-2, -1, 7},
+		{5, 100, 4},
+		{3, 1, 0},
+	}
+	for _, tt := range tests {
+		if got := s.BitCount("str", tt.start, tt.end); got != tt.want {
+			t.Errorf("BitCount(%d, %d) = %d, want %d", tt.start, tt.end, got, tt.want)
+		}
+	}
+
+	// SetBit keeps the key's TTL.
+	s.Expire("str", 100)
+	s.SetBit("str", 0, true)
+	if ttl := s.TTL("str"); ttl <= 0 {
+		t.Errorf("TTL after SetBit = %d, want > 0", ttl)
+	}
+
+	s.SetVector("vec", []float32{1})
+	if s.SetBit("vec", 0, true) != -1 || s.GetBit("vec", 0) != -1 || s.BitCount("vec", 0, -1) != -1 {
+		t.Error("bitmap operations on a vector should report WRONGTYPE")
+	}
+}
+
+func TestStore_DelMany(t *testing.T) {
+	s := New()
+	s.Set("a", "1")
+	s.SetVector("b", []float32{1})
+	s.HSet("c", map[string]string{"f": "v"})
+	s.Set("expired", "x")
+	s.shard("expired").data["expired"] = Item{Type: TypeString, StrVal: "x", ExpiresAt: time.Now().Add(-time.Second)}
+
+	if n := s.DelMany([]string{"a", "b", "c", "missing", "expired", "a"}); n != 3 {
+		t.Errorf("DelMany = %d, want 3", n)
+	}
+	if s.lenWithoutLock() != 0 {
+		t.Errorf("%d keys left after DelMany, want 0", s.lenWithoutLock())
+	}
+}
+
+func TestStore_Touch(t *testing.T) {
+	s := New()
+	s.Set("k", "v")
+	s.shard("k").data["k"] = Item{Type: TypeString, StrVal: "v", LastAccess: time.Now().Add(-time.Hour)}
+	s.shard("expired").data["expired"] = Item{Type: TypeString, ExpiresAt: time.Now().Add(-time.Second)}
+
+	if !s.Touch("k") {
+		t.Error("Touch on an existing key = false")
+	}
+	if idle, _ := s.IdleTime("k"); idle != 0 {
+		t.Errorf("IdleTime after Touch = %d, want 0", idle)
+	}
+	if s.Touch("expired") || s.Touch("missing") {
+		t.Error("Touch on expired or missing key = true")
+	}
+}
+
+func TestStore_NoTouch(t *testing.T) {
+	s := New()
+	s.Set("k", "v")
+	s.Set("other", "v")
+	hourAgo := time.Now().Add(-time.Hour)
+	for _, key := range []string{"k", "other"} {
+		item := s.shard(key).data[key]
+		item.LastAccess = hourAgo
+		s.shard(key).data[key] = item
+	}
+
+	keys := []string{"k"}
+	s.LockKeys(keys)
+	s.SetNoTouchWithoutLock(keys, true)
+	s.GetWithoutLock("k")
+	if got := s.shard("k").data["k"].LastAccess; !got.Equal(hourAgo) {
+		t.Errorf("read in no-touch mode moved LastAccess to %v", got)
+	}
+	s.TouchWithoutLock("k")
+	if got := s.shard("k").data["k"].LastAccess; got.Equal(hourAgo) {
+		t.Error("TouchWithoutLock in no-touch mode didn't record the access")
+	}
+	s.SetNoTouchWithoutLock(keys, false)
+	s.UnlockKeys(keys)
+
+	// Every shard, and reads count again once the mode is off.
+	s.Lock()
+	s.SetNoTouchWithoutLock(nil, true)
+	s.GetWithoutLock("other")
+	s.SetNoTouchWithoutLock(nil, false)
+	s.Unlock()
+	if idle, _ := s.IdleTime("other"); idle < 3600 {
+		t.Errorf("IdleTime after a no-touch read = %d, want at least 3600", idle)
+	}
+	s.Get("other")
+	if idle, _ := s.IdleTime("other"); idle != 0 {
+		t.Errorf("IdleTime after a normal read = %d, want 0", idle)
+	}
+}
+
+func TestStore_PersistAndExpireAt(t *testing.T) {
+	s := New()
+	s.Set("k", "v")
+
+	if s.Persist("k") {
+		t.Error("Persist on a key without a TTL returned true")
+	}
+	if !s.ExpireAtIf("k", time.Now().Add(time.Hour), 0) {
+		t.Fatal("ExpireAtIf returned false")
+	}
+	if ttl := s.TTL("k"); ttl <= 0 || ttl > 3600 {
+		t.Errorf("TTL after ExpireAtIf = %d, want (0, 3600]", ttl)
+	}
+	if !s.Persist("k") {
+		t.Error("Persist on a key with a TTL returned false")
+	}
+	if ttl := s.TTL("k"); ttl != -1 {
+		t.Errorf("TTL after Persist = %d, want -1", ttl)
+	}
+	if s.Persist("missing") {
+		t.Error("Persist on a missing key returned true")
+	}
+
+	// A timestamp in the past deletes the key.
+	if !s.ExpireAtIf("k", time.Now().Add(-time.Second), 0) {
+		t.Fatal("ExpireAtIf in the past returned false")
+	}
+	if _, found, _ := s.Get("k"); found {
+		t.Error("key still exists after ExpireAtIf in the past")
+	}
+}
+
+func TestStore_UsedMemory(t *testing.T) {
+	s := New()
+	if n := s.UsedMemory(); n != 0 {
+		t.Fatalf("empty store uses %d bytes, want 0", n)
+	}
+
+	s.Set("k", "hello")
+	afterSet := s.UsedMemory()
+	if afterSet <= 5 {
+		t.Errorf("UsedMemory after SET = %d, want more than the value's 5 bytes", afterSet)
+	}
+	s.Set("k", "hello world")
+	if n := s.UsedMemory(); n != afterSet+6 {
+		t.Errorf("UsedMemory after overwrite = %d, want %d", n, afterSet+6)
+	}
+
+	s.HSet("h", map[string]string{"a": "1", "b": "2"})
+	s.HSet("h", map[string]string{"a": "100"})
+	s.HDel("h", []string{"b"})
+	s.SetVector("v", []float32{1, 2, 3})
+	s.SetBit("bm", 100, true)
+
+	var want int64
+	for key, item := range s.ItemsWithoutLock() {
+		want += itemSize(key, item)
+	}
+	if n := s.UsedMemory(); n != want {
+		t.Errorf("UsedMemory = %d, want %d recomputed from the items", n, want)
+	}
+
+	s.DelMany([]string{"k", "h", "v", "bm"})
+	if n := s.UsedMemory(); n != 0 {
+		t.Errorf("UsedMemory after deleting everything = %d, want 0", n)
+	}
+}
+
+func TestStore_Freq(t *testing.T) {
+	s := New()
+	s.Set("k", "v")
+	if freq, _ := s.Freq("k"); freq != lfuInitVal {
+		t.Errorf("Freq of a new key = %d, want %d", freq, lfuInitVal)
+	}
+
+	for range 1000 {
+		s.Get("k")
+	}
+	freq, _ := s.Freq("k")
+	if freq <= lfuInitVal || freq == 255 {
+		t.Errorf("Freq after 1000 reads = %d, want between %d and 255", freq, lfuInitVal)
+	}
+
+	// The counter loses a point for every minute without access.
+	item := s.shard("k").data["k"]
+	item.LastAccess = item.LastAccess.Add(-3 * lfuDecayTime)
+	s.shard("k").data["k"] = item
+	if decayed, _ := s.Freq("k"); decayed != freq-3 {
+		t.Errorf("Freq after 3 idle minutes = %d, want %d", decayed, freq-3)
+	}
+
+	if _, ok := s.Freq("missing"); ok {
+		t.Error("Freq found a missing key")
+	}
+}
+
+func TestStore_EvictLFU(t *testing.T) {
+	s := New()
+	for i := range 50 {
+		s.Set(fmt.Sprintf("hot%02d", i), "v")
+		s.Set(fmt.Sprintf("old%02d", i), "v")
+	}
+	for range 100 {
+		for i := range 50 {
+			s.Get(fmt.Sprintf("hot%02d", i))
+		}
+	}
+
+	// Evict half of the keys. Sampling is approximate, so a few hot keys may
+	// go, but the bulk of the evictions must hit the cold ones.
+	perKey := s.UsedMemory() / 100
+	evicted, ok := s.Evict(50*perKey, AllKeysLFU)
+	if !ok || len(evicted) != 50 {
+		t.Fatalf("Evict = %d keys, %v; want 50 keys, true", len(evicted), ok)
+	}
+	hot := 0
+	for _, key := range evicted {
+		if key[:3] == "hot" {
+			hot++
+		}
+	}
+	if hot > 10 {
+		t.Errorf("evicted %d frequently read keys out of 50, want at most 10", hot)
+	}
+}
+
+func TestStore_EvictNoEviction(t *testing.T) {
+	s := New()
+	s.Set("k", "v")
+
+	evicted, ok := s.Evict(1, NoEviction)
+	if ok || len(evicted) != 0 {
+		t.Errorf("Evict with NoEviction = %v, %v; want nothing evicted, false", evicted, ok)
+	}
+	if _, ok := s.Evict(s.UsedMemory(), NoEviction); !ok {
+		t.Error("Evict within the limit returned false")
+	}
+}
+
+// assertConsistent checks invariants that every store operation must keep:
+// the memory estimate matches the stored items and each item holds a value of
+// its own type only.
+func assertConsistent(t *testing.T, s *Store) {
+	t.Helper()
+	for i, sh := range s.shards {
+		var used int64
+		for key, item := range sh.data {
+			if s.shardIndex(key) != i {
+				t.Errorf("key %q is in shard %d, want %d", key, i, s.shardIndex(key))
+			}
+			used += itemSize(key, item)
+			switch item.Type {
+			case TypeString:
+				if item.VecVal != nil || item.HashVal != nil || item.HashPairs != nil {
+					t.Errorf("string %q also holds a vector or hash", key)
+				}
+			case TypeVector:
+				if item.StrVal != "" || item.HashVal != nil || item.HashPairs != nil {
+					t.Errorf("vector %q also holds a string or hash", key)
+				}
+			case TypeHash:
+				if item.StrVal != "" || item.VecVal != nil {
+					t.Errorf("hash %q also holds a string or vector", key)
+				}
+				if item.ListpackEncoded && (item.HashVal != nil || len(item.HashPairs) == 0 || len(item.HashPairs)%2 != 0) {
+					t.Errorf("listpack hash %q has a map or no field-value pairs", key)
+				}
+				if !item.ListpackEncoded && (item.HashVal == nil || item.HashPairs != nil) {
+					t.Errorf("hash table %q has no map or also has pairs", key)
+				}
+			default:
+				t.Errorf("key %q has unknown type %d", key, item.Type)
+			}
+		}
+		if used != sh.used {
+			t.Errorf("memory estimate of shard %d = %d, items add up to %d", i, sh.used, used)
+		}
+	}
+}
+
+// expireNow moves the expiry of key into the past without deleting it, as if
+// its TTL had run out and nothing had looked at it since.
+// fakeClock is a clock for Store.SetClock that only moves when advanced.
+type fakeClock struct {
+	t time.Time
+}
+
+// useFakeClock makes s read the time from a fake clock, starting at the
+// current time, and returns the clock.
+func useFakeClock(s *Store) *fakeClock {
+	c := &fakeClock{t: time.Now()}
+	s.SetClock(func() time.Time { return c.t })
+	return c
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func expireNow(s *Store, key string) {
+	item := s.shard(key).data[key]
+	item.ExpiresAt = time.Now().Add(-time.Millisecond)
+	s.shard(key).data[key] = item
+}
+
+// expireFieldNow moves the expiry of field in the hash at key into the past.
+func expireFieldNow(s *Store, key, field string) {
+	s.shard(key).data[key].FieldExpiresAt[field] = time.Now().Add(-time.Millisecond)
+}
+
+func TestStore_ExpireAndDelAcrossTypes(t *testing.T) {
+	create := map[string]func(s *Store, key string){
+		"string": func(s *Store, key string) { s.Set(key, "v") },
+		"vector": func(s *Store, key string) { s.SetVector(key, []float32{1, 2}) },
+		"hash":   func(s *Store, key string) { s.HSet(key, map[string]string{"f": "v"}) },
+	}
+
+	for name, set := range create {
+		t.Run(name, func(t *testing.T) {
+			s := New()
+			set(s, "k")
+
+			if !s.Expire("k", 100) {
+				t.Error("Expire on an existing key returned false")
+			}
+			if ttl := s.TTL("k"); ttl != 100 {
+				t.Errorf("TTL = %d, want 100", ttl)
+			}
+			if !s.Del("k") {
+				t.Error("Del on an existing key returned false")
+			}
+			if s.Del("k") || s.Expire("k", 100) {
+				t.Error("Del or Expire on a deleted key returned true")
+			}
+			if ttl := s.TTL("k"); ttl != -2 {
+				t.Errorf("TTL after Del = %d, want -2", ttl)
+			}
+
+			// An expired key is gone for every operation, and Del doesn't
+			// count it as deleted.
+			set(s, "k")
+			set(s, "other")
+			s.Expire("k", 100)
+			expireNow(s, "k")
+			if _, ok := s.Type("k"); ok {
+				t.Error("Type found an expired key")
+			}
+			set(s, "k")
+			expireNow(s, "k")
+			if s.Del("k") {
+				t.Error("Del counted an expired key")
+			}
+			assertConsistent(t, s)
+		})
+	}
+}
+
+func TestStore_VectorExpiry(t *testing.T) {
+	s := New()
+	s.SetVector("v", []float32{1, 2})
+	s.SetVector("w", []float32{3, 4})
+	s.Expire("v", 100)
+
+	if _, ok, _ := s.GetVector("v"); !ok {
+		t.Fatal("GetVector before expiry did not find the vector")
+	}
+
+	expireNow(s, "v")
+	if _, ok := s.GetAllVectors()["v"]; ok {
+		t.Error("expired vector is still returned by GetAllVectors")
+	}
+	if vec, ok, _ := s.GetVector("v"); ok {
+		t.Errorf("GetVector after expiry = %v, want not found", vec)
+	}
+	if _, ok := s.GetAllVectors()["w"]; !ok {
+		t.Error("vector without a TTL is missing from GetAllVectors")
+	}
+	assertConsistent(t, s)
+}
+
+func TestStore_Shards(t *testing.T) {
+	if n := NewSharded(0).Shards(); n != 1 {
+		t.Errorf("NewSharded(0).Shards() = %d, want 1", n)
+	}
+
+	s := New()
+	var a, b string
+	for i := 0; b == ""; i++ {
+		key := fmt.Sprintf("k%d", i)
+		switch {
+		case a == "":
+			a = key
+		case s.shardIndex(key) != s.shardIndex(a):
+			b = key
+		}
+	}
+
+	// Holding the shard of a doesn't block writes to b, or LockKeys of a set
+	// that shares no shard with it.
+	s.LockKeys([]string{a, a})
+	done := make(chan struct{})
+	go func() {
+		s.Set(b, "v")
+		s.LockKeys([]string{b})
+		s.UnlockKeys([]string{b})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing to another shard blocked")
+	}
+	s.SetWithoutLock(a, "v")
+	s.UnlockKeys([]string{a, a})
+
+	if got := len(s.ItemsWithoutLock()); got != 2 {
+		t.Errorf("store holds %d keys, want 2", got)
+	}
+	assertConsistent(t, s)
+}
+
+// BenchmarkStore_ParallelSet writes disjoint keys from many goroutines, with
+// a single shard as the baseline.
+func BenchmarkStore_ParallelSet(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := NewSharded(shards)
+			var next atomic.Int64
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				key := fmt.Sprintf("key:%d", next.Add(1))
+				for pb.Next() {
+					s.Set(key, "value")
+					s.Get(key)
+				}
+			})
+		})
+	}
+}
@@ -1,46 +1,125 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"jellyfish/internal/aof"
+	"jellyfish/internal/config"
 	"jellyfish/internal/handler"
 	"jellyfish/internal/resp"
 	"jellyfish/internal/store"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	fmt.Println("Listening on port :6379")
+	defaults := config.Default()
+	configFile := flag.String("config", "", "path to a redis.conf-style configuration file")
+	flag.Int("port", defaults.Port, "TCP port to listen on")
+	flag.String("bind", defaults.Bind, "interface address to listen on (default all interfaces)")
+	flag.String("unixsocket", defaults.UnixSocket, "path of a Unix socket to listen on as well")
+	flag.String("dir", defaults.Dir, "working directory for the append-only file")
+	flag.String("appendfilename", defaults.AppendFilename, "name of the append-only file within -dir")
+	flag.Parse()
 
-	l, err := net.Listen("tcp", ":6379")
-	if err != nil {
-		fmt.Println(err)
+	cfg := defaults
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	// Flags given on the command line override the file.
+	var flagErr error
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && flagErr == nil {
+			flagErr = cfg.Set(f.Name, f.Value.String())
+		}
+	})
+	if flagErr != nil {
+		fmt.Println(flagErr)
 		return
 	}
 
-	// Initialize the shared store
-	kv := store.New()
+	fmt.Printf("Listening on %s, appendonly %v, append-only file %s, appendfsync %v, maxmemory %d (%v)\n",
+		cfg.Addr(), cfg.AppendOnly, cfg.AOFPath(), cfg.AppendFsync, cfg.MaxMemory, cfg.MaxMemoryPolicy)
 
-	// Initialize AOF
-	aof, err := aof.New("database.aof")
+	l, err := net.Listen("tcp", cfg.Addr())
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	defer aof.Close()
+	listeners := []net.Listener{l}
+	if cfg.UnixSocket != "" {
+		ul, err := listenUnix(cfg.UnixSocket)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Listening on unix socket", cfg.UnixSocket)
+		listeners = append(listeners, ul)
+	}
+	// Closing a Unix listener also removes its socket file.
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
 
-	// Replay AOF
-	aof.Read(func(value resp.Value) {
-		// Create a temporary handler with nil AOF to avoid double logging
-		h := handler.New(kv, nil)
-		h.Execute(value, nil)
-	})
+	// Initialize the shared store
+	kv := store.NewSharded(cfg.Shards)
+
+	// Initialize AOF. With appendonly off nothing is loaded or logged.
+	var log *aof.Aof
+	if cfg.AppendOnly {
+		log, err = aof.New(cfg.AOFPath())
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer log.Close()
+		log.SetFsync(cfg.AppendFsync)
+
+		if err := replay(log, kv); err != nil {
+			fmt.Println(err)
+		}
+	}
 
 	// Initialize the handler with the store and AOF
-	h := handler.New(kv, aof)
+	h := handler.New(kv, log)
+	h.UseConfig(cfg)
+
+	for _, l := range listeners {
+		go serve(l, h)
+	}
+
+	// Run until interrupted, then return so that the deferred cleanup closes
+	// the listeners and the AOF.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	fmt.Println("shutting down on", <-sig)
+}
 
+// replay applies every command in log to kv. The commands go through a
+// handler without an AOF, so that replaying doesn't log them a second time.
+func replay(log *aof.Aof, kv *store.Store) error {
+	h := handler.New(kv, nil)
+	return log.Read(func(value resp.Value) {
+		h.Execute(value, nil)
+	})
+}
+
+// serve hands every connection accepted on l to h until l is closed.
+func serve(l net.Listener, h *handler.Handler) {
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Println(err)
 			continue
@@ -48,3 +127,15 @@ func main() {
 		go h.Handle(conn)
 	}
 }
+
+// listenUnix listens on a Unix socket at path. A socket file left behind by a
+// server that didn't shut down cleanly is removed first; any other file at
+// path is left alone and makes listening fail.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"jellyfish/internal/aof"
+	"jellyfish/internal/handler"
+	"jellyfish/internal/resp"
+	"jellyfish/internal/store"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jellyfish.sock")
+
+	// Leave a stale socket file behind, as a crashed server would.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("listenUnix over a stale socket: %v", err)
+	}
+	go serve(l, handler.New(store.New(), nil))
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	r, w := resp.NewReader(conn), resp.NewWriter(conn)
+	for _, tt := range []struct {
+		args []string
+		want resp.Value
+	}{
+		{[]string{"SET", "k", "v"}, resp.Value{Type: "string", Str: "OK"}},
+		{[]string{"GET", "k"}, resp.Value{Type: "bulk", Bulk: "v"}},
+	} {
+		cmd := resp.Value{Type: "array"}
+		for _, a := range tt.args {
+			cmd.Array = append(cmd.Array, resp.Value{Type: "bulk", Bulk: a})
+		}
+		if err := w.Write(cmd); err != nil {
+			t.Fatalf("write %v: %v", tt.args, err)
+		}
+		if v, err := r.Read(); err != nil || v.Type != tt.want.Type || v.Str != tt.want.Str || v.Bulk != tt.want.Bulk {
+			t.Errorf("%v = %#v, %v; want %#v", tt.args, v, err, tt.want)
+		}
+	}
+
+	// Closing the listener removes the socket file.
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after Close: %v", err)
+	}
+
+	// A regular file at the path is not removed.
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenUnix(path); err == nil {
+		l.Close()
+		t.Error("listenUnix replaced a regular file")
+	}
+}
+
+// BenchmarkReplay loads an AOF of benchAOFSize bytes of SET commands into a
+// store the way the server does at startup, including executing every command
+// through the handler, unlike BenchmarkAof_Read which only parses the file.
+func BenchmarkReplay(b *testing.B) {
+	const benchAOFSize = 16 << 20
+	path := filepath.Join(b.TempDir(), "bench.aof")
+	var buf bytes.Buffer
+	w := resp.NewWriter(&buf)
+	n := 0
+	for ; buf.Len() < benchAOFSize; n++ {
+		w.Write(resp.Value{Type: "array", Array: []resp.Value{
+			{Type: "bulk", Bulk: "SET"},
+			{Type: "bulk", Bulk: "key:" + strconv.Itoa(n)},
+			{Type: "bulk", Bulk: strings.Repeat("v", n%64)},
+		}})
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		b.Fatal(err)
+	}
+	log, err := aof.New(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer log.Close()
+
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+	for range b.N {
+		kv := store.New()
+		if err := replay(log, kv); err != nil {
+			b.Fatal(err)
+		}
+		if _, found, _ := kv.Get("key:" + strconv.Itoa(n-1)); !found {
+			b.Fatalf("replay didn't reach the last of %d keys", n)
+		}
+	}
+}